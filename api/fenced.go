@@ -0,0 +1,9 @@
+package api
+
+// Fenced is an item stored by the fetcher along with the fencing token of the leadership it was
+// stored under, so that a previous leader holding a lower token cannot overwrite it. Value is nil
+// if the item only records the token of a leader which did not store a value yet.
+type Fenced[T any] struct {
+	FencingToken uint64 `json:"fencing_token"`
+	Value        *T     `json:"value,omitempty"`
+}
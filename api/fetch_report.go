@@ -0,0 +1,54 @@
+package api
+
+import "time"
+
+const (
+	// FetchSucceeded is the status of a run which fetched every repository
+	FetchSucceeded = "succeeded"
+
+	// FetchPartiallyFailed is the status of a run which failed to fetch some repositories, they
+	// are stored as stale
+	FetchPartiallyFailed = "partially_failed"
+
+	// FetchFailed is the status of a run which did not store any repository
+	FetchFailed = "failed"
+)
+
+type FetchReport struct {
+
+	// Status of the run: succeeded, partially_failed or failed
+	Status string `json:"status"`
+
+	// Start and end of the run
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	// Number of repositories processed, the listed ones and the stale ones fetched again, and how
+	// many of them were fetched successfully, failed, or were skipped as they did not change since
+	// their languages were fetched
+	Repositories int `json:"repositories"`
+	Succeeded    int `json:"succeeded"`
+	Failed       int `json:"failed"`
+	Skipped      int `json:"skipped"`
+
+	// Number of stale repositories in the stored dataset once the run finished
+	Stale int `json:"stale"`
+
+	// Cost of the GraphQL queries against the GraphQL rate limit, with the graphql backend
+	GraphQLCost int `json:"graphql_cost,omitempty"`
+
+	// Failures of the repositories which could not be fetched
+	Failures []FetchFailure `json:"failures,omitempty"`
+
+	// Error which caused the run to fail
+	Error string `json:"error,omitempty"`
+}
+
+type FetchFailure struct {
+
+	// Full name of the repository
+	FullName string `json:"full_name"`
+
+	// Error which caused the fetch to fail
+	Error string `json:"error"`
+}
@@ -13,6 +13,10 @@ type Repository struct {
 
 	// Dictionary of used languages
 	Languages map[string]Language `json:"languages"`
+
+	// Whether the last fetch of the repository failed, its languages are the ones of the last
+	// successful fetch if any
+	Stale bool `json:"stale,omitempty"`
 }
 
 type Language struct {
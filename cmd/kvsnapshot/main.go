@@ -0,0 +1,312 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/MarouaneMan/github-api/internal/config"
+	"github.com/MarouaneMan/github-api/internal/fetcher"
+	"github.com/MarouaneMan/github-api/internal/github"
+	"github.com/MarouaneMan/github-api/internal/storage"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"github.com/MarouaneMan/github-api/middleware"
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: kvsnapshot <command> [flags]
+
+Dumps the key value store of the service to a portable snapshot file and restores it into any
+backend. The store is configured with the same environment variables as the service. The disk
+backend can only be accessed while the service is stopped, its log being locked by the service.
+
+Commands:
+  dump     write a snapshot of the store
+  restore  write the items of a snapshot to the store
+  inspect  describe a snapshot without accessing the store
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx := logger.ToCtx(context.Background(), logger.Default())
+	var err error
+	switch os.Args[1] {
+	case "dump":
+		err = dump(ctx, os.Args[2:])
+	case "restore":
+		err = restore(ctx, os.Args[2:])
+	case "inspect":
+		err = inspect(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kvsnapshot %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func dump(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	output := flags.String("o", "-", "snapshot file, gzipped if it ends with .gz, - for stdout")
+	// cached responses only live in the store with the redis backend, and can be rebuilt anyway
+	namespaces := flags.String("namespaces", storage.DatasetNamespace, "comma separated namespaces to dump, empty for every key")
+	_ = flags.Parse(args)
+
+	store, err := openStore(ctx)
+	if err != nil {
+		return err
+	}
+	w, err := createSnapshotFile(*output)
+	if err != nil {
+		return err
+	}
+	exported, err := kvstore.Export(ctx, store, w, kvstore.SnapshotOptions{
+		Prefixes: namespacePrefixes(*namespaces),
+		TypeOf:   snapshotType,
+	})
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return errors.Wrap(err, "Failed to write snapshot file")
+	}
+	fmt.Fprintf(os.Stderr, "%d items dumped\n", exported)
+	return nil
+}
+
+func restore(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	input := flags.String("i", "-", "snapshot file, gzipped if it ends with .gz, - for stdin")
+	namespaces := flags.String("namespaces", "", "comma separated namespaces to restore, empty for every item of the snapshot")
+	flush := flags.Bool("flush", false, "flush the restored namespaces before restoring")
+	_ = flags.Parse(args)
+
+	store, err := openStore(ctx)
+	if err != nil {
+		return err
+	}
+	r, err := openSnapshotFile(*input)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	prefixes := namespacePrefixes(*namespaces)
+	if *flush {
+		if len(prefixes) == 0 {
+			return errors.New("-flush requires -namespaces")
+		}
+		for _, prefix := range prefixes {
+			namespace, err := kvstore.NewNamespacedStore(store, strings.TrimSuffix(prefix, kvstore.NamespaceSeparator), kvstore.NamespaceOptions{})
+			if err != nil {
+				return err
+			}
+			flushed, err := namespace.Flush(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "%d items flushed from namespace %q\n", flushed, namespace.Name())
+		}
+	}
+
+	imported, err := kvstore.Import(ctx, store, r, kvstore.SnapshotOptions{
+		Prefixes: prefixes,
+		TypeOf:   snapshotType,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d items restored\n", imported)
+	return nil
+}
+
+func inspect(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	input := flags.String("i", "-", "snapshot file, gzipped if it ends with .gz, - for stdin")
+	keys := flags.Bool("keys", false, "list every item with its time to live and size")
+	_ = flags.Parse(args)
+
+	r, err := openSnapshotFile(*input)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	type namespaceStats struct {
+		items int
+		bytes int
+	}
+	stats := map[string]*namespaceStats{}
+	out := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if *keys {
+		fmt.Fprintln(out, "KEY\tTTL\tBYTES")
+	}
+	header, err := kvstore.ReadSnapshot(r, func(item kvstore.SnapshotItem) error {
+		namespace, _, found := strings.Cut(item.Key, kvstore.NamespaceSeparator)
+		if !found {
+			namespace = ""
+		}
+		if stats[namespace] == nil {
+			stats[namespace] = &namespaceStats{}
+		}
+		stats[namespace].items++
+		stats[namespace].bytes += len(item.Value)
+		if *keys {
+			ttl := "none"
+			if item.TTL != kvstore.NoExpiration {
+				ttl = item.TTL.Round(time.Second).String()
+			}
+			fmt.Fprintf(out, "%s\t%s\t%d\n", item.Key, ttl, len(item.Value))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if *keys {
+		fmt.Fprintln(out)
+	}
+
+	fmt.Fprintf(out, "Snapshot taken at %s, format version %d\n\n", header.CreatedAt.Format(time.RFC3339), header.Version)
+	fmt.Fprintln(out, "NAMESPACE\tITEMS\tBYTES")
+	namespaces := make([]string, 0, len(stats))
+	for namespace := range stats {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		name := namespace
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(out, "%s\t%d\t%d\n", name, stats[namespace].items, stats[namespace].bytes)
+	}
+	return out.Flush()
+}
+
+// openStore opens the store of the service, in the namespace of the configured environment
+func openStore(ctx context.Context) (kvstore.ReadWriter, error) {
+	cfg := &config.StoreConfig{}
+	err := envconfig.Process("", cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read store configuration")
+	}
+	if cfg.StoreBackend == "memory" {
+		return nil, errors.New("The memory backend only lives in the service process, it cannot be accessed")
+	}
+	// the tool does not close the store: writes are synced right away and the log is left for
+	// the service to compact
+	cfg.DiskStoreSync = string(kvstore.SyncAlways)
+	cfg.DiskStoreCompactionInterval = 0
+
+	store, err := storage.NewBackend(ctx, cfg)
+	if errors.Is(err, kvstore.ErrDiskStoreLocked) {
+		return nil, errors.Wrap(err, "The disk store is in use, stop the service first")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return storage.Root(store, cfg)
+}
+
+// snapshotType returns a pointer to a new value of the type the service stores under key, as
+// reported by the subsystem owning the namespace of key
+func snapshotType(key string) any {
+	namespace, key, _ := strings.Cut(key, kvstore.NamespaceSeparator)
+	switch namespace {
+	case storage.DatasetNamespace:
+		return fetcher.StoredType(key)
+	case storage.ResponsesNamespace:
+		return middleware.StoredType(key)
+	case storage.HTTPCacheNamespace:
+		return github.StoredType(key)
+	}
+	return nil
+}
+
+// namespacePrefixes returns the key prefixes of comma separated namespaces
+func namespacePrefixes(namespaces string) []string {
+	prefixes := []string{}
+	for _, namespace := range strings.Split(namespaces, ",") {
+		namespace = strings.TrimSpace(namespace)
+		if namespace != "" {
+			prefixes = append(prefixes, namespace+kvstore.NamespaceSeparator)
+		}
+	}
+	return prefixes
+}
+
+func createSnapshotFile(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopWriteCloser{Writer: os.Stdout}, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create snapshot file")
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+	return &gzipFile{Writer: gzip.NewWriter(file), file: file}, nil
+}
+
+func openSnapshotFile(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open snapshot file")
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, errors.Wrap(err, "Failed to read gzipped snapshot file")
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{Reader: reader, Closer: file}, nil
+}
+
+// gzipFile closes the file once the gzip stream is flushed
+type gzipFile struct {
+	*gzip.Writer
+	file *os.File
+}
+
+func (gf *gzipFile) Close() error {
+	err := gf.Writer.Close()
+	if err != nil {
+		_ = gf.file.Close()
+		return err
+	}
+	return gf.file.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -5,15 +5,22 @@ import (
 	"fmt"
 	"github.com/MarouaneMan/github-api/internal/config"
 	"github.com/MarouaneMan/github-api/internal/fetcher"
+	"github.com/MarouaneMan/github-api/internal/github"
+	"github.com/MarouaneMan/github-api/internal/leader"
+	"github.com/MarouaneMan/github-api/internal/metrics"
 	"github.com/MarouaneMan/github-api/internal/restservice"
+	"github.com/MarouaneMan/github-api/internal/storage"
 	"github.com/MarouaneMan/github-api/kvstore"
 	"github.com/MarouaneMan/github-api/middleware"
 	"github.com/Scalingo/go-handlers"
 	"github.com/Scalingo/go-utils/logger"
 	"github.com/go-co-op/gocron"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -31,37 +38,142 @@ func main() {
 		}
 	}
 
+	registry := metrics.NewRegistry()
+
+	// the context is canceled on shutdown, so that the fetcher stops and releases its leadership
+	shutdownCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Instantiate a new key value store
-	store := kvstore.NewInMemoryStore(30*time.Minute, 30*time.Minute)
+	store, err := storage.New(logger.ToCtx(context.Background(), log), &cfg.StoreConfig, registry)
+	if err != nil {
+		log.WithError(err).Error("Fail to initialize key value store")
+		os.Exit(1)
+	}
+
+	// subsystems keep their keys in their own namespace so that they cannot collide, their
+	// operations are reported under the store label of their namespace
+	store, err = storage.Root(store, &cfg.StoreConfig)
+	if err != nil {
+		log.WithError(err).Error("Fail to initialize key value store namespace")
+		os.Exit(1)
+	}
+	store = kvstore.NewInstrumentedStore(store, storage.Metrics(registry), kvstore.InstrumentedOptions{Name: "root", ByNamespace: true})
+	datasetStore, err := storage.Namespace(store, storage.DatasetNamespace)
+	if err != nil {
+		log.WithError(err).Error("Fail to initialize dataset store")
+		os.Exit(1)
+	}
+	cacheStore, err := newResponseCacheStore(cfg, store, registry)
+	if err != nil {
+		log.WithError(err).Error("Fail to initialize response cache store")
+		os.Exit(1)
+	}
+	err = middleware.InvalidateCachedResponses(logger.ToCtx(context.Background(), log), datasetStore, "repositories", cacheStore)
+	if err != nil {
+		log.WithError(err).Warn("Cached responses will not be invalidated when repositories are updated")
+	}
+
+	// the client is shared by the fetcher runs so that they keep track of the rate limit of the token
+	var githubTransport http.RoundTripper = github.NewRetryTransport(&http.Transport{
+		MaxConnsPerHost: 5, // do not overwhelm Github, http/2.0 takes care of concurrency
+	}, github.RetryPolicy{
+		MaxAttempts:    cfg.GithubRetryMaxAttempts,
+		InitialBackoff: cfg.GithubRetryInitialBackoff,
+		MaxBackoff:     cfg.GithubRetryMaxBackoff,
+	})
+	// responses are validated with conditional requests, which do not count against the rate limit
+	if cfg.GithubCacheTTL > 0 {
+		httpCacheStore, err := storage.Namespace(store, storage.HTTPCacheNamespace)
+		if err != nil {
+			log.WithError(err).Error("Fail to initialize GitHub responses cache store")
+			os.Exit(1)
+		}
+		githubTransport = github.NewCachingTransport(githubTransport, httpCacheStore, github.CacheOptions{TTL: cfg.GithubCacheTTL})
+	}
+	githubClient := github.NewClient(cfg.GithubToken, githubTransport, github.Options{
+		RequestsPerSecond: cfg.GithubRequestsPerSecond,
+		Burst:             cfg.GithubRequestsBurst,
+		Timeout:           cfg.GithubRequestTimeout,
+	})
+	registry.GaugeFunc("github_ratelimit_remaining", "Requests left in the current GitHub rate limit window.", func() float64 {
+		return float64(githubClient.Quota().Remaining)
+	})
 
 	// Spawn fetcher job to periodically pull Github data
 	// !! Usually this block needs to run in its own process/dedicated node when using redis as a backend store
+	// closed once the fetcher leadership is released on shutdown, nil without leader election
+	var resigned <-chan struct{}
 	{
-		ctx := logger.ToCtx(context.Background(), log)
-		cronScheduler := gocron.NewScheduler(time.UTC)
-		cronScheduler.Every(cfg.FetchIntervalHours).Hours().StartImmediately().Do(func() {
-			// httpTransport is reused across goroutines to avoid creating too many connections
-			// we do not share the client instead to have the possibility to personalise it per use-case if needed
-			httpTransport := &http.Transport{
-				MaxConnsPerHost: 5, // do not overwhelm Github, http/2.0 takes care of concurrency
+		ctx := logger.ToCtx(shutdownCtx, log)
+		fetcherMetrics := fetcher.NewMetrics(registry)
+		fetch := func(ctx context.Context, token uint64) {
+			fetcher.Run(ctx, cfg, datasetStore, githubClient, fetcherMetrics, token)
+		}
+		job := func() { fetch(ctx, 0) }
+
+		// replicas share the redis store, only the elected one fetches so that Github is not
+		// hammered in parallel
+		if cfg.StoreBackend == "redis" {
+			lockStore, err := storage.Namespace(store, storage.LocksNamespace)
+			if err != nil {
+				log.WithError(err).Error("Fail to initialize lock store")
+				os.Exit(1)
+			}
+			elector, err := leader.NewElector(lockStore, "fetcher", kvstore.LockOptions{TTL: cfg.FetcherLockTTL})
+			if err != nil {
+				log.WithError(err).Error("Fail to initialize fetcher leader election")
+				os.Exit(1)
 			}
-			fetcher.Run(ctx, cfg, store, httpTransport)
-		})
+			resigned = elector.Campaign(ctx)
+			job = func() {
+				ran := elector.Lead(ctx, func(ctx context.Context, token uint64) {
+					fetch(logger.ToCtx(ctx, log.WithField("fencing_token", token)), token)
+				})
+				if !ran {
+					log.Info("Another replica is the fetcher leader, skipping fetch")
+				}
+			}
+		}
+
+		cronScheduler := gocron.NewScheduler(time.UTC)
+		cronScheduler.Every(cfg.FetchIntervalHours).Hours().StartImmediately().Do(job)
 		cronScheduler.StartAsync()
 	}
 
 	log.Info("Initializing routes")
 	router := handlers.NewRouter(log)
-	router.Use(middleware.NewResponseCachingMiddleware(store, store))
+	router.Use(middleware.NewResponseCachingMiddleware(cacheStore, cacheStore))
 	router.HandleFunc("/ping", restservice.PongHandler).Methods("GET", "POST")
-	router.HandleFunc("/repos", restservice.ReposHandler(store)).Methods("GET")
-	router.HandleFunc("/stats", restservice.StatsHandler(store)).Methods("GET")
+	router.HandleFunc("/repos", restservice.ReposHandler(datasetStore)).Methods("GET")
+	router.HandleFunc("/stats", restservice.StatsHandler(datasetStore)).Methods("GET")
+
+	// metrics, rate limit and fetch report are served outside of the router so that they are never cached
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	mux.Handle("/ratelimit", restservice.RateLimitHandler(githubClient))
+	mux.Handle("/fetcher/report", restservice.FetchReportHandler(datasetStore))
+	mux.Handle("/", router)
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: mux}
+	go func() {
+		<-shutdownCtx.Done()
+		log.Info("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
 
 	log = log.WithField("port", cfg.Port)
 	log.Info("Listening...")
-	err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), router)
-	if err != nil {
+	err = server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.WithError(err).Error("Fail to listen to the given port")
 		os.Exit(2)
 	}
+
+	// wait for the fetcher leadership to be released, so that another replica takes over right away
+	if resigned != nil {
+		<-resigned
+	}
 }
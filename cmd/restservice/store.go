@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/MarouaneMan/github-api/internal/config"
+	"github.com/MarouaneMan/github-api/internal/metrics"
+	"github.com/MarouaneMan/github-api/internal/storage"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"time"
+)
+
+// newResponseCacheStore returns the store used to cache handlers responses, the responses
+// namespace of the main store with the redis backend.
+// Local backends cache responses in a bounded in-memory store as every distinct URL is cached,
+// while the dataset is kept in the main store to never be evicted.
+func newResponseCacheStore(cfg *config.Config, store kvstore.ReadWriter, registry *metrics.Registry) (kvstore.ReadWriter, error) {
+	if cfg.StoreBackend == "redis" {
+		return storage.Namespace(store, storage.ResponsesNamespace)
+	}
+	cacheStore, err := kvstore.NewBoundedStore(kvstore.BoundedOptions{
+		MaxEntries:        cfg.CacheMaxEntries,
+		MaxBytes:          cfg.CacheMaxBytes,
+		Policy:            kvstore.EvictionPolicy(cfg.CacheEvictionPolicy),
+		DefaultExpiration: 30 * time.Minute,
+		CleanupInterval:   30 * time.Minute,
+	})
+	if err != nil {
+		return nil, err
+	}
+	registry.GaugeFunc("response_cache_entries", "Number of cached responses.", func() float64 {
+		return float64(cacheStore.Stats().Entries)
+	})
+	registry.GaugeFunc("response_cache_bytes", "Estimated size of the cached responses.", func() float64 {
+		return float64(cacheStore.Stats().Bytes)
+	})
+	registry.GaugeFunc("response_cache_evictions", "Number of cached responses evicted to make room.", func() float64 {
+		return float64(cacheStore.Stats().Evictions)
+	})
+	return storage.Namespace(kvstore.NewInstrumentedStore(cacheStore, storage.Metrics(registry), kvstore.InstrumentedOptions{Name: "responses", ByNamespace: true}), storage.ResponsesNamespace)
+}
@@ -1,7 +1,106 @@
 package config
 
+import "time"
+
 type Config struct {
 	Port               int    `envconfig:"PORT" default:"5000"`
 	GithubToken        string `envconfig:"GITHUB_TOKEN" required:"True"`
 	FetchIntervalHours int    `envconfig:"FETCH_INTERVAL_HOURS" default:"3"`
+
+	// Rate and burst at which requests are sent to GitHub, secondary rate limits forbid bursts
+	GithubRequestsPerSecond float64 `envconfig:"GITHUB_REQUESTS_PER_SECOND" default:"10"`
+	GithubRequestsBurst     int     `envconfig:"GITHUB_REQUESTS_BURST" default:"10"`
+
+	// Timeout of every request sent to GitHub, started once the request leaves the queues and
+	// bounding its retries
+	GithubRequestTimeout time.Duration `envconfig:"GITHUB_REQUEST_TIMEOUT" default:"30s"`
+
+	// Time GitHub responses are cached after they were last validated, 0 disables the cache
+	GithubCacheTTL time.Duration `envconfig:"GITHUB_CACHE_TTL" default:"168h"`
+
+	// Attempts and exponential backoff bounds of GitHub requests failing with a transient error
+	GithubRetryMaxAttempts    int           `envconfig:"GITHUB_RETRY_MAX_ATTEMPTS" default:"3"`
+	GithubRetryInitialBackoff time.Duration `envconfig:"GITHUB_RETRY_INITIAL_BACKOFF" default:"500ms"`
+	GithubRetryMaxBackoff     time.Duration `envconfig:"GITHUB_RETRY_MAX_BACKOFF" default:"10s"`
+
+	// Backend listing the repositories: rest, fetching the languages of every repository with its
+	// own request, or graphql, searching the repositories matching the search along with their
+	// languages
+	FetchBackend        string `envconfig:"FETCH_BACKEND" default:"rest"`
+	GithubGraphQLURL    string `envconfig:"GITHUB_GRAPHQL_URL" default:"https://api.github.com/graphql"`
+	GithubGraphQLSearch string `envconfig:"GITHUB_GRAPHQL_SEARCH" default:"is:public"`
+
+	// Pages of repositories and number of repositories fetched per run, 0 means unlimited
+	FetchMaxPages        int `envconfig:"FETCH_MAX_PAGES" default:"1"`
+	FetchMaxRepositories int `envconfig:"FETCH_MAX_REPOSITORIES" default:"0"`
+
+	// Number of repositories kept in the dataset across runs, the least recently fetched ones are
+	// evicted first. 0 means unlimited
+	FetchMaxStoredRepositories int `envconfig:"FETCH_MAX_STORED_REPOSITORIES" default:"1000"`
+
+	// Number of repositories whose languages are fetched concurrently, 0 means unlimited
+	FetchConcurrency int `envconfig:"FETCH_CONCURRENCY" default:"5"`
+
+	// Languages are only fetched again for repositories updated or pushed to since they were
+	// fetched, or fetched longer than the max age ago (0 means no limit), unless a full refresh is
+	// forced
+	FetchRefreshMaxAge time.Duration `envconfig:"FETCH_REFRESH_MAX_AGE" default:"168h"`
+	FetchFullRefresh   bool          `envconfig:"FETCH_FULL_REFRESH" default:"false"`
+
+	// Lease duration of the lock electing the replica running the fetcher, with the redis backend
+	FetcherLockTTL time.Duration `envconfig:"FETCHER_LOCK_TTL" default:"30s"`
+
+	StoreConfig
+
+	// Bounds of the response cache when using the memory backend, 0 means unlimited.
+	// Eviction policy: lru or lfu
+	CacheMaxEntries     int    `envconfig:"CACHE_MAX_ENTRIES" default:"10000"`
+	CacheMaxBytes       int64  `envconfig:"CACHE_MAX_BYTES" default:"67108864"`
+	CacheEvictionPolicy string `envconfig:"CACHE_EVICTION_POLICY" default:"lru"`
+}
+
+// StoreConfig configures the key value store backend, it is shared by the service and the tools
+// accessing its store
+type StoreConfig struct {
+	// Key value store backend: memory, disk or redis
+	StoreBackend string `envconfig:"STORE_BACKEND" default:"memory"`
+
+	// Codec used by out-of-process backends to serialize values: json, gob or binary
+	StoreCodec string `envconfig:"STORE_CODEC" default:"json"`
+
+	// Values of out-of-process backends larger than the threshold are gzipped, 0 disables it.
+	// Comma separated id:base64 AES keys encrypting values, the first one encrypts new values.
+	StoreCompressionThreshold int    `envconfig:"STORE_COMPRESSION_THRESHOLD" default:"0"`
+	StoreEncryptionKeys       string `envconfig:"STORE_ENCRYPTION_KEYS"`
+
+	// Namespace prefixing every key, so that several environments or tenants can share a backend
+	StoreNamespace string `envconfig:"STORE_NAMESPACE"`
+
+	// Disk backend settings, sync policy: always, interval or never
+	DiskStorePath               string        `envconfig:"DISK_STORE_PATH" default:"data/kvstore.log"`
+	DiskStoreSync               string        `envconfig:"DISK_STORE_SYNC" default:"interval"`
+	DiskStoreSyncInterval       time.Duration `envconfig:"DISK_STORE_SYNC_INTERVAL" default:"1s"`
+	DiskStoreCompactionInterval time.Duration `envconfig:"DISK_STORE_COMPACTION_INTERVAL" default:"10m"`
+
+	RedisAddr         string        `envconfig:"REDIS_ADDR" default:"localhost:6379"`
+	RedisPassword     string        `envconfig:"REDIS_PASSWORD"`
+	RedisDB           int           `envconfig:"REDIS_DB" default:"0"`
+	RedisPoolSize     int           `envconfig:"REDIS_POOL_SIZE" default:"10"`
+	RedisDialTimeout  time.Duration `envconfig:"REDIS_DIAL_TIMEOUT" default:"5s"`
+	RedisReadTimeout  time.Duration `envconfig:"REDIS_READ_TIMEOUT" default:"3s"`
+	RedisWriteTimeout time.Duration `envconfig:"REDIS_WRITE_TIMEOUT" default:"3s"`
+
+	// Comma separated redis replicas serving reads, writes always go to REDIS_ADDR.
+	// Read balancing: round_robin or least_latency
+	RedisReplicaAddrs         []string      `envconfig:"REDIS_REPLICA_ADDRS"`
+	RedisReadBalancing        string        `envconfig:"REDIS_READ_BALANCING" default:"round_robin"`
+	RedisReadYourWritesWindow time.Duration `envconfig:"REDIS_READ_YOUR_WRITES_WINDOW" default:"1s"`
+
+	// Comma separated redis nodes sharing the keys with REDIS_ADDR through consistent hashing,
+	// cannot be combined with replicas
+	RedisShardAddrs []string `envconfig:"REDIS_SHARD_ADDRS"`
+
+	// Local in-memory tier in front of redis, 0 disables it. Mode: write_through or write_around
+	RedisL1TTL  time.Duration `envconfig:"REDIS_L1_TTL" default:"30s"`
+	RedisL1Mode string        `envconfig:"REDIS_L1_MODE" default:"write_through"`
 }
@@ -0,0 +1,119 @@
+package fetcher
+
+import (
+	"context"
+	"github.com/MarouaneMan/github-api/api"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"github.com/pkg/errors"
+)
+
+// errFenced is returned when a run holding a higher fencing token started since this one
+var errFenced = errors.New("A run holding a higher fencing token started in the meantime")
+
+// claim records token in every item stored by the runs, so that the runs holding a lower token
+// cannot write them anymore, or returns errFenced if a run holding a higher token already started.
+// 0 disables fencing.
+func claim(ctx context.Context, store kvstore.ReadWriter, token uint64) error {
+	if token == 0 {
+		return nil
+	}
+	for _, claimKey := range []func() error{
+		func() error { return claimItem[[]*api.Repository](ctx, store, repositoriesKey, token) },
+		func() error { return claimItem[api.FetchReport](ctx, store, reportKey, token) },
+		func() error { return claimItem[int64](ctx, store, cursorKey, token) },
+		func() error { return claimItem[GraphQLCursor](ctx, store, graphqlCursorKey, token) },
+		func() error { return claimItem[map[string]RepositoryMetadata](ctx, store, metadataKey, token) },
+	} {
+		err := claimKey()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimItem records token in the item stored under key, keeping its value. Items which cannot be
+// decoded are left as is, they are overwritten by the next write.
+func claimItem[T any](ctx context.Context, store kvstore.ReadWriter, key string, token uint64) error {
+	for {
+		item, version, err := readFenced[T](ctx, store, key)
+		var decodeErr *kvstore.DecodeError
+		if errors.As(err, &decodeErr) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read %s from store", key)
+		}
+		if item.FencingToken > token {
+			return errFenced
+		}
+		if item.FencingToken == token {
+			return nil
+		}
+		err = writeFenced(ctx, store, key, token, item.Value, version)
+		if errors.Is(err, kvstore.ErrVersionMismatch) && ctx.Err() == nil {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Failed to write fencing token of %s to store", key)
+		}
+		return nil
+	}
+}
+
+// storeFenced stores value under key along with token, or returns errFenced if the item was stored
+// by a run holding a higher token. The token check and the write are a single compare-and-swap,
+// retried if the item is modified in between, so that a run which lost its leadership cannot
+// overwrite the items of the current leader. 0 disables fencing.
+func storeFenced[T any](ctx context.Context, store kvstore.ReadWriter, key string, token uint64, value T) error {
+	for {
+		item, version, err := readFenced[T](ctx, store, key)
+		var decodeErr *kvstore.DecodeError
+		if err != nil && !errors.As(err, &decodeErr) {
+			return err
+		}
+		if token != 0 && item.FencingToken > token {
+			return errFenced
+		}
+		err = writeFenced(ctx, store, key, token, &value, version)
+		if errors.Is(err, kvstore.ErrVersionMismatch) && ctx.Err() == nil {
+			continue
+		}
+		return err
+	}
+}
+
+// readFenced reads the item stored under key along with its version, an empty item of version 0 if
+// none is stored. The version is nil if the store has no versions or the item cannot be decoded,
+// in which case it is overwritten unconditionally.
+func readFenced[T any](ctx context.Context, store kvstore.Reader, key string) (api.Fenced[T], *uint64, error) {
+	var item api.Fenced[T]
+	version, err := kvstore.ReadVersion(ctx, store, key, &item)
+	if errors.Is(err, kvstore.ErrVersioningNotSupported) {
+		err = kvstore.ReadInto(ctx, store, key, &item)
+		if errors.Is(err, kvstore.ErrNotFound) {
+			return api.Fenced[T]{}, nil, nil
+		}
+		return item, nil, err
+	}
+	if errors.Is(err, kvstore.ErrNotFound) {
+		var missing uint64
+		return api.Fenced[T]{}, &missing, nil
+	}
+	if err != nil {
+		return api.Fenced[T]{}, nil, err
+	}
+	return item, &version, nil
+}
+
+// writeFenced stores value under key along with token, only if the item still has version, nil
+// meaning unconditionally. Stores without versions cannot check the token atomically, the item is
+// written as is.
+func writeFenced[T any](ctx context.Context, store kvstore.Writer, key string, token uint64, value *T, version *uint64) error {
+	item := api.Fenced[T]{FencingToken: token, Value: value}
+	if version == nil {
+		return store.Write(ctx, key, item, kvstore.NoExpiration)
+	}
+	_, err := kvstore.WriteIfVersion(ctx, store, key, item, *version, kvstore.NoExpiration)
+	return err
+}
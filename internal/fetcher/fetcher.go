@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/MarouaneMan/github-api/api"
 	"github.com/MarouaneMan/github-api/internal/config"
+	"github.com/MarouaneMan/github-api/internal/github"
 	"github.com/MarouaneMan/github-api/kvstore"
 	"github.com/Scalingo/go-utils/logger"
 	"github.com/pkg/errors"
@@ -20,124 +21,453 @@ type githubOwner struct {
 }
 
 type githubRepository struct {
+	ID        int64       `json:"id"`
+	NodeID    string      `json:"node_id"`
 	Name      string      `json:"name"`
 	FullName  string      `json:"full_name"`
 	Owner     githubOwner `json:"owner"`
 	URL       string      `json:"url"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	PushedAt  time.Time   `json:"pushed_at"`
 	Languages map[string]uint64
 }
 
 const (
-	githubApiUrl     = "https://api.github.com"
-	githubApiVersion = "2022-11-28"
+	githubApiUrl    = "https://api.github.com"
+	repositoriesKey = "repositories"
+
+	// cursorKey stores the id of the last fetched repository, the next run resumes after it
+	cursorKey = "fetcher:cursor"
+
+	// reportKey stores the report of the last run
+	reportKey = "fetcher:report"
 )
 
+// storedTypes maps the keys stored by the runs to constructors of the types of their items
+var storedTypes = map[string]func() any{
+	repositoriesKey:  func() any { return &api.Fenced[[]*api.Repository]{} },
+	cursorKey:        func() any { return &api.Fenced[int64]{} },
+	reportKey:        func() any { return &api.Fenced[api.FetchReport]{} },
+	metadataKey:      func() any { return &api.Fenced[map[string]RepositoryMetadata]{} },
+	graphqlCursorKey: func() any { return &api.Fenced[GraphQLCursor]{} },
+}
+
+// StoredType returns a pointer to a new value of the type the runs store under key, relative to
+// the store given to Run, or nil if the runs store nothing under key.
+func StoredType(key string) any {
+	newValue, ok := storedTypes[key]
+	if !ok {
+		return nil
+	}
+	return newValue()
+}
+
 // Run is the main function to fetch repositories and their languages from GitHub.
 // It initializes the required components and orchestrates the fetching and storing process.
+// A repository whose languages fail to be fetched does not fail the run, it is stored as stale with
+// the languages of its previous version and fetched again by the next run. The report of the run
+// is stored, recorded in metrics unless nil, and returned.
+// fencingToken is the fencing token of the leadership the run is made under, 0 if none: nothing is
+// stored once a run holding a higher token started, so that a previous leader which lost its
+// leadership while running cannot overwrite the results of the current one.
 func Run(
 	ctx context.Context,
 	config *config.Config,
-	storeWriter kvstore.Writer,
-	httpTransport http.RoundTripper,
-) {
+	store kvstore.ReadWriter,
+	client github.Client,
+	metrics *Metrics,
+	fencingToken uint64,
+) (report api.FetchReport) {
 	// Fetch all repositories
 	log := logger.Get(ctx)
 	log.Info("Fetching repositories...")
+	report = api.FetchReport{Status: api.FetchFailed, StartedAt: time.Now().UTC()}
 	defer func() {
-		log.Info("Fetching repositories finished")
+		report.FinishedAt = time.Now().UTC()
+		metrics.observeRun(report)
+		err := storeFenced(ctx, store, reportKey, fencingToken, report)
+		if err != nil {
+			log.WithError(err).Error("Failed to write fetch report to store")
+		}
+		quota := client.Quota()
+		log.WithField("status", report.Status).WithField("succeeded", report.Succeeded).WithField("failed", report.Failed).
+			WithField("skipped", report.Skipped).WithField("stale", report.Stale).WithField("ratelimit_remaining", quota.Remaining).WithField("ratelimit_limit", quota.Limit).
+			WithField("ratelimit_reset", quota.Reset).Info("Fetching repositories finished")
 	}()
 
-	// fetch and parse repositories
-	githubRepositories, err := fetchRepositories(ctx, config, httpTransport)
+	err := claim(ctx, store, fencingToken)
+	if err != nil {
+		log.WithError(err).Error("Failed to claim fencing token")
+		report.Error = errors.Wrap(err, "Failed to claim fencing token").Error()
+		return report
+	}
+
+	// remember the version of the stored repositories, so that a concurrent run storing its
+	// repositories first is not overwritten by this one
+	previous, version, err := readRepositories(ctx, store)
+	if err != nil {
+		log.WithError(err).Error("Failed to read repositories from store")
+		report.Error = errors.Wrap(err, "Failed to read repositories from store").Error()
+		return report
+	}
+
+	// fetch and parse repositories, resuming after the last repository fetched by the previous run
+	githubRepositories, cost, writeCursor, err := listRepositories(ctx, config, store, client)
+	report.GraphQLCost = cost
 	if err != nil {
 		log.WithError(err).Errorf("Failed to fetch repositories")
-		return
+		report.Error = errors.Wrap(err, "Failed to fetch repositories").Error()
+		return report
 	}
 
-	// fetch repo languages
-	{
-		eg, egCtx := errgroup.WithContext(ctx)
-		for _, repo := range githubRepositories {
-			repo := repo // closure capture fixed in go 1.22 ?
-			eg.Go(func() error {
-				return fetchRepositoryLanguages(egCtx, config, httpTransport, repo)
-			})
-		}
-		err = eg.Wait()
+	// fetch the languages of the repositories which changed since their languages were fetched,
+	// along with the ones of the stale repositories of the previous runs
+	githubRepositories = append(githubRepositories, staleRepositories(previous, githubRepositories)...)
+	previousByName := make(map[string]*api.Repository, len(previous))
+	for _, repo := range previous {
+		previousByName[repo.FullName] = repo
+	}
+	metadata := readMetadata(ctx, store)
+	now := time.Now().UTC()
+	if config.FetchBackend != "graphql" {
+		// the REST listing does not report the timestamps of the repositories, they are looked up
+		// with GraphQL to tell the unchanged ones
+		cost, err := lookupTimestamps(ctx, config, client, githubRepositories)
+		report.GraphQLCost += cost
 		if err != nil {
-			log.WithError(err).Error("Failed to fetch repositories languages")
-			return
+			log.WithError(err).Warn("Failed to look up repositories timestamps, fetching the languages of every repository")
+		}
+	}
+	skipped := map[string]bool{}
+	changed := make([]*githubRepository, 0, len(githubRepositories))
+	for _, repo := range githubRepositories {
+		if repo.Languages != nil {
+			// fetched along with the repository
+			continue
+		}
+		if previous, ok := previousByName[repo.FullName]; ok && !previous.Stale && !config.FetchFullRefresh &&
+			unchanged(repo, metadata[repo.FullName], config.FetchRefreshMaxAge, now) {
+			skipped[repo.FullName] = true
+			continue
+		}
+		changed = append(changed, repo)
+	}
+	errs := fetchRepositoriesLanguages(ctx, client, changed, config.FetchConcurrency, metrics)
+	fetchErrs := make(map[string]error, len(errs))
+	for i, err := range errs {
+		fetchErrs[changed[i].FullName] = err
+	}
+
+	// transform the repositories, the unchanged ones and the ones which failed keep their previous
+	// languages
+	fetched := mapGithubReposToAPIRepos(githubRepositories)
+	for i, repo := range fetched {
+		if skipped[repo.FullName] {
+			report.Skipped++
+			fetched[i] = previousByName[repo.FullName]
+			continue
+		}
+		err := fetchErrs[repo.FullName]
+		if err == nil {
+			report.Succeeded++
+			metadata[repo.FullName] = RepositoryMetadata{
+				UpdatedAt:          githubRepositories[i].UpdatedAt,
+				PushedAt:           githubRepositories[i].PushedAt,
+				LanguagesFetchedAt: now,
+			}
+			continue
 		}
+		log.WithError(err).WithField("repository", repo.FullName).Warn("Failed to fetch repository languages, storing it as stale")
+		report.Failed++
+		report.Failures = append(report.Failures, api.FetchFailure{FullName: repo.FullName, Error: err.Error()})
+		if previous, ok := previousByName[repo.FullName]; ok {
+			stale := *previous
+			fetched[i] = &stale
+		}
+		fetched[i].Stale = true
 	}
+	report.Repositories = len(fetched)
 
-	// transform and store repositories
-	repositories := mapGithubReposToAPIRepos(githubRepositories)
-	err = storeWriter.Write(ctx, "repositories", repositories, kvstore.NoExpiration)
+	// store repositories along with the ones fetched by the previous runs, up to the configured
+	// number of repositories
+	repositories, evicted := mergeRepositories(previous, fetched, config.FetchMaxStoredRepositories)
+	if evicted > 0 {
+		log.WithField("evicted", evicted).Info("Evicting the least recently fetched repositories")
+	}
+	err = writeRepositories(ctx, store, repositories, fencingToken, version)
+	if errors.Is(err, errFenced) {
+		log.Warn("A run holding a higher fencing token started in the meantime, discarding the fetched repositories")
+		report.Error = err.Error()
+		return report
+	}
+	if errors.Is(err, kvstore.ErrVersionMismatch) {
+		log.Warn("Repositories were stored by a concurrent run in the meantime, discarding the fetched ones")
+		report.Error = "Repositories were stored by a concurrent run in the meantime"
+		return report
+	}
 	if err != nil {
 		log.WithError(err).Error("Failed to write repositories to store")
+		report.Error = errors.Wrap(err, "Failed to write repositories to store").Error()
+		return report
+	}
+	report.Status = api.FetchSucceeded
+	if report.Failed > 0 {
+		report.Status = api.FetchPartiallyFailed
+	}
+	for _, repo := range repositories {
+		if repo.Stale {
+			report.Stale++
+		}
+	}
+
+	// the cursor only moves forward once the repositories are stored, if it fails to be written the
+	// next run fetches the same repositories again
+	err = writeCursor(fencingToken)
+	if err != nil {
+		log.WithError(err).Error("Failed to write repositories cursor to store")
+	}
+
+	// if the metadata fails to be written, the next run fetches the languages of every repository
+	pruneMetadata(metadata, repositories)
+	err = storeFenced(ctx, store, metadataKey, fencingToken, metadata)
+	if err != nil {
+		log.WithError(err).Error("Failed to write repositories metadata to store")
 	}
+	return report
 }
 
-// fetchRepositories fetches a list of repositories from GitHub.
-// It makes an HTTP GET request to the GitHub API and returns a slice of githubRepository.
-func fetchRepositories(ctx context.Context, config *config.Config, httpTransport http.RoundTripper) ([]*githubRepository, error) {
+// listRepositories lists the repositories with the configured backend, resuming after the ones
+// listed by the previous run. It returns the cost of the GraphQL queries, and a function storing
+// the cursor the next run resumes from under a fencing token.
+func listRepositories(ctx context.Context, config *config.Config, store kvstore.ReadWriter, client github.Client) ([]*githubRepository, int, func(token uint64) error, error) {
+	log := logger.Get(ctx)
+	switch config.FetchBackend {
+	case "", "rest":
+		since := readCursor(ctx, store)
+		repositories, cursor, err := fetchRepositories(ctx, config, client, since)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		log.WithField("since", since).WithField("count", len(repositories)).Info("Repositories fetched")
+		return repositories, 0, func(token uint64) error {
+			return storeFenced(ctx, store, cursorKey, token, cursor)
+		}, nil
+	case "graphql":
+		after := readGraphQLCursor(ctx, store, config.GithubGraphQLSearch)
+		repositories, cursor, cost, err := fetchRepositoriesGraphQL(ctx, config, client, after)
+		if err != nil {
+			return nil, cost, nil, err
+		}
+		log.WithField("after", after).WithField("count", len(repositories)).WithField("cost", cost).Info("Repositories fetched with GraphQL")
+		return repositories, cost, func(token uint64) error {
+			return storeFenced(ctx, store, graphqlCursorKey, token, GraphQLCursor{Search: config.GithubGraphQLSearch, After: cursor})
+		}, nil
+	}
+	return nil, 0, nil, errors.Errorf("Unknown fetch backend %q", config.FetchBackend)
+}
 
-	// Create a context with a timeout
-	ctxWithTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
-	defer cancel()
+// readRepositories returns the stored repositories along with their version, 0 if none are
+// stored. The version is nil if the store has no versions or the stored repositories cannot be
+// decoded, in which case they are overwritten unconditionally.
+func readRepositories(ctx context.Context, store kvstore.Reader) ([]*api.Repository, *uint64, error) {
+	item, version, err := readFenced[[]*api.Repository](ctx, store, repositoriesKey)
+	var decodeErr *kvstore.DecodeError
+	if errors.As(err, &decodeErr) {
+		return nil, nil, nil
+	}
+	if err != nil || item.Value == nil {
+		return nil, version, err
+	}
+	return *item.Value, version, nil
+}
+
+// readCursor returns the id of the last repository fetched by the previous run, 0 to start from
+// the first repository
+func readCursor(ctx context.Context, store kvstore.Reader) int64 {
+	item, _, err := readFenced[int64](ctx, store, cursorKey)
+	if err != nil {
+		logger.Get(ctx).WithError(err).Warn("Failed to read repositories cursor from store, fetching from the first repository")
+		return 0
+	}
+	if item.Value == nil {
+		return 0
+	}
+	return *item.Value
+}
+
+// staleRepositories returns the stale repositories of previous which are not part of fetched, so
+// that their languages are fetched again
+func staleRepositories(previous []*api.Repository, fetched []*githubRepository) []*githubRepository {
+	listed := make(map[string]bool, len(fetched))
+	for _, repo := range fetched {
+		listed[repo.FullName] = true
+	}
+	stale := []*githubRepository{}
+	for _, repo := range previous {
+		if !repo.Stale || listed[repo.FullName] {
+			continue
+		}
+		stale = append(stale, &githubRepository{
+			Name:     repo.Repository,
+			FullName: repo.FullName,
+			Owner:    githubOwner{Login: repo.Owner},
+			URL:      fmt.Sprintf("%s/repos/%s", githubApiUrl, repo.FullName),
+		})
+	}
+	return stale
+}
+
+// mergeRepositories adds the fetched repositories to the previous ones, replacing the previous
+// version of the repositories fetched again. Repositories are ordered from the least recently
+// fetched, which are evicted first so that at most max repositories are kept, 0 meaning unlimited.
+// It returns the merged repositories along with the number of evicted ones.
+func mergeRepositories(previous, fetched []*api.Repository, max int) ([]*api.Repository, int) {
+	refetched := make(map[string]bool, len(fetched))
+	for _, repo := range fetched {
+		refetched[repo.FullName] = true
+	}
+	merged := make([]*api.Repository, 0, len(previous)+len(fetched))
+	for _, repo := range previous {
+		if !refetched[repo.FullName] {
+			merged = append(merged, repo)
+		}
+	}
+	merged = append(merged, fetched...)
+
+	if max <= 0 || len(merged) <= max {
+		return merged, 0
+	}
+	evicted := len(merged) - max
+	return merged[evicted:], evicted
+}
+
+// writeRepositories stores the repositories along with the fencing token, only if they were not
+// modified since version was read. It returns errFenced if they were stored by a run holding a
+// higher token in the meantime.
+func writeRepositories(ctx context.Context, store kvstore.ReadWriter, repositories []*api.Repository, token uint64, version *uint64) error {
+	err := writeFenced(ctx, store, repositoriesKey, token, &repositories, version)
+	if !errors.Is(err, kvstore.ErrVersionMismatch) || token == 0 {
+		return err
+	}
+	item, _, readErr := readFenced[[]*api.Repository](ctx, store, repositoriesKey)
+	if readErr == nil && item.FencingToken > token {
+		return errFenced
+	}
+	return err
+}
+
+// fetchRepositories fetches the repositories created after the repository since from GitHub,
+// following the pages of the listing until the configured number of pages or repositories is
+// reached. It returns the repositories along with the cursor the next run resumes from, the id of
+// the last fetched repository or 0 once the end of the listing is reached.
+func fetchRepositories(ctx context.Context, config *config.Config, client github.Client, since int64) ([]*githubRepository, int64, error) {
 
 	// Node: the endpoint /repositories does not return the most recent repositories but the oldest ones.
 	// As of the time of writing this, there is no direct method using the '/search' endpoint with sort/q/order filters to fetch the latest repositories.
-	req, _ := http.NewRequestWithContext(ctxWithTimeout, "GET", fmt.Sprintf("%s/repositories", githubApiUrl), nil)
+	url := fmt.Sprintf("%s/repositories", githubApiUrl)
+	if since > 0 {
+		url = fmt.Sprintf("%s?since=%d", url, since)
+	}
 
-	// Add the authorization/apiVersion headers to the request
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", config.GithubToken))
-	req.Header.Set("X-GitHub-Api-Version", githubApiVersion)
+	repositories := []*githubRepository{}
+	cursor := since
+	for page := 1; ; page++ {
+		pageRepositories, next, err := fetchRepositoriesPage(ctx, client, url)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "Failed to fetch page %d", page)
+		}
+		if config.FetchMaxRepositories > 0 && len(repositories)+len(pageRepositories) > config.FetchMaxRepositories {
+			pageRepositories = pageRepositories[:config.FetchMaxRepositories-len(repositories)]
+		}
+		repositories = append(repositories, pageRepositories...)
+		if len(pageRepositories) > 0 {
+			cursor = pageRepositories[len(pageRepositories)-1].ID
+		}
 
-	// Send request
-	client := &http.Client{
-		Transport: httpTransport,
+		switch {
+		case config.FetchMaxRepositories > 0 && len(repositories) >= config.FetchMaxRepositories:
+			return repositories, cursor, nil
+		case next == "":
+			// end of the listing, the next run starts over
+			return repositories, 0, nil
+		case config.FetchMaxPages > 0 && page >= config.FetchMaxPages:
+			return repositories, cursor, nil
+		}
+		url = next
 	}
-	resp, err := client.Do(req)
+}
+
+// fetchRepositoriesPage fetches a page of repositories, it returns the url of the next page taken
+// from the Link header, empty for the last page
+func fetchRepositoriesPage(ctx context.Context, client github.Client, url string) ([]*githubRepository, string, error) {
+	resp, err := client.Get(ctx, url)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to execute http request")
+		return nil, "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("Unexpected http statusCode = %d", resp.StatusCode)
+		return nil, "", errors.Errorf("Unexpected http statusCode = %d", resp.StatusCode)
 	}
 
 	// Decode JSON response
 	var repositories []*githubRepository
 	err = json.NewDecoder(resp.Body).Decode(&repositories)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error while decoding JSON response")
+		return nil, "", errors.Wrap(err, "Error while decoding JSON response")
 	}
-	return repositories, nil
+	return repositories, nextPageURL(resp.Header.Get("Link")), nil
 }
 
-// fetchRepositoryLanguages fetches programming languages for a given repository.
-// The result is directly updated in the provided repo object.
-func fetchRepositoryLanguages(ctx context.Context, config *config.Config, httpTransport http.RoundTripper, repo *githubRepository) error {
-
-	// Create a context with a timeout
-	ctxWithTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
-	defer cancel()
-
-	req, _ := http.NewRequestWithContext(ctxWithTimeout, "GET", fmt.Sprintf("%s/languages", repo.URL), nil)
-
-	// Add the authorization/apiVersion headers to the request
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", config.GithubToken))
-	req.Header.Set("X-GitHub-Api-Version", githubApiVersion)
+// nextPageURL returns the url of the rel="next" link of a Link header, empty if there is none
+func nextPageURL(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		target, params, found := strings.Cut(part, ";")
+		if !found {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(target), "<>")
+			}
+		}
+	}
+	return ""
+}
 
-	// Send request
-	client := &http.Client{
-		Transport: httpTransport,
+// fetchRepositoriesLanguages fetches the languages of the repositories with up to concurrency
+// workers, 0 meaning one per repository. It returns the error of every repository, nil if its
+// languages were fetched.
+// Repositories wait for a worker before their request is sent, so that the request timeout does not
+// run while they are queued.
+func fetchRepositoriesLanguages(ctx context.Context, client github.Client, repositories []*githubRepository, concurrency int, metrics *Metrics) []error {
+	errs := make([]error, len(repositories))
+	var eg errgroup.Group
+	if concurrency > 0 {
+		eg.SetLimit(concurrency)
 	}
-	resp, err := client.Do(req)
+	metrics.observeQueued(len(repositories))
+	queuedAt := time.Now()
+	for i, repo := range repositories {
+		i, repo := i, repo // closure capture fixed in go 1.22 ?
+		eg.Go(func() error {
+			start := time.Now()
+			metrics.observeStarted(start.Sub(queuedAt))
+			errs[i] = fetchRepositoryLanguages(ctx, client, repo)
+			metrics.observeFinished(time.Since(start))
+			return nil
+		})
+	}
+	_ = eg.Wait()
+	return errs
+}
+
+// fetchRepositoryLanguages fetches programming languages for a given repository.
+// The result is directly updated in the provided repo object.
+func fetchRepositoryLanguages(ctx context.Context, client github.Client, repo *githubRepository) error {
+	resp, err := client.Get(ctx, fmt.Sprintf("%s/languages", repo.URL))
 	if err != nil {
-		return errors.Wrap(err, "Failed to execute http request")
+		return err
 	}
 	defer resp.Body.Close()
 
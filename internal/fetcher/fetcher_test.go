@@ -2,12 +2,21 @@ package fetcher
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/MarouaneMan/github-api/api"
 	"github.com/MarouaneMan/github-api/internal/config"
+	"github.com/MarouaneMan/github-api/internal/github"
+	"github.com/MarouaneMan/github-api/internal/metrics"
 	"github.com/MarouaneMan/github-api/kvstore"
 	"github.com/jarcoal/httpmock"
+	"net/http"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const repositoriesResponseMock = `
@@ -42,6 +51,25 @@ const languagesResponseMockSecond = `
 }
 `
 
+// readStored decodes the value of an item stored by the fetcher into dst, returns
+// kvstore.ErrNotFound if it has none
+func readStored[T any](ctx context.Context, store kvstore.Reader, key string, dst *T) error {
+	item, _, err := readFenced[T](ctx, store, key)
+	if err != nil {
+		return err
+	}
+	if item.Value == nil {
+		return kvstore.ErrNotFound
+	}
+	*dst = *item.Value
+	return nil
+}
+
+// newTestClient returns a GitHub client sending its requests to httpmock without throttling them
+func newTestClient() github.Client {
+	return github.NewClient("", httpmock.DefaultTransport, github.Options{RequestsPerSecond: 1000})
+}
+
 func TestFetcher(t *testing.T) {
 
 	httpmock.Activate()
@@ -68,10 +96,11 @@ func TestFetcher(t *testing.T) {
 	}
 
 	// run fetcher
-	Run(ctx, &config.Config{}, store, httpmock.DefaultTransport)
+	Run(ctx, &config.Config{}, store, newTestClient(), nil, 0)
 
-	repositories, ok := store.Read(ctx, "repositories").([]*api.Repository)
-	if !ok {
+	var repositories []*api.Repository
+	err := readStored(ctx, store, "repositories", &repositories)
+	if err != nil {
 		t.Error("Failed to retrieve cached data from the store")
 	}
 
@@ -102,3 +131,578 @@ func TestFetcher(t *testing.T) {
 		t.Errorf("Fetched repositories do not match expected: got %+v, want %+v", repositories, expected)
 	}
 }
+
+func TestStoredType(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	ctx := context.Background()
+
+	httpmock.RegisterResponder("GET", `=~^.+/repositories\z`,
+		httpmock.NewStringResponder(200, repositoriesResponseMock),
+	)
+	httpmock.RegisterResponder("GET", `=~^.+/languages\z`,
+		httpmock.NewStringResponder(200, languagesResponseMockFirst),
+	)
+
+	Run(ctx, &config.Config{}, store, newTestClient(), nil, 1)
+
+	keys, err := store.Scan(ctx, "")
+	if err != nil {
+		t.Fatalf("Failed to scan the store: %v", err)
+	}
+	if len(keys) == 0 {
+		t.Fatal("Nothing was stored by the run")
+	}
+	for _, key := range keys {
+		dst := StoredType(key)
+		if dst == nil {
+			t.Errorf("No type is registered for key %s", key)
+			continue
+		}
+		err := kvstore.ReadInto(ctx, store, key, dst)
+		if err != nil {
+			t.Errorf("Failed to read %s into its registered type: %v", key, err)
+		}
+	}
+
+	if StoredType("unknown") != nil {
+		t.Error("A type is returned for a key the runs do not store")
+	}
+}
+
+func TestFetcherRefusesStaleOverwrite(t *testing.T) {
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	ctx := context.Background()
+
+	// a concurrent run stores its repositories while this one is fetching
+	newer := []*api.Repository{{FullName: "gopher/newer", Repository: "newer", Owner: "gopher"}}
+	concurrentRun := true
+	httpmock.RegisterResponder("GET", `=~^.+/repositories\z`,
+		func(req *http.Request) (*http.Response, error) {
+			if concurrentRun {
+				_ = writeFenced(ctx, store, "repositories", 0, &newer, nil)
+				concurrentRun = false
+			}
+			return httpmock.NewStringResponse(200, repositoriesResponseMock), nil
+		},
+	)
+	httpmock.RegisterResponder("GET", `=~^.+/languages\z`,
+		httpmock.NewStringResponder(200, languagesResponseMockFirst),
+	)
+
+	Run(ctx, &config.Config{}, store, newTestClient(), nil, 0)
+
+	var repositories []*api.Repository
+	err := readStored(ctx, store, "repositories", &repositories)
+	if err != nil {
+		t.Fatalf("Failed to retrieve cached data from the store: %v", err)
+	}
+	if !reflect.DeepEqual(repositories, newer) {
+		t.Errorf("Repositories stored by the concurrent run should not be overwritten, got %+v", repositories)
+	}
+
+	// the next run starts from the current version
+	Run(ctx, &config.Config{}, store, newTestClient(), nil, 0)
+	_ = readStored(ctx, store, "repositories", &repositories)
+	if len(repositories) != 3 {
+		t.Errorf("Repositories should be stored by a run started afterwards, got %+v", repositories)
+	}
+}
+
+func TestFetcherFencing(t *testing.T) {
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	ctx := context.Background()
+
+	// the current leader starts a run while a previous leader is still fetching
+	current := []*api.Repository{{FullName: "gopher/current", Repository: "current", Owner: "gopher"}}
+	newLeader := true
+	httpmock.RegisterResponder("GET", `=~^.+/repositories\z`,
+		func(req *http.Request) (*http.Response, error) {
+			if newLeader {
+				_ = claim(ctx, store, 3)
+				_ = writeFenced(ctx, store, "repositories", 3, &current, nil)
+				newLeader = false
+			}
+			return httpmock.NewStringResponse(200, repositoriesResponseMock), nil
+		},
+	)
+	httpmock.RegisterResponder("GET", `=~^.+/languages\z`,
+		httpmock.NewStringResponder(200, languagesResponseMockFirst),
+	)
+
+	report := Run(ctx, &config.Config{}, store, newTestClient(), nil, 2)
+	if report.Status != api.FetchFailed {
+		t.Errorf("Run of a previous leader should fail, got status %q", report.Status)
+	}
+	var repositories []*api.Repository
+	_ = readStored(ctx, store, "repositories", &repositories)
+	if !reflect.DeepEqual(repositories, current) {
+		t.Errorf("Repositories of the current leader should not be overwritten, got %+v", repositories)
+	}
+	var stored api.FetchReport
+	if err := readStored(ctx, store, "fetcher:report", &stored); err != kvstore.ErrNotFound {
+		t.Errorf("Report of a previous leader should not be stored, got error %v", err)
+	}
+	var cursor int64
+	if err := readStored(ctx, store, "fetcher:cursor", &cursor); err != kvstore.ErrNotFound {
+		t.Errorf("Cursor of a previous leader should not be stored, got error %v", err)
+	}
+
+	// a run holding a lower token does not even start
+	report = Run(ctx, &config.Config{}, store, newTestClient(), nil, 1)
+	if report.Status != api.FetchFailed || report.Succeeded != 0 {
+		t.Errorf("Run holding a lower token should fail right away, got %+v", report)
+	}
+
+	report = Run(ctx, &config.Config{}, store, newTestClient(), nil, 3)
+	if report.Status != api.FetchSucceeded {
+		t.Errorf("Run of the current leader should succeed, got %+v", report)
+	}
+	repositoriesItem, _, _ := readFenced[[]*api.Repository](ctx, store, "repositories")
+	cursorItem, _, _ := readFenced[int64](ctx, store, "fetcher:cursor")
+	if repositoriesItem.FencingToken != 3 || cursorItem.FencingToken != 3 {
+		t.Errorf("Fencing token should be kept, got %d and %d", repositoriesItem.FencingToken, cursorItem.FencingToken)
+	}
+}
+
+// registerRepositoriesPages mocks a listing of total repositories served pageSize at a time,
+// the next page being linked until the end of the listing. It returns the requested since cursors.
+func registerRepositoriesPages(total, pageSize int) *[]string {
+	requested := []string{}
+	httpmock.RegisterResponder("GET", `=~^.+/repositories`,
+		func(req *http.Request) (*http.Response, error) {
+			since, _ := strconv.Atoi(req.URL.Query().Get("since"))
+			requested = append(requested, strconv.Itoa(since))
+			repositories := []string{}
+			for id := since + 1; id <= total && id <= since+pageSize; id++ {
+				repositories = append(repositories, fmt.Sprintf(
+					`{"id": %d, "name": "repo-%d", "full_name": "gopher/repo-%d", "owner": {"login": "gopher"}, "url": "https://api.github.com/repos/gopher/repo-%d"}`,
+					id, id, id, id,
+				))
+			}
+			resp := httpmock.NewStringResponse(200, "["+strings.Join(repositories, ",")+"]")
+			if since+pageSize < total {
+				resp.Header.Set("Link", fmt.Sprintf(
+					`<https://api.github.com/repositories?since=%d>; rel="next", <https://api.github.com/repositories{?since}>; rel="first"`,
+					since+pageSize,
+				))
+			}
+			return resp, nil
+		},
+	)
+	httpmock.RegisterResponder("GET", `=~^.+/languages\z`,
+		httpmock.NewStringResponder(200, languagesResponseMockFirst),
+	)
+	return &requested
+}
+
+func TestFetcherPagination(t *testing.T) {
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	ctx := context.Background()
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	requested := registerRepositoriesPages(10, 2)
+	cfg := &config.Config{FetchMaxPages: 2}
+
+	repositoriesCount := func() int {
+		var repositories []*api.Repository
+		_ = readStored(ctx, store, "repositories", &repositories)
+		return len(repositories)
+	}
+	cursor := func() int64 {
+		var cursor int64
+		_ = readStored(ctx, store, "fetcher:cursor", &cursor)
+		return cursor
+	}
+
+	Run(ctx, cfg, store, newTestClient(), nil, 0)
+	if repositoriesCount() != 4 || cursor() != 4 {
+		t.Errorf("Expected 2 pages to be fetched, got %d repositories and cursor %d", repositoriesCount(), cursor())
+	}
+
+	// the next run resumes after the last fetched repository
+	Run(ctx, cfg, store, newTestClient(), nil, 0)
+	if repositoriesCount() != 8 || cursor() != 8 {
+		t.Errorf("Expected the next run to resume from the cursor, got %d repositories and cursor %d", repositoriesCount(), cursor())
+	}
+
+	// the end of the listing is reached, the following run starts over
+	Run(ctx, cfg, store, newTestClient(), nil, 0)
+	if repositoriesCount() != 10 || cursor() != 0 {
+		t.Errorf("Expected the cursor to be reset at the end of the listing, got %d repositories and cursor %d", repositoriesCount(), cursor())
+	}
+	Run(ctx, cfg, store, newTestClient(), nil, 0)
+	if repositoriesCount() != 10 {
+		t.Errorf("Repositories fetched again should not be duplicated, got %d repositories", repositoriesCount())
+	}
+
+	expected := []string{"0", "2", "4", "6", "8", "0", "2"}
+	if !reflect.DeepEqual(*requested, expected) {
+		t.Errorf("Unexpected pages requested: got %v, want %v", *requested, expected)
+	}
+}
+
+func TestFetcherMaxRepositories(t *testing.T) {
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	ctx := context.Background()
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	registerRepositoriesPages(10, 4)
+
+	Run(ctx, &config.Config{FetchMaxRepositories: 5}, store, newTestClient(), nil, 0)
+
+	var repositories []*api.Repository
+	_ = readStored(ctx, store, "repositories", &repositories)
+	var cursor int64
+	_ = readStored(ctx, store, "fetcher:cursor", &cursor)
+	if len(repositories) != 5 || cursor != 5 {
+		t.Errorf("Expected 5 repositories to be fetched, got %d repositories and cursor %d", len(repositories), cursor)
+	}
+}
+
+func TestFetcherMaxStoredRepositories(t *testing.T) {
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	ctx := context.Background()
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	registerRepositoriesPages(6, 2)
+	cfg := &config.Config{FetchMaxPages: 1, FetchMaxStoredRepositories: 3}
+
+	storedNames := func() []string {
+		var repositories []*api.Repository
+		_ = readStored(ctx, store, "repositories", &repositories)
+		names := []string{}
+		for _, repo := range repositories {
+			names = append(names, repo.Repository)
+		}
+		return names
+	}
+
+	Run(ctx, cfg, store, newTestClient(), nil, 0)
+	Run(ctx, cfg, store, newTestClient(), nil, 0)
+	if expected := []string{"repo-2", "repo-3", "repo-4"}; !reflect.DeepEqual(storedNames(), expected) {
+		t.Errorf("Expected the least recently fetched repositories to be evicted: got %v, want %v", storedNames(), expected)
+	}
+
+	// the listing starts over after the last page, repositories fetched again are the most recent
+	Run(ctx, cfg, store, newTestClient(), nil, 0)
+	Run(ctx, cfg, store, newTestClient(), nil, 0)
+	if expected := []string{"repo-6", "repo-1", "repo-2"}; !reflect.DeepEqual(storedNames(), expected) {
+		t.Errorf("Expected repositories fetched again to be kept: got %v, want %v", storedNames(), expected)
+	}
+}
+
+func TestFetcherRetriesTransientFailures(t *testing.T) {
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	ctx := context.Background()
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	httpmock.RegisterResponder("GET", `=~^.+/repositories\z`,
+		httpmock.NewStringResponder(200, repositoriesResponseMock),
+	)
+	// the first languages request of foo hits a gateway error
+	httpmock.RegisterResponder("GET", `=~^.+/repos/gopher/foo/languages\z`,
+		httpmock.NewStringResponder(502, "bad gateway").Then(httpmock.NewStringResponder(200, languagesResponseMockFirst)),
+	)
+	httpmock.RegisterResponder("GET", `=~^.+/languages\z`,
+		httpmock.NewStringResponder(200, languagesResponseMockSecond),
+	)
+
+	transport := github.NewRetryTransport(httpmock.DefaultTransport, github.RetryPolicy{InitialBackoff: time.Millisecond})
+	Run(ctx, &config.Config{}, store, github.NewClient("", transport, github.Options{RequestsPerSecond: 1000}), nil, 0)
+
+	var repositories []*api.Repository
+	_ = readStored(ctx, store, "repositories", &repositories)
+	if len(repositories) != 2 {
+		t.Fatalf("Expected the run to succeed despite the transient failure, got %d repositories", len(repositories))
+	}
+	info := httpmock.GetCallCountInfo()
+	if calls := info[`GET =~^.+/repos/gopher/foo/languages\z`]; calls != 2 {
+		t.Errorf("Expected the failed request to be retried once, sent %d times", calls)
+	}
+}
+
+func TestFetcherPartialFailure(t *testing.T) {
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	ctx := context.Background()
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+
+	// foo was fetched by a previous run, the languages of foo and bar fail to be fetched
+	previous := []*api.Repository{{
+		FullName:   "gopher/foo",
+		Repository: "foo",
+		Owner:      "gopher",
+		Languages:  map[string]api.Language{"golang": {Bytes: 1}},
+	}}
+	_ = writeFenced(ctx, store, "repositories", 0, &previous, nil)
+	httpmock.RegisterResponder("GET", `=~^.+/repositories\z`,
+		httpmock.NewStringResponder(200, repositoriesResponseMock),
+	)
+	httpmock.RegisterResponder("GET", `=~^.+/languages\z`,
+		httpmock.NewStringResponder(404, "not found"),
+	)
+
+	report := Run(ctx, &config.Config{}, store, newTestClient(), nil, 0)
+
+	if report.Status != api.FetchPartiallyFailed || report.Repositories != 2 || report.Succeeded != 0 || report.Failed != 2 || report.Stale != 2 || len(report.Failures) != 2 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	var stored api.FetchReport
+	err := readStored(ctx, store, "fetcher:report", &stored)
+	if err != nil || stored.Status != report.Status || stored.Failed != report.Failed {
+		t.Errorf("The report should be stored, got %+v (%v)", stored, err)
+	}
+
+	expected := []*api.Repository{
+		{
+			FullName:   "gopher/foo",
+			Repository: "foo",
+			Owner:      "gopher",
+			Languages:  map[string]api.Language{"golang": {Bytes: 1}},
+			Stale:      true,
+		},
+		{
+			FullName:   "gopher/bar",
+			Repository: "bar",
+			Owner:      "gopher",
+			Languages:  map[string]api.Language{},
+			Stale:      true,
+		},
+	}
+	var repositories []*api.Repository
+	_ = readStored(ctx, store, "repositories", &repositories)
+	if !reflect.DeepEqual(repositories, expected) {
+		t.Errorf("Failed repositories should be stored as stale: got %+v, want %+v", repositories, expected)
+	}
+	if previous[0].Stale {
+		t.Error("The previous repositories should not be modified")
+	}
+
+	// the next run fetches the stale repositories again, even though they are not listed anymore
+	httpmock.Reset()
+	httpmock.RegisterResponder("GET", `=~^.+/repositories\z`,
+		httpmock.NewStringResponder(200, "[]"),
+	)
+	httpmock.RegisterResponder("GET", `=~^.+/repos/gopher/foo/languages\z`,
+		httpmock.NewStringResponder(200, languagesResponseMockFirst),
+	)
+	httpmock.RegisterResponder("GET", `=~^.+/repos/gopher/bar/languages\z`,
+		httpmock.NewStringResponder(200, languagesResponseMockSecond),
+	)
+
+	report = Run(ctx, &config.Config{}, store, newTestClient(), nil, 0)
+
+	if report.Status != api.FetchSucceeded || report.Repositories != 2 || report.Succeeded != 2 || report.Stale != 0 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	_ = readStored(ctx, store, "repositories", &repositories)
+	expected[0].Languages = map[string]api.Language{"golang": {Bytes: 1234}}
+	expected[1].Languages = map[string]api.Language{"c++": {Bytes: 5678}}
+	expected[0].Stale, expected[1].Stale = false, false
+	if !reflect.DeepEqual(repositories, expected) {
+		t.Errorf("Stale repositories should be refreshed: got %+v, want %+v", repositories, expected)
+	}
+}
+
+func TestFetcherFailedRunReport(t *testing.T) {
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	ctx := context.Background()
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	httpmock.RegisterResponder("GET", `=~^.+/repositories\z`,
+		httpmock.NewStringResponder(500, "internal error"),
+	)
+
+	report := Run(ctx, &config.Config{}, store, newTestClient(), nil, 0)
+
+	if report.Status != api.FetchFailed || report.Error == "" || report.FinishedAt.Before(report.StartedAt) {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	var stored api.FetchReport
+	err := readStored(ctx, store, "fetcher:report", &stored)
+	if err != nil || stored.Status != api.FetchFailed {
+		t.Errorf("The report of the failed run should be stored, got %+v (%v)", stored, err)
+	}
+}
+
+func TestFetcherConcurrencyLimit(t *testing.T) {
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	ctx := context.Background()
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	registerRepositoriesPages(20, 20)
+
+	// count the languages requests in flight, the metrics are checked while the requests wait
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	registry := metrics.NewRegistry()
+	fetcherMetrics := NewMetrics(registry)
+	httpmock.RegisterResponder("GET", `=~^.+/languages\z`, func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		if gauge := fetcherMetrics.inFlight.With().Value(); gauge > 3 {
+			t.Errorf("Expected at most 3 requests in flight to be reported, got %v", gauge)
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return httpmock.NewStringResponse(200, languagesResponseMockFirst), nil
+	})
+
+	report := Run(ctx, &config.Config{FetchConcurrency: 3}, store, newTestClient(), fetcherMetrics, 0)
+
+	if report.Succeeded != 20 {
+		t.Fatalf("Expected every repository to be fetched, got %+v", report)
+	}
+	if maxInFlight != 3 {
+		t.Errorf("Expected 3 languages requests in flight at most, got %d", maxInFlight)
+	}
+	if depth := fetcherMetrics.queueDepth.With().Value(); depth != 0 {
+		t.Errorf("Expected the queue to be drained, got a depth of %v", depth)
+	}
+	if runs := fetcherMetrics.runs.With(api.FetchSucceeded).Value(); runs != 1 {
+		t.Errorf("Expected the run to be recorded, got %v runs", runs)
+	}
+	text := &strings.Builder{}
+	_ = registry.WriteText(text)
+	if !strings.Contains(text.String(), "fetcher_languages_queue_wait_seconds_count 20") {
+		t.Errorf("Expected the queue wait of every repository to be recorded, got:\n%s", text)
+	}
+}
+
+func TestFetcherIncrementalRefresh(t *testing.T) {
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	ctx := context.Background()
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+
+	// the REST listing reports no timestamps, they are looked up with GraphQL: foo is pushed to
+	// between the runs, bar does not change and baz cannot be resolved
+	httpmock.RegisterResponder("GET", `=~^.+/repositories\z`, httpmock.NewStringResponder(200, `[
+		{"id": 1, "node_id": "MDEwOlJlcG9zaXRvcnkx", "name": "foo", "full_name": "gopher/foo", "private": false, "owner": {"login": "gopher", "id": 1, "node_id": "MDQ6VXNlcjE=", "type": "User"}, "html_url": "https://github.com/gopher/foo", "description": null, "fork": false, "url": "https://api.github.com/repos/gopher/foo", "languages_url": "https://api.github.com/repos/gopher/foo/languages"},
+		{"id": 2, "node_id": "MDEwOlJlcG9zaXRvcnky", "name": "bar", "full_name": "gopher/bar", "private": false, "owner": {"login": "gopher", "id": 1, "node_id": "MDQ6VXNlcjE=", "type": "User"}, "html_url": "https://github.com/gopher/bar", "description": null, "fork": false, "url": "https://api.github.com/repos/gopher/bar", "languages_url": "https://api.github.com/repos/gopher/bar/languages"},
+		{"id": 3, "node_id": "MDEwOlJlcG9zaXRvcnkz", "name": "baz", "full_name": "gopher/baz", "private": false, "owner": {"login": "gopher", "id": 1, "node_id": "MDQ6VXNlcjE=", "type": "User"}, "html_url": "https://github.com/gopher/baz", "description": null, "fork": false, "url": "https://api.github.com/repos/gopher/baz", "languages_url": "https://api.github.com/repos/gopher/baz/languages"}
+	]`))
+	var mu sync.Mutex
+	pushedAt := map[string]string{"MDEwOlJlcG9zaXRvcnkx": "2024-01-01T00:00:00Z", "MDEwOlJlcG9zaXRvcnky": "2023-01-01T00:00:00Z"}
+	httpmock.RegisterResponder("POST", "https://api.github.com/graphql", func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		var query struct {
+			Variables struct {
+				IDs []string `json:"ids"`
+			} `json:"variables"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&query)
+		nodes := []any{}
+		for _, id := range query.Variables.IDs {
+			if pushedAt[id] == "" {
+				nodes = append(nodes, nil)
+				continue
+			}
+			nodes = append(nodes, map[string]string{"id": id, "updatedAt": "2023-01-01T00:00:00Z", "pushedAt": pushedAt[id]})
+		}
+		return httpmock.NewJsonResponse(200, map[string]any{
+			"data": map[string]any{"rateLimit": map[string]int{"cost": 1, "remaining": 4999}, "nodes": nodes},
+		})
+	})
+	httpmock.RegisterResponder("GET", `=~^.+/languages\z`,
+		httpmock.NewStringResponder(200, languagesResponseMockFirst),
+	)
+	run := func(cfg *config.Config) (api.FetchReport, map[string]int) {
+		httpmock.ZeroCallCounters()
+		report := Run(ctx, cfg, store, newTestClient(), nil, 0)
+		calls := map[string]int{}
+		for route, count := range httpmock.GetCallCountInfo() {
+			if count > 0 && strings.HasSuffix(route, "/languages") {
+				calls[route] = count
+			}
+		}
+		return report, calls
+	}
+	languagesRoute := func(name string) string {
+		return "GET https://api.github.com/repos/gopher/" + name + "/languages"
+	}
+
+	cfg := &config.Config{GithubGraphQLURL: "https://api.github.com/graphql"}
+	report, calls := run(cfg)
+	if report.Succeeded != 3 || report.Skipped != 0 || len(calls) != 3 || report.GraphQLCost != 1 {
+		t.Fatalf("Expected every repository to be fetched on the first run, got %+v and calls %v", report, calls)
+	}
+	var metadata map[string]RepositoryMetadata
+	_ = readStored(ctx, store, "fetcher:metadata", &metadata)
+	if len(metadata) != 3 || metadata["gopher/bar"].PushedAt.IsZero() || metadata["gopher/bar"].LanguagesFetchedAt.IsZero() {
+		t.Errorf("Expected the metadata of the repositories to be stored, got %+v", metadata)
+	}
+
+	mu.Lock()
+	pushedAt["MDEwOlJlcG9zaXRvcnkx"] = "2024-02-01T00:00:00Z"
+	mu.Unlock()
+	report, calls = run(cfg)
+	expected := map[string]int{languagesRoute("foo"): 1, languagesRoute("baz"): 1}
+	if report.Succeeded != 2 || report.Skipped != 1 || !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected the languages of the changed repositories to be fetched, got %+v and calls %v", report, calls)
+	}
+	var repositories []*api.Repository
+	_ = readStored(ctx, store, "repositories", &repositories)
+	if len(repositories) != 3 || repositories[1].FullName != "gopher/bar" || repositories[1].Languages["golang"].Bytes != 1234 {
+		t.Errorf("Expected the skipped repositories to keep their languages, got %+v", repositories)
+	}
+
+	// a full refresh ignores the metadata, as does a refresh of languages older than the max age
+	for name, cfg := range map[string]*config.Config{
+		"FullRefresh": {GithubGraphQLURL: cfg.GithubGraphQLURL, FetchFullRefresh: true},
+		"MaxAge":      {GithubGraphQLURL: cfg.GithubGraphQLURL, FetchRefreshMaxAge: time.Nanosecond},
+	} {
+		report, calls = run(cfg)
+		if report.Succeeded != 3 || report.Skipped != 0 || len(calls) != 3 {
+			t.Errorf("%s: expected every repository to be fetched, got %+v and calls %v", name, report, calls)
+		}
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	testCases := map[string]string{
+		``: ``,
+		`<https://api.github.com/repositories?since=369>; rel="next", <https://api.github.com/repositories{?since}>; rel="first"`: `https://api.github.com/repositories?since=369`,
+		`<https://api.github.com/repositories{?since}>; rel="first"`:                                                              ``,
+		`<https://api.github.com/repositories?since=1>; type="json"; rel="next"`:                                                  `https://api.github.com/repositories?since=1`,
+	}
+	for link, expected := range testCases {
+		if next := nextPageURL(link); next != expected {
+			t.Errorf("nextPageURL(%q) = %q, want %q", link, next, expected)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package fetcher
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/MarouaneMan/github-api/internal/config"
+	"github.com/MarouaneMan/github-api/internal/github"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// graphqlCursorKey stores the search and the cursor of its last fetched page, the next run
+	// resumes after it
+	graphqlCursorKey = "fetcher:graphql-cursor"
+
+	// graphqlPageSize is the number of repositories per page, the maximum allowed by GitHub
+	graphqlPageSize = 100
+
+	// graphqlLanguages is the number of languages fetched per repository, the largest ones first
+	graphqlLanguages = 100
+)
+
+// repositoriesQuery searches repositories along with their languages, and reports the cost of the
+// query against the GraphQL rate limit
+const repositoriesQuery = `query($search: String!, $first: Int!, $after: String, $languages: Int!) {
+  rateLimit {
+    cost
+    remaining
+  }
+  search(query: $search, type: REPOSITORY, first: $first, after: $after) {
+    pageInfo {
+      hasNextPage
+      endCursor
+    }
+    nodes {
+      ... on Repository {
+        databaseId
+        name
+        nameWithOwner
+        owner {
+          login
+        }
+        updatedAt
+        pushedAt
+        languages(first: $languages, orderBy: {field: SIZE, direction: DESC}) {
+          edges {
+            size
+            node {
+              name
+            }
+          }
+        }
+      }
+    }
+  }
+}`
+
+// timestampsQuery looks up the timestamps of repositories by node id, and reports the cost of the
+// query against the GraphQL rate limit
+const timestampsQuery = `query($ids: [ID!]!) {
+  rateLimit {
+    cost
+    remaining
+  }
+  nodes(ids: $ids) {
+    ... on Repository {
+      id
+      updatedAt
+      pushedAt
+    }
+  }
+}`
+
+// GraphQLCursor is the position of the fetcher in the results of a search.
+type GraphQLCursor struct {
+	Search string `json:"search"`
+	After  string `json:"after"`
+}
+
+type graphqlError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type graphqlRateLimit struct {
+	Cost      int `json:"cost"`
+	Remaining int `json:"remaining"`
+}
+
+type graphqlResponse[T any] struct {
+	Data   *T             `json:"data"`
+	Errors []graphqlError `json:"errors"`
+}
+
+type graphqlRepository struct {
+	DatabaseID    int64       `json:"databaseId"`
+	Name          string      `json:"name"`
+	NameWithOwner string      `json:"nameWithOwner"`
+	Owner         githubOwner `json:"owner"`
+	UpdatedAt     time.Time   `json:"updatedAt"`
+	PushedAt      time.Time   `json:"pushedAt"`
+	Languages     struct {
+		Edges []struct {
+			Size uint64 `json:"size"`
+			Node struct {
+				Name string `json:"name"`
+			} `json:"node"`
+		} `json:"edges"`
+	} `json:"languages"`
+}
+
+type repositoriesQueryData struct {
+	RateLimit graphqlRateLimit `json:"rateLimit"`
+	Search    struct {
+		PageInfo struct {
+			HasNextPage bool   `json:"hasNextPage"`
+			EndCursor   string `json:"endCursor"`
+		} `json:"pageInfo"`
+		Nodes []*graphqlRepository `json:"nodes"`
+	} `json:"search"`
+}
+
+type timestampsQueryData struct {
+	RateLimit graphqlRateLimit `json:"rateLimit"`
+	Nodes     []*struct {
+		ID        string    `json:"id"`
+		UpdatedAt time.Time `json:"updatedAt"`
+		PushedAt  time.Time `json:"pushedAt"`
+	} `json:"nodes"`
+}
+
+// readGraphQLCursor returns the cursor of the last page fetched by the previous run of the search,
+// empty to start from the first page
+func readGraphQLCursor(ctx context.Context, store kvstore.Reader, search string) string {
+	item, _, err := readFenced[GraphQLCursor](ctx, store, graphqlCursorKey)
+	if err != nil {
+		logger.Get(ctx).WithError(err).Warn("Failed to read GraphQL cursor from store, fetching from the first page")
+		return ""
+	}
+	cursor := item.Value
+	if cursor == nil || cursor.Search != search {
+		return ""
+	}
+	return cursor.After
+}
+
+// fetchRepositoriesGraphQL fetches the repositories matching the configured search along with
+// their languages with the GraphQL API, following the pages of the search after the cursor after
+// until the configured number of pages or repositories is reached. It returns the repositories
+// along with the cursor the next run resumes from, empty once the search is exhausted, and the cost
+// of the queries.
+func fetchRepositoriesGraphQL(ctx context.Context, config *config.Config, client github.Client, after string) ([]*githubRepository, string, int, error) {
+	log := logger.Get(ctx)
+	repositories := []*githubRepository{}
+	cost := 0
+	for page := 1; ; page++ {
+		first := graphqlPageSize
+		if config.FetchMaxRepositories > 0 && config.FetchMaxRepositories-len(repositories) < first {
+			first = config.FetchMaxRepositories - len(repositories)
+		}
+		result, err := queryRepositoriesPage(ctx, config, client, after, first)
+		if err != nil {
+			return nil, "", cost, errors.Wrapf(err, "Failed to fetch page %d", page)
+		}
+		cost += result.RateLimit.Cost
+		log.WithField("page", page).WithField("cost", result.RateLimit.Cost).
+			WithField("ratelimit_remaining", result.RateLimit.Remaining).Debug("GraphQL repositories page fetched")
+
+		for _, node := range result.Search.Nodes {
+			if node != nil {
+				repositories = append(repositories, node.githubRepository())
+			}
+		}
+		pageInfo := result.Search.PageInfo
+		after = pageInfo.EndCursor
+
+		switch {
+		case config.FetchMaxRepositories > 0 && len(repositories) >= config.FetchMaxRepositories:
+			return repositories, after, cost, nil
+		case !pageInfo.HasNextPage:
+			// end of the search, the next run starts over
+			return repositories, "", cost, nil
+		case config.FetchMaxPages > 0 && page >= config.FetchMaxPages:
+			return repositories, after, cost, nil
+		}
+	}
+}
+
+// queryRepositoriesPage fetches a page of the search
+func queryRepositoriesPage(ctx context.Context, config *config.Config, client github.Client, after string, first int) (*repositoriesQueryData, error) {
+	variables := map[string]any{
+		"search":    config.GithubGraphQLSearch,
+		"first":     first,
+		"languages": graphqlLanguages,
+	}
+	if after != "" {
+		variables["after"] = after
+	}
+	return sendQuery[repositoriesQueryData](ctx, config, client, repositoriesQuery, variables)
+}
+
+// lookupTimestamps fills the timestamps of the repositories listed without them, the REST listing
+// not reporting them, 100 repositories per query. Repositories without node id, or which cannot be
+// resolved, are left without timestamps. It returns the cost of the queries.
+func lookupTimestamps(ctx context.Context, config *config.Config, client github.Client, repositories []*githubRepository) (int, error) {
+	byID := map[string]*githubRepository{}
+	ids := []string{}
+	for _, repo := range repositories {
+		if repo.NodeID != "" && repo.UpdatedAt.IsZero() && repo.PushedAt.IsZero() {
+			byID[repo.NodeID] = repo
+			ids = append(ids, repo.NodeID)
+		}
+	}
+
+	cost := 0
+	for start := 0; start < len(ids); start += graphqlPageSize {
+		end := start + graphqlPageSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		result, err := sendQuery[timestampsQueryData](ctx, config, client, timestampsQuery, map[string]any{"ids": ids[start:end]})
+		if err != nil {
+			return cost, err
+		}
+		cost += result.RateLimit.Cost
+		for _, node := range result.Nodes {
+			if node != nil && byID[node.ID] != nil {
+				byID[node.ID].UpdatedAt = node.UpdatedAt
+				byID[node.ID].PushedAt = node.PushedAt
+			}
+		}
+	}
+	return cost, nil
+}
+
+// sendQuery sends a GraphQL query and returns its data. Errors reported along with data, e.g. a
+// repository which cannot be resolved, are logged and the data is returned.
+func sendQuery[T any](ctx context.Context, config *config.Config, client github.Client, graphqlQuery string, variables map[string]any) (*T, error) {
+	query, err := json.Marshal(map[string]any{"query": graphqlQuery, "variables": variables})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to encode GraphQL query")
+	}
+
+	resp, err := client.Query(ctx, config.GithubGraphQLURL, query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Unexpected http statusCode = %d", resp.StatusCode)
+	}
+
+	// Decode JSON response
+	var result graphqlResponse[T]
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while decoding JSON response")
+	}
+	if len(result.Errors) > 0 {
+		messages := make([]string, 0, len(result.Errors))
+		for _, graphqlErr := range result.Errors {
+			messages = append(messages, graphqlErr.Message)
+		}
+		if result.Data == nil {
+			return nil, errors.Errorf("GraphQL query failed: %s", strings.Join(messages, "; "))
+		}
+		logger.Get(ctx).WithField("errors", messages).Warn("GraphQL query partially failed")
+	}
+	if result.Data == nil {
+		return nil, errors.New("GraphQL response has no data")
+	}
+	return result.Data, nil
+}
+
+// githubRepository converts the repository to its REST representation, its languages being fetched
+func (gr *graphqlRepository) githubRepository() *githubRepository {
+	repo := &githubRepository{
+		ID:        gr.DatabaseID,
+		Name:      gr.Name,
+		FullName:  gr.NameWithOwner,
+		Owner:     gr.Owner,
+		URL:       githubApiUrl + "/repos/" + gr.NameWithOwner,
+		UpdatedAt: gr.UpdatedAt,
+		PushedAt:  gr.PushedAt,
+		Languages: make(map[string]uint64, len(gr.Languages.Edges)),
+	}
+	for _, edge := range gr.Languages.Edges {
+		repo.Languages[edge.Node.Name] = edge.Size
+	}
+	return repo
+}
@@ -0,0 +1,199 @@
+package fetcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/MarouaneMan/github-api/api"
+	"github.com/MarouaneMan/github-api/internal/config"
+	"github.com/MarouaneMan/github-api/internal/github"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGraphQL is a local GraphQL endpoint serving a search over total repositories, each page
+// costing 1 point
+type fakeGraphQL struct {
+	total int
+
+	// errors are reported without data instead of the search results
+	errors []string
+
+	mu        sync.Mutex
+	variables []map[string]any
+}
+
+func newFakeGraphQL(t *testing.T, total int) (*fakeGraphQL, *httptest.Server) {
+	fake := &fakeGraphQL{total: total}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (fg *fakeGraphQL) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Query     string         `json:"query"`
+		Variables map[string]any `json:"variables"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if r.Method != "POST" || r.URL.Path != "/graphql" || err != nil ||
+		!strings.Contains(request.Query, "search(") || !strings.Contains(request.Query, "languages(") {
+		http.Error(w, `{"message": "Bad request"}`, http.StatusBadRequest)
+		return
+	}
+	fg.mu.Lock()
+	fg.variables = append(fg.variables, request.Variables)
+	remaining := 5000 - len(fg.variables)
+	fg.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(fg.errors) > 0 {
+		graphqlErrors := []map[string]string{}
+		for _, message := range fg.errors {
+			graphqlErrors = append(graphqlErrors, map[string]string{"type": "INVALID", "message": message})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"errors": graphqlErrors})
+		return
+	}
+
+	start := 0
+	if after, ok := request.Variables["after"].(string); ok {
+		start, _ = strconv.Atoi(strings.TrimPrefix(after, "cursor:"))
+	}
+	end := start + int(request.Variables["first"].(float64))
+	if end > fg.total {
+		end = fg.total
+	}
+	nodes := []map[string]any{}
+	for i := start; i < end; i++ {
+		nodes = append(nodes, map[string]any{
+			"databaseId":    i + 1,
+			"name":          fmt.Sprintf("repo%d", i),
+			"nameWithOwner": fmt.Sprintf("gopher/repo%d", i),
+			"owner":         map[string]string{"login": "gopher"},
+			"updatedAt":     "2024-01-01T00:00:00Z",
+			"pushedAt":      nil,
+			"languages": map[string]any{
+				"edges": []map[string]any{
+					{"size": 1234, "node": map[string]string{"name": "Go"}},
+					{"size": i, "node": map[string]string{"name": "Shell"}},
+				},
+			},
+		})
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"data": map[string]any{
+			"rateLimit": map[string]int{"cost": 1, "remaining": remaining},
+			"search": map[string]any{
+				"pageInfo": map[string]any{"hasNextPage": end < fg.total, "endCursor": fmt.Sprintf("cursor:%d", end)},
+				"nodes":    nodes,
+			},
+		},
+	})
+}
+
+// requests returns the variables of the queries received so far
+func (fg *fakeGraphQL) requests() []map[string]any {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	return fg.variables
+}
+
+func newGraphQLConfig(server *httptest.Server) *config.Config {
+	return &config.Config{
+		FetchBackend:        "graphql",
+		GithubGraphQLURL:    server.URL + "/graphql",
+		GithubGraphQLSearch: "is:public",
+	}
+}
+
+func TestFetcherGraphQL(t *testing.T) {
+	fake, server := newFakeGraphQL(t, 250)
+	ctx := context.Background()
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	client := github.NewClient("", server.Client().Transport, github.Options{RequestsPerSecond: 1000})
+
+	// no language is fetched with its own request: the fake endpoint refuses them
+	report := Run(ctx, newGraphQLConfig(server), store, client, nil, 0)
+
+	if report.Status != api.FetchSucceeded || report.Repositories != 250 || report.Succeeded != 250 || report.GraphQLCost != 3 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if requests := fake.requests(); len(requests) != 3 || requests[0]["search"] != "is:public" || requests[2]["after"] != "cursor:200" {
+		t.Errorf("Expected the 3 pages of the search to be queried, got %v", requests)
+	}
+
+	var repositories []*api.Repository
+	_ = readStored(ctx, store, "repositories", &repositories)
+	if len(repositories) != 250 {
+		t.Fatalf("Expected 250 repositories to be stored, got %d", len(repositories))
+	}
+	expected := &api.Repository{
+		FullName:   "gopher/repo42",
+		Repository: "repo42",
+		Owner:      "gopher",
+		Languages:  map[string]api.Language{"go": {Bytes: 1234}, "shell": {Bytes: 42}},
+	}
+	if repo := repositories[42]; !reflect.DeepEqual(repo, expected) {
+		t.Errorf("Unexpected repository: got %+v, want %+v", repo, expected)
+	}
+
+	// the end of the search was reached, the next run starts over
+	var cursor GraphQLCursor
+	_ = readStored(ctx, store, "fetcher:graphql-cursor", &cursor)
+	if cursor != (GraphQLCursor{Search: "is:public"}) {
+		t.Errorf("Expected the cursor to be reset, got %+v", cursor)
+	}
+}
+
+func TestFetcherGraphQLCursor(t *testing.T) {
+	fake, server := newFakeGraphQL(t, 250)
+	ctx := context.Background()
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	client := github.NewClient("", server.Client().Transport, github.Options{RequestsPerSecond: 1000})
+	cfg := newGraphQLConfig(server)
+	cfg.FetchMaxPages = 1
+	cfg.FetchMaxRepositories = 150
+
+	Run(ctx, cfg, store, client, nil, 0)
+	Run(ctx, cfg, store, client, nil, 0)
+	cfg.GithubGraphQLSearch = "language:go"
+	Run(ctx, cfg, store, client, nil, 0)
+
+	requests := fake.requests()
+	if len(requests) != 3 {
+		t.Fatalf("Expected a query per run, got %v", requests)
+	}
+	if _, ok := requests[0]["after"]; ok || requests[0]["first"] != float64(100) {
+		t.Errorf("Expected the first run to start from the first page, got %v", requests[0])
+	}
+	if requests[1]["after"] != "cursor:100" {
+		t.Errorf("Expected the second run to resume after the first one, got %v", requests[1])
+	}
+	if _, ok := requests[2]["after"]; ok || requests[2]["search"] != "language:go" {
+		t.Errorf("Expected a new search to start from the first page, got %v", requests[2])
+	}
+}
+
+func TestFetcherGraphQLErrors(t *testing.T) {
+	fake, server := newFakeGraphQL(t, 10)
+	fake.errors = []string{"Something went wrong"}
+	ctx := context.Background()
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	client := github.NewClient("", server.Client().Transport, github.Options{RequestsPerSecond: 1000})
+
+	report := Run(ctx, newGraphQLConfig(server), store, client, nil, 0)
+
+	if report.Status != api.FetchFailed || !strings.Contains(report.Error, "Something went wrong") {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if exists, _ := store.Exists(ctx, "repositories"); exists {
+		t.Error("No repository should be stored")
+	}
+}
@@ -0,0 +1,66 @@
+package fetcher
+
+import (
+	"context"
+	"github.com/MarouaneMan/github-api/api"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"github.com/Scalingo/go-utils/logger"
+	"time"
+)
+
+// metadataKey stores the metadata of the repositories, by full name
+const metadataKey = "fetcher:metadata"
+
+// RepositoryMetadata is what the fetcher remembers of a repository to tell whether its languages
+// must be fetched again.
+type RepositoryMetadata struct {
+	// UpdatedAt and PushedAt are the timestamps GitHub reported when the languages were fetched
+	UpdatedAt time.Time `json:"updated_at"`
+	PushedAt  time.Time `json:"pushed_at"`
+
+	// LanguagesFetchedAt is the time the languages were last fetched successfully
+	LanguagesFetchedAt time.Time `json:"languages_fetched_at"`
+}
+
+// readMetadata returns the stored metadata of the repositories, empty if none can be read so that
+// every repository is fetched
+func readMetadata(ctx context.Context, store kvstore.Reader) map[string]RepositoryMetadata {
+	item, _, err := readFenced[map[string]RepositoryMetadata](ctx, store, metadataKey)
+	if err != nil {
+		logger.Get(ctx).WithError(err).Warn("Failed to read repositories metadata from store, fetching every repository")
+		return map[string]RepositoryMetadata{}
+	}
+	if item.Value == nil || *item.Value == nil {
+		return map[string]RepositoryMetadata{}
+	}
+	return *item.Value
+}
+
+// unchanged reports whether the languages of repo fetched on a previous run are still up to date:
+// GitHub reports the same timestamps as when they were fetched, and they were fetched less than
+// maxAge ago, 0 meaning no limit. Repositories without timestamps, whose timestamps could not be
+// looked up, are never considered unchanged and their languages are fetched again.
+func unchanged(repo *githubRepository, metadata RepositoryMetadata, maxAge time.Duration, now time.Time) bool {
+	switch {
+	case metadata.LanguagesFetchedAt.IsZero():
+		return false
+	case repo.UpdatedAt.IsZero() && repo.PushedAt.IsZero():
+		return false
+	case maxAge > 0 && now.Sub(metadata.LanguagesFetchedAt) >= maxAge:
+		return false
+	}
+	return repo.UpdatedAt.Equal(metadata.UpdatedAt) && repo.PushedAt.Equal(metadata.PushedAt)
+}
+
+// pruneMetadata removes the metadata of the repositories which are not stored anymore
+func pruneMetadata(metadata map[string]RepositoryMetadata, repositories []*api.Repository) {
+	stored := make(map[string]bool, len(repositories))
+	for _, repo := range repositories {
+		stored[repo.FullName] = true
+	}
+	for fullName := range metadata {
+		if !stored[fullName] {
+			delete(metadata, fullName)
+		}
+	}
+}
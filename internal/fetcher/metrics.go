@@ -0,0 +1,84 @@
+package fetcher
+
+import (
+	"github.com/MarouaneMan/github-api/api"
+	"github.com/MarouaneMan/github-api/internal/metrics"
+	"time"
+)
+
+var durationBuckets = metrics.ExponentialBuckets(0.01, 4, 8) // 10ms to 164s
+
+// Metrics records the outcome of the runs and the progress of the languages fetches. A nil
+// *Metrics records nothing.
+type Metrics struct {
+	runs       *metrics.CounterVec
+	failures   *metrics.CounterVec
+	cost       *metrics.CounterVec
+	stale      *metrics.GaugeVec
+	queueDepth *metrics.GaugeVec
+	inFlight   *metrics.GaugeVec
+	queueWait  *metrics.HistogramVec
+	durations  *metrics.HistogramVec
+}
+
+// NewMetrics returns metrics recording the fetcher runs in registry
+func NewMetrics(registry *metrics.Registry) *Metrics {
+	return &Metrics{
+		runs: registry.Counter("fetcher_runs_total",
+			"Number of fetcher runs, by status.", "status"),
+		failures: registry.Counter("fetcher_repository_failures_total",
+			"Number of repositories whose languages failed to be fetched."),
+		cost: registry.Counter("fetcher_graphql_cost_total",
+			"Cost of the GraphQL queries against the GraphQL rate limit."),
+		stale: registry.Gauge("fetcher_stale_repositories",
+			"Number of stale repositories in the dataset after the last run."),
+		queueDepth: registry.Gauge("fetcher_languages_queue_depth",
+			"Number of repositories waiting for a worker to fetch their languages."),
+		inFlight: registry.Gauge("fetcher_languages_in_flight",
+			"Number of repositories whose languages are being fetched."),
+		queueWait: registry.Histogram("fetcher_languages_queue_wait_seconds",
+			"Time repositories waited for a worker to fetch their languages.", durationBuckets),
+		durations: registry.Histogram("fetcher_languages_fetch_duration_seconds",
+			"Time taken to fetch the languages of a repository.", durationBuckets),
+	}
+}
+
+// observeRun records the outcome of a run
+func (m *Metrics) observeRun(report api.FetchReport) {
+	if m == nil {
+		return
+	}
+	m.runs.With(report.Status).Inc()
+	m.failures.With().Add(float64(report.Failed))
+	m.cost.With().Add(float64(report.GraphQLCost))
+	if report.Status != api.FetchFailed {
+		m.stale.With().Set(float64(report.Stale))
+	}
+}
+
+// observeQueued records repositories queued for their languages to be fetched
+func (m *Metrics) observeQueued(count int) {
+	if m == nil {
+		return
+	}
+	m.queueDepth.With().Add(float64(count))
+}
+
+// observeStarted records a worker starting to fetch the languages of a repository
+func (m *Metrics) observeStarted(wait time.Duration) {
+	if m == nil {
+		return
+	}
+	m.queueDepth.With().Add(-1)
+	m.inFlight.With().Add(1)
+	m.queueWait.With().Observe(wait.Seconds())
+}
+
+// observeFinished records a worker done fetching the languages of a repository
+func (m *Metrics) observeFinished(duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.inFlight.With().Add(-1)
+	m.durations.With().Observe(duration.Seconds())
+}
@@ -0,0 +1,156 @@
+package github
+
+import (
+	"bytes"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// CachedResponse is a response stored by the caching transport along with its validators.
+type CachedResponse struct {
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	Header       http.Header `json:"header"`
+	Body         []byte      `json:"body"`
+}
+
+// StoredType returns a pointer to a new value of the type the caching transport stores under key,
+// every item of its store being a CachedResponse.
+func StoredType(key string) any {
+	return &CachedResponse{}
+}
+
+// CacheOptions configures a caching transport.
+type CacheOptions struct {
+	// TTL is the time a response is kept in the store after it was last validated, defaults to 7 days
+	TTL time.Duration
+}
+
+type cachingTransport struct {
+	next  http.RoundTripper
+	store kvstore.ReadWriter
+	opts  CacheOptions
+}
+
+// NewCachingTransport returns a transport sending requests through next and storing the successful
+// responses to GET requests carrying an ETag or Last-Modified header in store, under their URL.
+// Requests of a stored response are sent conditionally, the stored body is reused when GitHub
+// responds 304 Not Modified, which does not count against the rate limit.
+// Responses are not keyed by token, the store must not be shared by clients of different tokens.
+func NewCachingTransport(next http.RoundTripper, store kvstore.ReadWriter, opts CacheOptions) *cachingTransport {
+	if opts.TTL <= 0 {
+		opts.TTL = 7 * 24 * time.Hour
+	}
+	return &cachingTransport{next: next, store: store, opts: opts}
+}
+
+// RoundTrip sends the request, conditionally if its response is stored. A stored response is
+// deleted when GitHub answers with a response that cannot be stored, server errors aside.
+// Failing to read or write the store does not fail the request, it is sent unconditionally.
+func (ct *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !cacheable(req) {
+		return ct.next.RoundTrip(req)
+	}
+	ctx := req.Context()
+	log := logger.Get(ctx).WithField("url", req.URL.String())
+	key := req.URL.String()
+
+	var cached CachedResponse
+	err := kvstore.ReadInto(ctx, ct.store, key, &cached)
+	found := err == nil
+	if err != nil && !errors.Is(err, kvstore.ErrNotFound) {
+		log.WithError(err).Warn("Failed to read cached GitHub response from store")
+	}
+	if found {
+		req = req.Clone(ctx)
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := ct.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if found && resp.StatusCode == http.StatusNotModified {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		// the response is still valid, keep it for another TTL
+		err = ct.store.Write(ctx, key, cached, ct.opts.TTL)
+		if err != nil {
+			log.WithError(err).Warn("Failed to write cached GitHub response to store")
+		}
+		return cached.response(req, resp), nil
+	}
+
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || (etag == "" && lastModified == "") {
+		if found && resp.StatusCode < http.StatusInternalServerError {
+			// the stored response is superseded by one that cannot be stored, it must not be
+			// revalidated and served again later
+			err = ct.store.Delete(ctx, key)
+			if err != nil {
+				log.WithError(err).Warn("Failed to delete cached GitHub response from store")
+			}
+		}
+		return resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read response body")
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	err = ct.store.Write(ctx, key, CachedResponse{
+		ETag:         etag,
+		LastModified: lastModified,
+		Header:       resp.Header.Clone(),
+		Body:         body,
+	}, ct.opts.TTL)
+	if err != nil {
+		log.WithError(err).Warn("Failed to write cached GitHub response to store")
+	}
+	return resp, nil
+}
+
+// response returns the stored response, with the headers of the 304 response validating it
+// (e.g. the rate limit) and a X-From-Cache header
+func (cr CachedResponse) response(req *http.Request, notModified *http.Response) *http.Response {
+	header := cr.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	for name, values := range notModified.Header {
+		header[name] = values
+	}
+	header.Del("Content-Length")
+	header.Set("X-From-Cache", "1")
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         notModified.Proto,
+		ProtoMajor:    notModified.ProtoMajor,
+		ProtoMinor:    notModified.ProtoMinor,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(cr.Body)),
+		ContentLength: int64(len(cr.Body)),
+		Request:       req,
+	}
+}
+
+// cacheable reports whether the response of the request can be stored: it must be a plain GET,
+// not already conditional nor partial
+func cacheable(req *http.Request) bool {
+	return (req.Method == "" || req.Method == http.MethodGet) &&
+		req.Header.Get("If-None-Match") == "" &&
+		req.Header.Get("If-Modified-Since") == "" &&
+		req.Header.Get("Range") == ""
+}
@@ -0,0 +1,232 @@
+package github
+
+import (
+	"context"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"github.com/jarcoal/httpmock"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// conditionalResponder responds 304 to requests carrying one of the validators, 200 with the
+// validators and the body otherwise. Every response reports remaining as the rate limit left.
+func conditionalResponder(etag, lastModified, body string, remaining *string) httpmock.Responder {
+	return func(req *http.Request) (*http.Response, error) {
+		var resp *http.Response
+		if (etag != "" && req.Header.Get("If-None-Match") == etag) ||
+			(lastModified != "" && req.Header.Get("If-Modified-Since") == lastModified) {
+			resp = httpmock.NewStringResponse(http.StatusNotModified, "")
+		} else {
+			resp = httpmock.NewStringResponse(http.StatusOK, body)
+			resp.Header.Set("Content-Type", "application/json")
+			resp.Header.Set("Link", `<https://api.github.com/repositories?since=2>; rel="next"`)
+			if etag != "" {
+				resp.Header.Set("ETag", etag)
+			}
+			if lastModified != "" {
+				resp.Header.Set("Last-Modified", lastModified)
+			}
+		}
+		resp.Header.Set("X-RateLimit-Remaining", *remaining)
+		return resp, nil
+	}
+}
+
+func TestCachingTransport(t *testing.T) {
+	testCases := map[string]struct {
+		etag         string
+		lastModified string
+	}{
+		"ETag":         {etag: `W/"abc"`},
+		"LastModified": {lastModified: "Mon, 01 Jan 2024 00:00:00 GMT"},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+			mock := httpmock.NewMockTransport()
+			remaining := "4999"
+			mock.RegisterResponder("GET", "https://api.github.com/repositories",
+				conditionalResponder(testCase.etag, testCase.lastModified, `[{"id": 1}]`, &remaining),
+			)
+			transport := NewCachingTransport(mock, store, CacheOptions{})
+
+			req, _ := http.NewRequest("GET", "https://api.github.com/repositories", nil)
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != `[{"id": 1}]` || resp.Header.Get("X-From-Cache") != "" {
+				t.Errorf("unexpected first response: status %d, body %q, headers %v", resp.StatusCode, body, resp.Header)
+			}
+
+			remaining = "4998"
+			resp, err = transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			body, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != `[{"id": 1}]` || resp.Header.Get("X-From-Cache") != "1" {
+				t.Errorf("cached response should be reused on 304: status %d, body %q, headers %v", resp.StatusCode, body, resp.Header)
+			}
+			if resp.Header.Get("X-RateLimit-Remaining") != "4998" || resp.Header.Get("Link") == "" {
+				t.Errorf("headers of the 304 response should be merged into the cached ones, got %v", resp.Header)
+			}
+			if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+				t.Error("the request of the caller should not be modified")
+			}
+			if mock.GetTotalCallCount() != 2 {
+				t.Errorf("expected 2 requests to be sent, got %d", mock.GetTotalCallCount())
+			}
+		})
+	}
+}
+
+func TestCachingTransportDoesNotCache(t *testing.T) {
+	testCases := map[string]struct {
+		method    string
+		header    http.Header
+		responder httpmock.Responder
+	}{
+		"NoValidator": {
+			responder: httpmock.NewStringResponder(http.StatusOK, "{}"),
+		},
+		"NotFound": {
+			responder: httpmock.NewStringResponder(http.StatusNotFound, "{}").HeaderSet(http.Header{"Etag": {`"abc"`}}),
+		},
+		"Post": {
+			method:    "POST",
+			responder: httpmock.NewStringResponder(http.StatusOK, "{}").HeaderSet(http.Header{"Etag": {`"abc"`}}),
+		},
+		"Conditional": {
+			header:    http.Header{"If-None-Match": {`"def"`}},
+			responder: httpmock.NewStringResponder(http.StatusOK, "{}").HeaderSet(http.Header{"Etag": {`"abc"`}}),
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+			mock := httpmock.NewMockTransport()
+			mock.RegisterNoResponder(testCase.responder)
+			transport := NewCachingTransport(mock, store, CacheOptions{})
+
+			method := testCase.method
+			if method == "" {
+				method = "GET"
+			}
+			req, _ := http.NewRequest(method, "https://api.github.com/repos/gopher/foo/languages", nil)
+			for name, values := range testCase.header {
+				req.Header[name] = values
+			}
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+
+			keys, _ := store.Scan(context.Background(), "")
+			if len(keys) != 0 {
+				t.Errorf("response should not be stored, got keys %v", keys)
+			}
+		})
+	}
+}
+
+func TestCachingTransportDeletesSupersededResponse(t *testing.T) {
+	testCases := map[string]struct {
+		responder httpmock.Responder
+		deleted   bool
+	}{
+		"NoValidator": {
+			responder: httpmock.NewStringResponder(http.StatusOK, `[{"id": 2}]`),
+			deleted:   true,
+		},
+		"NotFound": {
+			responder: httpmock.NewStringResponder(http.StatusNotFound, "{}"),
+			deleted:   true,
+		},
+		"ServerError": {
+			responder: httpmock.NewStringResponder(http.StatusBadGateway, "{}"),
+			deleted:   false,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+			mock := httpmock.NewMockTransport()
+			remaining := "4999"
+			mock.RegisterResponder("GET", "https://api.github.com/repositories",
+				conditionalResponder(`"abc"`, "", `[{"id": 1}]`, &remaining),
+			)
+			transport := NewCachingTransport(mock, store, CacheOptions{})
+
+			req, _ := http.NewRequest("GET", "https://api.github.com/repositories", nil)
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+
+			mock.RegisterResponder("GET", "https://api.github.com/repositories", testCase.responder)
+			resp, err = transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.Header.Get("X-From-Cache") != "" || string(body) == `[{"id": 1}]` {
+				t.Errorf("fresh response should be returned, got body %q and headers %v", body, resp.Header)
+			}
+
+			exists, _ := store.Exists(context.Background(), "https://api.github.com/repositories")
+			if exists == testCase.deleted {
+				t.Errorf("unexpected stored response: got stored %v want %v", exists, !testCase.deleted)
+			}
+
+			// once deleted, requests are no longer conditional
+			mock.RegisterResponder("GET", "https://api.github.com/repositories",
+				func(req *http.Request) (*http.Response, error) {
+					if testCase.deleted && req.Header.Get("If-None-Match") != "" {
+						t.Error("request should not be sent conditionally once the stored response is deleted")
+					}
+					return httpmock.NewStringResponse(http.StatusOK, `[{"id": 3}]`), nil
+				},
+			)
+			resp, err = transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestClientWithCachingTransport(t *testing.T) {
+	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	mock := httpmock.NewMockTransport()
+	remaining := "10"
+	mock.RegisterResponder("GET", "https://api.github.com/repos/gopher/foo/languages",
+		conditionalResponder(`"abc"`, "", `{"Go": 1234}`, &remaining),
+	)
+	client := NewClient("", NewCachingTransport(mock, store, CacheOptions{}), Options{RequestsPerSecond: 1000})
+
+	for i, expected := range []int{10, 9} {
+		remaining = strconv.Itoa(expected)
+		resp, err := client.Get(context.Background(), "https://api.github.com/repos/gopher/foo/languages")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != `{"Go": 1234}` {
+			t.Errorf("unexpected response %d: status %d, body %q", i, resp.StatusCode, body)
+		}
+		if quota := client.Quota(); quota.Remaining != expected {
+			t.Errorf("quota should be updated from response %d, got %+v", i, quota)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// Package github implements a GitHub REST API client sharing the rate limits of a token.
+package github
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiVersion = "2022-11-28"
+
+	// secondaryRateLimitWait is the time waited after hitting a secondary rate limit without
+	// Retry-After header, as recommended by GitHub
+	secondaryRateLimitWait = time.Minute
+
+	// rateLimitAttempts is the number of times a rate limited request is sent before giving up
+	rateLimitAttempts = 3
+)
+
+// Options configures a client.
+type Options struct {
+	// RequestsPerSecond is the rate at which requests are sent, defaults to 10
+	RequestsPerSecond float64
+
+	// Burst is the number of requests that can be sent at once, defaults to RequestsPerSecond
+	Burst int
+
+	// Timeout bounds every attempt, including the retries of the transport, until the response
+	// body is closed, defaults to 30s
+	Timeout time.Duration
+}
+
+// Quota is the state of the primary rate limit of the token, as last reported by GitHub.
+type Quota struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Used      int       `json:"used"`
+	Reset     time.Time `json:"reset"`
+
+	// UpdatedAt is the time of the last response carrying the rate limit headers, zero if no
+	// request was sent yet
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Client sends requests to the GitHub API.
+type Client interface {
+	// Get sends a GET request to url, the caller must close the body of the returned response
+	Get(ctx context.Context, url string) (*http.Response, error)
+
+	// Query sends a GraphQL query to url, the caller must close the body of the returned response
+	Query(ctx context.Context, url string, query []byte) (*http.Response, error)
+
+	// Quota returns the state of the rate limit as last reported by GitHub
+	Quota() Quota
+}
+
+type client struct {
+	token      string
+	httpClient *http.Client
+	opts       Options
+	bucket     *tokenBucket
+
+	mu    sync.Mutex
+	quota Quota
+}
+
+// NewClient returns a client authenticated with token, sending its requests through transport.
+// Requests are throttled with a token bucket, wait for the quota to be reset once exhausted and
+// are retried once rate limits are lifted.
+func NewClient(token string, transport http.RoundTripper, opts Options) *client {
+	if opts.RequestsPerSecond <= 0 {
+		opts.RequestsPerSecond = 10
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = int(opts.RequestsPerSecond)
+		if opts.Burst < 1 {
+			opts.Burst = 1
+		}
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	return &client{
+		token:      token,
+		httpClient: &http.Client{Transport: transport},
+		opts:       opts,
+		bucket:     newTokenBucket(opts.RequestsPerSecond, opts.Burst),
+	}
+}
+
+// Quota returns the state of the rate limit as last reported by GitHub
+func (c *client) Quota() Quota {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.quota
+}
+
+// Get sends a GET request to url. The caller must close the body of the returned response.
+// Rate limited requests are retried after the time GitHub asks to wait, the response is
+// returned as is once the attempts are exhausted.
+func (c *client) Get(ctx context.Context, url string) (*http.Response, error) {
+	return c.send(ctx, "GET", url, nil)
+}
+
+// Query sends the GraphQL query, a JSON document holding the query and its variables, to url with
+// a POST request, rate limited like Get. The caller must close the body of the returned response.
+// Queries being read-only, the request is marked with WithReplayable so that the retry transport
+// retries it.
+func (c *client) Query(ctx context.Context, url string, query []byte) (*http.Response, error) {
+	return c.send(WithReplayable(ctx), "POST", url, query)
+}
+
+// send sends a request until it is not rate limited anymore or the attempts are exhausted
+func (c *client) send(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	log := logger.Get(ctx)
+	for attempt := 1; ; attempt++ {
+		err := c.waitQuota(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = c.bucket.wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.do(ctx, method, url, body)
+		if err != nil {
+			return nil, err
+		}
+		wait, limited := c.rateLimited(resp)
+		if !limited || attempt >= rateLimitAttempts {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		quota := c.Quota()
+		log.WithField("url", url).WithField("status_code", resp.StatusCode).
+			WithField("remaining", quota.Remaining).WithField("reset", quota.Reset).WithField("wait", wait).
+			Warn("GitHub rate limit reached, waiting before retrying")
+		err = sleep(ctx, wait)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// do sends a single request, the attempt timeout is released when the body is closed
+func (c *client) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		cancel()
+		return nil, errors.Wrap(err, "Failed to create http request")
+	}
+
+	// Add the authorization/apiVersion headers to the request
+	if c.token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", c.token))
+	}
+	req.Header.Set("X-GitHub-Api-Version", apiVersion)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, errors.Wrap(err, "Failed to execute http request")
+	}
+	c.updateQuota(resp.Header)
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// waitQuota waits for the quota to be reset if it is exhausted
+func (c *client) waitQuota(ctx context.Context) error {
+	quota := c.Quota()
+	if quota.UpdatedAt.IsZero() || quota.Remaining > 0 {
+		return nil
+	}
+	wait := time.Until(quota.Reset)
+	if wait <= 0 {
+		return nil
+	}
+	logger.Get(ctx).WithField("reset", quota.Reset).WithField("wait", wait).
+		Warn("GitHub rate limit exhausted, waiting for it to be reset")
+	return sleep(ctx, wait)
+}
+
+// rateLimited reports whether the response is a rate limit error and how long to wait before
+// retrying. Primary rate limits are lifted when the quota is reset, secondary ones tell how long
+// to wait with Retry-After.
+func (c *client) rateLimited(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if wait, ok := retryAfter(resp.Header); ok {
+		return wait, true
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		// the reset time has a second precision
+		return time.Until(c.Quota().Reset) + time.Second, true
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || isSecondaryRateLimit(resp) {
+		return secondaryRateLimitWait, true
+	}
+	return 0, false
+}
+
+// retryAfter parses the Retry-After header, given either in seconds or as an HTTP date
+func retryAfter(header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	wait := time.Until(date)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// updateQuota records the rate limit reported in the headers of a response
+func (c *client) updateQuota(header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	limit, _ := strconv.Atoi(header.Get("X-RateLimit-Limit"))
+	used, _ := strconv.Atoi(header.Get("X-RateLimit-Used"))
+	reset, _ := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.quota = Quota{
+		Limit:     limit,
+		Remaining: remaining,
+		Used:      used,
+		Reset:     time.Unix(reset, 0).UTC(),
+		UpdatedAt: time.Now().UTC(),
+	}
+}
+
+// isSecondaryRateLimit reports whether a 403 response is due to a secondary rate limit, which
+// is only told by its message. The body is left readable.
+func isSecondaryRateLimit(resp *http.Response) bool {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+	return err == nil && strings.Contains(strings.ToLower(string(body)), "secondary rate limit")
+}
+
+// sleep waits for d, returns early with an error if ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (coc *cancelOnClose) Close() error {
+	defer coc.cancel()
+	return coc.ReadCloser.Close()
+}
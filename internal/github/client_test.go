@@ -0,0 +1,238 @@
+package github
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server answering with respond, along with the number of requests received
+func newTestServer(t *testing.T, respond func(w http.ResponseWriter, r *http.Request, attempt int32)) (*httptest.Server, *atomic.Int32) {
+	attempts := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond(w, r, attempts.Add(1))
+	}))
+	t.Cleanup(server.Close)
+	return server, attempts
+}
+
+func TestClientQuota(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	server, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request, _ int32) {
+		if r.Header.Get("Authorization") != "token secret" || r.Header.Get("X-GitHub-Api-Version") == "" {
+			t.Errorf("request should be authenticated and versioned, got headers %v", r.Header)
+		}
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.Header().Set("X-RateLimit-Used", "1")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		_, _ = io.WriteString(w, "[]")
+	})
+	client := NewClient("secret", http.DefaultTransport, Options{})
+	if !client.Quota().UpdatedAt.IsZero() {
+		t.Error("quota should be unknown before the first request")
+	}
+
+	resp, err := client.Get(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "[]" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	quota := client.Quota()
+	if quota.Limit != 5000 || quota.Remaining != 4999 || quota.Used != 1 || !quota.Reset.Equal(reset) || quota.UpdatedAt.IsZero() {
+		t.Errorf("quota should be read from the response headers, got %+v", quota)
+	}
+}
+
+func TestClientRetriesRateLimitedRequests(t *testing.T) {
+	testCases := map[string]func(w http.ResponseWriter){
+		"RetryAfter": func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		},
+		"PrimaryRateLimit": func(w http.ResponseWriter) {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10))
+			w.WriteHeader(http.StatusForbidden)
+		},
+	}
+	for name, rateLimited := range testCases {
+		t.Run(name, func(t *testing.T) {
+			server, attempts := newTestServer(t, func(w http.ResponseWriter, _ *http.Request, attempt int32) {
+				if attempt == 1 {
+					rateLimited(w)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			})
+			client := NewClient("", http.DefaultTransport, Options{})
+
+			resp, err := client.Get(context.Background(), server.URL)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || attempts.Load() != 2 {
+				t.Errorf("rate limited request should be retried, got status %d after %d attempts", resp.StatusCode, attempts.Load())
+			}
+		})
+	}
+}
+
+func TestClientGivesUpRateLimitedRequests(t *testing.T) {
+	server, attempts := newTestServer(t, func(w http.ResponseWriter, _ *http.Request, _ int32) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	client := NewClient("", http.DefaultTransport, Options{})
+
+	resp, err := client.Get(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || attempts.Load() != rateLimitAttempts {
+		t.Errorf("rate limited response should be returned after %d attempts, got status %d after %d attempts", rateLimitAttempts, resp.StatusCode, attempts.Load())
+	}
+}
+
+func TestClientDoesNotRetryForbiddenRequests(t *testing.T) {
+	server, attempts := newTestServer(t, func(w http.ResponseWriter, _ *http.Request, _ int32) {
+		w.Header().Set("X-RateLimit-Remaining", "4000")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = io.WriteString(w, `{"message": "Repository access blocked"}`)
+	})
+	client := NewClient("", http.DefaultTransport, Options{})
+
+	resp, err := client.Get(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || attempts.Load() != 1 {
+		t.Errorf("forbidden request should not be retried, got status %d after %d attempts", resp.StatusCode, attempts.Load())
+	}
+	if !strings.Contains(string(body), "Repository access blocked") {
+		t.Errorf("body should be left readable, got %q", body)
+	}
+}
+
+func TestIsSecondaryRateLimit(t *testing.T) {
+	message := `{"message": "You have exceeded a secondary rate limit. Please wait a few minutes before you try again."}`
+	resp := &http.Response{StatusCode: http.StatusForbidden, Body: io.NopCloser(strings.NewReader(message))}
+	if !isSecondaryRateLimit(resp) {
+		t.Error("secondary rate limit should be detected from the message")
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != message {
+		t.Errorf("body should be left readable, got %q", body)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	testCases := []struct {
+		value string
+		min   time.Duration
+		max   time.Duration
+		ok    bool
+	}{
+		{value: "", ok: false},
+		{value: "soon", ok: false},
+		{value: "120", min: 2 * time.Minute, max: 2 * time.Minute, ok: true},
+		{value: time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), min: 58 * time.Second, max: time.Minute, ok: true},
+		{value: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), min: 0, max: 0, ok: true},
+	}
+	for _, tc := range testCases {
+		wait, ok := retryAfter(http.Header{"Retry-After": []string{tc.value}})
+		if ok != tc.ok {
+			t.Errorf("unexpected parsing of Retry-After %q: got %v want %v", tc.value, ok, tc.ok)
+		}
+		if wait < tc.min || wait > tc.max {
+			t.Errorf("wait of Retry-After %q should be between %v and %v, got %v", tc.value, tc.min, tc.max, wait)
+		}
+	}
+}
+
+func TestClientWaitsForQuotaReset(t *testing.T) {
+	server, _ := newTestServer(t, func(w http.ResponseWriter, _ *http.Request, _ int32) {
+		w.WriteHeader(http.StatusOK)
+	})
+	client := NewClient("", http.DefaultTransport, Options{})
+	client.quota = Quota{Remaining: 0, Reset: time.Now().Add(200 * time.Millisecond), UpdatedAt: time.Now()}
+
+	start := time.Now()
+	resp, err := client.Get(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("request should wait for the quota to be reset, sent after %v", elapsed)
+	}
+
+	client.quota = Quota{Remaining: 0, Reset: time.Now().Add(time.Hour), UpdatedAt: time.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.Get(ctx, server.URL)
+	if err == nil {
+		t.Error("waiting for the quota reset should stop when the context is done")
+	}
+}
+
+func TestClientThrottlesRequests(t *testing.T) {
+	server, _ := newTestServer(t, func(w http.ResponseWriter, _ *http.Request, _ int32) {
+		w.WriteHeader(http.StatusOK)
+	})
+	client := NewClient("", http.DefaultTransport, Options{RequestsPerSecond: 20, Burst: 1})
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(context.Background(), server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("5 requests at 20 per second should take at least 200ms, took %v", elapsed)
+	}
+}
+
+func TestClientQuery(t *testing.T) {
+	query := `{"query": "{ viewer { login } }"}`
+	server, attempts := newTestServer(t, func(w http.ResponseWriter, r *http.Request, attempt int32) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != "POST" || string(body) != query || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Idempotency-Key") != "" {
+			t.Errorf("unexpected query: %s %q with headers %v", r.Method, body, r.Header)
+		}
+		if attempt == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = io.WriteString(w, `{"data": {}}`)
+	})
+	// queries are retried by the retry transport
+	transport := NewRetryTransport(http.DefaultTransport, RetryPolicy{InitialBackoff: time.Millisecond})
+	client := NewClient("", transport, Options{RequestsPerSecond: 1000})
+
+	resp, err := client.Query(context.Background(), server.URL+"/graphql", []byte(query))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || attempts.Load() != 2 {
+		t.Errorf("query should be retried, got status %d after %d attempts", resp.StatusCode, attempts.Load())
+	}
+}
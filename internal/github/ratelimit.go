@@ -0,0 +1,56 @@
+package github
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket throttles requests: tokens are refilled at rate per second up to burst, a request
+// takes a token or waits for one to be refilled
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait takes a token, waiting for it to be refilled if the bucket is empty
+func (tb *tokenBucket) wait(ctx context.Context) error {
+	delay := tb.reserve()
+	if delay <= 0 {
+		return nil
+	}
+	return sleep(ctx, delay)
+}
+
+// reserve takes a token and returns the time to wait before it is available, tokens may go
+// negative so that concurrent waiters are served in order
+func (tb *tokenBucket) reserve() time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	tb.tokens--
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
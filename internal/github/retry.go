@@ -0,0 +1,181 @@
+package github
+
+import (
+	"context"
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/pkg/errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy configures which requests are retried and how long to wait between attempts.
+// Zero fields take their default value.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is sent, defaults to 3, 1 disables retries
+	MaxAttempts int
+
+	// InitialBackoff is the time waited before the first retry, defaults to 500ms. It is then
+	// multiplied by Multiplier, defaulting to 2, at every retry up to MaxBackoff, defaulting to 10s.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Jitter is the fraction of the backoff which is randomized, so that clients failing at the
+	// same time do not retry in lockstep, defaults to 0.5. A negative value disables it.
+	Jitter float64
+
+	// RetryableStatusCodes are the status codes of the responses retried, defaults to 500, 502,
+	// 503 and 504
+	RetryableStatusCodes []int
+
+	// RetryableError reports whether a transport error is retried, defaults to every error except
+	// the cancellation or expiration of the request context
+	RetryableError func(err error) bool
+
+	// RetryNonIdempotent retries the requests whose method is not idempotent, which are otherwise
+	// only retried if their context was marked with WithReplayable
+	RetryNonIdempotent bool
+}
+
+type replayableKey struct{}
+
+// WithReplayable returns a copy of ctx marking the requests sent with it as replayable whatever
+// their method, e.g. read-only GraphQL queries sent with POST, so that they are retried.
+func WithReplayable(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replayableKey{}, true)
+}
+
+type retryTransport struct {
+	next   http.RoundTripper
+	policy RetryPolicy
+}
+
+// NewRetryTransport returns a transport sending requests through next and retrying them with an
+// exponential backoff when they fail with a transient error
+func NewRetryTransport(next http.RoundTripper, policy RetryPolicy) *retryTransport {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 3
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = 500 * time.Millisecond
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = 10 * time.Second
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = 2
+	}
+	if policy.Jitter == 0 {
+		policy.Jitter = 0.5
+	}
+	if policy.Jitter < 0 {
+		policy.Jitter = 0
+	}
+	if policy.Jitter > 1 {
+		policy.Jitter = 1
+	}
+	if policy.RetryableStatusCodes == nil {
+		policy.RetryableStatusCodes = []int{
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		}
+	}
+	if policy.RetryableError == nil {
+		policy.RetryableError = func(err error) bool {
+			return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+		}
+	}
+	return &retryTransport{next: next, policy: policy}
+}
+
+// RoundTrip sends the request, retrying it while it fails with a retryable error and attempts
+// are left. The last response or error is returned.
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	log := logger.Get(req.Context())
+	retryable := rt.replayable(req)
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, errors.Wrap(err, "Failed to rewind request body")
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		resp, err := rt.next.RoundTrip(req)
+		if !retryable || attempt >= rt.policy.MaxAttempts || !rt.retryable(req, resp, err) {
+			return resp, err
+		}
+
+		wait := rt.backoff(attempt, resp)
+		entry := log.WithField("url", req.URL.String()).WithField("attempt", attempt).WithField("wait", wait)
+		if err != nil {
+			entry.WithError(err).Warn("GitHub request failed, retrying")
+		} else {
+			entry.WithField("status_code", resp.StatusCode).Warn("GitHub request failed, retrying")
+			// drain the body so that the connection can be reused
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+
+		err = sleep(req.Context(), wait)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// replayable reports whether the request can be sent again: its method must be idempotent, or its
+// context marked with WithReplayable, and its body must be rewindable
+func (rt *retryTransport) replayable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	replayable, _ := req.Context().Value(replayableKey{}).(bool)
+	return rt.policy.RetryNonIdempotent || replayable
+}
+
+// retryable reports whether the outcome of an attempt is a transient failure
+func (rt *retryTransport) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil && rt.policy.RetryableError(err)
+	}
+	for _, statusCode := range rt.policy.RetryableStatusCodes {
+		if resp.StatusCode == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the time to wait after the given failed attempt, at least the Retry-After the
+// server asked for, up to MaxBackoff
+func (rt *retryTransport) backoff(attempt int, resp *http.Response) time.Duration {
+	backoff := float64(rt.policy.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		backoff *= rt.policy.Multiplier
+	}
+	if backoff > float64(rt.policy.MaxBackoff) {
+		backoff = float64(rt.policy.MaxBackoff)
+	}
+	wait := time.Duration(backoff * (1 - rt.policy.Jitter*rand.Float64()))
+
+	if resp != nil {
+		if serverWait, ok := retryAfter(resp.Header); ok && serverWait > wait {
+			wait = serverWait
+		}
+	}
+	if wait > rt.policy.MaxBackoff {
+		wait = rt.policy.MaxBackoff
+	}
+	return wait
+}
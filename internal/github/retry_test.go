@@ -0,0 +1,193 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"github.com/jarcoal/httpmock"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestRetryTransport returns a retry transport around a mock transport, waiting 1ms between attempts
+func newTestRetryTransport(policy RetryPolicy) (*retryTransport, *httpmock.MockTransport) {
+	mock := httpmock.NewMockTransport()
+	policy.InitialBackoff = time.Millisecond
+	policy.Jitter = -1
+	return NewRetryTransport(mock, policy), mock
+}
+
+// sequenceResponder responds with the responders one after the other, repeating the last one
+func sequenceResponder(responders ...httpmock.Responder) httpmock.Responder {
+	calls := 0
+	return func(req *http.Request) (*http.Response, error) {
+		responder := responders[len(responders)-1]
+		if calls < len(responders) {
+			responder = responders[calls]
+		}
+		calls++
+		return responder(req)
+	}
+}
+
+func TestRetryTransportRetriesTransientFailures(t *testing.T) {
+	testCases := map[string]httpmock.Responder{
+		"BadGateway":         httpmock.NewStringResponder(http.StatusBadGateway, "bad gateway"),
+		"ServiceUnavailable": httpmock.NewStringResponder(http.StatusServiceUnavailable, "unavailable"),
+		"NetworkError":       httpmock.NewErrorResponder(io.ErrUnexpectedEOF),
+	}
+	for name, failure := range testCases {
+		t.Run(name, func(t *testing.T) {
+			transport, mock := newTestRetryTransport(RetryPolicy{})
+			mock.RegisterResponder("GET", "https://api.github.com/repositories",
+				sequenceResponder(failure, httpmock.NewStringResponder(http.StatusOK, "[]")),
+			)
+
+			req, _ := http.NewRequest("GET", "https://api.github.com/repositories", nil)
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || mock.GetTotalCallCount() != 2 {
+				t.Errorf("request should be retried, got status %d after %d attempts", resp.StatusCode, mock.GetTotalCallCount())
+			}
+		})
+	}
+}
+
+func TestRetryTransportGivesUp(t *testing.T) {
+	transport, mock := newTestRetryTransport(RetryPolicy{MaxAttempts: 4})
+	mock.RegisterResponder("GET", "https://api.github.com/repositories",
+		httpmock.NewStringResponder(http.StatusBadGateway, "bad gateway"),
+	)
+
+	req, _ := http.NewRequest("GET", "https://api.github.com/repositories", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || string(body) != "bad gateway" || mock.GetTotalCallCount() != 4 {
+		t.Errorf("last response should be returned after 4 attempts, got status %d and body %q after %d attempts", resp.StatusCode, body, mock.GetTotalCallCount())
+	}
+}
+
+func TestRetryTransportDoesNotRetry(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	testCases := map[string]struct {
+		policy    RetryPolicy
+		request   func() *http.Request
+		responder httpmock.Responder
+	}{
+		"NotFound": {
+			request: func() *http.Request {
+				req, _ := http.NewRequest("GET", "https://api.github.com/repositories", nil)
+				return req
+			},
+			responder: httpmock.NewStringResponder(http.StatusNotFound, "not found"),
+		},
+		"NonRetryableStatusCode": {
+			policy: RetryPolicy{RetryableStatusCodes: []int{http.StatusServiceUnavailable}},
+			request: func() *http.Request {
+				req, _ := http.NewRequest("GET", "https://api.github.com/repositories", nil)
+				return req
+			},
+			responder: httpmock.NewStringResponder(http.StatusBadGateway, "bad gateway"),
+		},
+		"NonIdempotentMethod": {
+			request: func() *http.Request {
+				req, _ := http.NewRequest("POST", "https://api.github.com/repositories", bytes.NewReader([]byte("{}")))
+				return req
+			},
+			responder: httpmock.NewStringResponder(http.StatusBadGateway, "bad gateway"),
+		},
+		"NonRetryableError": {
+			policy: RetryPolicy{RetryableError: func(err error) bool { return false }},
+			request: func() *http.Request {
+				req, _ := http.NewRequest("GET", "https://api.github.com/repositories", nil)
+				return req
+			},
+			responder: httpmock.NewErrorResponder(io.ErrUnexpectedEOF),
+		},
+		"CanceledContext": {
+			request: func() *http.Request {
+				req, _ := http.NewRequestWithContext(canceled, "GET", "https://api.github.com/repositories", nil)
+				return req
+			},
+			responder: httpmock.NewErrorResponder(context.Canceled),
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			transport, mock := newTestRetryTransport(testCase.policy)
+			mock.RegisterNoResponder(testCase.responder)
+
+			resp, _ := transport.RoundTrip(testCase.request())
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if mock.GetTotalCallCount() != 1 {
+				t.Errorf("request should not be retried, sent %d times", mock.GetTotalCallCount())
+			}
+		})
+	}
+}
+
+func TestRetryTransportReplaysBody(t *testing.T) {
+	transport, mock := newTestRetryTransport(RetryPolicy{})
+	bodies := []string{}
+	mock.RegisterResponder("POST", "https://api.github.com/graphql", func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			return httpmock.NewStringResponse(http.StatusBadGateway, "bad gateway"), nil
+		}
+		return httpmock.NewStringResponse(http.StatusOK, "{}"), nil
+	})
+
+	req, _ := http.NewRequestWithContext(WithReplayable(context.Background()), "POST", "https://api.github.com/graphql", bytes.NewReader([]byte(`{"query": "{}"}`)))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(bodies) != 2 || bodies[1] != `{"query": "{}"}` {
+		t.Errorf("replayable request should be retried with its body, got status %d and bodies %q", resp.StatusCode, bodies)
+	}
+}
+
+func TestRetryTransportBackoff(t *testing.T) {
+	transport := NewRetryTransport(http.DefaultTransport, RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Jitter:         0.5,
+	})
+	for attempt, expected := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		5: time.Second,
+	} {
+		for i := 0; i < 100; i++ {
+			backoff := transport.backoff(attempt, nil)
+			if backoff < expected/2 || backoff > expected {
+				t.Fatalf("backoff of attempt %d should be between %v and %v, got %v", attempt, expected/2, expected, backoff)
+			}
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"60"}}}
+	if backoff := transport.backoff(1, resp); backoff != time.Second {
+		t.Errorf("Retry-After should be honored up to the max backoff, got %v", backoff)
+	}
+
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	resp = &http.Response{Header: http.Header{"Retry-After": []string{date}}}
+	if backoff := transport.backoff(1, resp); backoff != time.Second {
+		t.Errorf("Retry-After given as an HTTP date should be honored up to the max backoff, got %v", backoff)
+	}
+}
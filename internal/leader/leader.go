@@ -0,0 +1,158 @@
+// Package leader elects a single leader among the instances sharing a key value store.
+package leader
+
+import (
+	"context"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// elector campaigns for the leadership by holding a lease on a kvstore lock.
+type elector struct {
+	lock interface {
+		Acquire(ctx context.Context) (*kvstore.Lease, error)
+		Owner() string
+		TTL() time.Duration
+	}
+
+	mu           sync.Mutex
+	lease        *kvstore.Lease
+	renewedAt    time.Time
+	leaderCtx    context.Context
+	cancelLeader context.CancelFunc
+}
+
+// NewElector returns an elector campaigning on the lock stored under key, the store must support
+// versioned writes
+func NewElector(store kvstore.ReadWriter, key string, opts kvstore.LockOptions) (*elector, error) {
+	lock, err := kvstore.NewLock(store, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &elector{lock: lock}, nil
+}
+
+// Campaign tries to become the leader until ctx is done, the first attempt is made before
+// Campaign returns. Once elected, the lease is renewed every third of the lock TTL and released
+// when ctx is done so that another instance takes over without waiting for it to expire.
+// The returned channel is closed once the campaign stopped and the lease was released.
+func (e *elector) Campaign(ctx context.Context) <-chan struct{} {
+	e.tick(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(e.lock.TTL() / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				e.resign(logger.ToCtx(context.Background(), logger.Get(ctx)))
+				return
+			case <-ticker.C:
+				e.tick(ctx)
+			}
+		}
+	}()
+	return done
+}
+
+// IsLeader reports whether this instance currently holds the leadership
+func (e *elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lease != nil
+}
+
+// Lead runs fn if this instance is the leader and reports whether it ran. The context passed to
+// fn is canceled as soon as the leadership is lost, token is the fencing token of the lease.
+func (e *elector) Lead(ctx context.Context, fn func(ctx context.Context, token uint64)) bool {
+	e.mu.Lock()
+	lease, leaderCtx := e.lease, e.leaderCtx
+	e.mu.Unlock()
+	if lease == nil {
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-leaderCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	fn(ctx, lease.Token)
+	return true
+}
+
+// tick acquires the leadership, or renews the lease when already leading
+func (e *elector) tick(ctx context.Context) {
+	log := logger.Get(ctx).WithField("owner", e.lock.Owner())
+	e.mu.Lock()
+	lease, renewedAt := e.lease, e.renewedAt
+	e.mu.Unlock()
+
+	if lease == nil {
+		lease, err := e.lock.Acquire(ctx)
+		if errors.Is(err, kvstore.ErrLockHeld) {
+			return
+		}
+		if err != nil {
+			log.WithError(err).Warn("Failed to campaign for leadership")
+			return
+		}
+		e.mu.Lock()
+		e.lease, e.renewedAt = lease, time.Now()
+		e.leaderCtx, e.cancelLeader = context.WithCancel(context.Background())
+		e.mu.Unlock()
+		log.WithField("fencing_token", lease.Token).Info("Elected leader")
+		return
+	}
+
+	err := lease.Renew(ctx)
+	switch {
+	case err == nil:
+		e.mu.Lock()
+		e.renewedAt = time.Now()
+		e.mu.Unlock()
+	case errors.Is(err, kvstore.ErrLockLost):
+		log.Warn("Leadership lost")
+		e.stepDown(lease)
+	case time.Since(renewedAt) >= e.lock.TTL():
+		// the lease expired while the store was unreachable
+		log.WithError(err).Warn("Leadership lost, failed to renew the lease in time")
+		e.stepDown(lease)
+	default:
+		log.WithError(err).Warn("Failed to renew leadership lease")
+	}
+}
+
+// stepDown drops the leadership held with lease
+func (e *elector) stepDown(lease *kvstore.Lease) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lease != lease {
+		return
+	}
+	e.lease = nil
+	e.cancelLeader()
+}
+
+// resign releases the leadership if held
+func (e *elector) resign(ctx context.Context) {
+	e.mu.Lock()
+	lease := e.lease
+	e.mu.Unlock()
+	if lease == nil {
+		return
+	}
+	e.stepDown(lease)
+	err := lease.Release(ctx)
+	if err != nil && !errors.Is(err, kvstore.ErrLockLost) {
+		logger.Get(ctx).WithError(err).Warn("Failed to release leadership lease")
+	}
+}
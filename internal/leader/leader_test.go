@@ -0,0 +1,110 @@
+package leader
+
+import (
+	"context"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"testing"
+	"time"
+)
+
+func newTestElector(t *testing.T, store kvstore.ReadWriter, owner string) *elector {
+	e, err := NewElector(store, "locks:leader", kvstore.LockOptions{TTL: 60 * time.Millisecond, Owner: owner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func waitFor(t *testing.T, condition func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestElector(t *testing.T) {
+	store := kvstore.NewInMemoryStore(kvstore.NoExpiration, time.Minute)
+	first, second := newTestElector(t, store, "first"), newTestElector(t, store, "second")
+
+	firstCtx, resign := context.WithCancel(context.Background())
+	defer resign()
+	secondCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first.Campaign(firstCtx)
+	second.Campaign(secondCtx)
+
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatalf("The first instance campaigning should be elected")
+	}
+
+	// the leadership is kept past the lock TTL
+	time.Sleep(100 * time.Millisecond)
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatalf("The leader should renew its lease")
+	}
+
+	ran := false
+	if second.Lead(context.Background(), func(context.Context, uint64) { ran = true }) || ran {
+		t.Errorf("Followers should not run the leader function")
+	}
+	var token uint64
+	if !first.Lead(context.Background(), func(_ context.Context, t uint64) { token = t }) || token == 0 {
+		t.Errorf("The leader should run the leader function with its fencing token")
+	}
+
+	resign()
+	waitFor(t, second.IsLeader, "Another instance should take over once the leader resigned")
+	if first.IsLeader() {
+		t.Errorf("The leader should step down once resigned")
+	}
+}
+
+func TestElectorLeadershipLost(t *testing.T) {
+	store := kvstore.NewInMemoryStore(kvstore.NoExpiration, time.Minute)
+	e := newTestElector(t, store, "leader")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e.Campaign(ctx)
+
+	e.Lead(context.Background(), func(ctx context.Context, _ uint64) {
+		// the lock is stolen, e.g. the lease expired during a long pause
+		_ = store.Write(context.Background(), "locks:leader", "stolen", kvstore.NoExpiration)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Errorf("The leader context should be canceled once the leadership is lost")
+		}
+	})
+	if e.IsLeader() {
+		t.Errorf("The elector should step down once the leadership is lost")
+	}
+}
+
+func TestElectorReleasesLeaseOnceStopped(t *testing.T) {
+	store := kvstore.NewInMemoryStore(kvstore.NoExpiration, time.Minute)
+	first, second := newTestElector(t, store, "first"), newTestElector(t, store, "second")
+	ctx, stop := context.WithCancel(context.Background())
+	done := first.Campaign(ctx)
+
+	stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("The campaign should stop once its context is done")
+	}
+	if first.IsLeader() {
+		t.Errorf("The leader should step down once stopped")
+	}
+
+	// the lease was released, another instance is elected right away
+	secondCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	second.Campaign(secondCtx)
+	if !second.IsLeader() {
+		t.Errorf("The lease should be released once the campaign stopped")
+	}
+}
@@ -0,0 +1,345 @@
+// Package metrics implements counters, gauges and histograms exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metric families and renders them in the Prometheus text format.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+	names    []string
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		families: map[string]*family{},
+	}
+}
+
+// family is a metric and its series, one per label values combination
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+
+	// collect returns the value of a gauge computed on scrape
+	collect func() float64
+}
+
+// series holds the value of a metric for a label values combination
+type series struct {
+	labelValues []string
+
+	mu    sync.Mutex
+	value float64
+
+	// histograms only, counts are per bucket and not cumulative
+	counts []uint64
+	count  uint64
+}
+
+// register returns the family registered under name, creating it if needed.
+// Registering a name twice with another kind or other labels panics.
+func (r *Registry) register(name, help, kind string, buckets []float64, labelNames []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.families[name]; ok {
+		if f.kind != kind || strings.Join(f.labelNames, ",") != strings.Join(labelNames, ",") {
+			panic(fmt.Sprintf("metric %s registered twice with different kinds or labels", name))
+		}
+		return f
+	}
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*series{},
+	}
+	r.families[name] = f
+	r.names = append(r.names, name)
+	return f
+}
+
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		if f.buckets != nil {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	family *family
+}
+
+// Counter returns the counter family registered under name, creating it if needed
+func (r *Registry) Counter(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{family: r.register(name, help, "counter", nil, labelNames)}
+}
+
+// With returns the counter for the given label values
+func (cv *CounterVec) With(labelValues ...string) *Counter {
+	return &Counter{series: cv.family.with(labelValues)}
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	series *series
+}
+
+// Inc increments the counter by 1
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increments the counter by v, which must not be negative
+func (c *Counter) Add(v float64) {
+	c.series.mu.Lock()
+	defer c.series.mu.Unlock()
+	c.series.value += v
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() float64 {
+	c.series.mu.Lock()
+	defer c.series.mu.Unlock()
+	return c.series.value
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	family *family
+}
+
+// Gauge returns the gauge family registered under name, creating it if needed
+func (r *Registry) Gauge(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{family: r.register(name, help, "gauge", nil, labelNames)}
+}
+
+// GaugeFunc registers an unlabeled gauge whose value is computed by collect on every scrape
+func (r *Registry) GaugeFunc(name, help string, collect func() float64) {
+	f := r.register(name, help, "gauge", nil, nil)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.collect = collect
+}
+
+// With returns the gauge for the given label values
+func (gv *GaugeVec) With(labelValues ...string) *Gauge {
+	return &Gauge{series: gv.family.with(labelValues)}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	series *series
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64) {
+	g.series.mu.Lock()
+	defer g.series.mu.Unlock()
+	g.series.value = v
+}
+
+// Add adds v, which may be negative, to the gauge
+func (g *Gauge) Add(v float64) {
+	g.series.mu.Lock()
+	defer g.series.mu.Unlock()
+	g.series.value += v
+}
+
+// Value returns the current value of the gauge
+func (g *Gauge) Value() float64 {
+	g.series.mu.Lock()
+	defer g.series.mu.Unlock()
+	return g.series.value
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	family *family
+}
+
+// Histogram returns the histogram family registered under name, creating it if needed.
+// buckets are the sorted upper bounds of the buckets, the +Inf bucket is implicit.
+func (r *Registry) Histogram(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{family: r.register(name, help, "histogram", buckets, labelNames)}
+}
+
+// With returns the histogram for the given label values
+func (hv *HistogramVec) With(labelValues ...string) *Histogram {
+	return &Histogram{series: hv.family.with(labelValues), buckets: hv.family.buckets}
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	series  *series
+	buckets []float64
+}
+
+// Observe adds an observation
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+	if i < len(h.buckets) {
+		h.series.counts[i]++
+	}
+	h.series.count++
+	h.series.value += v
+}
+
+// ExponentialBuckets returns count buckets, the first one being start and each following one
+// factor times the previous one
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// WriteText writes every metric in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.names))
+	for _, name := range r.names {
+		families = append(families, r.families[name])
+	}
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP exposes the metrics to Prometheus
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.WriteText(w)
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	collect := f.collect
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mu.Unlock()
+	if collect == nil && len(all) == 0 {
+		return
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labelValues, "\xff") < strings.Join(all[j].labelValues, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	if collect != nil {
+		fmt.Fprintf(w, "%s %s\n", f.name, formatValue(collect()))
+		return
+	}
+
+	for _, s := range all {
+		s.mu.Lock()
+		labels := formatLabels(f.labelNames, s.labelValues)
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, wrapLabels(labels), formatValue(s.value))
+			s.mu.Unlock()
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, wrapLabels(joinLabels(labels, `le="`+formatValue(bound)+`"`)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, wrapLabels(joinLabels(labels, `le="+Inf"`)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, wrapLabels(labels), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, wrapLabels(labels), s.count)
+		s.mu.Unlock()
+	}
+}
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabelValue(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
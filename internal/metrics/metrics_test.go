@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.Counter("requests_total", "Number of requests.", "path")
+	requests.With("/b").Inc()
+	requests.With("/a").Add(2)
+	registry.Gauge("temperature", "Current temperature.", "room").With(`living "room"`).Set(21.5)
+	registry.GaugeFunc("queue_depth", "Pending jobs.", func() float64 { return 3 })
+	latency := registry.Histogram("latency_seconds", "Requests latency.", []float64{0.1, 1}, "path")
+	latency.With("/a").Observe(0.05)
+	latency.With("/a").Observe(0.5)
+	latency.With("/a").Observe(5)
+	registry.Counter("unused_total", "Never incremented.")
+
+	var builder strings.Builder
+	err := registry.WriteText(&builder)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{path="/a"} 2
+requests_total{path="/b"} 1
+# HELP temperature Current temperature.
+# TYPE temperature gauge
+temperature{room="living \"room\""} 21.5
+# HELP queue_depth Pending jobs.
+# TYPE queue_depth gauge
+queue_depth 3
+# HELP latency_seconds Requests latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/a",le="0.1"} 1
+latency_seconds_bucket{path="/a",le="1"} 2
+latency_seconds_bucket{path="/a",le="+Inf"} 3
+latency_seconds_sum{path="/a"} 5.55
+latency_seconds_count{path="/a"} 3
+`
+	if builder.String() != expected {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", builder.String(), expected)
+	}
+}
+
+func TestRegistryRegisterTwice(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("requests_total", "Number of requests.", "path").With("/").Inc()
+	counter := registry.Counter("requests_total", "Number of requests.", "path").With("/")
+	if counter.Value() != 1 {
+		t.Errorf("registering twice should return the same family, got value %v", counter.Value())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name with other labels should panic")
+		}
+	}()
+	registry.Counter("requests_total", "Number of requests.", "method")
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("requests_total", "Number of requests.").With().Inc()
+
+	rr := httptest.NewRecorder()
+	registry.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", rr.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rr.Body.String(), "requests_total 1\n") {
+		t.Errorf("unexpected body %q", rr.Body.String())
+	}
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	buckets := ExponentialBuckets(1, 4, 3)
+	if len(buckets) != 3 || buckets[0] != 1 || buckets[1] != 4 || buckets[2] != 16 {
+		t.Errorf("unexpected buckets %v", buckets)
+	}
+}
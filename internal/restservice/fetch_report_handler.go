@@ -0,0 +1,43 @@
+package restservice
+
+import (
+	"encoding/json"
+	"github.com/MarouaneMan/github-api/api"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// FetchReportHandler returns the report of the last fetcher run as JSON, or 404 if the fetcher did
+// not finish any run yet. It is served outside of the router as the report is updated by every
+// run, even when the repositories are not.
+func FetchReportHandler(storeReader kvstore.Reader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.Get(r.Context())
+
+		// the report is stored along with the fencing token of the run
+		var report api.Fenced[api.FetchReport]
+		err := kvstore.ReadInto(r.Context(), storeReader, "fetcher:report", &report)
+		if errors.Is(err, kvstore.ErrNotFound) || (err == nil && report.Value == nil) {
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			err = json.NewEncoder(w).Encode(map[string]string{"error": "No fetcher run finished yet"})
+			if err != nil {
+				log.WithError(err).Error("Fail to encode JSON")
+			}
+			return
+		}
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(report.Value)
+		if err != nil {
+			log.WithError(err).Error("Fail to encode JSON")
+		}
+	}
+}
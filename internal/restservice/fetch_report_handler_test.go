@@ -0,0 +1,56 @@
+package restservice
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/MarouaneMan/github-api/api"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFetchReportHandler(t *testing.T) {
+	startedAt := time.Now().UTC().Truncate(time.Second)
+	expected := api.FetchReport{
+		Status:       api.FetchPartiallyFailed,
+		StartedAt:    startedAt,
+		FinishedAt:   startedAt.Add(time.Minute),
+		Repositories: 2,
+		Succeeded:    1,
+		Failed:       1,
+		Stale:        1,
+		Failures:     []api.FetchFailure{{FullName: "owner2/repo2", Error: "Unexpected http statusCode = 404"}},
+	}
+
+	for name, store := range newStoresMock(t) {
+		t.Run(name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/fetcher/report", nil)
+			rr := httptest.NewRecorder()
+			FetchReportHandler(store).ServeHTTP(rr, req)
+			if rr.Code != http.StatusNotFound {
+				t.Errorf("unexpected status code before any run: got %v, want %v", rr.Code, http.StatusNotFound)
+			}
+
+			err := store.Write(context.Background(), "fetcher:report", api.Fenced[api.FetchReport]{FencingToken: 1, Value: &expected}, kvstore.NoExpiration)
+			if err != nil {
+				t.Fatalf("failed to write report: %v", err)
+			}
+			rr = httptest.NewRecorder()
+			FetchReportHandler(store).ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusOK)
+			}
+			var report api.FetchReport
+			err = json.Unmarshal(rr.Body.Bytes(), &report)
+			if err != nil {
+				t.Fatalf("failed to unmarshal JSON response: %v", err)
+			}
+			if !reflect.DeepEqual(report, expected) {
+				t.Errorf("unexpected report: got %+v, want %+v", report, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package restservice
+
+import (
+	"encoding/json"
+	"github.com/MarouaneMan/github-api/internal/github"
+	"github.com/Scalingo/go-utils/logger"
+	"net/http"
+)
+
+// RateLimitHandler returns the GitHub rate limit quota of the fetcher, as last reported by GitHub.
+// It is served outside of the router as the quota must never be cached.
+func RateLimitHandler(client interface{ Quota() github.Quota }) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.Get(r.Context())
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		err := json.NewEncoder(w).Encode(client.Quota())
+		if err != nil {
+			log.WithError(err).Error("Fail to encode JSON")
+		}
+	}
+}
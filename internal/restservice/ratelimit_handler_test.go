@@ -0,0 +1,36 @@
+package restservice
+
+import (
+	"encoding/json"
+	"github.com/MarouaneMan/github-api/internal/github"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type quotaMock github.Quota
+
+func (qm quotaMock) Quota() github.Quota {
+	return github.Quota(qm)
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	expected := github.Quota{Limit: 5000, Remaining: 42, Used: 4958, Reset: time.Now().Add(time.Hour).UTC().Truncate(time.Second)}
+	req, _ := http.NewRequest("GET", "/ratelimit", nil)
+	rr := httptest.NewRecorder()
+
+	RateLimitHandler(quotaMock(expected)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	var quota github.Quota
+	err := json.Unmarshal(rr.Body.Bytes(), &quota)
+	if err != nil {
+		t.Fatalf("failed to unmarshal JSON response: %v", err)
+	}
+	if quota != expected {
+		t.Errorf("unexpected quota: got %+v, want %+v", quota, expected)
+	}
+}
@@ -2,7 +2,6 @@ package restservice
 
 import (
 	"encoding/json"
-	"github.com/MarouaneMan/github-api/api"
 	"github.com/MarouaneMan/github-api/kvstore"
 	"github.com/Scalingo/go-utils/logger"
 	"net/http"
@@ -15,9 +14,10 @@ func ReposHandler(storeReader kvstore.Reader) func(http.ResponseWriter, *http.Re
 
 		queryParams := r.URL.Query()
 
-		repositories, ok := storeReader.Read(r.Context(), "repositories").([]*api.Repository)
-		if !ok {
-			repositories = []*api.Repository{}
+		repositories, err := readRepositories(r.Context(), storeReader)
+		if err != nil {
+			writeStoreError(w, r, err)
+			return nil
 		}
 
 		var filteredRepositories = FilterRepositories(
@@ -32,7 +32,7 @@ func ReposHandler(storeReader kvstore.Reader) func(http.ResponseWriter, *http.Re
 
 		w.Header().Add("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		err := json.NewEncoder(w).Encode(filteredRepositories)
+		err = json.NewEncoder(w).Encode(filteredRepositories)
 		if err != nil {
 			log.WithError(err).Error("Fail to encode JSON")
 		}
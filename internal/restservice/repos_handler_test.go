@@ -8,54 +8,80 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 )
 
 func TestReposHandler(t *testing.T) {
+	for name, store := range newStoresMock(t) {
+		t.Run(name, func(t *testing.T) {
+			_ = store.Write(context.Background(), "repositories", api.Fenced[[]*api.Repository]{Value: &reposMock}, kvstore.NoExpiration)
 
-	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+			// Create a request with the desired query parameters
+			req, err := http.NewRequest("GET", "/repositories?language=golang&owner=owner3&limit=1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-	_ = store.Write(context.Background(), "repositories", reposMock, kvstore.NoExpiration)
+			rr := httptest.NewRecorder()
 
-	// Create a request with the desired query parameters
-	req, err := http.NewRequest("GET", "/repositories?language=golang&owner=owner3&limit=1", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+			handler := ReposHandler(store)
+			err = handler(rr, req, nil)
+			if err != nil {
+				t.Fatalf("Failed to handle reposMock request: %v", err)
+				return
+			}
 
-	rr := httptest.NewRecorder()
+			if status := rr.Code; status != http.StatusOK {
+				t.Errorf("unexpected status code: got %v, want %v", status, http.StatusOK)
+			}
 
-	handler := ReposHandler(store)
-	err = handler(rr, req, nil)
-	if err != nil {
-		t.Fatalf("Failed to handle reposMock request: %v", err)
-		return
-	}
+			// Parse the response body and check its content
+			var responseRepositories []*api.Repository
+			err = json.Unmarshal(rr.Body.Bytes(), &responseRepositories)
+			if err != nil {
+				t.Errorf("Failed to unmarshal JSON response: %v", err)
+			}
 
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("unexpected status code: got %v, want %v", status, http.StatusOK)
-	}
+			expected := []*api.Repository{
+				{
+					Repository: "repo3",
+					Owner:      "owner3",
+					Languages: map[string]api.Language{
+						"golang": {
+							Bytes: 1234,
+						},
+					},
+				},
+			}
 
-	// Parse the response body and check its content
-	var responseRepositories []*api.Repository
-	err = json.Unmarshal(rr.Body.Bytes(), &responseRepositories)
-	if err != nil {
-		t.Errorf("Failed to unmarshal JSON response: %v", err)
+			if !reflect.DeepEqual(responseRepositories, expected) {
+				t.Errorf("Fetched repositories do not match expected: got %+v, want %+v", responseRepositories, expected)
+			}
+		})
 	}
+}
 
-	expected := []*api.Repository{
-		{
-			Repository: "repo3",
-			Owner:      "owner3",
-			Languages: map[string]api.Language{
-				"golang": {
-					Bytes: 1234,
-				},
-			},
-		},
-	}
+func TestReposHandlerStoreErrors(t *testing.T) {
+	for name, tc := range newFailingStoresMock(t) {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/repositories", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			err = ReposHandler(tc.store)(rr, req, nil)
+			if err != nil {
+				t.Fatalf("Failed to handle reposMock request: %v", err)
+			}
 
-	if !reflect.DeepEqual(responseRepositories, expected) {
-		t.Errorf("Fetched repositories do not match expected: got %+v, want %+v", responseRepositories, expected)
+			if status := rr.Code; status != tc.statusCode {
+				t.Errorf("unexpected status code: got %v, want %v", status, tc.statusCode)
+			}
+			if tc.statusCode == http.StatusOK && strings.TrimSpace(rr.Body.String()) != "[]" {
+				t.Errorf("unexpected body: got %q, want an empty list", rr.Body.String())
+			}
+		})
 	}
 }
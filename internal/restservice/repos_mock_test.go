@@ -1,6 +1,60 @@
 package restservice
 
-import "github.com/MarouaneMan/github-api/api"
+import (
+	"context"
+	"github.com/MarouaneMan/github-api/api"
+	"github.com/MarouaneMan/github-api/internal/testutil/redistest"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"net/http"
+	"testing"
+)
+
+// newStoresMock returns every store backend handlers are expected to work with
+func newStoresMock(t *testing.T) map[string]kvstore.ReadWriter {
+	stores := map[string]kvstore.ReadWriter{
+		"memory": kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration),
+	}
+	for _, codecName := range []string{"json", "gob", "binary"} {
+		codec, _ := kvstore.CodecByName(codecName)
+		store := kvstore.NewRedisStore(kvstore.RedisOptions{
+			Addr:  redistest.New(t, "").Addr(),
+			Codec: codec,
+		}, kvstore.DefaultExpiration)
+		t.Cleanup(func() {
+			_ = store.Close()
+		})
+		stores["redis_"+codecName] = store
+	}
+	return stores
+}
+
+// newFailingStoresMock returns stores failing to provide repositories along with the status code
+// handlers are expected to respond with
+func newFailingStoresMock(t *testing.T) map[string]struct {
+	store      kvstore.ReadWriter
+	statusCode int
+} {
+	// nothing fetched yet
+	empty := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+
+	// corrupted dataset
+	corrupted := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	_ = corrupted.Write(context.Background(), "repositories", "not a dataset", kvstore.NoExpiration)
+
+	// unreachable backend
+	server := redistest.New(t, "")
+	unreachable := kvstore.NewRedisStore(kvstore.RedisOptions{Addr: server.Addr()}, kvstore.DefaultExpiration)
+	server.Close()
+
+	return map[string]struct {
+		store      kvstore.ReadWriter
+		statusCode int
+	}{
+		"NotFound":    {store: empty, statusCode: http.StatusOK},
+		"DecodeError": {store: corrupted, statusCode: http.StatusInternalServerError},
+		"Unreachable": {store: unreachable, statusCode: http.StatusServiceUnavailable},
+	}
+}
 
 var reposMock = []*api.Repository{
 	{
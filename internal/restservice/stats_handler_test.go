@@ -12,43 +12,79 @@ import (
 )
 
 func TestStatsHandler(t *testing.T) {
-	store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	for name, store := range newStoresMock(t) {
+		t.Run(name, func(t *testing.T) {
+			_ = store.Write(context.Background(), "repositories", api.Fenced[[]*api.Repository]{Value: &reposMock}, kvstore.NoExpiration)
 
-	_ = store.Write(context.Background(), "repositories", reposMock, kvstore.NoExpiration)
+			req, err := http.NewRequest("GET", "/stats?language=golang", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-	req, err := http.NewRequest("GET", "/stats?language=golang", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+			rr := httptest.NewRecorder()
 
-	rr := httptest.NewRecorder()
+			handler := StatsHandler(store)
+			err = handler(rr, req, nil)
+			if err != nil {
+				t.Fatalf("failed to handle stats request: %v", err)
+				return
+			}
 
-	handler := StatsHandler(store)
-	err = handler(rr, req, nil)
-	if err != nil {
-		t.Fatalf("failed to handle stats request: %v", err)
-		return
-	}
+			if status := rr.Code; status != http.StatusOK {
+				t.Errorf("unexpected status code: got %v, want %v", status, http.StatusOK)
+			}
 
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("unexpected status code: got %v, want %v", status, http.StatusOK)
-	}
+			var statsResponse api.Stats
+			err = json.Unmarshal(rr.Body.Bytes(), &statsResponse)
+			if err != nil {
+				t.Errorf("failed to unmarshal JSON response: %v", err)
+			}
 
-	var statsResponse api.Stats
-	err = json.Unmarshal(rr.Body.Bytes(), &statsResponse)
-	if err != nil {
-		t.Errorf("failed to unmarshal JSON response: %v", err)
-	}
+			expectedStats := api.Stats{
+				Language:          "golang",
+				TotalUsage:        3,
+				TotalCodeSize:     3702,
+				TotalRepositories: 4,
+				AverageCodeSize:   1234,
+			}
 
-	expectedStats := api.Stats{
-		Language:          "golang",
-		TotalUsage:        3,
-		TotalCodeSize:     3702,
-		TotalRepositories: 4,
-		AverageCodeSize:   1234,
+			if !reflect.DeepEqual(statsResponse, expectedStats) {
+				t.Errorf("fetched stats do not match expected: got %+v, want %+v", statsResponse, expectedStats)
+			}
+		})
 	}
+}
+
+func TestStatsHandlerStoreErrors(t *testing.T) {
+	for name, tc := range newFailingStoresMock(t) {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/stats?language=golang", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			err = StatsHandler(tc.store)(rr, req, nil)
+			if err != nil {
+				t.Fatalf("failed to handle stats request: %v", err)
+			}
+
+			if status := rr.Code; status != tc.statusCode {
+				t.Errorf("unexpected status code: got %v, want %v", status, tc.statusCode)
+			}
+			if tc.statusCode != http.StatusOK {
+				return
+			}
 
-	if !reflect.DeepEqual(statsResponse, expectedStats) {
-		t.Errorf("fetched stats do not match expected: got %+v, want %+v", statsResponse, expectedStats)
+			var statsResponse api.Stats
+			err = json.Unmarshal(rr.Body.Bytes(), &statsResponse)
+			if err != nil {
+				t.Errorf("failed to unmarshal JSON response: %v", err)
+			}
+			expectedStats := api.Stats{Language: "golang"}
+			if !reflect.DeepEqual(statsResponse, expectedStats) {
+				t.Errorf("fetched stats do not match expected: got %+v, want %+v", statsResponse, expectedStats)
+			}
+		})
 	}
 }
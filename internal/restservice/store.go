@@ -0,0 +1,45 @@
+package restservice
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/MarouaneMan/github-api/api"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// readRepositories reads the repositories stored by the fetcher along with its fencing token.
+// An empty dataset is returned if the fetcher did not store any repositories yet.
+func readRepositories(ctx context.Context, storeReader kvstore.Reader) ([]*api.Repository, error) {
+	var repositories api.Fenced[[]*api.Repository]
+	err := kvstore.ReadInto(ctx, storeReader, "repositories", &repositories)
+	if errors.Is(err, kvstore.ErrNotFound) || (err == nil && repositories.Value == nil) {
+		return []*api.Repository{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return *repositories.Value, nil
+}
+
+// writeStoreError responds with 500 if the stored data is corrupted, or with 503 if the store
+// is unavailable so that clients know they can retry later.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	log := logger.Get(r.Context())
+
+	statusCode := http.StatusServiceUnavailable
+	var decodeErr *kvstore.DecodeError
+	if errors.As(err, &decodeErr) {
+		statusCode = http.StatusInternalServerError
+	}
+	log.WithError(err).Error("Failed to read from store")
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	err = json.NewEncoder(w).Encode(map[string]string{"error": http.StatusText(statusCode)})
+	if err != nil {
+		log.WithError(err).Error("Fail to encode JSON")
+	}
+}
@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"github.com/MarouaneMan/github-api/internal/metrics"
+	"github.com/MarouaneMan/github-api/kvstore"
+)
+
+// Metrics returns the metrics of instrumented stores, recorded in registry
+func Metrics(registry *metrics.Registry) kvstore.Metrics {
+	return registryMetrics{registry: registry}
+}
+
+type registryMetrics struct {
+	registry *metrics.Registry
+}
+
+func (rm registryMetrics) Counter(name, help string, labelNames ...string) kvstore.CounterVec {
+	return counterVec{CounterVec: rm.registry.Counter(name, help, labelNames...)}
+}
+
+func (rm registryMetrics) Histogram(name, help string, buckets []float64, labelNames ...string) kvstore.HistogramVec {
+	return histogramVec{HistogramVec: rm.registry.Histogram(name, help, buckets, labelNames...)}
+}
+
+type counterVec struct {
+	*metrics.CounterVec
+}
+
+func (cv counterVec) With(labelValues ...string) kvstore.Counter {
+	return cv.CounterVec.With(labelValues...)
+}
+
+type histogramVec struct {
+	*metrics.HistogramVec
+}
+
+func (hv histogramVec) With(labelValues ...string) kvstore.Histogram {
+	return hv.HistogramVec.With(labelValues...)
+}
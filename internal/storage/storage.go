@@ -0,0 +1,283 @@
+// Package storage instantiates the key value store backend selected in the configuration and
+// splits it into the namespaces of the subsystems
+package storage
+
+import (
+	"context"
+	"github.com/MarouaneMan/github-api/internal/config"
+	"github.com/MarouaneMan/github-api/internal/metrics"
+	"github.com/MarouaneMan/github-api/kvstore"
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/pkg/errors"
+	"regexp"
+	"time"
+)
+
+// Namespaces of the subsystems
+const (
+	// DatasetNamespace holds the data pulled by the fetcher
+	DatasetNamespace = "dataset"
+
+	// ResponsesNamespace holds the cached handlers responses
+	ResponsesNamespace = "responses"
+
+	// LocksNamespace holds the leases of the locks
+	LocksNamespace = "locks"
+
+	// HTTPCacheNamespace holds the GitHub responses cached by the fetcher, keyed by URL
+	HTTPCacheNamespace = "http"
+)
+
+// keySchemas are the schemas of the keys of the namespaces
+var keySchemas = map[string]*regexp.Regexp{
+	DatasetNamespace:   regexp.MustCompile(`^[a-z][a-z0-9_-]*(:[a-z0-9_-]+)*$`),
+	ResponsesNamespace: regexp.MustCompile(`^/`),
+	LocksNamespace:     regexp.MustCompile(`^[a-z][a-z0-9_-]*$`),
+	HTTPCacheNamespace: regexp.MustCompile(`^https?://`),
+}
+
+// Namespace returns the namespace name of store, refusing keys not matching its schema
+func Namespace(store kvstore.ReadWriter, name string) (kvstore.ReadWriter, error) {
+	return kvstore.NewNamespacedStore(store, name, kvstore.NamespaceOptions{KeyPattern: keySchemas[name]})
+}
+
+// Root returns the namespace of the configured environment or tenant, holding the namespaces of
+// the subsystems, or store itself if no namespace is configured
+func Root(store kvstore.ReadWriter, cfg *config.StoreConfig) (kvstore.ReadWriter, error) {
+	if cfg.StoreNamespace == "" {
+		return store, nil
+	}
+	return kvstore.NewNamespacedStore(store, cfg.StoreNamespace, kvstore.NamespaceOptions{})
+}
+
+// New instantiates the key value store backend selected in the configuration for the service
+func New(ctx context.Context, cfg *config.StoreConfig, registry *metrics.Registry) (kvstore.ReadWriter, error) {
+	return newStore(ctx, cfg, registry, true)
+}
+
+// NewBackend instantiates the key value store backend selected in the configuration for the tools
+// accessing the store of the service from another process. It has no side effects on the backend:
+// redis keyspace notifications are not enabled, shards are not monitored, encryption keys are not
+// rotated and items are not cached in memory.
+func NewBackend(ctx context.Context, cfg *config.StoreConfig) (kvstore.ReadWriter, error) {
+	return newStore(ctx, cfg, nil, false)
+}
+
+// newStore instantiates the backend, along with its background tasks if service is set
+func newStore(ctx context.Context, cfg *config.StoreConfig, registry *metrics.Registry, service bool) (kvstore.ReadWriter, error) {
+	switch cfg.StoreBackend {
+	case "memory":
+		return kvstore.NewInMemoryStore(30*time.Minute, 30*time.Minute), nil
+	case "disk":
+		codec, backendCodec, err := storeCodecs(cfg)
+		if err != nil {
+			return nil, err
+		}
+		store, err := kvstore.NewDiskStore(kvstore.DiskOptions{
+			Path:               cfg.DiskStorePath,
+			Codec:              backendCodec,
+			DefaultExpiration:  30 * time.Minute,
+			SyncPolicy:         kvstore.SyncPolicy(cfg.DiskStoreSync),
+			SyncInterval:       cfg.DiskStoreSyncInterval,
+			CompactionInterval: cfg.DiskStoreCompactionInterval,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return transformValues(ctx, cfg, store, codec, service)
+	case "redis":
+		codec, backendCodec, err := storeCodecs(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if len(cfg.RedisReplicaAddrs) > 0 && len(cfg.RedisShardAddrs) > 0 {
+			return nil, errors.New("Redis replicas and shards cannot be combined")
+		}
+		primary := newRedisStore(ctx, cfg, cfg.RedisAddr, backendCodec)
+		if service {
+			enableKeyspaceNotifications(ctx, primary, cfg.RedisAddr)
+		}
+		var store kvstore.ReadWriter = primary
+		if len(cfg.RedisShardAddrs) > 0 {
+			// the primary is the first shard and keeps carrying the invalidations
+			shards := []kvstore.Shard{{Name: cfg.RedisAddr, Store: primary}}
+			for _, addr := range cfg.RedisShardAddrs {
+				shard := newRedisStore(ctx, cfg, addr, backendCodec)
+				if service {
+					enableKeyspaceNotifications(ctx, shard, addr)
+				}
+				shards = append(shards, kvstore.Shard{Name: addr, Store: shard})
+			}
+			sharded, err := kvstore.NewShardedStore(shards, kvstore.ShardedOptions{})
+			if err != nil {
+				return nil, err
+			}
+			if service {
+				go monitorShards(ctx, sharded, registry)
+			}
+			store = sharded
+		}
+		if len(cfg.RedisReplicaAddrs) > 0 {
+			replicas := []kvstore.Reader{}
+			for _, addr := range cfg.RedisReplicaAddrs {
+				replicas = append(replicas, newRedisStore(ctx, cfg, addr, backendCodec))
+			}
+			store, err = kvstore.NewRoutingStore(primary, replicas, kvstore.RoutingOptions{
+				Balancing:            kvstore.ReadBalancing(cfg.RedisReadBalancing),
+				ReadYourWritesWindow: cfg.RedisReadYourWritesWindow,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		store, err = transformValues(ctx, cfg, store, codec, service)
+		if err != nil {
+			return nil, err
+		}
+		if !service || cfg.RedisL1TTL <= 0 {
+			return store, nil
+		}
+
+		// serve hot items from memory, invalidations are broadcast through the primary
+		return kvstore.NewTieredStore(store, kvstore.TieredOptions{
+			L1TTL:  cfg.RedisL1TTL,
+			Mode:   kvstore.TieredMode(cfg.RedisL1Mode),
+			PubSub: primary,
+			Codec:  codec,
+		})
+	}
+	return nil, errors.Errorf("Unknown store backend %q", cfg.StoreBackend)
+}
+
+// storeCodecs returns the codec serializing the values and the codec of the out-of-process backend,
+// which stores raw bytes when values are compressed or encrypted
+func storeCodecs(cfg *config.StoreConfig) (kvstore.Codec, kvstore.Codec, error) {
+	codec, err := kvstore.CodecByName(cfg.StoreCodec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.StoreCompressionThreshold > 0 || cfg.StoreEncryptionKeys != "" {
+		return codec, kvstore.RawCodec, nil
+	}
+	return codec, codec, nil
+}
+
+// transformValues wraps the store of an out-of-process backend so that values are compressed and
+// then encrypted at rest, according to the configuration. The values encrypted with old keys are
+// re-encrypted in the background if rotate is set.
+func transformValues(ctx context.Context, cfg *config.StoreConfig, store kvstore.ReadWriter, codec kvstore.Codec, rotate bool) (kvstore.ReadWriter, error) {
+	compress := cfg.StoreCompressionThreshold > 0
+	if cfg.StoreEncryptionKeys != "" {
+		keys, err := kvstore.ParseEncryptionKeys(cfg.StoreEncryptionKeys)
+		if err != nil {
+			return nil, err
+		}
+		encryptionCodec := codec
+		if compress {
+			encryptionCodec = kvstore.RawCodec
+		}
+		encrypted, err := kvstore.NewEncryptedStore(store, kvstore.EncryptionOptions{
+			Codec: encryptionCodec,
+			Keys:  keys,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if rotate && len(keys) > 1 {
+			go rotateEncryptionKeys(ctx, encrypted)
+		}
+		store = encrypted
+	}
+	if compress {
+		return kvstore.NewCompressedStore(store, kvstore.CompressionOptions{
+			Codec:     codec,
+			Threshold: cfg.StoreCompressionThreshold,
+		})
+	}
+	return store, nil
+}
+
+// rotateEncryptionKeys re-encrypts with the active key the values encrypted with the old keys,
+// which can be removed from the configuration once done
+func rotateEncryptionKeys(ctx context.Context, store interface {
+	Rotate(ctx context.Context, prefix string) (int, error)
+}) {
+	log := logger.Get(ctx)
+	rotated, err := store.Rotate(ctx, "")
+	if err != nil {
+		log.WithError(err).WithField("rotated", rotated).Error("Failed to rotate encryption keys")
+		return
+	}
+	log.WithField("rotated", rotated).Info("Encryption keys rotated")
+}
+
+// enableKeyspaceNotifications enables the keyspace notifications of a redis server, keys cannot be
+// watched otherwise
+func enableKeyspaceNotifications(ctx context.Context, store redisBackend, addr string) {
+	err := store.EnableKeyspaceNotifications(ctx)
+	if err != nil {
+		logger.Get(ctx).WithError(err).WithField("redis_addr", addr).Warn("Failed to enable redis keyspace notifications, keys cannot be watched")
+	}
+}
+
+// monitorShards periodically checks the health of the shards, logs their changes and exposes it
+// in the kvstore_shard_up metric
+func monitorShards(ctx context.Context, store interface {
+	CheckHealth(ctx context.Context) []kvstore.ShardHealth
+}, registry *metrics.Registry) {
+	log := logger.Get(ctx)
+	up := registry.Gauge("kvstore_shard_up", "Whether a store shard is healthy.", "shard")
+	healthy := map[string]bool{}
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		for _, shard := range store.CheckHealth(ctx) {
+			was, known := healthy[shard.Name]
+			healthy[shard.Name] = shard.Healthy
+			if shard.Healthy {
+				up.With(shard.Name).Set(1)
+				if known && !was {
+					log.WithField("shard", shard.Name).Info("Store shard recovered")
+				}
+				continue
+			}
+			up.With(shard.Name).Set(0)
+			if !known || was {
+				log.WithError(shard.LastError).WithField("shard", shard.Name).Warn("Store shard is unhealthy")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// redisBackend is the store backed by a redis server
+type redisBackend interface {
+	kvstore.ReadWriter
+	kvstore.PubSub
+	EnableKeyspaceNotifications(ctx context.Context) error
+}
+
+// newRedisStore returns a store backed by the redis server at addr
+func newRedisStore(ctx context.Context, cfg *config.StoreConfig, addr string, codec kvstore.Codec) redisBackend {
+	store := kvstore.NewRedisStore(kvstore.RedisOptions{
+		Addr:         addr,
+		Password:     cfg.RedisPassword,
+		DB:           cfg.RedisDB,
+		PoolSize:     cfg.RedisPoolSize,
+		DialTimeout:  cfg.RedisDialTimeout,
+		ReadTimeout:  cfg.RedisReadTimeout,
+		WriteTimeout: cfg.RedisWriteTimeout,
+		Codec:        codec,
+	}, 30*time.Minute)
+
+	// redis may not be up yet, the pool will reconnect lazily so we only warn here
+	err := store.Ping(ctx)
+	if err != nil {
+		logger.Get(ctx).WithError(err).WithField("redis_addr", addr).Warn("Redis store is unreachable")
+	}
+	return store
+}
@@ -0,0 +1,631 @@
+// Package redistest provides an in-process redis server to be used in the tests of the packages
+// talking to redis, it is not meant to be imported by production code.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server is a minimal in-process redis server speaking RESP.
+// It implements the subset of commands used by the kvstore redis backend.
+type Server struct {
+	listener net.Listener
+	password string
+
+	mu           sync.Mutex
+	dbs          map[int]map[string]*entry
+	subscribers  map[string]map[*session]bool
+	psubscribers map[string]map[*session]bool
+
+	// notifyFlags is the notify-keyspace-events configuration
+	notifyFlags string
+
+	// revisions counts the modifications of every key, keyed by db and key, to abort the
+	// transactions watching a modified key
+	revisions map[string]uint64
+
+	conns map[net.Conn]bool
+}
+
+type entry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// session holds the per-connection state
+type session struct {
+	db            int
+	authenticated bool
+	channels      map[string]bool
+	patterns      map[string]bool
+
+	// transaction state: revisions of the watched keys and commands queued after MULTI
+	watched map[string]uint64
+	multi   bool
+	queued  [][]string
+
+	// mu serializes writes to the connection, messages are pushed by publishers' goroutines
+	mu     sync.Mutex
+	writer *bufio.Writer
+}
+
+// write sends a reply to the client
+func (sess *session) write(r reply) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	r(sess.writer)
+	return sess.writer.Flush()
+}
+
+type reply func(w *bufio.Writer)
+
+// New starts a fake redis server requiring the given password, or no authentication if empty.
+// The server is stopped when the test ends.
+func New(t testing.TB, password string) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake redis: %v", err)
+	}
+	srv := &Server{
+		listener:     listener,
+		password:     password,
+		dbs:          map[int]map[string]*entry{},
+		subscribers:  map[string]map[*session]bool{},
+		psubscribers: map[string]map[*session]bool{},
+		conns:        map[net.Conn]bool{},
+		revisions:    map[string]uint64{},
+	}
+	go srv.serve()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Addr returns the address the server listens on
+func (srv *Server) Addr() string {
+	return srv.listener.Addr().String()
+}
+
+// Close stops accepting new connections
+func (srv *Server) Close() {
+	_ = srv.listener.Close()
+}
+
+// DropConnections closes the connections of every client, as a server restart would
+func (srv *Server) DropConnections() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for conn := range srv.conns {
+		_ = conn.Close()
+	}
+}
+
+func (srv *Server) serve() {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.conns[conn] = true
+		srv.mu.Unlock()
+		go srv.handle(conn)
+	}
+}
+
+func (srv *Server) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	sess := &session{
+		authenticated: srv.password == "",
+		channels:      map[string]bool{},
+		patterns:      map[string]bool{},
+		writer:        bufio.NewWriter(conn),
+	}
+	defer func() {
+		_ = conn.Close()
+		srv.mu.Lock()
+		delete(srv.conns, conn)
+		srv.unsubscribe(sess, nil)
+		srv.punsubscribe(sess, nil)
+		srv.mu.Unlock()
+	}()
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		if sess.write(srv.exec(sess, args)) != nil {
+			return
+		}
+	}
+}
+
+func (srv *Server) exec(sess *session, args []string) reply {
+	if len(args) == 0 {
+		return replyError("ERR empty command")
+	}
+	cmd := strings.ToUpper(args[0])
+	if cmd == "AUTH" {
+		if len(args) != 2 || args[1] != srv.password {
+			return replyError("WRONGPASS invalid password")
+		}
+		sess.authenticated = true
+		return replySimple("OK")
+	}
+	if !sess.authenticated {
+		return replyError("NOAUTH Authentication required.")
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	switch cmd {
+	case "WATCH":
+		if sess.multi {
+			return replyError("ERR WATCH inside MULTI is not allowed")
+		}
+		if sess.watched == nil {
+			sess.watched = map[string]uint64{}
+		}
+		for _, key := range args[1:] {
+			// lazily expire the key so that its expiration does not abort the transaction later
+			srv.lookup(sess.db, key)
+			sess.watched[revisionKey(sess.db, key)] = srv.revisions[revisionKey(sess.db, key)]
+		}
+		return replySimple("OK")
+	case "UNWATCH":
+		sess.watched = nil
+		return replySimple("OK")
+	case "MULTI":
+		if sess.multi {
+			return replyError("ERR MULTI calls can not be nested")
+		}
+		sess.multi = true
+		return replySimple("OK")
+	case "DISCARD":
+		if !sess.multi {
+			return replyError("ERR DISCARD without MULTI")
+		}
+		sess.multi, sess.queued, sess.watched = false, nil, nil
+		return replySimple("OK")
+	case "EXEC":
+		if !sess.multi {
+			return replyError("ERR EXEC without MULTI")
+		}
+		return srv.execTransaction(sess)
+	}
+	if sess.multi {
+		sess.queued = append(sess.queued, args)
+		return replySimple("QUEUED")
+	}
+	return srv.command(sess, args)
+}
+
+// execTransaction runs the queued commands, unless a watched key was modified since WATCH.
+// The server lock must be held.
+func (srv *Server) execTransaction(sess *session) reply {
+	queued, watched := sess.queued, sess.watched
+	sess.multi, sess.queued, sess.watched = false, nil, nil
+	for key, revision := range watched {
+		if srv.revisions[key] != revision {
+			return replyNullArray()
+		}
+	}
+	replies := make([]reply, len(queued))
+	for i, args := range queued {
+		replies[i] = srv.command(sess, args)
+	}
+	return replyArray(replies...)
+}
+
+// command runs a regular command, the server lock must be held
+func (srv *Server) command(sess *session, args []string) reply {
+	cmd := strings.ToUpper(args[0])
+	switch cmd {
+	case "PING":
+		return replySimple("PONG")
+	case "SELECT":
+		db, err := strconv.Atoi(args[1])
+		if err != nil {
+			return replyError("ERR invalid DB index")
+		}
+		sess.db = db
+		return replySimple("OK")
+	case "GET":
+		e := srv.lookup(sess.db, args[1])
+		if e == nil {
+			return replyBulk(nil)
+		}
+		return replyBulk(e.value)
+	case "SET":
+		e := &entry{value: []byte(args[2])}
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "PX", "EX":
+				n, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil || n <= 0 {
+					return replyError("ERR invalid expire time in 'set' command")
+				}
+				unit := time.Millisecond
+				if strings.ToUpper(args[i]) == "EX" {
+					unit = time.Second
+				}
+				e.expiresAt = time.Now().Add(time.Duration(n) * unit)
+				i++
+			default:
+				return replyError("ERR syntax error")
+			}
+		}
+		srv.db(sess.db)[args[1]] = e
+		srv.notify(sess.db, args[1], "set", '$')
+		if !e.expiresAt.IsZero() {
+			srv.notify(sess.db, args[1], "expire", 'g')
+		}
+		return replySimple("OK")
+	case "DEL", "EXISTS":
+		var n int64
+		for _, key := range args[1:] {
+			if srv.lookup(sess.db, key) != nil {
+				n++
+				if cmd == "DEL" {
+					delete(srv.db(sess.db), key)
+					srv.notify(sess.db, key, "del", 'g')
+				}
+			}
+		}
+		return replyInt(n)
+	case "PTTL":
+		e := srv.lookup(sess.db, args[1])
+		if e == nil {
+			return replyInt(-2)
+		}
+		if e.expiresAt.IsZero() {
+			return replyInt(-1)
+		}
+		return replyInt(time.Until(e.expiresAt).Milliseconds())
+	case "PEXPIRE":
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return replyError("ERR value is not an integer or out of range")
+		}
+		e := srv.lookup(sess.db, args[1])
+		if e == nil {
+			return replyInt(0)
+		}
+		e.expiresAt = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		srv.notify(sess.db, args[1], "expire", 'g')
+		return replyInt(1)
+	case "PERSIST":
+		e := srv.lookup(sess.db, args[1])
+		if e == nil || e.expiresAt.IsZero() {
+			return replyInt(0)
+		}
+		e.expiresAt = time.Time{}
+		srv.notify(sess.db, args[1], "persist", 'g')
+		return replyInt(1)
+	case "SCAN":
+		return srv.scan(sess, args[1:])
+	case "SUBSCRIBE":
+		var replies []reply
+		for _, channel := range args[1:] {
+			sess.channels[channel] = true
+			if srv.subscribers[channel] == nil {
+				srv.subscribers[channel] = map[*session]bool{}
+			}
+			srv.subscribers[channel][sess] = true
+			replies = append(replies, replyArray(
+				replyBulk([]byte("subscribe")), replyBulk([]byte(channel)), replyInt(sess.subscriptions())))
+		}
+		return replySequence(replies...)
+	case "PSUBSCRIBE":
+		var replies []reply
+		for _, pattern := range args[1:] {
+			sess.patterns[pattern] = true
+			if srv.psubscribers[pattern] == nil {
+				srv.psubscribers[pattern] = map[*session]bool{}
+			}
+			srv.psubscribers[pattern][sess] = true
+			replies = append(replies, replyArray(
+				replyBulk([]byte("psubscribe")), replyBulk([]byte(pattern)), replyInt(sess.subscriptions())))
+		}
+		return replySequence(replies...)
+	case "UNSUBSCRIBE":
+		return srv.unsubscribe(sess, args[1:])
+	case "PUNSUBSCRIBE":
+		return srv.punsubscribe(sess, args[1:])
+	case "PUBLISH":
+		return replyInt(srv.publish(args[1], args[2]))
+	case "CONFIG":
+		return srv.config(args[1:])
+	}
+	return replyError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+}
+
+// subscriptions returns the number of channels and patterns the session is subscribed to
+func (sess *session) subscriptions() int64 {
+	return int64(len(sess.channels) + len(sess.patterns))
+}
+
+// publish sends a message to the subscribers of channel and of the patterns matching it,
+// returns the number of receivers. The server lock must be held.
+func (srv *Server) publish(channel, payload string) int64 {
+	var n int64
+	message := replyArray(replyBulk([]byte("message")), replyBulk([]byte(channel)), replyBulk([]byte(payload)))
+	for subscriber := range srv.subscribers[channel] {
+		if subscriber.write(message) == nil {
+			n++
+		}
+	}
+	for pattern, subscribers := range srv.psubscribers {
+		if !matchPattern(pattern, channel) {
+			continue
+		}
+		message := replyArray(replyBulk([]byte("pmessage")), replyBulk([]byte(pattern)),
+			replyBulk([]byte(channel)), replyBulk([]byte(payload)))
+		for subscriber := range subscribers {
+			if subscriber.write(message) == nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// notify records a modification of key, aborting the transactions watching it, and publishes a
+// keyspace notification if enabled for the event class, A enabling every class.
+// The server lock must be held.
+func (srv *Server) notify(db int, key, event string, class byte) {
+	srv.revisions[revisionKey(db, key)]++
+
+	enabled := strings.IndexByte(srv.notifyFlags, class) >= 0 || strings.Contains(srv.notifyFlags, "A")
+	if !strings.Contains(srv.notifyFlags, "K") || !enabled {
+		return
+	}
+	srv.publish(fmt.Sprintf("__keyspace@%d__:%s", db, key), event)
+}
+
+// config supports reading and writing the notify-keyspace-events parameter
+func (srv *Server) config(args []string) reply {
+	if len(args) < 2 || !strings.EqualFold(args[1], "notify-keyspace-events") {
+		return replyError("ERR unsupported CONFIG parameter")
+	}
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		return replyArray(replyBulk([]byte("notify-keyspace-events")), replyBulk([]byte(srv.notifyFlags)))
+	case "SET":
+		if len(args) != 3 {
+			return replyError("ERR wrong number of arguments for 'config|set' command")
+		}
+		srv.notifyFlags = args[2]
+		return replySimple("OK")
+	}
+	return replyError("ERR unknown CONFIG subcommand")
+}
+
+// unsubscribe removes the session from the given channels, or from every channel if none is given.
+// The server lock must be held.
+func (srv *Server) unsubscribe(sess *session, channels []string) reply {
+	if len(channels) == 0 {
+		for channel := range sess.channels {
+			channels = append(channels, channel)
+		}
+		sort.Strings(channels)
+	}
+	var replies []reply
+	for _, channel := range channels {
+		delete(sess.channels, channel)
+		delete(srv.subscribers[channel], sess)
+		replies = append(replies, replyArray(
+			replyBulk([]byte("unsubscribe")), replyBulk([]byte(channel)), replyInt(sess.subscriptions())))
+	}
+	return replySequence(replies...)
+}
+
+// punsubscribe removes the session from the given patterns, or from every pattern if none is given.
+// The server lock must be held.
+func (srv *Server) punsubscribe(sess *session, patterns []string) reply {
+	if len(patterns) == 0 {
+		for pattern := range sess.patterns {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+	}
+	var replies []reply
+	for _, pattern := range patterns {
+		delete(sess.patterns, pattern)
+		delete(srv.psubscribers[pattern], sess)
+		replies = append(replies, replyArray(
+			replyBulk([]byte("punsubscribe")), replyBulk([]byte(pattern)), replyInt(sess.subscriptions())))
+	}
+	return replySequence(replies...)
+}
+
+// scan iterates over the keys in lexicographical order, the cursor being the index of the
+// next key to return
+func (srv *Server) scan(sess *session, args []string) reply {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil {
+		return replyError("ERR invalid cursor")
+	}
+	pattern, count := "*", 10
+	for i := 1; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil {
+				return replyError("ERR value is not an integer or out of range")
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(srv.db(sess.db)))
+	for key := range srv.db(sess.db) {
+		if srv.lookup(sess.db, key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var matches []reply
+	for ; cursor < len(keys) && count > 0; cursor, count = cursor+1, count-1 {
+		if matchPattern(pattern, keys[cursor]) {
+			matches = append(matches, replyBulk([]byte(keys[cursor])))
+		}
+	}
+	if cursor >= len(keys) {
+		cursor = 0
+	}
+	return replyArray(replyBulk([]byte(strconv.Itoa(cursor))), replyArray(matches...))
+}
+
+// matchPattern reports whether s matches the redis glob pattern, supporting *, ? and \ escapes
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+func (srv *Server) db(index int) map[string]*entry {
+	db, ok := srv.dbs[index]
+	if !ok {
+		db = map[string]*entry{}
+		srv.dbs[index] = db
+	}
+	return db
+}
+
+// lookup returns the entry stored under key, lazily evicting it if expired
+func (srv *Server) lookup(index int, key string) *entry {
+	db := srv.db(index)
+	e, ok := db[key]
+	if !ok {
+		return nil
+	}
+	if !e.expiresAt.IsZero() && !time.Now().Before(e.expiresAt) {
+		delete(db, key)
+		srv.notify(index, key, "expired", 'x')
+		return nil
+	}
+	return e
+}
+
+func revisionKey(db int, key string) string {
+	return strconv.Itoa(db) + ":" + key
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected command line %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(reader, buf)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func replySimple(s string) reply {
+	return func(w *bufio.Writer) {
+		fmt.Fprintf(w, "+%s\r\n", s)
+	}
+}
+
+func replyError(s string) reply {
+	return func(w *bufio.Writer) {
+		fmt.Fprintf(w, "-%s\r\n", s)
+	}
+}
+
+func replyInt(n int64) reply {
+	return func(w *bufio.Writer) {
+		fmt.Fprintf(w, ":%d\r\n", n)
+	}
+}
+
+func replyBulk(b []byte) reply {
+	return func(w *bufio.Writer) {
+		if b == nil {
+			fmt.Fprint(w, "$-1\r\n")
+			return
+		}
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(b), b)
+	}
+}
+
+// replySequence sends several replies in a row, as (UN)SUBSCRIBE does for every channel
+func replySequence(replies ...reply) reply {
+	return func(w *bufio.Writer) {
+		for _, r := range replies {
+			r(w)
+		}
+	}
+}
+
+func replyNullArray() reply {
+	return func(w *bufio.Writer) {
+		fmt.Fprint(w, "*-1\r\n")
+	}
+}
+
+func replyArray(elems ...reply) reply {
+	return func(w *bufio.Writer) {
+		fmt.Fprintf(w, "*%d\r\n", len(elems))
+		for _, elem := range elems {
+			elem(w)
+		}
+	}
+}
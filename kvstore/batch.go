@@ -0,0 +1,97 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"reflect"
+	"time"
+)
+
+// BatchReader is implemented by stores able to read many items in a single round trip.
+type BatchReader interface {
+	// ReadManyInto decodes the items stored under keys into the map pointed to by dst, which must
+	// be a *map[string]T, missing items are absent from the map.
+	// Returns a *DecodeError if an item cannot be decoded into T.
+	ReadManyInto(ctx context.Context, keys []string, dst any) error
+}
+
+// BatchWriter is implemented by stores able to write many items in a single round trip.
+type BatchWriter interface {
+	// WriteMany sets several items with the same expiry, expiry follows the same rules as in Write.
+	WriteMany(ctx context.Context, items map[string]any, expiry time.Duration) error
+}
+
+// ReadMany returns the items stored under keys, missing items are absent from the result.
+// Serializing stores decode the items into untyped values, use ReadManyInto to decode typed values.
+func ReadMany(ctx context.Context, reader Reader, keys []string) (map[string]any, error) {
+	items := map[string]any{}
+	err := ReadManyInto(ctx, reader, keys, &items)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// ReadManyInto reads the items stored under keys into the map pointed to by dst, a *map[string]T,
+// in a single round trip if the store supports it or one key after the other otherwise
+func ReadManyInto(ctx context.Context, reader Reader, keys []string, dst any) error {
+	items, err := batchDestination(dst)
+	if err != nil {
+		return err
+	}
+	if batchReader, ok := reader.(BatchReader); ok {
+		return batchReader.ReadManyInto(ctx, keys, dst)
+	}
+
+	for _, key := range keys {
+		key := key
+		err = decodeBatchItem(items, key, func(dst any) error {
+			return ReadInto(ctx, reader, key, dst)
+		})
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteMany sets several items with the same expiry, in a single round trip if the store supports
+// it or one key after the other otherwise
+func WriteMany(ctx context.Context, writer Writer, items map[string]any, expiry time.Duration) error {
+	if batchWriter, ok := writer.(BatchWriter); ok {
+		return batchWriter.WriteMany(ctx, items, expiry)
+	}
+	for key, value := range items {
+		err := writer.Write(ctx, key, value, expiry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchDestination checks dst is a *map[string]T and returns the map, allocated if nil
+func batchDestination(dst any) (reflect.Value, error) {
+	dstValue := reflect.ValueOf(dst)
+	if dstValue.Kind() != reflect.Pointer || dstValue.IsNil() ||
+		dstValue.Elem().Kind() != reflect.Map || dstValue.Elem().Type().Key().Kind() != reflect.String {
+		return reflect.Value{}, errors.Errorf("Destination must be a non-nil pointer to a map[string]T, got %T", dst)
+	}
+	items := dstValue.Elem()
+	if items.IsNil() {
+		items.Set(reflect.MakeMap(items.Type()))
+	}
+	return items, nil
+}
+
+// decodeBatchItem decodes an item with decode into a new value of the map element type and adds it
+// to items
+func decodeBatchItem(items reflect.Value, key string, decode func(dst any) error) error {
+	item := reflect.New(items.Type().Elem())
+	err := decode(item.Interface())
+	if err != nil {
+		return err
+	}
+	items.SetMapIndex(reflect.ValueOf(key).Convert(items.Type().Key()), item.Elem())
+	return nil
+}
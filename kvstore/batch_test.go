@@ -0,0 +1,171 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"github.com/MarouaneMan/github-api/internal/testutil/redistest"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type batchItemMock struct {
+	Name  string `json:"name"`
+	Stars int    `json:"stars"`
+}
+
+// testBatch runs the behavioral test suite of batch operations, the store must be empty
+func testBatch(t *testing.T, store ReadWriter) {
+	ctx := context.Background()
+
+	err := WriteMany(ctx, store, map[string]any{
+		"batch:foo": batchItemMock{Name: "foo", Stars: 1},
+		"batch:bar": batchItemMock{Name: "bar", Stars: 2},
+	}, NoExpiration)
+	assert.NoError(t, err, "should not error on write many")
+
+	var typed map[string]batchItemMock
+	err = ReadManyInto(ctx, store, []string{"batch:foo", "batch:missing", "batch:bar"}, &typed)
+	assert.NoError(t, err, "should not error on read many")
+	assert.Equal(t, map[string]batchItemMock{
+		"batch:foo": {Name: "foo", Stars: 1},
+		"batch:bar": {Name: "bar", Stars: 2},
+	}, typed, "missing items should be absent")
+
+	untyped, err := ReadMany(ctx, store, []string{"batch:foo", "batch:bar"})
+	assert.NoError(t, err)
+	assert.Len(t, untyped, 2)
+
+	items, err := ReadMany(ctx, store, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, items, "reading no keys should return an empty map")
+
+	err = WriteMany(ctx, store, map[string]any{"batch:expiring": "value"}, 50*time.Millisecond)
+	assert.NoError(t, err)
+	time.Sleep(60 * time.Millisecond)
+	items, _ = ReadMany(ctx, store, []string{"batch:expiring"})
+	assert.Empty(t, items, "items should expire")
+
+	var invalid []batchItemMock
+	assert.Error(t, ReadManyInto(ctx, store, []string{"batch:foo"}, &invalid), "should only read into maps")
+	var mismatch map[string]int
+	err = ReadManyInto(ctx, store, []string{"batch:foo"}, &mismatch)
+	var decodeErr *DecodeError
+	assert.ErrorAs(t, err, &decodeErr, "should return a DecodeError for items not fitting the map")
+}
+
+func TestBatchStores(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testBatch(t, NewInMemoryStore(NoExpiration, time.Minute))
+	})
+	t.Run("redis", func(t *testing.T) {
+		testBatch(t, newTestRedisStore(t, redistest.New(t, ""), RedisOptions{}))
+	})
+	t.Run("disk", func(t *testing.T) {
+		testBatch(t, newTestDiskStore(t, DiskOptions{Path: filepath.Join(t.TempDir(), "store.log")}))
+	})
+	t.Run("routing", func(t *testing.T) {
+		primary := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})
+		testBatch(t, newTestRoutingStore(t, primary, []Reader{primary}, RoutingOptions{}))
+	})
+	t.Run("tiered", func(t *testing.T) {
+		l2 := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})
+		testBatch(t, newTestTieredStore(t, l2, TieredOptions{PubSub: l2}))
+	})
+	t.Run("transformed", func(t *testing.T) {
+		inner := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{Codec: RawCodec})
+		encrypted, err := NewEncryptedStore(inner, EncryptionOptions{Codec: RawCodec, Keys: []EncryptionKey{testEncryptionKey("a")}})
+		assert.NoError(t, err)
+		testBatch(t, newTestCompressedStore(t, encrypted, CompressionOptions{Threshold: 1}))
+	})
+	t.Run("instrumented", func(t *testing.T) {
+		testBatch(t, NewInstrumentedStore(NewInMemoryStore(NoExpiration, time.Minute), newTestMetrics(), InstrumentedOptions{}))
+	})
+	t.Run("sharded", func(t *testing.T) {
+		shards := []Shard{}
+		for _, name := range []string{"a", "b", "c"} {
+			shards = append(shards, Shard{Name: name, Store: newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})})
+		}
+		testBatch(t, newTestShardedStore(t, shards, ShardedOptions{}))
+	})
+}
+
+func TestRedisStoreBatchPipelineSize(t *testing.T) {
+	ctx := context.Background()
+	store := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})
+	items := map[string]any{}
+	keys := []string{}
+	for i := 0; i < redisPipelineSize*2+10; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		items[key] = i
+		keys = append(keys, key)
+	}
+	assert.NoError(t, store.WriteMany(ctx, items, NoExpiration))
+
+	var read map[string]int
+	assert.NoError(t, store.ReadManyInto(ctx, keys, &read))
+	assert.Len(t, read, len(items), "batches larger than a pipeline should be split")
+	assert.Equal(t, 42, read["key:42"])
+}
+
+func TestTieredStoreWriteManyInvalidation(t *testing.T) {
+	ctx := context.Background()
+	l2 := NewInMemoryStore(NoExpiration, time.Minute)
+	pubsub := NewLocalPubSub()
+	first := newTestTieredStore(t, l2, TieredOptions{PubSub: pubsub})
+	second := newTestTieredStore(t, l2, TieredOptions{PubSub: pubsub})
+
+	_ = second.WriteMany(ctx, map[string]any{"a": 1, "b": 1}, NoExpiration)
+	_ = first.WriteMany(ctx, map[string]any{"a": 2, "b": 2}, NoExpiration)
+	items, _ := ReadMany(ctx, second, []string{"a", "b"})
+	assert.Equal(t, map[string]any{"a": 2, "b": 2}, items, "every written key should be invalidated")
+}
+
+// benchmarkBatch compares reading and writing batchSize keys one after the other with batch operations
+func benchmarkBatch(b *testing.B, store ReadWriter) {
+	const batchSize = 100
+	ctx := context.Background()
+	items := map[string]any{}
+	keys := []string{}
+	for i := 0; i < batchSize; i++ {
+		key := fmt.Sprintf("repositories:gopher/repo-%d", i)
+		items[key] = batchItemMock{Name: key, Stars: i}
+		keys = append(keys, key)
+	}
+
+	b.Run("WriteSequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for key, value := range items {
+				_ = store.Write(ctx, key, value, NoExpiration)
+			}
+		}
+	})
+	b.Run("WriteMany", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = WriteMany(ctx, store, items, NoExpiration)
+		}
+	})
+	b.Run("ReadSequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				var item batchItemMock
+				_ = ReadInto(ctx, store, key, &item)
+			}
+		}
+	})
+	b.Run("ReadMany", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var read map[string]batchItemMock
+			_ = ReadManyInto(ctx, store, keys, &read)
+		}
+	})
+}
+
+func BenchmarkInMemoryStoreBatch(b *testing.B) {
+	benchmarkBatch(b, NewInMemoryStore(NoExpiration, time.Minute))
+}
+
+func BenchmarkRedisStoreBatch(b *testing.B) {
+	benchmarkBatch(b, newTestRedisStore(b, redistest.New(b, ""), RedisOptions{}))
+}
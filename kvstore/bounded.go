@@ -0,0 +1,422 @@
+package kvstore
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy selects the item a bounded store evicts when it is full.
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the least recently used item.
+	EvictLRU EvictionPolicy = "lru"
+
+	// EvictLFU evicts the least frequently used item, ties are broken by recency.
+	EvictLFU EvictionPolicy = "lfu"
+)
+
+// ErrValueTooLarge is returned when writing an item that exceeds the store capacity on its own.
+var ErrValueTooLarge = errors.New("Value exceeds the store capacity")
+
+// BoundedOptions configures a bounded in-memory store.
+type BoundedOptions struct {
+	// MaxEntries is the maximum number of items, 0 means unlimited
+	MaxEntries int
+
+	// MaxBytes is the maximum estimated size of the items, 0 means unlimited
+	MaxBytes int64
+
+	// Policy selects the evicted item when the store is full, defaults to EvictLRU
+	Policy EvictionPolicy
+
+	// DefaultExpiration applies to items written with DefaultExpiration
+	DefaultExpiration time.Duration
+
+	// CleanupInterval is the interval at which expired items are purged, 0 disables the purge
+	// and expired items are only removed when accessed or evicted
+	CleanupInterval time.Duration
+
+	// Sizer estimates the size in bytes of an item, defaults to a reflection based estimation
+	Sizer func(key string, value any) int64
+}
+
+// BoundedStats holds the counters of a bounded store.
+type BoundedStats struct {
+	Entries     int
+	Bytes       int64
+	Evictions   uint64
+	Expirations uint64
+}
+
+type boundedEntry struct {
+	key       string
+	value     any
+	size      int64
+	expiresAt time.Time
+
+	// eviction bookkeeping
+	element   *list.Element
+	frequency uint64
+	lastUsed  uint64
+	index     int
+}
+
+func (be *boundedEntry) expired(now time.Time) bool {
+	return !be.expiresAt.IsZero() && !now.Before(be.expiresAt)
+}
+
+type boundedStore struct {
+	opts BoundedOptions
+
+	mu      sync.Mutex
+	entries map[string]*boundedEntry
+	queue   evictionQueue
+	bytes   int64
+
+	// clock is a logical clock used to order accesses
+	clock uint64
+
+	evictions   uint64
+	expirations uint64
+
+	stop chan struct{}
+}
+
+// NewBoundedStore returns a new in-memory key value store holding at most opts.MaxEntries items
+// and opts.MaxBytes bytes. When full, items are evicted according to opts.Policy.
+// Call Close to stop the cleanup goroutine.
+func NewBoundedStore(opts BoundedOptions) (*boundedStore, error) {
+	bs := &boundedStore{
+		opts:    opts,
+		entries: map[string]*boundedEntry{},
+		stop:    make(chan struct{}),
+	}
+
+	switch opts.Policy {
+	case EvictLRU, "":
+		bs.queue = &lruQueue{list: list.New()}
+	case EvictLFU:
+		bs.queue = &lfuQueue{}
+	default:
+		return nil, errors.Errorf("Unknown eviction policy %q", opts.Policy)
+	}
+
+	if bs.opts.Sizer == nil {
+		bs.opts.Sizer = func(key string, value any) int64 {
+			return int64(len(key)) + estimateSize(value)
+		}
+	}
+
+	if opts.CleanupInterval > 0 {
+		go bs.janitor(opts.CleanupInterval)
+	}
+	return bs, nil
+}
+
+// Write an item to the store, overriding the existing one and evicting items if the store is full
+func (bs *boundedStore) Write(_ context.Context, key string, value any, expiry time.Duration) error {
+	size := bs.opts.Sizer(key, value)
+	if bs.opts.MaxBytes > 0 && size > bs.opts.MaxBytes {
+		return errors.Wrapf(ErrValueTooLarge, "Failed to write key %q of %d bytes", key, size)
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if old, ok := bs.entries[key]; ok {
+		bs.remove(old)
+	}
+
+	entry := &boundedEntry{
+		key:       key,
+		value:     value,
+		size:      size,
+		expiresAt: bs.expiresAt(expiry),
+	}
+	bs.clock++
+	entry.frequency = 1
+	entry.lastUsed = bs.clock
+	bs.entries[key] = entry
+	bs.bytes += size
+	bs.queue.push(entry)
+
+	// evict until the store fits its bounds, never evicting the item being written
+	now := time.Now()
+	for bs.full() {
+		victim := bs.queue.victim(entry)
+		if victim == nil {
+			break
+		}
+		bs.remove(victim)
+		if victim.expired(now) {
+			bs.expirations++
+		} else {
+			bs.evictions++
+		}
+	}
+	return nil
+}
+
+// Read an item from the store, returns the item or ErrNotFound if not found
+func (bs *boundedStore) Read(_ context.Context, key string) (any, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	entry := bs.lookup(key)
+	if entry == nil {
+		return nil, ErrNotFound
+	}
+	bs.clock++
+	entry.frequency++
+	entry.lastUsed = bs.clock
+	bs.queue.touch(entry)
+	return entry.value, nil
+}
+
+// Exists reports whether an item is stored under key, it does not count as an access
+func (bs *boundedStore) Exists(_ context.Context, key string) (bool, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.lookup(key) != nil, nil
+}
+
+// TTL returns the remaining time to live of an item, or NoExpiration if it never expires
+func (bs *boundedStore) TTL(_ context.Context, key string) (time.Duration, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	entry := bs.lookup(key)
+	if entry == nil {
+		return 0, ErrNotFound
+	}
+	if entry.expiresAt.IsZero() {
+		return NoExpiration, nil
+	}
+	return time.Until(entry.expiresAt), nil
+}
+
+// Scan returns the keys starting with prefix
+func (bs *boundedStore) Scan(_ context.Context, prefix string) ([]string, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	now := time.Now()
+	keys := []string{}
+	for key, entry := range bs.entries {
+		if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Delete removes an item from the store
+func (bs *boundedStore) Delete(_ context.Context, key string) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if entry, ok := bs.entries[key]; ok {
+		bs.remove(entry)
+	}
+	return nil
+}
+
+// Touch resets the expiry of an item
+func (bs *boundedStore) Touch(_ context.Context, key string, expiry time.Duration) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	entry := bs.lookup(key)
+	if entry == nil {
+		return ErrNotFound
+	}
+	entry.expiresAt = bs.expiresAt(expiry)
+	return nil
+}
+
+// Stats returns the store counters
+func (bs *boundedStore) Stats() BoundedStats {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return BoundedStats{
+		Entries:     len(bs.entries),
+		Bytes:       bs.bytes,
+		Evictions:   bs.evictions,
+		Expirations: bs.expirations,
+	}
+}
+
+// Close stops the cleanup goroutine
+func (bs *boundedStore) Close() error {
+	select {
+	case <-bs.stop:
+	default:
+		close(bs.stop)
+	}
+	return nil
+}
+
+// lookup returns the live entry stored under key, expired entries are removed on the fly.
+// The store lock must be held.
+func (bs *boundedStore) lookup(key string) *boundedEntry {
+	entry, ok := bs.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.expired(time.Now()) {
+		bs.remove(entry)
+		bs.expirations++
+		return nil
+	}
+	return entry
+}
+
+// remove deletes an entry and releases its size, the store lock must be held
+func (bs *boundedStore) remove(entry *boundedEntry) {
+	delete(bs.entries, entry.key)
+	bs.queue.remove(entry)
+	bs.bytes -= entry.size
+}
+
+func (bs *boundedStore) full() bool {
+	return (bs.opts.MaxEntries > 0 && len(bs.entries) > bs.opts.MaxEntries) ||
+		(bs.opts.MaxBytes > 0 && bs.bytes > bs.opts.MaxBytes)
+}
+
+// expiresAt resolves an expiry into an expiration date, the zero time meaning no expiration
+func (bs *boundedStore) expiresAt(expiry time.Duration) time.Time {
+	if expiry == DefaultExpiration {
+		expiry = bs.opts.DefaultExpiration
+	}
+	if expiry <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(expiry)
+}
+
+// janitor periodically purges expired entries until the store is closed
+func (bs *boundedStore) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bs.stop:
+			return
+		case <-ticker.C:
+			bs.mu.Lock()
+			now := time.Now()
+			for _, entry := range bs.entries {
+				if entry.expired(now) {
+					bs.remove(entry)
+					bs.expirations++
+				}
+			}
+			bs.mu.Unlock()
+		}
+	}
+}
+
+// evictionQueue orders entries by eviction priority
+type evictionQueue interface {
+	push(entry *boundedEntry)
+	touch(entry *boundedEntry)
+	remove(entry *boundedEntry)
+
+	// victim returns the next entry to evict other than exclude, or nil if there is none
+	victim(exclude *boundedEntry) *boundedEntry
+}
+
+// lruQueue keeps entries from the most to the least recently used
+type lruQueue struct {
+	list *list.List
+}
+
+func (q *lruQueue) push(entry *boundedEntry) {
+	entry.element = q.list.PushFront(entry)
+}
+
+func (q *lruQueue) touch(entry *boundedEntry) {
+	q.list.MoveToFront(entry.element)
+}
+
+func (q *lruQueue) remove(entry *boundedEntry) {
+	q.list.Remove(entry.element)
+}
+
+func (q *lruQueue) victim(exclude *boundedEntry) *boundedEntry {
+	for element := q.list.Back(); element != nil; element = element.Prev() {
+		if entry := element.Value.(*boundedEntry); entry != exclude {
+			return entry
+		}
+	}
+	return nil
+}
+
+// lfuQueue is a min-heap of entries ordered by access frequency, then by last access
+type lfuQueue []*boundedEntry
+
+func (q lfuQueue) Len() int {
+	return len(q)
+}
+
+func (q lfuQueue) Less(i, j int) bool {
+	if q[i].frequency != q[j].frequency {
+		return q[i].frequency < q[j].frequency
+	}
+	return q[i].lastUsed < q[j].lastUsed
+}
+
+func (q lfuQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *lfuQueue) Push(x any) {
+	entry := x.(*boundedEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *lfuQueue) Pop() any {
+	old := *q
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return entry
+}
+
+func (q *lfuQueue) push(entry *boundedEntry) {
+	heap.Push(q, entry)
+}
+
+func (q *lfuQueue) touch(entry *boundedEntry) {
+	heap.Fix(q, entry.index)
+}
+
+func (q *lfuQueue) remove(entry *boundedEntry) {
+	heap.Remove(q, entry.index)
+}
+
+func (q *lfuQueue) victim(exclude *boundedEntry) *boundedEntry {
+	h := *q
+	if len(h) == 0 {
+		return nil
+	}
+	if h[0] != exclude {
+		return h[0]
+	}
+	// the next smallest entry is one of the root's children
+	switch {
+	case len(h) == 1:
+		return nil
+	case len(h) == 2 || h.Less(1, 2):
+		return h[1]
+	}
+	return h[2]
+}
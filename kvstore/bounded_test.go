@@ -0,0 +1,127 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestBoundedStore(t *testing.T, opts BoundedOptions) *boundedStore {
+	store, err := NewBoundedStore(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	return store
+}
+
+func TestBoundedStore(t *testing.T) {
+	for _, policy := range []EvictionPolicy{EvictLRU, EvictLFU} {
+		t.Run(string(policy), func(t *testing.T) {
+			testStore(t, newTestBoundedStore(t, BoundedOptions{
+				MaxEntries:        100,
+				Policy:            policy,
+				DefaultExpiration: 50 * time.Millisecond,
+				CleanupInterval:   10 * time.Millisecond,
+			}))
+		})
+	}
+}
+
+func TestBoundedStoreLRU(t *testing.T) {
+	ctx := context.Background()
+	store := newTestBoundedStore(t, BoundedOptions{MaxEntries: 2, Policy: EvictLRU})
+
+	_ = store.Write(ctx, "a", 1, NoExpiration)
+	_ = store.Write(ctx, "b", 2, NoExpiration)
+	_, _ = store.Read(ctx, "a") // b becomes the least recently used
+	_ = store.Write(ctx, "c", 3, NoExpiration)
+
+	keys, _ := store.Scan(ctx, "")
+	assert.ElementsMatch(t, []string{"a", "c"}, keys, "least recently used item should be evicted")
+	assert.Equal(t, uint64(1), store.Stats().Evictions)
+}
+
+func TestBoundedStoreLFU(t *testing.T) {
+	ctx := context.Background()
+	store := newTestBoundedStore(t, BoundedOptions{MaxEntries: 2, Policy: EvictLFU})
+
+	_ = store.Write(ctx, "a", 1, NoExpiration)
+	_ = store.Write(ctx, "b", 2, NoExpiration)
+	_, _ = store.Read(ctx, "a")
+	_, _ = store.Read(ctx, "a")
+	_, _ = store.Read(ctx, "b")
+	_ = store.Write(ctx, "c", 3, NoExpiration) // b is the least frequently used, c is never evicted on write
+	_ = store.Write(ctx, "d", 4, NoExpiration) // c is the least frequently used
+
+	keys, _ := store.Scan(ctx, "")
+	assert.ElementsMatch(t, []string{"a", "d"}, keys, "least frequently used items should be evicted")
+	assert.Equal(t, uint64(2), store.Stats().Evictions)
+}
+
+func TestBoundedStoreMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	store := newTestBoundedStore(t, BoundedOptions{
+		MaxBytes: 10,
+		Sizer: func(_ string, value any) int64 {
+			return int64(len(value.(string)))
+		},
+	})
+
+	assert.NoError(t, store.Write(ctx, "a", "1234", NoExpiration))
+	assert.NoError(t, store.Write(ctx, "b", "1234", NoExpiration))
+	assert.Equal(t, int64(8), store.Stats().Bytes)
+
+	assert.NoError(t, store.Write(ctx, "c", "123456", NoExpiration))
+	stats := store.Stats()
+	assert.Equal(t, BoundedStats{Entries: 2, Bytes: 10, Evictions: 1}, stats)
+	exists, _ := store.Exists(ctx, "a")
+	assert.False(t, exists, "oldest item should be evicted to make room")
+
+	assert.NoError(t, store.Write(ctx, "c", "1", NoExpiration), "overwriting should release the former size")
+	assert.Equal(t, int64(5), store.Stats().Bytes)
+
+	assert.ErrorIs(t, store.Write(ctx, "d", "12345678901", NoExpiration), ErrValueTooLarge)
+	assert.NoError(t, store.Delete(ctx, "b"))
+	assert.Equal(t, BoundedStats{Entries: 1, Bytes: 1, Evictions: 1}, store.Stats())
+}
+
+func TestBoundedStoreExpirations(t *testing.T) {
+	ctx := context.Background()
+	store := newTestBoundedStore(t, BoundedOptions{
+		MaxEntries:      10,
+		CleanupInterval: 5 * time.Millisecond,
+	})
+
+	_ = store.Write(ctx, "a", 1, time.Millisecond)
+	_ = store.Write(ctx, "b", 2, NoExpiration)
+	time.Sleep(20 * time.Millisecond)
+
+	stats := store.Stats()
+	assert.Equal(t, 1, stats.Entries, "expired items should be purged")
+	assert.Equal(t, uint64(1), stats.Expirations)
+	assert.Equal(t, uint64(0), stats.Evictions)
+}
+
+func TestBoundedStoreUnknownPolicy(t *testing.T) {
+	_, err := NewBoundedStore(BoundedOptions{Policy: "fifo"})
+	assert.Error(t, err)
+}
+
+func TestEstimateSize(t *testing.T) {
+	type item struct {
+		Name  string
+		Tags  []string
+		Attrs map[string]int
+	}
+	small := estimateSize(&item{Name: "a"})
+	large := estimateSize(&item{Name: "a", Tags: make([]string, 100), Attrs: map[string]int{"k": 1}})
+	assert.Greater(t, small, int64(0))
+	assert.Greater(t, large, small, "size should grow with the content")
+
+	shared := &item{Name: "shared"}
+	assert.Less(t, estimateSize([]*item{shared, shared}), 2*estimateSize([]*item{shared}), "shared values should be counted once")
+}
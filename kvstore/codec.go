@@ -0,0 +1,94 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/pkg/errors"
+)
+
+// Codec serializes values for stores that do not keep Go values in memory.
+type Codec interface {
+	// Marshal encodes value into bytes
+	Marshal(value any) ([]byte, error)
+
+	// Unmarshal decodes data into the value pointed to by dst
+	Unmarshal(data []byte, dst any) error
+}
+
+var (
+	// JSONCodec encodes values as JSON, it is human-readable and can decode into untyped values.
+	JSONCodec Codec = jsonCodec{}
+
+	// GobCodec encodes values using encoding/gob, it can only decode into typed values.
+	GobCodec Codec = gobCodec{}
+
+	// BinaryCodec encodes values in a compact MessagePack-like binary format.
+	BinaryCodec Codec = binaryCodec{}
+
+	// RawCodec stores []byte values as is, it lets stores holding values already serialized by a
+	// wrapper (e.g. compressed or encrypted values) skip a second serialization.
+	RawCodec Codec = rawCodec{}
+)
+
+// CodecByName returns the codec registered under the given name: json, gob, binary or raw
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case "json":
+		return JSONCodec, nil
+	case "gob":
+		return GobCodec, nil
+	case "binary":
+		return BinaryCodec, nil
+	case "raw":
+		return RawCodec, nil
+	}
+	return nil, errors.Errorf("Unknown codec %q", name)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(value any) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, dst any) error {
+	return json.Unmarshal(data, dst)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(value any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, dst any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(dst)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Marshal(value any) ([]byte, error) {
+	data, ok := value.([]byte)
+	if !ok {
+		return nil, errors.Errorf("Raw codec cannot encode %T values, only []byte", value)
+	}
+	return data, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, dst any) error {
+	switch d := dst.(type) {
+	case *[]byte:
+		*d = append([]byte(nil), data...)
+	case *any:
+		*d = append([]byte(nil), data...)
+	default:
+		return errors.Errorf("Raw codec cannot decode into %T, only *[]byte", dst)
+	}
+	return nil
+}
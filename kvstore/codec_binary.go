@@ -0,0 +1,744 @@
+package kvstore
+
+import (
+	"encoding"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MessagePack format markers used by binaryCodec
+const (
+	mpNil     = 0xc0
+	mpFalse   = 0xc2
+	mpTrue    = 0xc3
+	mpBin8    = 0xc4
+	mpBin16   = 0xc5
+	mpBin32   = 0xc6
+	mpFloat32 = 0xca
+	mpFloat64 = 0xcb
+	mpUint8   = 0xcc
+	mpUint16  = 0xcd
+	mpUint32  = 0xce
+	mpUint64  = 0xcf
+	mpInt8    = 0xd0
+	mpInt16   = 0xd1
+	mpInt32   = 0xd2
+	mpInt64   = 0xd3
+	mpStr8    = 0xd9
+	mpStr16   = 0xda
+	mpStr32   = 0xdb
+	mpArray16 = 0xdc
+	mpArray32 = 0xdd
+	mpMap16   = 0xde
+	mpMap32   = 0xdf
+)
+
+var (
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// binaryCodec encodes values in a MessagePack-like format.
+// Structs are encoded as maps keyed by field name, honoring the name given in json tags,
+// and types implementing encoding.BinaryMarshaler (e.g. time.Time) are encoded as binary blobs.
+type binaryCodec struct{}
+
+func (binaryCodec) Marshal(value any) ([]byte, error) {
+	enc := &binaryEncoder{}
+	err := enc.encode(reflect.ValueOf(value))
+	if err != nil {
+		return nil, err
+	}
+	return enc.buf, nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, dst any) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return errors.Errorf("binary codec: destination must be a non-nil pointer, got %T", dst)
+	}
+	dec := &binaryDecoder{data: data}
+	err := dec.decode(v.Elem())
+	if err != nil {
+		return err
+	}
+	if dec.pos != len(data) {
+		return errors.Errorf("binary codec: %d trailing bytes", len(data)-dec.pos)
+	}
+	return nil
+}
+
+// binaryField is an exported struct field along with its encoded name
+type binaryField struct {
+	name  string
+	index int
+}
+
+var binaryFieldsCache sync.Map // map[reflect.Type][]binaryField
+
+func binaryFields(t reflect.Type) []binaryField {
+	if fields, ok := binaryFieldsCache.Load(t); ok {
+		return fields.([]binaryField)
+	}
+	fields := make([]binaryField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			tagName, _, _ := strings.Cut(tag, ",")
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+		fields = append(fields, binaryField{name: name, index: i})
+	}
+	binaryFieldsCache.Store(t, fields)
+	return fields
+}
+
+type binaryEncoder struct {
+	buf []byte
+}
+
+func (e *binaryEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, mpNil)
+		return nil
+	}
+
+	if v.Type().Implements(binaryMarshalerType) {
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			e.buf = append(e.buf, mpNil)
+			return nil
+		}
+		data, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return errors.Wrapf(err, "binary codec: failed to marshal %s", v.Type())
+		}
+		e.writeBin(data)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			e.buf = append(e.buf, mpNil)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, mpTrue)
+		} else {
+			e.buf = append(e.buf, mpFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, mpFloat32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = append(e.buf, mpFloat64)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, mpNil)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.writeBin(v.Bytes())
+			return nil
+		}
+		return e.encodeList(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			e.writeBin(data)
+			return nil
+		}
+		return e.encodeList(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, mpNil)
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Struct:
+		fields := binaryFields(v.Type())
+		e.writeHeader(len(fields), 0x80, mpMap16, mpMap32)
+		for _, field := range fields {
+			e.writeString(field.name)
+			err := e.encode(v.Field(field.index))
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.Errorf("binary codec: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (e *binaryEncoder) encodeList(v reflect.Value) error {
+	e.writeHeader(v.Len(), 0x90, mpArray16, mpArray32)
+	for i := 0; i < v.Len(); i++ {
+		err := e.encode(v.Index(i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *binaryEncoder) encodeMap(v reflect.Value) error {
+	keys := v.MapKeys()
+	if v.Type().Key().Kind() == reflect.String {
+		// sort string keys so that equal maps are always encoded the same way
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+	}
+	e.writeHeader(len(keys), 0x80, mpMap16, mpMap32)
+	for _, key := range keys {
+		err := e.encode(key)
+		if err != nil {
+			return err
+		}
+		err = e.encode(v.MapIndex(key))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *binaryEncoder) writeInt(n int64) {
+	switch {
+	case n >= 0:
+		e.writeUint(uint64(n))
+	case n >= -32:
+		e.buf = append(e.buf, byte(n))
+	case n >= math.MinInt8:
+		e.buf = append(e.buf, mpInt8, byte(n))
+	case n >= math.MinInt16:
+		e.buf = append(e.buf, mpInt16)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	case n >= math.MinInt32:
+		e.buf = append(e.buf, mpInt32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	default:
+		e.buf = append(e.buf, mpInt64)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(n))
+	}
+}
+
+func (e *binaryEncoder) writeUint(n uint64) {
+	switch {
+	case n < 0x80:
+		e.buf = append(e.buf, byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, mpUint8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, mpUint16)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = append(e.buf, mpUint32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	default:
+		e.buf = append(e.buf, mpUint64)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, n)
+	}
+}
+
+func (e *binaryEncoder) writeString(s string) {
+	switch n := len(s); {
+	case n < 32:
+		e.buf = append(e.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, mpStr8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, mpStr16)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, mpStr32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *binaryEncoder) writeBin(data []byte) {
+	switch n := len(data); {
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, mpBin8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, mpBin16)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, mpBin32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, data...)
+}
+
+// writeHeader writes an array or map header, using the fix format for small lengths
+func (e *binaryEncoder) writeHeader(n int, fix, marker16, marker32 byte) {
+	switch {
+	case n < 16:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, marker16)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, marker32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+}
+
+type binaryDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *binaryDecoder) decode(v reflect.Value) error {
+	marker, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if marker == mpNil {
+		d.pos++
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	}
+
+	if v.CanAddr() && v.Addr().Type().Implements(binaryUnmarshalerType) {
+		data, err := d.readBin()
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return errors.Errorf("binary codec: cannot decode into non-empty interface %s", v.Type())
+		}
+		generic, err := d.decodeGeneric()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(generic))
+	case reflect.Bool:
+		marker, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		if marker != mpTrue && marker != mpFalse {
+			return errors.Errorf("binary codec: expected bool, got marker 0x%x", marker)
+		}
+		v.SetBool(marker == mpTrue)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := d.readInt()
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(n) {
+			return errors.Errorf("binary codec: %d overflows %s", n, v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := d.readUint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(n) {
+			return errors.Errorf("binary codec: %d overflows %s", n, v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := d.readFloat()
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		s, err := d.readString()
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data, err := d.readBin()
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte{}, data...))
+			return nil
+		}
+		n, err := d.readArrayHeader()
+		if err != nil {
+			return err
+		}
+		slice := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			err = d.decode(slice.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data, err := d.readBin()
+			if err != nil {
+				return err
+			}
+			reflect.Copy(v, reflect.ValueOf(data))
+			return nil
+		}
+		n, err := d.readArrayHeader()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if i < v.Len() {
+				err = d.decode(v.Index(i))
+			} else {
+				err = d.skip()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		n, err := d.readMapHeader()
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), n))
+		}
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			err = d.decode(key)
+			if err != nil {
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			err = d.decode(elem)
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	case reflect.Struct:
+		n, err := d.readMapHeader()
+		if err != nil {
+			return err
+		}
+		fields := binaryFields(v.Type())
+		for i := 0; i < n; i++ {
+			name, err := d.readString()
+			if err != nil {
+				return err
+			}
+			index := -1
+			for _, field := range fields {
+				if field.name == name {
+					index = field.index
+					break
+				}
+			}
+			if index < 0 {
+				err = d.skip() // unknown field
+			} else {
+				err = d.decode(v.Field(index))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.Errorf("binary codec: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// decodeGeneric decodes the next value without type information: integers are returned as
+// int64 (or uint64 if they overflow it), floats as float64, arrays as []any and maps as map[string]any
+func (d *binaryDecoder) decodeGeneric() (any, error) {
+	marker, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case marker == mpNil:
+		d.pos++
+		return nil, nil
+	case marker == mpTrue || marker == mpFalse:
+		d.pos++
+		return marker == mpTrue, nil
+	case marker < 0x80 || marker >= 0xe0 || (marker >= mpInt8 && marker <= mpInt64):
+		return d.readInt()
+	case marker >= mpUint8 && marker <= mpUint64:
+		n, err := d.readUint()
+		if err != nil || n > math.MaxInt64 {
+			return n, err
+		}
+		return int64(n), nil
+	case marker == mpFloat32 || marker == mpFloat64:
+		return d.readFloat()
+	case marker&0xe0 == 0xa0 || (marker >= mpStr8 && marker <= mpStr32):
+		return d.readString()
+	case marker >= mpBin8 && marker <= mpBin32:
+		data, err := d.readBin()
+		return append([]byte{}, data...), err
+	case marker&0xf0 == 0x90 || marker == mpArray16 || marker == mpArray32:
+		n, err := d.readArrayHeader()
+		if err != nil {
+			return nil, err
+		}
+		array := make([]any, n)
+		for i := range array {
+			array[i], err = d.decodeGeneric()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	case marker&0xf0 == 0x80 || marker == mpMap16 || marker == mpMap32:
+		n, err := d.readMapHeader()
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]any, n)
+		for i := 0; i < n; i++ {
+			key, err := d.decodeGeneric()
+			if err != nil {
+				return nil, err
+			}
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, errors.Errorf("binary codec: unsupported map key type %T", key)
+			}
+			m[keyStr], err = d.decodeGeneric()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, errors.Errorf("binary codec: unknown marker 0x%x", marker)
+}
+
+func (d *binaryDecoder) skip() error {
+	_, err := d.decodeGeneric()
+	return err
+}
+
+func (d *binaryDecoder) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errors.New("binary codec: unexpected end of data")
+	}
+	return d.data[d.pos], nil
+}
+
+func (d *binaryDecoder) readByte() (byte, error) {
+	b, err := d.peek()
+	if err != nil {
+		return 0, err
+	}
+	d.pos++
+	return b, nil
+}
+
+func (d *binaryDecoder) readN(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errors.New("binary codec: unexpected end of data")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// readBigEndian reads an unsigned integer of the given size in bytes
+func (d *binaryDecoder) readBigEndian(size int) (uint64, error) {
+	b, err := d.readN(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (d *binaryDecoder) readInt() (int64, error) {
+	marker, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case marker < 0x80:
+		return int64(marker), nil
+	case marker >= 0xe0:
+		return int64(int8(marker)), nil
+	case marker >= mpUint8 && marker <= mpUint64:
+		n, err := d.readBigEndian(1 << (marker - mpUint8))
+		if err == nil && n > math.MaxInt64 {
+			return 0, errors.Errorf("binary codec: %d overflows int64", n)
+		}
+		return int64(n), err
+	case marker == mpInt8:
+		n, err := d.readBigEndian(1)
+		return int64(int8(n)), err
+	case marker == mpInt16:
+		n, err := d.readBigEndian(2)
+		return int64(int16(n)), err
+	case marker == mpInt32:
+		n, err := d.readBigEndian(4)
+		return int64(int32(n)), err
+	case marker == mpInt64:
+		n, err := d.readBigEndian(8)
+		return int64(n), err
+	}
+	return 0, errors.Errorf("binary codec: expected integer, got marker 0x%x", marker)
+}
+
+func (d *binaryDecoder) readUint() (uint64, error) {
+	marker, err := d.peek()
+	if err != nil {
+		return 0, err
+	}
+	if marker >= mpUint8 && marker <= mpUint64 {
+		d.pos++
+		return d.readBigEndian(1 << (marker - mpUint8))
+	}
+	n, err := d.readInt()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.Errorf("binary codec: %d overflows unsigned integer", n)
+	}
+	return uint64(n), nil
+}
+
+func (d *binaryDecoder) readFloat() (float64, error) {
+	marker, err := d.peek()
+	if err != nil {
+		return 0, err
+	}
+	switch marker {
+	case mpFloat32:
+		d.pos++
+		bits, err := d.readBigEndian(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case mpFloat64:
+		d.pos++
+		bits, err := d.readBigEndian(8)
+		return math.Float64frombits(bits), err
+	}
+	n, err := d.readInt()
+	return float64(n), err
+}
+
+func (d *binaryDecoder) readString() (string, error) {
+	marker, err := d.readByte()
+	if err != nil {
+		return "", err
+	}
+	var n uint64
+	switch {
+	case marker&0xe0 == 0xa0:
+		n = uint64(marker & 0x1f)
+	case marker >= mpStr8 && marker <= mpStr32:
+		n, err = d.readBigEndian(1 << (marker - mpStr8))
+	default:
+		return "", errors.Errorf("binary codec: expected string, got marker 0x%x", marker)
+	}
+	if err != nil {
+		return "", err
+	}
+	b, err := d.readN(int(n))
+	return string(b), err
+}
+
+func (d *binaryDecoder) readBin() ([]byte, error) {
+	marker, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	if marker < mpBin8 || marker > mpBin32 {
+		return nil, errors.Errorf("binary codec: expected binary, got marker 0x%x", marker)
+	}
+	n, err := d.readBigEndian(1 << (marker - mpBin8))
+	if err != nil {
+		return nil, err
+	}
+	return d.readN(int(n))
+}
+
+func (d *binaryDecoder) readArrayHeader() (int, error) {
+	return d.readHeader(0x90, mpArray16, mpArray32)
+}
+
+func (d *binaryDecoder) readMapHeader() (int, error) {
+	return d.readHeader(0x80, mpMap16, mpMap32)
+}
+
+func (d *binaryDecoder) readHeader(fix, marker16, marker32 byte) (int, error) {
+	marker, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	switch marker {
+	case marker16:
+		n, err = d.readBigEndian(2)
+	case marker32:
+		n, err = d.readBigEndian(4)
+	default:
+		if marker&0xf0 != fix {
+			return 0, errors.Errorf("binary codec: unexpected marker 0x%x", marker)
+		}
+		n = uint64(marker & 0x0f)
+	}
+	if err != nil {
+		return 0, err
+	}
+	// every element takes at least one byte, reject lengths the remaining data cannot hold
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, errors.New("binary codec: unexpected end of data")
+	}
+	return int(n), nil
+}
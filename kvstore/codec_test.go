@@ -0,0 +1,161 @@
+package kvstore
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+	"time"
+)
+
+type codecLanguageMock struct {
+	Bytes uint64 `json:"bytes"`
+}
+
+type codecItemMock struct {
+	Name      string                       `json:"name"`
+	Owner     *string                      `json:"owner"`
+	Stars     int                          `json:"stars"`
+	Delta     int64                        `json:"delta"`
+	Score     float64                      `json:"score"`
+	Private   bool                         `json:"private"`
+	Body      []byte                       `json:"body"`
+	Topics    []string                     `json:"topics"`
+	Languages map[string]codecLanguageMock `json:"languages"`
+	Headers   map[string][]string          `json:"headers"`
+	UpdatedAt time.Time                    `json:"updated_at"`
+	Ignored   string                       `json:"-"`
+}
+
+func newCodecItemMock() []*codecItemMock {
+	owner := "gopher"
+	return []*codecItemMock{
+		{
+			Name:    "foo",
+			Owner:   &owner,
+			Stars:   42,
+			Delta:   math.MinInt64,
+			Score:   3.14,
+			Private: true,
+			Body:    []byte("sweet bytes"),
+			Topics:  []string{"go", "redis"},
+			Languages: map[string]codecLanguageMock{
+				"golang": {Bytes: math.MaxUint64},
+				"c++":    {Bytes: 300},
+			},
+			Headers:   map[string][]string{"Content-Type": {"application/json"}},
+			UpdatedAt: time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+		},
+		{
+			// gob does not distinguish empty collections from nil ones
+			Name:  "bar",
+			Stars: -7,
+		},
+	}
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, name := range []string{"json", "gob", "binary"} {
+		t.Run(name, func(t *testing.T) {
+			codec, err := CodecByName(name)
+			assert.NoError(t, err)
+
+			data, err := codec.Marshal(newCodecItemMock())
+			assert.NoError(t, err, "should not error on marshal")
+
+			var decoded []*codecItemMock
+			err = codec.Unmarshal(data, &decoded)
+			assert.NoError(t, err, "should not error on unmarshal")
+			assert.Equal(t, newCodecItemMock(), decoded, "decoded value should match encoded value")
+		})
+	}
+}
+
+func TestCodecByNameUnknown(t *testing.T) {
+	_, err := CodecByName("xml")
+	assert.Error(t, err)
+}
+
+func TestRawCodec(t *testing.T) {
+	data, err := RawCodec.Marshal([]byte("raw"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("raw"), data)
+
+	var decoded []byte
+	assert.NoError(t, RawCodec.Unmarshal(data, &decoded))
+	assert.Equal(t, []byte("raw"), decoded)
+
+	var untyped any
+	assert.NoError(t, RawCodec.Unmarshal(data, &untyped))
+	assert.Equal(t, []byte("raw"), untyped)
+
+	_, err = RawCodec.Marshal("string")
+	assert.Error(t, err, "should only encode []byte")
+	var s string
+	assert.Error(t, RawCodec.Unmarshal(data, &s), "should only decode into []byte")
+}
+
+func TestBinaryCodec(t *testing.T) {
+	t.Run("Untyped", func(t *testing.T) {
+		data, err := BinaryCodec.Marshal(map[string]any{
+			"string": "value",
+			"int":    -3,
+			"uint":   uint64(math.MaxUint64),
+			"float":  1.5,
+			"list":   []any{true, nil, "x"},
+		})
+		assert.NoError(t, err)
+
+		var decoded any
+		assert.NoError(t, BinaryCodec.Unmarshal(data, &decoded))
+		assert.Equal(t, map[string]any{
+			"string": "value",
+			"int":    int64(-3),
+			"uint":   uint64(math.MaxUint64),
+			"float":  1.5,
+			"list":   []any{true, nil, "x"},
+		}, decoded)
+	})
+
+	t.Run("UnknownFieldsAreSkipped", func(t *testing.T) {
+		data, err := BinaryCodec.Marshal(newCodecItemMock()[0])
+		assert.NoError(t, err)
+
+		var decoded codecLanguageMock
+		assert.NoError(t, BinaryCodec.Unmarshal(data, &decoded))
+		assert.Equal(t, codecLanguageMock{}, decoded)
+	})
+
+	t.Run("Overflow", func(t *testing.T) {
+		data, err := BinaryCodec.Marshal(300)
+		assert.NoError(t, err)
+
+		var decoded int8
+		assert.Error(t, BinaryCodec.Unmarshal(data, &decoded))
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		data, err := BinaryCodec.Marshal(newCodecItemMock())
+		assert.NoError(t, err)
+
+		var decoded []*codecItemMock
+		assert.Error(t, BinaryCodec.Unmarshal(data[:len(data)-1], &decoded))
+	})
+
+	t.Run("TrailingData", func(t *testing.T) {
+		var decoded string
+		assert.Error(t, BinaryCodec.Unmarshal([]byte{0xa1, 'a', 'b'}, &decoded))
+	})
+
+	t.Run("LargeCollections", func(t *testing.T) {
+		list := make([]string, 70000)
+		for i := range list {
+			list[i] = "item"
+		}
+		data, err := BinaryCodec.Marshal(list)
+		assert.NoError(t, err)
+
+		var decoded []string
+		assert.NoError(t, BinaryCodec.Unmarshal(data, &decoded))
+		assert.Equal(t, list, decoded)
+	})
+}
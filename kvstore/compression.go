@@ -0,0 +1,108 @@
+package kvstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/pkg/errors"
+	"io"
+	"sync"
+)
+
+// DefaultCompressionThreshold is the size from which values are compressed by default.
+const DefaultCompressionThreshold = 1024
+
+// Compressed values are prefixed with a byte telling how they were encoded
+const (
+	compressionNone byte = 0
+	compressionGzip byte = 1
+)
+
+// CompressionOptions configures a compressed store.
+type CompressionOptions struct {
+	// Codec serializes the values before compression, defaults to JSONCodec
+	Codec Codec
+
+	// Threshold is the size from which serialized values are compressed, smaller values are
+	// stored as is. Defaults to DefaultCompressionThreshold.
+	Threshold int
+
+	// Level is the gzip compression level, defaults to gzip.DefaultCompression
+	Level int
+}
+
+type compressor struct {
+	threshold int
+	level     int
+	writers   sync.Pool
+}
+
+// NewCompressedStore returns a store compressing the values larger than the threshold before
+// writing them to inner, which receives []byte values and should therefore use RawCodec.
+func NewCompressedStore(inner ReadWriter, opts CompressionOptions) (*transformingStore, error) {
+	if opts.Threshold <= 0 {
+		opts.Threshold = DefaultCompressionThreshold
+	}
+	if opts.Level == 0 {
+		opts.Level = gzip.DefaultCompression
+	}
+	// validate the level once rather than on every write
+	_, err := gzip.NewWriterLevel(io.Discard, opts.Level)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid compression level")
+	}
+	return newTransformingStore(inner, opts.Codec, &compressor{
+		threshold: opts.Threshold,
+		level:     opts.Level,
+	}), nil
+}
+
+func (c *compressor) encode(_ string, data []byte) ([]byte, error) {
+	if len(data) < c.threshold {
+		return append([]byte{compressionNone}, data...), nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(compressionGzip)
+	zw, _ := c.writers.Get().(*gzip.Writer)
+	if zw == nil {
+		zw, _ = gzip.NewWriterLevel(&buf, c.level)
+	} else {
+		zw.Reset(&buf)
+	}
+	defer c.writers.Put(zw)
+
+	_, err := zw.Write(data)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to compress value")
+	}
+	// incompressible values are stored as is
+	if buf.Len() >= len(data)+1 {
+		return append([]byte{compressionNone}, data...), nil
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *compressor) decode(_ string, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("Empty compressed value")
+	}
+	switch data[0] {
+	case compressionNone:
+		return data[1:], nil
+	case compressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to decompress value")
+		}
+		defer zr.Close()
+		data, err = io.ReadAll(zr)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to decompress value")
+		}
+		return data, nil
+	}
+	return nil, errors.Errorf("Unknown compression %d", data[0])
+}
@@ -0,0 +1,67 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/MarouaneMan/github-api/internal/testutil/redistest"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCompressedStore(t *testing.T, inner ReadWriter, opts CompressionOptions) *transformingStore {
+	store, err := NewCompressedStore(inner, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestCompressedStore(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		inner := NewInMemoryStore(50*time.Millisecond, time.Minute)
+		testStore(t, newTestCompressedStore(t, inner, CompressionOptions{Threshold: 1}))
+	})
+	t.Run("redis", func(t *testing.T) {
+		inner := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{Codec: RawCodec})
+		testStore(t, newTestCompressedStore(t, inner, CompressionOptions{Threshold: 1}))
+	})
+}
+
+func TestCompressedStoreThreshold(t *testing.T) {
+	ctx := context.Background()
+	inner := NewInMemoryStore(NoExpiration, time.Minute)
+	store := newTestCompressedStore(t, inner, CompressionOptions{Threshold: 64})
+
+	large := strings.Repeat("golang ", 100)
+	_ = store.Write(ctx, "small", "value", NoExpiration)
+	_ = store.Write(ctx, "large", large, NoExpiration)
+
+	var data []byte
+	_ = ReadInto(ctx, inner, "small", &data)
+	assert.Equal(t, compressionNone, data[0], "small values should not be compressed")
+	_ = ReadInto(ctx, inner, "large", &data)
+	assert.Equal(t, compressionGzip, data[0], "large values should be compressed")
+	assert.Less(t, len(data), len(large), "compressed value should be smaller")
+
+	var value string
+	err := ReadInto(ctx, store, "large", &value)
+	assert.NoError(t, err)
+	assert.Equal(t, large, value)
+}
+
+func TestCompressedStoreCorrupted(t *testing.T) {
+	ctx := context.Background()
+	inner := NewInMemoryStore(NoExpiration, time.Minute)
+	store := newTestCompressedStore(t, inner, CompressionOptions{})
+
+	_ = inner.Write(ctx, "key", []byte{compressionGzip, 'x'}, NoExpiration)
+	_, err := store.Read(ctx, "key")
+	var decodeErr *DecodeError
+	assert.ErrorAs(t, err, &decodeErr, "corrupted values should return a DecodeError")
+}
+
+func TestCompressedStoreInvalidLevel(t *testing.T) {
+	_, err := NewCompressedStore(NewInMemoryStore(NoExpiration, time.Minute), CompressionOptions{Level: 42})
+	assert.Error(t, err)
+}
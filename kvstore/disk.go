@@ -0,0 +1,558 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy defines when a disk store flushes its log to stable storage.
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs the log after every mutation, no acknowledged write is lost on crash.
+	SyncAlways SyncPolicy = "always"
+
+	// SyncInterval fsyncs the log periodically, a crash loses at most the last interval of writes.
+	SyncInterval SyncPolicy = "interval"
+
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = "never"
+)
+
+// DiskOptions configures a disk store.
+type DiskOptions struct {
+	// Path of the log file, parent directories are created if needed
+	Path string
+
+	// Codec used to serialize values, defaults to JSONCodec
+	Codec Codec
+
+	// DefaultExpiration applies to items written with DefaultExpiration
+	DefaultExpiration time.Duration
+
+	// SyncPolicy defaults to SyncInterval
+	SyncPolicy SyncPolicy
+
+	// SyncInterval is the fsync interval of the SyncInterval policy, defaults to 1s
+	SyncInterval time.Duration
+
+	// CompactionInterval is the interval at which expired items are purged and the log is
+	// compacted if at least half of it is made of stale records, 0 disables periodic compaction.
+	// Expired items are purged on access as well.
+	CompactionInterval time.Duration
+}
+
+// disk log record operations
+const (
+	diskOpSet    byte = 1
+	diskOpDelete byte = 2
+)
+
+// ErrDiskStoreLocked is returned when opening a disk store whose log is held by another process.
+var ErrDiskStoreLocked = errors.New("Disk store log is in use by another process")
+
+// diskRecordHeaderSize is the size of a record header:
+// crc32 (4) | op (1) | expiresAt unix nanoseconds (8) | key length (4) | value length (4)
+const diskRecordHeaderSize = 21
+
+type diskEntry struct {
+	data       []byte
+	expiresAt  time.Time
+	recordSize int64
+}
+
+func (de *diskEntry) expired(now time.Time) bool {
+	return !de.expiresAt.IsZero() && !now.Before(de.expiresAt)
+}
+
+type diskStore struct {
+	opts  DiskOptions
+	codec Codec
+
+	mu      sync.Mutex
+	file    *os.File
+	entries map[string]*diskEntry
+
+	// logSize is the size of the log file, liveSize the size of the records of live entries,
+	// the records of purged expired entries are dead bytes
+	logSize  int64
+	liveSize int64
+
+	watchers watchHub
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewDiskStore opens the disk store stored at opts.Path, creating it if needed.
+// Mutations are appended to a log file which is replayed on startup so that the store survives
+// restarts, the whole dataset is kept in memory. A truncated or corrupted log tail, left by a
+// crash during a write, is discarded. The log must not be shared by several processes: it is
+// locked until the store is closed, and ErrDiskStoreLocked is returned while another process holds it.
+func NewDiskStore(opts DiskOptions) (*diskStore, error) {
+	if opts.Codec == nil {
+		opts.Codec = JSONCodec
+	}
+	if opts.SyncPolicy == "" {
+		opts.SyncPolicy = SyncInterval
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+	switch opts.SyncPolicy {
+	case SyncAlways, SyncInterval, SyncNever:
+	default:
+		return nil, errors.Errorf("Unknown sync policy %q", opts.SyncPolicy)
+	}
+
+	err := os.MkdirAll(filepath.Dir(opts.Path), 0o755)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create disk store directory")
+	}
+	file, err := os.OpenFile(opts.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open disk store log")
+	}
+	err = lockFile(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	ds := &diskStore{
+		opts:    opts,
+		codec:   opts.Codec,
+		file:    file,
+		entries: map[string]*diskEntry{},
+		stop:    make(chan struct{}),
+	}
+	err = ds.replay()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if opts.SyncPolicy == SyncInterval {
+		ds.every(opts.SyncInterval, ds.sync)
+	}
+	if opts.CompactionInterval > 0 {
+		ds.every(opts.CompactionInterval, ds.compactIfNeeded)
+	}
+	return ds, nil
+}
+
+// Write an item to the store, overriding the existing one.
+// The value is serialized using the store's codec.
+func (ds *diskStore) Write(_ context.Context, key string, value any, expiry time.Duration) error {
+	data, err := ds.codec.Marshal(value)
+	if err != nil {
+		return errors.Wrap(err, "Failed to serialize value")
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	err = ds.set(key, data, ds.expiresAt(expiry))
+	if err != nil {
+		return err
+	}
+	ds.watchers.notify(EventWrite, key)
+	return nil
+}
+
+// Read an item from the store, returns the item or ErrNotFound if not found.
+// The item is decoded into an untyped value, use ReadInto to decode typed values.
+func (ds *diskStore) Read(ctx context.Context, key string) (any, error) {
+	var value any
+	err := ds.ReadInto(ctx, key, &value)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// ReadInto decodes the item stored under key into the value pointed to by dst
+func (ds *diskStore) ReadInto(_ context.Context, key string, dst any) error {
+	ds.mu.Lock()
+	entry := ds.lookup(key)
+	ds.mu.Unlock()
+	if entry == nil {
+		return ErrNotFound
+	}
+
+	err := ds.codec.Unmarshal(entry.data, dst)
+	if err != nil {
+		return &DecodeError{Key: key, Err: err}
+	}
+	return nil
+}
+
+// Exists reports whether an item is stored under key
+func (ds *diskStore) Exists(_ context.Context, key string) (bool, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.lookup(key) != nil, nil
+}
+
+// TTL returns the remaining time to live of an item, or NoExpiration if it never expires
+func (ds *diskStore) TTL(_ context.Context, key string) (time.Duration, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	entry := ds.lookup(key)
+	if entry == nil {
+		return 0, ErrNotFound
+	}
+	if entry.expiresAt.IsZero() {
+		return NoExpiration, nil
+	}
+	return time.Until(entry.expiresAt), nil
+}
+
+// Scan returns the keys starting with prefix
+func (ds *diskStore) Scan(_ context.Context, prefix string) ([]string, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.purgeExpired()
+	keys := []string{}
+	for key := range ds.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Delete removes an item from the store
+func (ds *diskStore) Delete(_ context.Context, key string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	entry, ok := ds.entries[key]
+	if !ok {
+		return nil
+	}
+	_, err := ds.append(diskOpDelete, key, nil, time.Time{})
+	if err != nil {
+		return err
+	}
+	delete(ds.entries, key)
+	ds.liveSize -= entry.recordSize
+	ds.watchers.notify(EventDelete, key)
+	return nil
+}
+
+// Touch resets the expiry of an item
+func (ds *diskStore) Touch(_ context.Context, key string, expiry time.Duration) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	entry := ds.lookup(key)
+	if entry == nil {
+		return ErrNotFound
+	}
+	err := ds.set(key, entry.data, ds.expiresAt(expiry))
+	if err != nil {
+		return err
+	}
+	ds.watchers.notify(EventTouch, key)
+	return nil
+}
+
+// Watch returns a channel receiving the changes of the keys starting with prefix.
+// Expired items are dropped lazily, their expiration is not notified.
+func (ds *diskStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return ds.watchers.watch(ctx, prefix), nil
+}
+
+// Compact rewrites the log with the live entries only
+func (ds *diskStore) Compact() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.compact()
+}
+
+// Close flushes the log to stable storage and closes it
+func (ds *diskStore) Close() error {
+	select {
+	case <-ds.stop:
+		return nil
+	default:
+		close(ds.stop)
+	}
+	ds.wg.Wait()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	err := ds.file.Sync()
+	if err != nil {
+		_ = ds.file.Close()
+		return errors.Wrap(err, "Failed to sync disk store log")
+	}
+	return ds.file.Close()
+}
+
+// set appends a set record and indexes the entry, the store lock must be held
+func (ds *diskStore) set(key string, data []byte, expiresAt time.Time) error {
+	recordSize, err := ds.append(diskOpSet, key, data, expiresAt)
+	if err != nil {
+		return err
+	}
+	if old, ok := ds.entries[key]; ok {
+		ds.liveSize -= old.recordSize
+	}
+	ds.entries[key] = &diskEntry{data: data, expiresAt: expiresAt, recordSize: recordSize}
+	ds.liveSize += recordSize
+	return nil
+}
+
+// append writes a record at the end of the log, the store lock must be held
+func (ds *diskStore) append(op byte, key string, data []byte, expiresAt time.Time) (int64, error) {
+	record := encodeDiskRecord(op, key, data, expiresAt)
+	_, err := ds.file.Write(record)
+	if err != nil {
+		// drop the partially written record so that the next ones are not appended after garbage
+		_ = ds.file.Truncate(ds.logSize)
+		return 0, errors.Wrapf(err, "Failed to append key %q to disk store log", key)
+	}
+	ds.logSize += int64(len(record))
+
+	if ds.opts.SyncPolicy == SyncAlways {
+		err = ds.file.Sync()
+		if err != nil {
+			return 0, errors.Wrap(err, "Failed to sync disk store log")
+		}
+	}
+	return int64(len(record)), nil
+}
+
+// lookup returns the live entry stored under key, purging it if expired.
+// The store lock must be held.
+func (ds *diskStore) lookup(key string) *diskEntry {
+	entry, ok := ds.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.expired(time.Now()) {
+		delete(ds.entries, key)
+		ds.liveSize -= entry.recordSize
+		return nil
+	}
+	return entry
+}
+
+// purgeExpired drops the expired entries from the index, their records become dead bytes
+// reclaimed by the next compaction. The store lock must be held.
+func (ds *diskStore) purgeExpired() {
+	now := time.Now()
+	for key, entry := range ds.entries {
+		if entry.expired(now) {
+			delete(ds.entries, key)
+			ds.liveSize -= entry.recordSize
+		}
+	}
+}
+
+func (ds *diskStore) expiresAt(expiry time.Duration) time.Time {
+	if expiry == DefaultExpiration {
+		expiry = ds.opts.DefaultExpiration
+	}
+	if expiry <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(expiry)
+}
+
+// replay rebuilds the index from the log, truncating it after the last valid record
+func (ds *diskStore) replay() error {
+	info, err := ds.file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "Failed to stat disk store log")
+	}
+
+	reader := bufio.NewReader(ds.file)
+	now := time.Now()
+	for {
+		op, key, data, expiresAt, size, err := readDiskRecord(reader, info.Size()-ds.logSize)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// a crash occurred while appending the last record
+			err = ds.file.Truncate(ds.logSize)
+			if err != nil {
+				return errors.Wrap(err, "Failed to truncate corrupted disk store log")
+			}
+			break
+		}
+		ds.logSize += size
+
+		if old, ok := ds.entries[key]; ok {
+			ds.liveSize -= old.recordSize
+			delete(ds.entries, key)
+		}
+		if op == diskOpSet && (expiresAt.IsZero() || now.Before(expiresAt)) {
+			ds.entries[key] = &diskEntry{data: data, expiresAt: expiresAt, recordSize: size}
+			ds.liveSize += size
+		}
+	}
+	return nil
+}
+
+// compact rewrites the log into a temporary file which then atomically replaces the log.
+// The store lock must be held.
+func (ds *diskStore) compact() error {
+	tmpPath := ds.opts.Path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create compacted disk store log")
+	}
+	// lock the compacted log before it replaces the log, so that it is never left unlocked
+	err = lockFile(tmp)
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpPath)
+		return errors.Wrap(err, "Failed to compact disk store log")
+	}
+
+	ds.purgeExpired()
+	writer := bufio.NewWriter(tmp)
+	var size int64
+	for key, entry := range ds.entries {
+		record := encodeDiskRecord(diskOpSet, key, entry.data, entry.expiresAt)
+		_, err = writer.Write(record)
+		if err != nil {
+			break
+		}
+		size += int64(len(record))
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, ds.opts.Path)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpPath)
+		return errors.Wrap(err, "Failed to compact disk store log")
+	}
+	syncDir(filepath.Dir(ds.opts.Path))
+
+	// the rename succeeded, switch to the compacted log
+	_ = ds.file.Close()
+	ds.file = tmp
+	ds.logSize = size
+	ds.liveSize = size
+	return nil
+}
+
+func (ds *diskStore) compactIfNeeded() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.purgeExpired()
+	if ds.logSize > 2*ds.liveSize {
+		_ = ds.compact()
+	}
+}
+
+func (ds *diskStore) sync() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	_ = ds.file.Sync()
+}
+
+// every runs fn periodically until the store is closed
+func (ds *diskStore) every(interval time.Duration, fn func()) {
+	ds.wg.Add(1)
+	go func() {
+		defer ds.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ds.stop:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+}
+
+// syncDir fsyncs a directory so that a rename in it is durable, it is best effort as not every
+// platform supports it
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	_ = dir.Sync()
+	_ = dir.Close()
+}
+
+func encodeDiskRecord(op byte, key string, data []byte, expiresAt time.Time) []byte {
+	record := make([]byte, diskRecordHeaderSize, diskRecordHeaderSize+len(key)+len(data))
+	record[4] = op
+	if !expiresAt.IsZero() {
+		binary.BigEndian.PutUint64(record[5:13], uint64(expiresAt.UnixNano()))
+	}
+	binary.BigEndian.PutUint32(record[13:17], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[17:21], uint32(len(data)))
+	record = append(record, key...)
+	record = append(record, data...)
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// readDiskRecord reads the next record of the log, remaining being the number of bytes left in it.
+// io.EOF is only returned at a record boundary.
+func readDiskRecord(reader *bufio.Reader, remaining int64) (op byte, key string, data []byte, expiresAt time.Time, size int64, err error) {
+	header := make([]byte, diskRecordHeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if err == io.EOF {
+		return 0, "", nil, time.Time{}, 0, io.EOF
+	}
+	if err != nil {
+		return 0, "", nil, time.Time{}, 0, errors.Wrapf(err, "Truncated record header (%d bytes)", n)
+	}
+
+	keyLen := binary.BigEndian.Uint32(header[13:17])
+	dataLen := binary.BigEndian.Uint32(header[17:21])
+	if int64(diskRecordHeaderSize)+int64(keyLen)+int64(dataLen) > remaining {
+		return 0, "", nil, time.Time{}, 0, errors.New("Truncated or corrupted record")
+	}
+	body := make([]byte, int(keyLen)+int(dataLen))
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return 0, "", nil, time.Time{}, 0, errors.Wrap(err, "Truncated record body")
+	}
+
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(header[4:])
+	_, _ = crc.Write(body)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[0:4]) {
+		return 0, "", nil, time.Time{}, 0, errors.New("Corrupted record")
+	}
+
+	op = header[4]
+	if op != diskOpSet && op != diskOpDelete {
+		return 0, "", nil, time.Time{}, 0, errors.Errorf("Unknown record operation %d", op)
+	}
+	if nanos := binary.BigEndian.Uint64(header[5:13]); nanos != 0 {
+		expiresAt = time.Unix(0, int64(nanos))
+	}
+	return op, string(body[:keyLen]), body[keyLen:], expiresAt, int64(len(header) + len(body)), nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package kvstore
+
+import "os"
+
+// lockFile is a no-op where flock is not available, the log is not protected from other processes
+func lockFile(_ *os.File) error {
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package kvstore
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on file, released once it is closed
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrDiskStoreLocked
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to lock disk store log")
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDiskStore(t *testing.T, opts DiskOptions) *diskStore {
+	store, err := NewDiskStore(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	return store
+}
+
+func TestDiskStore(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		t.Run(string(policy), func(t *testing.T) {
+			testStore(t, newTestDiskStore(t, DiskOptions{
+				Path:              filepath.Join(t.TempDir(), "store.log"),
+				DefaultExpiration: 50 * time.Millisecond,
+				SyncPolicy:        policy,
+				SyncInterval:      10 * time.Millisecond,
+			}))
+		})
+	}
+}
+
+func TestDiskStoreRestart(t *testing.T) {
+	ctx := context.Background()
+	opts := DiskOptions{Path: filepath.Join(t.TempDir(), "data", "store.log"), Codec: BinaryCodec}
+
+	store := newTestDiskStore(t, opts)
+	assert.NoError(t, store.Write(ctx, "items", newCodecItemMock(), NoExpiration))
+	assert.NoError(t, store.Write(ctx, "deleted", "value", NoExpiration))
+	assert.NoError(t, store.Delete(ctx, "deleted"))
+	assert.NoError(t, store.Write(ctx, "expiring", "value", 20*time.Millisecond))
+	assert.NoError(t, store.Write(ctx, "touched", "value", 20*time.Millisecond))
+	assert.NoError(t, store.Touch(ctx, "touched", NoExpiration))
+	assert.NoError(t, store.Close())
+	time.Sleep(30 * time.Millisecond)
+
+	store = newTestDiskStore(t, opts)
+	var items []*codecItemMock
+	assert.NoError(t, ReadInto(ctx, store, "items", &items), "items should survive a restart")
+	assert.Equal(t, newCodecItemMock(), items)
+
+	keys, err := store.Scan(ctx, "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"items", "touched"}, keys, "deleted and expired items should not be restored")
+}
+
+func TestDiskStoreCorruptedTail(t *testing.T) {
+	ctx := context.Background()
+	opts := DiskOptions{Path: filepath.Join(t.TempDir(), "store.log"), SyncPolicy: SyncAlways}
+
+	store := newTestDiskStore(t, opts)
+	assert.NoError(t, store.Write(ctx, "first", "value", NoExpiration))
+	assert.NoError(t, store.Write(ctx, "second", "value", NoExpiration))
+	assert.NoError(t, store.Close())
+
+	// simulate a crash in the middle of the second record
+	info, err := os.Stat(opts.Path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(opts.Path, info.Size()-3))
+
+	store = newTestDiskStore(t, opts)
+	keys, _ := store.Scan(ctx, "")
+	assert.Equal(t, []string{"first"}, keys, "the truncated record should be discarded")
+
+	// the store should remain writable after recovering
+	assert.NoError(t, store.Write(ctx, "third", "value", NoExpiration))
+	assert.NoError(t, store.Close())
+
+	// flip a byte of the last record
+	data, err := os.ReadFile(opts.Path)
+	assert.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.NoError(t, os.WriteFile(opts.Path, data, 0o644))
+
+	store = newTestDiskStore(t, opts)
+	keys, _ = store.Scan(ctx, "")
+	assert.Equal(t, []string{"first"}, keys, "the corrupted record should be discarded")
+}
+
+func TestDiskStoreCompaction(t *testing.T) {
+	ctx := context.Background()
+	opts := DiskOptions{Path: filepath.Join(t.TempDir(), "store.log"), CompactionInterval: 10 * time.Millisecond}
+
+	store := newTestDiskStore(t, opts)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, store.Write(ctx, "key", i, NoExpiration))
+	}
+	assert.NoError(t, store.Write(ctx, "expired", "value", time.Millisecond))
+	before, _ := os.Stat(opts.Path)
+	time.Sleep(50 * time.Millisecond)
+
+	after, _ := os.Stat(opts.Path)
+	assert.Less(t, after.Size(), before.Size()/10, "stale records should be compacted")
+
+	// the compacted log should still be usable and replayable
+	assert.NoError(t, store.Write(ctx, "other", "value", NoExpiration))
+	assert.NoError(t, store.Close())
+
+	store = newTestDiskStore(t, opts)
+	var value int
+	assert.NoError(t, ReadInto(ctx, store, "key", &value))
+	assert.Equal(t, 99, value)
+	keys, _ := store.Scan(ctx, "")
+	assert.ElementsMatch(t, []string{"key", "other"}, keys)
+}
+
+func TestDiskStoreExpiredEntriesAreDeadBytes(t *testing.T) {
+	ctx := context.Background()
+	opts := DiskOptions{Path: filepath.Join(t.TempDir(), "store.log")}
+
+	store := newTestDiskStore(t, opts)
+	assert.NoError(t, store.Write(ctx, "live", "value", NoExpiration))
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, store.Write(ctx, fmt.Sprintf("expired-%d", i), "value", time.Millisecond))
+	}
+	liveSize := store.liveSize
+	time.Sleep(5 * time.Millisecond)
+
+	_, err := store.Read(ctx, "expired-0")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Len(t, store.entries, 10, "expired entry should be purged on read")
+	assert.Less(t, store.liveSize, liveSize, "purged entry should count as dead bytes")
+
+	// only a few bytes are live, the periodic compaction must kick in
+	store.compactIfNeeded()
+	assert.Len(t, store.entries, 1, "expired entries should be purged before compacting")
+	info, _ := os.Stat(opts.Path)
+	assert.Equal(t, store.liveSize, info.Size(), "log should be compacted")
+	assert.Equal(t, store.liveSize, store.logSize)
+}
+
+func TestDiskStoreUnknownSyncPolicy(t *testing.T) {
+	_, err := NewDiskStore(DiskOptions{Path: filepath.Join(t.TempDir(), "store.log"), SyncPolicy: "sometimes"})
+	assert.Error(t, err)
+}
+
+func TestDiskStoreLocksLog(t *testing.T) {
+	opts := DiskOptions{Path: filepath.Join(t.TempDir(), "store.log")}
+	store := newTestDiskStore(t, opts)
+
+	_, err := NewDiskStore(opts)
+	assert.ErrorIs(t, err, ErrDiskStoreLocked, "the log should not be opened twice")
+	assert.NoError(t, store.Compact())
+	_, err = NewDiskStore(opts)
+	assert.ErrorIs(t, err, ErrDiskStoreLocked, "the compacted log should stay locked")
+
+	assert.NoError(t, store.Close())
+	newTestDiskStore(t, opts)
+}
@@ -0,0 +1,227 @@
+package kvstore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// encryptionVersion is the first byte of encrypted values, followed by the key id length, the key
+// id, the nonce and the ciphertext
+const encryptionVersion byte = 1
+
+// EncryptionKey is an AES key, 16, 24 or 32 bytes long, identified by ID in the values it encrypts.
+type EncryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+// EncryptionOptions configures an encrypted store.
+type EncryptionOptions struct {
+	// Codec serializes the values before encryption, defaults to JSONCodec
+	Codec Codec
+
+	// Keys decrypt the values, the first one is the active key encrypting new values. Rotate keys
+	// by prepending the new key and keeping the old ones until Rotate re-encrypted every value.
+	Keys []EncryptionKey
+}
+
+// ParseEncryptionKeys parses a comma separated list of id:base64 keys, the first one being the
+// active key
+func ParseEncryptionKeys(s string) ([]EncryptionKey, error) {
+	var keys []EncryptionKey
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, errors.Errorf("Invalid encryption key %q, expected id:base64", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode encryption key %q", id)
+		}
+		keys = append(keys, EncryptionKey{ID: id, Key: key})
+	}
+	return keys, nil
+}
+
+type encryptor struct {
+	activeID string
+	aeads    map[string]cipher.AEAD
+}
+
+type encryptedStore struct {
+	*transformingStore
+	encryptor *encryptor
+}
+
+// NewEncryptedStore returns a store encrypting values with AES-GCM before writing them to inner,
+// which receives []byte values and should therefore use RawCodec. Keys are authenticated along
+// with the values so that a value cannot be moved to another key.
+func NewEncryptedStore(inner ReadWriter, opts EncryptionOptions) (*encryptedStore, error) {
+	if len(opts.Keys) == 0 {
+		return nil, errors.New("At least one encryption key is required")
+	}
+	e := &encryptor{
+		activeID: opts.Keys[0].ID,
+		aeads:    map[string]cipher.AEAD{},
+	}
+	for _, key := range opts.Keys {
+		if key.ID == "" || len(key.ID) > 255 {
+			return nil, errors.Errorf("Invalid encryption key id %q", key.ID)
+		}
+		if _, ok := e.aeads[key.ID]; ok {
+			return nil, errors.Errorf("Duplicate encryption key id %q", key.ID)
+		}
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid encryption key %q", key.ID)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid encryption key %q", key.ID)
+		}
+		e.aeads[key.ID] = aead
+	}
+	return &encryptedStore{
+		transformingStore: newTransformingStore(inner, opts.Codec, e),
+		encryptor:         e,
+	}, nil
+}
+
+// Rotate re-encrypts with the active key the items starting with prefix that were encrypted with
+// another key, preserving their expiry. Items are rewritten conditionally to their version when
+// the inner store supports it, so that concurrent writes are not overwritten.
+// Items which are not encrypted or cannot be decrypted are skipped, the other items are still
+// rotated, and a summary error wrapping the *DecodeError of the first skipped item is returned
+// once done. Returns the number of re-encrypted items.
+func (es *encryptedStore) Rotate(ctx context.Context, prefix string) (int, error) {
+	keys, err := es.ReadWriter.Scan(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	rotated, skipped := 0, 0
+	var skipErr error
+	skip := func(err error) {
+		if skipped == 0 {
+			skipErr = err
+		}
+		skipped++
+	}
+	for _, key := range keys {
+		var data []byte
+		version, err := ReadVersion(ctx, es.ReadWriter, key, &data)
+		versioned := !errors.Is(err, ErrVersioningNotSupported)
+		if !versioned {
+			err = ReadInto(ctx, es.ReadWriter, key, &data)
+		}
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		var decodeErr *DecodeError
+		if errors.As(err, &decodeErr) {
+			skip(err)
+			continue
+		}
+		if err != nil {
+			return rotated, err
+		}
+		id, err := encryptionKeyID(data)
+		if err != nil {
+			skip(&DecodeError{Key: key, Err: err})
+			continue
+		}
+		if id == es.encryptor.activeID {
+			continue
+		}
+
+		ttl, err := es.ReadWriter.TTL(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return rotated, err
+		}
+		if ttl != NoExpiration && ttl <= 0 {
+			continue
+		}
+		plaintext, err := es.encryptor.decode(key, data)
+		if err != nil {
+			skip(&DecodeError{Key: key, Err: err})
+			continue
+		}
+		data, err = es.encryptor.encode(key, plaintext)
+		if err != nil {
+			return rotated, err
+		}
+		if versioned {
+			_, err = WriteIfVersion(ctx, es.ReadWriter, key, data, version, ttl)
+		} else {
+			err = es.ReadWriter.Write(ctx, key, data, ttl)
+		}
+		if errors.Is(err, ErrVersionMismatch) {
+			// rewritten concurrently, hence with the active key
+			continue
+		}
+		if err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+	if skipped > 0 {
+		return rotated, errors.Wrapf(skipErr, "%d items are not encrypted or cannot be decrypted and were not rotated", skipped)
+	}
+	return rotated, nil
+}
+
+func (e *encryptor) encode(key string, data []byte) ([]byte, error) {
+	aead := e.aeads[e.activeID]
+	header := make([]byte, 0, 2+len(e.activeID)+aead.NonceSize())
+	header = append(header, encryptionVersion, byte(len(e.activeID)))
+	header = append(header, e.activeID...)
+	nonce := header[len(header) : len(header)+aead.NonceSize()]
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate nonce")
+	}
+	header = header[:len(header)+aead.NonceSize()]
+	return aead.Seal(header, nonce, data, []byte(key)), nil
+}
+
+func (e *encryptor) decode(key string, data []byte) ([]byte, error) {
+	id, err := encryptionKeyID(data)
+	if err != nil {
+		return nil, err
+	}
+	aead, ok := e.aeads[id]
+	if !ok {
+		return nil, errors.Errorf("Unknown encryption key %q", id)
+	}
+	data = data[2+len(id):]
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("Encrypted value is truncated")
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to decrypt value")
+	}
+	return plaintext, nil
+}
+
+// encryptionKeyID returns the id of the key an encrypted value was encrypted with
+func encryptionKeyID(data []byte) (string, error) {
+	if len(data) < 2 || data[0] != encryptionVersion {
+		return "", errors.New("Value is not encrypted")
+	}
+	if len(data) < 2+int(data[1]) {
+		return "", errors.New("Encrypted value is truncated")
+	}
+	return string(data[2 : 2+int(data[1])]), nil
+}
@@ -0,0 +1,160 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"github.com/MarouaneMan/github-api/internal/testutil/redistest"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestEncryptedStore(t *testing.T, inner ReadWriter, keys ...EncryptionKey) *encryptedStore {
+	store, err := NewEncryptedStore(inner, EncryptionOptions{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func testEncryptionKey(id string) EncryptionKey {
+	return EncryptionKey{ID: id, Key: bytes.Repeat([]byte(id[:1]), 32)}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		inner := NewInMemoryStore(50*time.Millisecond, time.Minute)
+		testStore(t, newTestEncryptedStore(t, inner, testEncryptionKey("a")))
+	})
+	t.Run("redis", func(t *testing.T) {
+		inner := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{Codec: RawCodec})
+		testStore(t, newTestEncryptedStore(t, inner, testEncryptionKey("a")))
+	})
+	t.Run("stacked", func(t *testing.T) {
+		inner := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{Codec: RawCodec})
+		encrypted, err := NewEncryptedStore(inner, EncryptionOptions{
+			Codec: RawCodec,
+			Keys:  []EncryptionKey{testEncryptionKey("a")},
+		})
+		assert.NoError(t, err)
+		testStore(t, newTestCompressedStore(t, encrypted, CompressionOptions{Threshold: 1}))
+	})
+}
+
+func TestEncryptedStoreCiphertext(t *testing.T) {
+	ctx := context.Background()
+	inner := NewInMemoryStore(NoExpiration, time.Minute)
+	store := newTestEncryptedStore(t, inner, testEncryptionKey("a"))
+
+	_ = store.Write(ctx, "key", "secret token", NoExpiration)
+	var data []byte
+	_ = ReadInto(ctx, inner, "key", &data)
+	assert.NotContains(t, string(data), "secret token", "values should be encrypted")
+
+	// values are bound to their key
+	_ = inner.Write(ctx, "other", data, NoExpiration)
+	_, err := store.Read(ctx, "other")
+	var decodeErr *DecodeError
+	assert.ErrorAs(t, err, &decodeErr, "values moved to another key should not decrypt")
+}
+
+func TestEncryptedStoreWrongKey(t *testing.T) {
+	ctx := context.Background()
+	inner := NewInMemoryStore(NoExpiration, time.Minute)
+	_ = newTestEncryptedStore(t, inner, testEncryptionKey("a")).Write(ctx, "key", "value", NoExpiration)
+
+	_, err := newTestEncryptedStore(t, inner, testEncryptionKey("b")).Read(ctx, "key")
+	var decodeErr *DecodeError
+	assert.ErrorAs(t, err, &decodeErr, "unknown keys should return a DecodeError")
+
+	wrong := EncryptionKey{ID: "a", Key: bytes.Repeat([]byte("z"), 32)}
+	_, err = newTestEncryptedStore(t, inner, wrong).Read(ctx, "key")
+	assert.ErrorAs(t, err, &decodeErr, "wrong keys should return a DecodeError")
+}
+
+func TestEncryptedStoreRotate(t *testing.T) {
+	ctx := context.Background()
+	inner := NewInMemoryStore(NoExpiration, time.Minute)
+	old := newTestEncryptedStore(t, inner, testEncryptionKey("a"))
+	_ = old.Write(ctx, "repositories", "value", NoExpiration)
+	_ = old.Write(ctx, "repositories:expiring", "value", time.Hour)
+
+	store := newTestEncryptedStore(t, inner, testEncryptionKey("b"), testEncryptionKey("a"))
+	value, err := store.Read(ctx, "repositories")
+	assert.NoError(t, err, "old keys should still decrypt")
+	assert.Equal(t, "value", value)
+	_ = store.Write(ctx, "repositories:new", "value", NoExpiration)
+
+	rotated, err := store.Rotate(ctx, "repositories")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rotated, "only values encrypted with old keys should be rotated")
+
+	ttl, _ := inner.TTL(ctx, "repositories:expiring")
+	assert.Greater(t, ttl, 59*time.Minute, "rotation should preserve the expiry")
+	ttl, _ = inner.TTL(ctx, "repositories")
+	assert.Equal(t, NoExpiration, ttl, "rotation should preserve the expiry")
+
+	rotated, _ = store.Rotate(ctx, "repositories")
+	assert.Equal(t, 0, rotated)
+
+	// the old key is no longer needed
+	value, err = newTestEncryptedStore(t, inner, testEncryptionKey("b")).Read(ctx, "repositories:expiring")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+}
+
+func TestEncryptedStoreRotateSkipsUndecodableItems(t *testing.T) {
+	ctx := context.Background()
+	inner := NewInMemoryStore(NoExpiration, time.Minute)
+	old := newTestEncryptedStore(t, inner, testEncryptionKey("a"))
+	_ = old.Write(ctx, "repositories:1", "value", NoExpiration)
+	_ = old.Write(ctx, "repositories:3", "value", NoExpiration)
+	_ = inner.Write(ctx, "repositories:2", []byte("plaintext"), NoExpiration)
+	unknown := newTestEncryptedStore(t, inner, testEncryptionKey("c"))
+	_ = unknown.Write(ctx, "repositories:4", "value", NoExpiration)
+
+	store := newTestEncryptedStore(t, inner, testEncryptionKey("b"), testEncryptionKey("a"))
+	rotated, err := store.Rotate(ctx, "repositories")
+	var decodeErr *DecodeError
+	assert.ErrorAs(t, err, &decodeErr, "skipped items should be reported")
+	assert.Contains(t, err.Error(), "2 items")
+	assert.Equal(t, 2, rotated, "items after an undecodable one should still be rotated")
+
+	for _, key := range []string{"repositories:1", "repositories:3"} {
+		value, err := newTestEncryptedStore(t, inner, testEncryptionKey("b")).Read(ctx, key)
+		assert.NoError(t, err)
+		assert.Equal(t, "value", value)
+	}
+}
+
+func TestNewEncryptedStoreInvalidKeys(t *testing.T) {
+	inner := NewInMemoryStore(NoExpiration, time.Minute)
+	for name, keys := range map[string][]EncryptionKey{
+		"none":      nil,
+		"length":    {{ID: "a", Key: []byte("short")}},
+		"id":        {{ID: "", Key: bytes.Repeat([]byte("a"), 32)}},
+		"duplicate": {testEncryptionKey("a"), testEncryptionKey("a")},
+	} {
+		_, err := NewEncryptedStore(inner, EncryptionOptions{Keys: keys})
+		assert.Error(t, err, name)
+	}
+}
+
+func TestParseEncryptionKeys(t *testing.T) {
+	keys, err := ParseEncryptionKeys("new:" + strings.Repeat("A", 43) + "=, old:" + strings.Repeat("B", 24))
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+	assert.Equal(t, "new", keys[0].ID)
+	assert.Len(t, keys[0].Key, 32)
+	assert.Len(t, keys[1].Key, 18)
+
+	keys, err = ParseEncryptionKeys("")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	_, err = ParseEncryptionKeys("nokey")
+	assert.Error(t, err)
+	_, err = ParseEncryptionKeys("id:not base64")
+	assert.Error(t, err)
+}
@@ -3,29 +3,221 @@ package kvstore
 import (
 	"context"
 	"github.com/patrickmn/go-cache"
+	"strings"
+	"sync"
 	"time"
 )
 
 type inMemoryStore struct {
 	cache *cache.Cache
+
+	// mu serializes mutations so that Touch cannot resurrect a value overwritten concurrently
+	mu sync.Mutex
+
+	watchers watchHub
+
+	// versions holds the version of the items, versionsMu is acquired after mu when both are held
+	versionsMu  sync.Mutex
+	versions    map[string]uint64
+	lastVersion uint64
+
+	// deleting is the key being deleted by Delete, the eviction callback is otherwise only
+	// called for expired items
+	evictionMu sync.Mutex
+	deleting   *string
 }
 
 // NewInMemoryStore returns a new key value store with a given default expiration and
 // cleanup interval
 func NewInMemoryStore(defaultExpiration, cleanupInterval time.Duration) *inMemoryStore {
-	return &inMemoryStore{
-		cache: cache.New(defaultExpiration, cleanupInterval),
+	ims := &inMemoryStore{
+		cache:    cache.New(defaultExpiration, cleanupInterval),
+		versions: map[string]uint64{},
 	}
+	ims.cache.OnEvicted(ims.onEvicted)
+	return ims
 }
 
 // Write an item to the store, overriding the existing one
 func (ims *inMemoryStore) Write(_ context.Context, key string, value any, expiry time.Duration) error {
-	ims.cache.Set(key, value, expiry)
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	ims.set(key, value, expiry)
+	return nil
+}
+
+// WriteMany sets several items at once
+func (ims *inMemoryStore) WriteMany(_ context.Context, items map[string]any, expiry time.Duration) error {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	for key, value := range items {
+		ims.set(key, value, expiry)
+	}
+	return nil
+}
+
+// ReadManyInto assigns the items stored under keys to the map pointed to by dst
+func (ims *inMemoryStore) ReadManyInto(_ context.Context, keys []string, dst any) error {
+	items, err := batchDestination(dst)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		val, found := ims.cache.Get(key)
+		if !found {
+			continue
+		}
+		err = decodeBatchItem(items, key, func(dst any) error {
+			return assignInto(key, val, dst)
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Read an item from the store, returns the item or nil if not found
-func (ims *inMemoryStore) Read(_ context.Context, key string) any {
-	val, _ := ims.cache.Get(key)
-	return val
+// ReadVersion assigns the item stored under key to the value pointed to by dst and returns its version
+func (ims *inMemoryStore) ReadVersion(_ context.Context, key string, dst any) (uint64, error) {
+	ims.versionsMu.Lock()
+	val, found := ims.cache.Get(key)
+	version := ims.versions[key]
+	ims.versionsMu.Unlock()
+	if !found {
+		return 0, ErrNotFound
+	}
+	err := assignInto(key, val, dst)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// WriteIfVersion writes an item only if its current version is version
+func (ims *inMemoryStore) WriteIfVersion(_ context.Context, key string, value any, version uint64, expiry time.Duration) (uint64, error) {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	if ims.version(key) != version {
+		return 0, ErrVersionMismatch
+	}
+	return ims.set(key, value, expiry), nil
+}
+
+// Read an item from the store, returns the item or ErrNotFound if not found
+func (ims *inMemoryStore) Read(_ context.Context, key string) (any, error) {
+	val, found := ims.cache.Get(key)
+	if !found {
+		return nil, ErrNotFound
+	}
+	return val, nil
+}
+
+// Exists reports whether an item is stored under key
+func (ims *inMemoryStore) Exists(_ context.Context, key string) (bool, error) {
+	_, found := ims.cache.Get(key)
+	return found, nil
+}
+
+// TTL returns the remaining time to live of an item, or NoExpiration if it never expires
+func (ims *inMemoryStore) TTL(_ context.Context, key string) (time.Duration, error) {
+	_, expiration, found := ims.cache.GetWithExpiration(key)
+	if !found {
+		return 0, ErrNotFound
+	}
+	if expiration.IsZero() {
+		return NoExpiration, nil
+	}
+	return time.Until(expiration), nil
+}
+
+// Scan returns the keys starting with prefix
+func (ims *inMemoryStore) Scan(_ context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	for key := range ims.cache.Items() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Delete removes an item from the store
+func (ims *inMemoryStore) Delete(_ context.Context, key string) error {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+
+	ims.evictionMu.Lock()
+	ims.deleting = &key
+	ims.evictionMu.Unlock()
+	defer func() {
+		ims.evictionMu.Lock()
+		ims.deleting = nil
+		ims.evictionMu.Unlock()
+	}()
+
+	ims.cache.Delete(key)
+	return nil
+}
+
+// Touch resets the expiry of an item
+func (ims *inMemoryStore) Touch(_ context.Context, key string, expiry time.Duration) error {
+	ims.mu.Lock()
+	defer ims.mu.Unlock()
+	val, found := ims.cache.Get(key)
+	if !found {
+		return ErrNotFound
+	}
+	ims.cache.Set(key, val, expiry)
+	ims.watchers.notify(EventTouch, key)
+	return nil
+}
+
+// Watch returns a channel receiving the changes of the keys starting with prefix.
+// Expirations are notified when expired items are purged, at every cleanup interval.
+func (ims *inMemoryStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return ims.watchers.watch(ctx, prefix), nil
+}
+
+// set writes an item under a new version, mu must be held
+func (ims *inMemoryStore) set(key string, value any, expiry time.Duration) uint64 {
+	ims.versionsMu.Lock()
+	ims.cache.Set(key, value, expiry)
+	ims.lastVersion++
+	version := ims.lastVersion
+	ims.versions[key] = version
+	ims.versionsMu.Unlock()
+
+	ims.watchers.notify(EventWrite, key)
+	return version
+}
+
+// version returns the current version of an item, 0 if it does not exist
+func (ims *inMemoryStore) version(key string) uint64 {
+	ims.versionsMu.Lock()
+	defer ims.versionsMu.Unlock()
+	if _, found := ims.cache.Get(key); !found {
+		return 0
+	}
+	return ims.versions[key]
+}
+
+// onEvicted is called whenever an item is removed from the cache, either by Delete or because
+// it expired
+func (ims *inMemoryStore) onEvicted(key string, _ any) {
+	// the item may have been written again since it expired
+	ims.versionsMu.Lock()
+	if _, found := ims.cache.Get(key); !found {
+		delete(ims.versions, key)
+	}
+	ims.versionsMu.Unlock()
+
+	ims.evictionMu.Lock()
+	deleted := ims.deleting != nil && *ims.deleting == key
+	ims.evictionMu.Unlock()
+
+	if deleted {
+		ims.watchers.notify(EventDelete, key)
+		return
+	}
+	ims.watchers.notify(EventExpire, key)
 }
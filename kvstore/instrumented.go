@@ -0,0 +1,367 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxInstrumentedPrefixes bounds the number of distinct prefixes reported per store, the keys of
+// the other prefixes are reported under otherPrefix
+const (
+	maxInstrumentedPrefixes = 64
+	otherPrefix             = "other"
+)
+
+// DefaultSizeSampleInterval is the default number of values read or written per value whose size
+// is estimated
+const DefaultSizeSampleInterval = 100
+
+var (
+	durationBuckets = exponentialBuckets(0.0001, 4, 10) // 100µs to 26s
+	sizeBuckets     = exponentialBuckets(64, 4, 10)     // 64B to 16MB
+)
+
+// Metrics creates the metrics recorded by an instrumented store, e.g. in a Prometheus registry.
+// Metrics are created once, their series are then selected by label values, given in the order of
+// the label names.
+type Metrics interface {
+	// Counter creates a counter named name for every combination of label values
+	Counter(name, help string, labelNames ...string) CounterVec
+
+	// Histogram creates a histogram named name with buckets for every combination of label values
+	Histogram(name, help string, buckets []float64, labelNames ...string) HistogramVec
+}
+
+// CounterVec is a family of counters sharing a name.
+type CounterVec interface {
+	With(labelValues ...string) Counter
+}
+
+// Counter is a value that only increases.
+type Counter interface {
+	Inc()
+}
+
+// HistogramVec is a family of histograms sharing a name.
+type HistogramVec interface {
+	With(labelValues ...string) Histogram
+}
+
+// Histogram samples observations into buckets.
+type Histogram interface {
+	Observe(v float64)
+}
+
+// InstrumentedOptions configures an instrumented store.
+type InstrumentedOptions struct {
+	// Name is the value of the store label of the metrics
+	Name string
+
+	// ByNamespace reports namespaced keys under the store label of their namespace, and the
+	// prefix of the key within it. Keys outside of any namespace are reported under Name.
+	ByNamespace bool
+
+	// Prefix returns the prefix a key is reported under, defaults to KeyPrefix
+	Prefix func(key string) string
+
+	// SizeSampleInterval is the number of values read or written per value whose size is
+	// estimated, as estimating walks through the whole value. Values serialized to bytes are
+	// always measured. Defaults to DefaultSizeSampleInterval, 1 estimates every value.
+	SizeSampleInterval int
+}
+
+// KeyPrefix returns the part of the key before the first ':' or '?', so that keys of the same kind
+// (e.g. namespaced keys or URLs with a query string) are aggregated together
+func KeyPrefix(key string) string {
+	if i := strings.IndexAny(key, ":?"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+type instrumentedStore struct {
+	store ReadWriter
+	opts  InstrumentedOptions
+
+	operations CounterVec
+	errors     CounterVec
+	hits       CounterVec
+	misses     CounterVec
+	durations  HistogramVec
+	sizes      HistogramVec
+
+	// sized counts the values that could have been sized, to sample them
+	sized atomic.Uint64
+
+	mu       sync.Mutex
+	prefixes map[instrumentedLabels]bool
+}
+
+// instrumentedLabels are the store and prefix labels a key is reported under
+type instrumentedLabels struct {
+	store  string
+	prefix string
+}
+
+// NewInstrumentedStore returns a store recording the operations made on store in metrics:
+// operations, errors, hits and misses counts, latencies and sampled value sizes per key prefix.
+func NewInstrumentedStore(store ReadWriter, metrics Metrics, opts InstrumentedOptions) *instrumentedStore {
+	if opts.Prefix == nil {
+		opts.Prefix = KeyPrefix
+	}
+	if opts.SizeSampleInterval <= 0 {
+		opts.SizeSampleInterval = DefaultSizeSampleInterval
+	}
+	return &instrumentedStore{
+		store: store,
+		opts:  opts,
+		operations: metrics.Counter("kvstore_operations_total",
+			"Number of key value store operations.", "store", "prefix", "operation"),
+		errors: metrics.Counter("kvstore_errors_total",
+			"Number of failed key value store operations, not found items and version mismatches excluded.", "store", "prefix", "operation"),
+		hits: metrics.Counter("kvstore_hits_total",
+			"Number of reads of existing items.", "store", "prefix"),
+		misses: metrics.Counter("kvstore_misses_total",
+			"Number of reads of missing items.", "store", "prefix"),
+		durations: metrics.Histogram("kvstore_operation_duration_seconds",
+			"Latency of key value store operations.", durationBuckets, "store", "prefix", "operation"),
+		sizes: metrics.Histogram("kvstore_value_size_bytes",
+			"Size of the values read and written, estimated for a sample of the values that are not serialized.", sizeBuckets, "store", "prefix", "operation"),
+		prefixes: map[instrumentedLabels]bool{},
+	}
+}
+
+// Write an item to the store
+func (is *instrumentedStore) Write(ctx context.Context, key string, value any, expiry time.Duration) error {
+	start := time.Now()
+	err := is.store.Write(ctx, key, value, expiry)
+	labels := is.observe("write", key, start, err)
+	if err == nil {
+		is.observeSize(labels, "write", value)
+	}
+	return err
+}
+
+// Read an item from the store
+func (is *instrumentedStore) Read(ctx context.Context, key string) (any, error) {
+	start := time.Now()
+	value, err := is.store.Read(ctx, key)
+	labels := is.observe("read", key, start, err)
+	is.observeRead(labels, value, err)
+	return value, err
+}
+
+// ReadInto decodes an item into the value pointed to by dst
+func (is *instrumentedStore) ReadInto(ctx context.Context, key string, dst any) error {
+	start := time.Now()
+	err := ReadInto(ctx, is.store, key, dst)
+	labels := is.observe("read", key, start, err)
+	var value any
+	if err == nil {
+		value = reflect.ValueOf(dst).Elem().Interface()
+	}
+	is.observeRead(labels, value, err)
+	return err
+}
+
+// ReadVersion reads an item and its version
+func (is *instrumentedStore) ReadVersion(ctx context.Context, key string, dst any) (uint64, error) {
+	start := time.Now()
+	version, err := ReadVersion(ctx, is.store, key, dst)
+	labels := is.observe("read", key, start, err)
+	var value any
+	if err == nil {
+		value = reflect.ValueOf(dst).Elem().Interface()
+	}
+	is.observeRead(labels, value, err)
+	return version, err
+}
+
+// WriteIfVersion writes an item only if its current version is version
+func (is *instrumentedStore) WriteIfVersion(ctx context.Context, key string, value any, version uint64, expiry time.Duration) (uint64, error) {
+	start := time.Now()
+	version, err := WriteIfVersion(ctx, is.store, key, value, version, expiry)
+	labels := is.observe("write", key, start, err)
+	if err == nil {
+		is.observeSize(labels, "write", value)
+	}
+	return version, err
+}
+
+// ReadManyInto decodes many items into the map pointed to by dst, the batch is recorded once per
+// key prefix and the hits and misses per key
+func (is *instrumentedStore) ReadManyInto(ctx context.Context, keys []string, dst any) error {
+	start := time.Now()
+	err := ReadManyInto(ctx, is.store, keys, dst)
+	labels := is.observeBatch("read_many", keys, start, err)
+	if err != nil {
+		return err
+	}
+	items := reflect.ValueOf(dst).Elem()
+	for i, key := range keys {
+		item := items.MapIndex(reflect.ValueOf(key).Convert(items.Type().Key()))
+		if !item.IsValid() {
+			is.observeRead(labels[i], nil, ErrNotFound)
+			continue
+		}
+		is.observeRead(labels[i], item.Interface(), nil)
+	}
+	return nil
+}
+
+// WriteMany sets several items, the batch is recorded once per key prefix
+func (is *instrumentedStore) WriteMany(ctx context.Context, items map[string]any, expiry time.Duration) error {
+	start := time.Now()
+	err := WriteMany(ctx, is.store, items, expiry)
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	labels := is.observeBatch("write_many", keys, start, err)
+	if err == nil {
+		for i, key := range keys {
+			is.observeSize(labels[i], "write", items[key])
+		}
+	}
+	return err
+}
+
+// Exists reports whether an item is stored under key
+func (is *instrumentedStore) Exists(ctx context.Context, key string) (bool, error) {
+	start := time.Now()
+	exists, err := is.store.Exists(ctx, key)
+	is.observe("exists", key, start, err)
+	return exists, err
+}
+
+// TTL returns the remaining time to live of an item
+func (is *instrumentedStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	start := time.Now()
+	ttl, err := is.store.TTL(ctx, key)
+	is.observe("ttl", key, start, err)
+	return ttl, err
+}
+
+// Scan returns the keys starting with prefix
+func (is *instrumentedStore) Scan(ctx context.Context, prefix string) ([]string, error) {
+	start := time.Now()
+	keys, err := is.store.Scan(ctx, prefix)
+	is.observe("scan", prefix, start, err)
+	return keys, err
+}
+
+// Delete removes an item from the store
+func (is *instrumentedStore) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	err := is.store.Delete(ctx, key)
+	is.observe("delete", key, start, err)
+	return err
+}
+
+// Touch resets the expiry of an item
+func (is *instrumentedStore) Touch(ctx context.Context, key string, expiry time.Duration) error {
+	start := time.Now()
+	err := is.store.Touch(ctx, key, expiry)
+	is.observe("touch", key, start, err)
+	return err
+}
+
+// Watch returns a channel receiving the changes of the keys starting with prefix
+func (is *instrumentedStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return Watch(ctx, is.store, prefix)
+}
+
+// observe records an operation and returns the labels it was reported under
+func (is *instrumentedStore) observe(operation, key string, start time.Time, err error) instrumentedLabels {
+	labels := is.labels(key)
+	is.operations.With(labels.store, labels.prefix, operation).Inc()
+	is.durations.With(labels.store, labels.prefix, operation).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrVersionMismatch) {
+		is.errors.With(labels.store, labels.prefix, operation).Inc()
+	}
+	return labels
+}
+
+// observeBatch records a batch operation once per distinct labels and returns the labels each
+// key was reported under
+func (is *instrumentedStore) observeBatch(operation string, keys []string, start time.Time, err error) []instrumentedLabels {
+	labels := make([]instrumentedLabels, len(keys))
+	observed := map[instrumentedLabels]bool{}
+	for i, key := range keys {
+		labels[i] = is.labels(key)
+		if observed[labels[i]] {
+			continue
+		}
+		observed[labels[i]] = true
+		is.observe(operation, key, start, err)
+	}
+	return labels
+}
+
+// observeRead records the outcome of a read
+func (is *instrumentedStore) observeRead(labels instrumentedLabels, value any, err error) {
+	switch {
+	case err == nil:
+		is.hits.With(labels.store, labels.prefix).Inc()
+		is.observeSize(labels, "read", value)
+	case errors.Is(err, ErrNotFound):
+		is.misses.With(labels.store, labels.prefix).Inc()
+	}
+	// failed reads are neither hits nor misses
+}
+
+// observeSize records the size of a value, serialized values are measured and the size of the
+// others is estimated for one value out of SizeSampleInterval
+func (is *instrumentedStore) observeSize(labels instrumentedLabels, operation string, value any) {
+	var size int
+	switch value := value.(type) {
+	case []byte:
+		size = len(value)
+	case string:
+		size = len(value)
+	default:
+		if (is.sized.Add(1)-1)%uint64(is.opts.SizeSampleInterval) != 0 {
+			return
+		}
+		size = int(estimateSize(value))
+	}
+	is.sizes.With(labels.store, labels.prefix, operation).Observe(float64(size))
+}
+
+// exponentialBuckets returns count buckets, the first one being start and each following one
+// factor times the previous one
+func exponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// labels returns the labels a key is reported under, bounding the number of distinct prefixes
+func (is *instrumentedStore) labels(key string) instrumentedLabels {
+	labels := instrumentedLabels{store: is.opts.Name}
+	if is.opts.ByNamespace {
+		if namespace, rest, found := strings.Cut(key, NamespaceSeparator); found {
+			labels.store, key = namespace, rest
+		}
+	}
+	labels.prefix = is.opts.Prefix(key)
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if is.prefixes[labels] {
+		return labels
+	}
+	if len(is.prefixes) >= maxInstrumentedPrefixes {
+		return instrumentedLabels{store: labels.store, prefix: otherPrefix}
+	}
+	is.prefixes[labels] = true
+	return labels
+}
@@ -0,0 +1,170 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMetrics records the metrics of instrumented stores in memory, series are keyed by the name
+// and the label values of their metric
+type testMetrics struct {
+	mu         sync.Mutex
+	counters   map[string]float64
+	histograms map[string][]float64
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{counters: map[string]float64{}, histograms: map[string][]float64{}}
+}
+
+func (tm *testMetrics) Counter(name, _ string, _ ...string) CounterVec {
+	return testCounterVec{metrics: tm, name: name}
+}
+
+func (tm *testMetrics) Histogram(name, _ string, _ []float64, _ ...string) HistogramVec {
+	return testHistogramVec{metrics: tm, name: name}
+}
+
+// counter returns the value of a counter
+func (tm *testMetrics) counter(name string, labelValues ...string) float64 {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.counters[seriesKey(name, labelValues)]
+}
+
+// observations returns the values observed by a histogram
+func (tm *testMetrics) observations(name string, labelValues ...string) []float64 {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.histograms[seriesKey(name, labelValues)]
+}
+
+func seriesKey(name string, labelValues []string) string {
+	return name + "{" + strings.Join(labelValues, ",") + "}"
+}
+
+type testCounterVec struct {
+	metrics *testMetrics
+	name    string
+}
+
+func (cv testCounterVec) With(labelValues ...string) Counter {
+	return testSeries{metrics: cv.metrics, key: seriesKey(cv.name, labelValues)}
+}
+
+type testHistogramVec struct {
+	metrics *testMetrics
+	name    string
+}
+
+func (hv testHistogramVec) With(labelValues ...string) Histogram {
+	return testSeries{metrics: hv.metrics, key: seriesKey(hv.name, labelValues)}
+}
+
+type testSeries struct {
+	metrics *testMetrics
+	key     string
+}
+
+func (ts testSeries) Inc() {
+	ts.metrics.mu.Lock()
+	defer ts.metrics.mu.Unlock()
+	ts.metrics.counters[ts.key]++
+}
+
+func (ts testSeries) Observe(v float64) {
+	ts.metrics.mu.Lock()
+	defer ts.metrics.mu.Unlock()
+	ts.metrics.histograms[ts.key] = append(ts.metrics.histograms[ts.key], v)
+}
+
+func TestInstrumentedStore(t *testing.T) {
+	store := NewInMemoryStore(50*time.Millisecond, time.Minute)
+	testStore(t, NewInstrumentedStore(store, newTestMetrics(), InstrumentedOptions{Name: "test"}))
+}
+
+func TestInstrumentedStoreMetrics(t *testing.T) {
+	ctx := context.Background()
+	metrics := newTestMetrics()
+	store := NewInstrumentedStore(NewInMemoryStore(NoExpiration, time.Minute), metrics, InstrumentedOptions{Name: "test", SizeSampleInterval: 1})
+
+	_ = store.Write(ctx, "/repos?language=go", "response", NoExpiration)
+	_, _ = store.Read(ctx, "/repos?language=go")
+	var dst string
+	_ = store.ReadInto(ctx, "/repos?language=rust", &dst)
+	_ = ReadInto(ctx, store, "/repos?language=go", &dst)
+	_, _ = store.Read(ctx, "repositories")
+	_ = ReadInto(ctx, store, "/repos?language=go", new(int))
+
+	assert.Equal(t, 4.0, metrics.counter("kvstore_operations_total", "test", "/repos", "read"))
+	assert.Equal(t, 1.0, metrics.counter("kvstore_operations_total", "test", "/repos", "write"))
+	assert.Equal(t, 1.0, metrics.counter("kvstore_operations_total", "test", "repositories", "read"))
+	assert.Equal(t, 1.0, metrics.counter("kvstore_errors_total", "test", "/repos", "read"))
+	assert.Equal(t, 2.0, metrics.counter("kvstore_hits_total", "test", "/repos"))
+	assert.Equal(t, 1.0, metrics.counter("kvstore_misses_total", "test", "/repos"))
+	assert.Equal(t, 1.0, metrics.counter("kvstore_misses_total", "test", "repositories"))
+	assert.Len(t, metrics.observations("kvstore_operation_duration_seconds", "test", "/repos", "read"), 4)
+	assert.Len(t, metrics.observations("kvstore_value_size_bytes", "test", "/repos", "read"), 2)
+	assert.Len(t, metrics.observations("kvstore_value_size_bytes", "test", "/repos", "write"), 1)
+}
+
+func TestInstrumentedStoreByNamespace(t *testing.T) {
+	ctx := context.Background()
+	metrics := newTestMetrics()
+	store := NewInstrumentedStore(NewInMemoryStore(NoExpiration, time.Minute), metrics, InstrumentedOptions{Name: "test", ByNamespace: true})
+
+	_ = store.Write(ctx, "dataset:repositories", "value", NoExpiration)
+	_ = store.Write(ctx, "dataset:fetcher:cursor", "value", NoExpiration)
+	_ = store.Write(ctx, "responses:/repos?language=go", "value", NoExpiration)
+	_ = store.Write(ctx, "repositories", "value", NoExpiration)
+
+	assert.Equal(t, 1.0, metrics.counter("kvstore_operations_total", "dataset", "repositories", "write"))
+	assert.Equal(t, 1.0, metrics.counter("kvstore_operations_total", "dataset", "fetcher", "write"))
+	assert.Equal(t, 1.0, metrics.counter("kvstore_operations_total", "responses", "/repos", "write"))
+	assert.Equal(t, 1.0, metrics.counter("kvstore_operations_total", "test", "repositories", "write"))
+}
+
+func TestInstrumentedStoreSizeSampling(t *testing.T) {
+	ctx := context.Background()
+	metrics := newTestMetrics()
+	store := NewInstrumentedStore(NewInMemoryStore(NoExpiration, time.Minute), metrics, InstrumentedOptions{Name: "test", SizeSampleInterval: 10})
+
+	for i := 0; i < 25; i++ {
+		_ = store.Write(ctx, "repositories", []int{i}, NoExpiration)
+		_ = store.Write(ctx, "raw", []byte("value"), NoExpiration)
+	}
+
+	assert.Len(t, metrics.observations("kvstore_value_size_bytes", "test", "repositories", "write"), 3, "sizes should be estimated for a sample of the values")
+	raw := metrics.observations("kvstore_value_size_bytes", "test", "raw", "write")
+	assert.Len(t, raw, 25, "serialized values should always be measured")
+	sum := 0.0
+	for _, size := range raw {
+		sum += size
+	}
+	assert.Equal(t, 125.0, sum)
+}
+
+func TestInstrumentedStorePrefixCardinality(t *testing.T) {
+	ctx := context.Background()
+	metrics := newTestMetrics()
+	store := NewInstrumentedStore(NewInMemoryStore(NoExpiration, time.Minute), metrics, InstrumentedOptions{
+		Name:   "test",
+		Prefix: func(key string) string { return key },
+	})
+
+	for i := 0; i < maxInstrumentedPrefixes+10; i++ {
+		_ = store.Write(ctx, strings.Repeat("k", i+1), i, NoExpiration)
+	}
+
+	assert.Equal(t, 10.0, metrics.counter("kvstore_operations_total", "test", "other", "write"))
+}
+
+func TestKeyPrefix(t *testing.T) {
+	assert.Equal(t, "repositories", KeyPrefix("repositories"))
+	assert.Equal(t, "/repos", KeyPrefix("/repos?language=go"))
+	assert.Equal(t, "fetcher", KeyPrefix("fetcher:cursor"))
+}
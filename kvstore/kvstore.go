@@ -2,6 +2,9 @@ package kvstore
 
 import (
 	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"reflect"
 	"time"
 )
 
@@ -13,13 +16,111 @@ const (
 	NoExpiration time.Duration = -1
 )
 
+// ErrNotFound is returned by readers when the key does not exist or has expired.
+var ErrNotFound = errors.New("Key not found")
+
+// DecodeError is returned by readers when an item exists but cannot be decoded into the
+// requested type. Any other error returned by a reader means the backend could not be reached.
+type DecodeError struct {
+	Key string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Failed to decode key %q: %v", e.Key, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
 type Reader interface {
-	// Read fetches an item by key. Returns nil if not found.
-	Read(ctx context.Context, key string) any
+	// Read fetches an item by key. Returns ErrNotFound if not found.
+	Read(ctx context.Context, key string) (any, error)
+
+	// Exists reports whether an item is stored under key.
+	Exists(ctx context.Context, key string) (bool, error)
+
+	// TTL returns the remaining time to live of an item, or NoExpiration if it never expires.
+	// Returns ErrNotFound if not found.
+	TTL(ctx context.Context, key string) (time.Duration, error)
+
+	// Scan returns the keys starting with prefix, in no particular order.
+	// An empty prefix matches every key.
+	Scan(ctx context.Context, prefix string) ([]string, error)
 }
 
 type Writer interface {
 	// Write sets an item with a specified expiry. Use DefaultExpiration for the store's default
 	// expiration time, or NoExpiration for no expiration.
 	Write(ctx context.Context, key string, value any, expiry time.Duration) error
+
+	// Delete removes an item, deleting a key that does not exist is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// Touch resets the expiry of an item without modifying it, expiry follows the same rules as
+	// in Write. Returns ErrNotFound if not found.
+	Touch(ctx context.Context, key string, expiry time.Duration) error
+}
+
+// ReadWriter groups the Reader and Writer interfaces, it is implemented by every store.
+type ReadWriter interface {
+	Reader
+	Writer
+}
+
+// TypedReader is implemented by stores that serialize values and are therefore able to decode
+// an item directly into a typed destination.
+type TypedReader interface {
+	// ReadInto decodes the item stored under key into the value pointed to by dst.
+	// Returns ErrNotFound if not found and a *DecodeError if the item cannot be decoded.
+	ReadInto(ctx context.Context, key string, dst any) error
+}
+
+// ReadInto reads the item stored under key into the value pointed to by dst, whatever the store
+// backend: serializing stores decode the item, in-memory stores assign it.
+// Returns ErrNotFound if not found and a *DecodeError if the item does not fit into dst.
+func ReadInto(ctx context.Context, reader Reader, key string, dst any) error {
+	dstValue := reflect.ValueOf(dst)
+	if dstValue.Kind() != reflect.Pointer || dstValue.IsNil() {
+		return errors.Errorf("Destination must be a non-nil pointer, got %T", dst)
+	}
+
+	if typedReader, ok := reader.(TypedReader); ok {
+		return typedReader.ReadInto(ctx, key, dst)
+	}
+
+	value, err := reader.Read(ctx, key)
+	if err != nil {
+		return err
+	}
+	return assignInto(key, value, dst)
+}
+
+// assignInto sets the value pointed to by dst to the item stored under key by an in-memory store.
+// Returns a *DecodeError if the item does not fit into dst.
+func assignInto(key string, value any, dst any) error {
+	dstValue := reflect.ValueOf(dst)
+	if dstValue.Kind() != reflect.Pointer || dstValue.IsNil() {
+		return errors.Errorf("Destination must be a non-nil pointer, got %T", dst)
+	}
+	err := assignValue(value, dstValue.Elem())
+	if err != nil {
+		return &DecodeError{Key: key, Err: err}
+	}
+	return nil
+}
+
+// assignValue sets dst to value, dereferencing value if dst holds the pointed type
+func assignValue(value any, dst reflect.Value) error {
+	src := reflect.ValueOf(value)
+	if src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return nil
+	}
+	if src.Kind() == reflect.Pointer && !src.IsNil() && src.Elem().Type().AssignableTo(dst.Type()) {
+		dst.Set(src.Elem())
+		return nil
+	}
+	return errors.Errorf("Cannot assign stored %T to %s", value, dst.Type())
 }
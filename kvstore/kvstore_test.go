@@ -0,0 +1,204 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// testStore runs the behavioral test suite every store implementation must pass.
+// The store must be created with a default expiration of 50ms.
+func testStore(t *testing.T, store interface {
+	Reader
+	Writer
+}) {
+	ctx := context.Background()
+	key := "testKey"
+	value := "testValue"
+
+	t.Run("Write", func(t *testing.T) {
+		err := store.Write(ctx, key, value, cache.DefaultExpiration)
+		assert.NoError(t, err, "should not error on write")
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		readValue, err := store.Read(ctx, key)
+		assert.NoError(t, err, "should not error on read")
+		assert.Equal(t, value, readValue, "read value should match written value")
+	})
+
+	t.Run("Expiration", func(t *testing.T) {
+		time.Sleep(60 * time.Millisecond) // Wait for the item to expire
+		readValue, err := store.Read(ctx, key)
+		assert.ErrorIs(t, err, ErrNotFound, "should return ErrNotFound after expiration")
+		assert.Nil(t, readValue, "read value should be nil after expiration")
+	})
+
+	t.Run("ReadNonExistent", func(t *testing.T) {
+		readValue, err := store.Read(ctx, "non-existent-key")
+		assert.ErrorIs(t, err, ErrNotFound, "should return ErrNotFound for non-existent key")
+		assert.Nil(t, readValue, "read value should be nil for non-existent key")
+	})
+
+	t.Run("NoExpiration", func(t *testing.T) {
+		err := store.Write(ctx, "persistentKey", value, NoExpiration)
+		assert.NoError(t, err, "should not error on write")
+		time.Sleep(60 * time.Millisecond)
+		readValue, err := store.Read(ctx, "persistentKey")
+		assert.NoError(t, err, "item should not expire")
+		assert.Equal(t, value, readValue, "item should not expire")
+	})
+
+	t.Run("CustomExpiration", func(t *testing.T) {
+		err := store.Write(ctx, "shortLivedKey", value, 20*time.Millisecond)
+		assert.NoError(t, err, "should not error on write")
+		readValue, err := store.Read(ctx, "shortLivedKey")
+		assert.NoError(t, err, "item should be readable before expiry")
+		assert.Equal(t, value, readValue, "item should be readable before expiry")
+		time.Sleep(30 * time.Millisecond)
+		_, err = store.Read(ctx, "shortLivedKey")
+		assert.ErrorIs(t, err, ErrNotFound, "item should expire after its own expiry")
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		_ = store.Write(ctx, "overwrittenKey", "first", NoExpiration)
+		_ = store.Write(ctx, "overwrittenKey", "second", NoExpiration)
+		readValue, err := store.Read(ctx, "overwrittenKey")
+		assert.NoError(t, err, "should not error on read")
+		assert.Equal(t, "second", readValue, "write should override the existing item")
+	})
+
+	t.Run("Exists", func(t *testing.T) {
+		_ = store.Write(ctx, "existingKey", value, NoExpiration)
+		exists, err := store.Exists(ctx, "existingKey")
+		assert.NoError(t, err)
+		assert.True(t, exists, "written key should exist")
+		exists, err = store.Exists(ctx, "non-existent-key")
+		assert.NoError(t, err)
+		assert.False(t, exists, "non-existent key should not exist")
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		_ = store.Write(ctx, "ttlKey", value, time.Minute)
+		ttl, err := store.TTL(ctx, "ttlKey")
+		assert.NoError(t, err)
+		assert.InDelta(t, time.Minute, ttl, float64(time.Second), "TTL should match the write expiry")
+
+		_ = store.Write(ctx, "ttlKey", value, NoExpiration)
+		ttl, err = store.TTL(ctx, "ttlKey")
+		assert.NoError(t, err)
+		assert.Equal(t, NoExpiration, ttl, "TTL should be NoExpiration for persistent items")
+
+		_, err = store.TTL(ctx, "non-existent-key")
+		assert.ErrorIs(t, err, ErrNotFound, "should return ErrNotFound for non-existent key")
+	})
+
+	t.Run("Touch", func(t *testing.T) {
+		_ = store.Write(ctx, "touchedKey", value, 20*time.Millisecond)
+		assert.NoError(t, store.Touch(ctx, "touchedKey", time.Minute))
+		time.Sleep(30 * time.Millisecond)
+		readValue, err := store.Read(ctx, "touchedKey")
+		assert.NoError(t, err, "touched item should not expire with its former expiry")
+		assert.Equal(t, value, readValue, "touch should not modify the item")
+
+		assert.NoError(t, store.Touch(ctx, "touchedKey", NoExpiration))
+		ttl, _ := store.TTL(ctx, "touchedKey")
+		assert.Equal(t, NoExpiration, ttl, "touch should be able to remove the expiry")
+		assert.NoError(t, store.Touch(ctx, "touchedKey", NoExpiration), "touching a persistent item should succeed")
+
+		assert.NoError(t, store.Touch(ctx, "touchedKey", DefaultExpiration))
+		time.Sleep(60 * time.Millisecond)
+		_, err = store.Read(ctx, "touchedKey")
+		assert.ErrorIs(t, err, ErrNotFound, "touch should apply the default expiration")
+
+		assert.ErrorIs(t, store.Touch(ctx, "non-existent-key", time.Minute), ErrNotFound)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		_ = store.Write(ctx, "deletedKey", value, NoExpiration)
+		assert.NoError(t, store.Delete(ctx, "deletedKey"))
+		_, err := store.Read(ctx, "deletedKey")
+		assert.ErrorIs(t, err, ErrNotFound, "deleted item should not be readable")
+		assert.NoError(t, store.Delete(ctx, "deletedKey"), "deleting a non-existent key should not error")
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		_ = store.Write(ctx, "scan:a", value, NoExpiration)
+		_ = store.Write(ctx, "scan:b", value, NoExpiration)
+		_ = store.Write(ctx, "scan*:c", value, NoExpiration)
+		_ = store.Write(ctx, "scan:expired", value, time.Millisecond)
+		_ = store.Write(ctx, "other", value, NoExpiration)
+		time.Sleep(5 * time.Millisecond)
+
+		keys, err := store.Scan(ctx, "scan:")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"scan:a", "scan:b"}, keys, "scan should only return live keys with the prefix")
+
+		keys, err = store.Scan(ctx, "scan*")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"scan*:c"}, keys, "prefix should be matched literally")
+
+		keys, err = store.Scan(ctx, "")
+		assert.NoError(t, err)
+		assert.Subset(t, keys, []string{"scan:a", "scan:b", "scan*:c", "other"}, "empty prefix should match every key")
+	})
+
+	t.Run("ReadIntoDecodeError", func(t *testing.T) {
+		_ = store.Write(ctx, "stringKey", value, NoExpiration)
+		var dst int
+		err := ReadInto(ctx, store, "stringKey", &dst)
+		var decodeErr *DecodeError
+		assert.ErrorAs(t, err, &decodeErr, "should return a DecodeError on type mismatch")
+		assert.Equal(t, "stringKey", decodeErr.Key)
+	})
+}
+
+func TestReadInto(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStore(NoExpiration, NoExpiration)
+	item := &codecItemMock{Name: "foo"}
+	_ = store.Write(ctx, "pointer", item, NoExpiration)
+	_ = store.Write(ctx, "value", *item, NoExpiration)
+
+	t.Run("Pointer", func(t *testing.T) {
+		var dst *codecItemMock
+		err := ReadInto(ctx, store, "pointer", &dst)
+		assert.NoError(t, err)
+		assert.Same(t, item, dst)
+	})
+
+	t.Run("DereferencedPointer", func(t *testing.T) {
+		var dst codecItemMock
+		err := ReadInto(ctx, store, "pointer", &dst)
+		assert.NoError(t, err)
+		assert.Equal(t, *item, dst)
+	})
+
+	t.Run("Value", func(t *testing.T) {
+		var dst codecItemMock
+		err := ReadInto(ctx, store, "value", &dst)
+		assert.NoError(t, err)
+		assert.Equal(t, *item, dst)
+	})
+
+	t.Run("TypeMismatch", func(t *testing.T) {
+		var dst string
+		err := ReadInto(ctx, store, "value", &dst)
+		var decodeErr *DecodeError
+		assert.ErrorAs(t, err, &decodeErr)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		var dst codecItemMock
+		err := ReadInto(ctx, store, "non-existent-key", &dst)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("InvalidDestination", func(t *testing.T) {
+		var dst codecItemMock
+		err := ReadInto(ctx, store, "value", dst)
+		assert.Error(t, err)
+	})
+}
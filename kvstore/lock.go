@@ -0,0 +1,168 @@
+package kvstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// DefaultLockTTL is the default duration of a lock lease.
+const DefaultLockTTL = 30 * time.Second
+
+var (
+	// ErrLockHeld is returned when acquiring a lock held by another owner.
+	ErrLockHeld = errors.New("Lock is held by another owner")
+
+	// ErrLockLost is returned when renewing or releasing a lease that expired, the lock may have
+	// been acquired by another owner since.
+	ErrLockLost = errors.New("Lock lease was lost")
+)
+
+// LockOptions configures a lock.
+type LockOptions struct {
+	// TTL is the duration of a lease, leases must be renewed before they expire. Defaults to
+	// DefaultLockTTL
+	TTL time.Duration
+
+	// Owner identifies the holder of the lock, defaults to a random id
+	Owner string
+}
+
+// lockLease is the value stored under the lock key, released leases have no owner
+type lockLease struct {
+	Owner string `json:"owner"`
+	Token uint64 `json:"token"`
+}
+
+type lock struct {
+	store ReadWriter
+	key   string
+	opts  LockOptions
+}
+
+// NewLock returns a lease-based lock stored under key, the store must support versioned writes.
+// Leases expire after the lock TTL unless renewed, so that a crashed holder does not keep the
+// lock forever.
+func NewLock(store ReadWriter, key string, opts LockOptions) (*lock, error) {
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultLockTTL
+	}
+	if opts.Owner == "" {
+		id := make([]byte, 8)
+		_, err := rand.Read(id)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to generate lock owner id")
+		}
+		opts.Owner = hex.EncodeToString(id)
+	}
+	return &lock{
+		store: store,
+		key:   key,
+		opts:  opts,
+	}, nil
+}
+
+// Owner returns the id identifying the holder of the lock
+func (l *lock) Owner() string {
+	return l.opts.Owner
+}
+
+// TTL returns the duration of a lease
+func (l *lock) TTL() time.Duration {
+	return l.opts.TTL
+}
+
+// Acquire takes the lock, returns ErrLockHeld if another owner holds it
+func (l *lock) Acquire(ctx context.Context) (*Lease, error) {
+	var current lockLease
+	version, err := ReadVersion(ctx, l.store, l.key, &current)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err == nil && current.Owner != "" && current.Owner != l.opts.Owner {
+		return nil, ErrLockHeld
+	}
+
+	token, err := l.nextToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lease := lockLease{Owner: l.opts.Owner, Token: token}
+	version, err = WriteIfVersion(ctx, l.store, l.key, lease, version, l.opts.TTL)
+	if errors.Is(err, ErrVersionMismatch) {
+		return nil, ErrLockHeld
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Lease{
+		Token:   token,
+		lock:    l,
+		version: version,
+	}, nil
+}
+
+// nextToken increments the fencing token of the lock, which never expires so that tokens keep
+// increasing across leases
+func (l *lock) nextToken(ctx context.Context) (uint64, error) {
+	key := l.key + ":fencing"
+	for {
+		var token uint64
+		version, err := ReadVersion(ctx, l.store, key, &token)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return 0, err
+		}
+		_, err = WriteIfVersion(ctx, l.store, key, token+1, version, NoExpiration)
+		if errors.Is(err, ErrVersionMismatch) && ctx.Err() == nil {
+			continue
+		}
+		if err != nil {
+			return 0, errors.Wrap(err, "Failed to increment lock fencing token")
+		}
+		return token + 1, nil
+	}
+}
+
+// Lease is a lock acquisition, valid until the lock TTL elapses unless renewed.
+type Lease struct {
+	// Token is the fencing token of the lease, it increases with every acquisition of the lock so
+	// that the resources it protects can reject the writes of previous holders
+	Token uint64
+
+	lock *lock
+
+	mu       sync.Mutex
+	version  uint64
+	released bool
+}
+
+// Renew extends the lease by the lock TTL, returns ErrLockLost if it expired in the meantime
+func (le *Lease) Renew(ctx context.Context) error {
+	return le.write(ctx, lockLease{Owner: le.lock.opts.Owner, Token: le.Token}, false)
+}
+
+// Release gives the lock back before the lease expires, returns ErrLockLost if it already expired
+func (le *Lease) Release(ctx context.Context) error {
+	return le.write(ctx, lockLease{Token: le.Token}, true)
+}
+
+func (le *Lease) write(ctx context.Context, lease lockLease, release bool) error {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if le.released {
+		return ErrLockLost
+	}
+	version, err := WriteIfVersion(ctx, le.lock.store, le.lock.key, lease, le.version, le.lock.opts.TTL)
+	if errors.Is(err, ErrVersionMismatch) {
+		return ErrLockLost
+	}
+	if err != nil {
+		return err
+	}
+	le.version = version
+	le.released = release
+	return nil
+}
@@ -0,0 +1,86 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/MarouaneMan/github-api/internal/testutil/redistest"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestLock(t *testing.T, store ReadWriter, owner string) *lock {
+	l, err := NewLock(store, "locks:test", LockOptions{TTL: 50 * time.Millisecond, Owner: owner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLock(t *testing.T) {
+	for name, store := range map[string]ReadWriter{
+		"memory": NewInMemoryStore(NoExpiration, time.Minute),
+		"redis":  newTestRedisStore(t, redistest.New(t, ""), RedisOptions{}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			first, second := newTestLock(t, store, "first"), newTestLock(t, store, "second")
+
+			lease, err := first.Acquire(ctx)
+			assert.NoError(t, err)
+			_, err = second.Acquire(ctx)
+			assert.ErrorIs(t, err, ErrLockHeld, "should not acquire a held lock")
+
+			// renewals keep the lease past its TTL
+			for i := 0; i < 3; i++ {
+				time.Sleep(30 * time.Millisecond)
+				assert.NoError(t, lease.Renew(ctx))
+			}
+			_, err = second.Acquire(ctx)
+			assert.ErrorIs(t, err, ErrLockHeld, "renewed leases should not expire")
+
+			assert.NoError(t, lease.Release(ctx))
+			assert.ErrorIs(t, lease.Renew(ctx), ErrLockLost, "released leases should not be renewed")
+			next, err := second.Acquire(ctx)
+			assert.NoError(t, err, "should acquire a released lock")
+			assert.Greater(t, next.Token, lease.Token, "fencing tokens should increase")
+
+			// expired leases are lost and the lock can be acquired again
+			time.Sleep(60 * time.Millisecond)
+			assert.ErrorIs(t, next.Renew(ctx), ErrLockLost)
+			last, err := first.Acquire(ctx)
+			assert.NoError(t, err, "should acquire an expired lock")
+			assert.Greater(t, last.Token, next.Token, "fencing tokens should increase across expirations")
+			assert.ErrorIs(t, next.Release(ctx), ErrLockLost, "should not release a lock acquired by another owner")
+			assert.NoError(t, last.Release(ctx))
+		})
+	}
+}
+
+func TestLockLeasesDoNotRepeat(t *testing.T) {
+	ctx := context.Background()
+	store := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})
+	lock := newTestLock(t, store, "owner")
+
+	var versions []uint64
+	for i := 0; i < 3; i++ {
+		lease, err := lock.Acquire(ctx)
+		assert.NoError(t, err)
+		var current lockLease
+		version, _ := store.ReadVersion(ctx, "locks:test", &current)
+		assert.NotContains(t, versions, version, "leases should never get a former version back")
+		versions = append(versions, version)
+		assert.NoError(t, lease.Release(ctx))
+	}
+}
+
+func TestLockNotSupported(t *testing.T) {
+	_, err := newTestLock(t, newTestBoundedStore(t, BoundedOptions{}), "").Acquire(context.Background())
+	assert.ErrorIs(t, err, ErrVersioningNotSupported)
+}
+
+func TestLockDefaults(t *testing.T) {
+	l, err := NewLock(NewInMemoryStore(NoExpiration, time.Minute), "locks:test", LockOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultLockTTL, l.TTL())
+	assert.Len(t, l.Owner(), 16, "should generate a random owner id")
+}
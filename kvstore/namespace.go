@@ -0,0 +1,246 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// NamespaceSeparator separates a namespace from the keys it holds.
+const NamespaceSeparator = ":"
+
+// ErrInvalidKey is returned when a key does not match the schema of its namespace.
+var ErrInvalidKey = errors.New("Invalid key")
+
+// NamespaceOptions configures a namespaced store.
+type NamespaceOptions struct {
+	// KeyPattern is the schema of the keys of the namespace, keys not matching it are refused
+	// with ErrInvalidKey. A nil pattern accepts every non-empty key.
+	KeyPattern *regexp.Regexp
+}
+
+// namespacedStore isolates the keys of a subsystem, tenant or environment by prefixing them with
+// the namespace name, so that they cannot collide with the keys of another namespace
+type namespacedStore struct {
+	inner  ReadWriter
+	name   string
+	prefix string
+	opts   NamespaceOptions
+}
+
+// NewNamespacedStore returns a store holding its keys under the namespace name of inner.
+// Namespaces are nested by wrapping a namespaced store.
+func NewNamespacedStore(inner ReadWriter, name string, opts NamespaceOptions) (*namespacedStore, error) {
+	if name == "" || strings.Contains(name, NamespaceSeparator) {
+		return nil, errors.Errorf("Invalid namespace %q, it must be non-empty and must not contain %q", name, NamespaceSeparator)
+	}
+	return &namespacedStore{
+		inner:  inner,
+		name:   name,
+		prefix: name + NamespaceSeparator,
+		opts:   opts,
+	}, nil
+}
+
+// Name returns the name of the namespace
+func (ns *namespacedStore) Name() string {
+	return ns.name
+}
+
+// Write an item to the namespace
+func (ns *namespacedStore) Write(ctx context.Context, key string, value any, expiry time.Duration) error {
+	storedKey, err := ns.storedKey(key)
+	if err != nil {
+		return err
+	}
+	return ns.inner.Write(ctx, storedKey, value, expiry)
+}
+
+// Delete removes an item from the namespace
+func (ns *namespacedStore) Delete(ctx context.Context, key string) error {
+	storedKey, err := ns.storedKey(key)
+	if err != nil {
+		return err
+	}
+	return ns.inner.Delete(ctx, storedKey)
+}
+
+// Touch resets the expiry of an item of the namespace
+func (ns *namespacedStore) Touch(ctx context.Context, key string, expiry time.Duration) error {
+	storedKey, err := ns.storedKey(key)
+	if err != nil {
+		return err
+	}
+	return ns.inner.Touch(ctx, storedKey, expiry)
+}
+
+// Read an item from the namespace
+func (ns *namespacedStore) Read(ctx context.Context, key string) (any, error) {
+	storedKey, err := ns.storedKey(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := ns.inner.Read(ctx, storedKey)
+	return value, ns.unqualify(err)
+}
+
+// ReadInto decodes an item of the namespace into the value pointed to by dst
+func (ns *namespacedStore) ReadInto(ctx context.Context, key string, dst any) error {
+	storedKey, err := ns.storedKey(key)
+	if err != nil {
+		return err
+	}
+	return ns.unqualify(ReadInto(ctx, ns.inner, storedKey, dst))
+}
+
+// Exists reports whether an item is stored under key in the namespace
+func (ns *namespacedStore) Exists(ctx context.Context, key string) (bool, error) {
+	storedKey, err := ns.storedKey(key)
+	if err != nil {
+		return false, err
+	}
+	return ns.inner.Exists(ctx, storedKey)
+}
+
+// TTL returns the remaining time to live of an item of the namespace
+func (ns *namespacedStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	storedKey, err := ns.storedKey(key)
+	if err != nil {
+		return 0, err
+	}
+	return ns.inner.TTL(ctx, storedKey)
+}
+
+// Scan returns the keys of the namespace starting with prefix, without the namespace prefix
+func (ns *namespacedStore) Scan(ctx context.Context, prefix string) ([]string, error) {
+	storedKeys, err := ns.inner.Scan(ctx, ns.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(storedKeys))
+	for _, storedKey := range storedKeys {
+		keys = append(keys, strings.TrimPrefix(storedKey, ns.prefix))
+	}
+	return keys, nil
+}
+
+// Flush deletes every item of the namespace, leaving the other namespaces untouched, and returns
+// the number of deleted items
+func (ns *namespacedStore) Flush(ctx context.Context) (int, error) {
+	storedKeys, err := ns.inner.Scan(ctx, ns.prefix)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to list the keys of namespace %q", ns.name)
+	}
+	for i, storedKey := range storedKeys {
+		err = ns.inner.Delete(ctx, storedKey)
+		if err != nil {
+			return i, errors.Wrapf(err, "Failed to flush namespace %q", ns.name)
+		}
+	}
+	return len(storedKeys), nil
+}
+
+// ReadManyInto decodes items of the namespace into the map pointed to by dst
+func (ns *namespacedStore) ReadManyInto(ctx context.Context, keys []string, dst any) error {
+	items, err := batchDestination(dst)
+	if err != nil {
+		return err
+	}
+	storedKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		storedKey, err := ns.storedKey(key)
+		if err != nil {
+			return err
+		}
+		storedKeys = append(storedKeys, storedKey)
+	}
+
+	stored := reflect.New(items.Type())
+	err = ReadManyInto(ctx, ns.inner, storedKeys, stored.Interface())
+	if err != nil {
+		return ns.unqualify(err)
+	}
+	iter := stored.Elem().MapRange()
+	for iter.Next() {
+		key := strings.TrimPrefix(iter.Key().String(), ns.prefix)
+		items.SetMapIndex(reflect.ValueOf(key).Convert(items.Type().Key()), iter.Value())
+	}
+	return nil
+}
+
+// WriteMany sets several items of the namespace
+func (ns *namespacedStore) WriteMany(ctx context.Context, items map[string]any, expiry time.Duration) error {
+	stored := make(map[string]any, len(items))
+	for key, value := range items {
+		storedKey, err := ns.storedKey(key)
+		if err != nil {
+			return err
+		}
+		stored[storedKey] = value
+	}
+	return WriteMany(ctx, ns.inner, stored, expiry)
+}
+
+// ReadVersion reads an item of the namespace and its version
+func (ns *namespacedStore) ReadVersion(ctx context.Context, key string, dst any) (uint64, error) {
+	storedKey, err := ns.storedKey(key)
+	if err != nil {
+		return 0, err
+	}
+	version, err := ReadVersion(ctx, ns.inner, storedKey, dst)
+	return version, ns.unqualify(err)
+}
+
+// WriteIfVersion writes an item of the namespace only if its current version is version
+func (ns *namespacedStore) WriteIfVersion(ctx context.Context, key string, value any, version uint64, expiry time.Duration) (uint64, error) {
+	storedKey, err := ns.storedKey(key)
+	if err != nil {
+		return 0, err
+	}
+	return WriteIfVersion(ctx, ns.inner, storedKey, value, version, expiry)
+}
+
+// Watch returns a channel receiving the changes of the keys of the namespace starting with prefix
+func (ns *namespacedStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	storedEvents, err := Watch(ctx, ns.inner, ns.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan Event, watchBuffer)
+	go func() {
+		defer close(events)
+		for event := range storedEvents {
+			event.Key = strings.TrimPrefix(event.Key, ns.prefix)
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// storedKey validates key against the schema of the namespace and returns the key it is stored
+// under in the inner store
+func (ns *namespacedStore) storedKey(key string) (string, error) {
+	if key == "" {
+		return "", errors.Wrapf(ErrInvalidKey, "Empty key in namespace %q", ns.name)
+	}
+	if ns.opts.KeyPattern != nil && !ns.opts.KeyPattern.MatchString(key) {
+		return "", errors.Wrapf(ErrInvalidKey, "Key %q does not match the schema %q of namespace %q", key, ns.opts.KeyPattern, ns.name)
+	}
+	return ns.prefix + key, nil
+}
+
+// unqualify reports decoding errors under the key of the namespace rather than the stored key
+func (ns *namespacedStore) unqualify(err error) error {
+	var decodeErr *DecodeError
+	if errors.As(err, &decodeErr) && strings.HasPrefix(decodeErr.Key, ns.prefix) {
+		return &DecodeError{Key: strings.TrimPrefix(decodeErr.Key, ns.prefix), Err: decodeErr.Err}
+	}
+	return err
+}
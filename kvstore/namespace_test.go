@@ -0,0 +1,91 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/MarouaneMan/github-api/internal/testutil/redistest"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func newTestNamespacedStore(t *testing.T, inner ReadWriter, name string, opts NamespaceOptions) *namespacedStore {
+	store, err := NewNamespacedStore(inner, name, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestNamespacedStore(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		store := newTestNamespacedStore(t, NewInMemoryStore(50*time.Millisecond, time.Minute), "tenant", NamespaceOptions{})
+		testStore(t, store)
+		testVersioner(t, store)
+		testWatch(t, store)
+	})
+	t.Run("redis", func(t *testing.T) {
+		inner := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})
+		store := newTestNamespacedStore(t, inner, "tenant", NamespaceOptions{})
+		testStore(t, store)
+		testBatch(t, store)
+	})
+	t.Run("nested", func(t *testing.T) {
+		env := newTestNamespacedStore(t, NewInMemoryStore(50*time.Millisecond, time.Minute), "prod", NamespaceOptions{})
+		store := newTestNamespacedStore(t, env, "tenant", NamespaceOptions{})
+		testStore(t, store)
+		testBatch(t, store)
+	})
+}
+
+func TestNamespacedStoreIsolation(t *testing.T) {
+	ctx := context.Background()
+	inner := NewInMemoryStore(NoExpiration, time.Minute)
+	dataset := newTestNamespacedStore(t, inner, "dataset", NamespaceOptions{})
+	responses := newTestNamespacedStore(t, inner, "responses", NamespaceOptions{})
+
+	assert.NoError(t, dataset.Write(ctx, "repositories", "dataset", NoExpiration))
+	assert.NoError(t, responses.Write(ctx, "repositories", "response", NoExpiration))
+	assert.NoError(t, responses.Write(ctx, "/repos", "response", NoExpiration))
+
+	value, err := dataset.Read(ctx, "repositories")
+	assert.NoError(t, err)
+	assert.Equal(t, "dataset", value, "namespaces should not collide")
+	exists, _ := inner.Exists(ctx, "dataset:repositories")
+	assert.True(t, exists, "keys should be stored under the namespace prefix")
+
+	keys, err := responses.Scan(ctx, "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"repositories", "/repos"}, keys, "scan should only list the keys of the namespace")
+
+	flushed, err := responses.Flush(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, flushed)
+	keys, _ = responses.Scan(ctx, "")
+	assert.Empty(t, keys, "flush should delete every key of the namespace")
+	value, err = dataset.Read(ctx, "repositories")
+	assert.NoError(t, err)
+	assert.Equal(t, "dataset", value, "flush should not touch other namespaces")
+}
+
+func TestNamespacedStoreKeySchema(t *testing.T) {
+	ctx := context.Background()
+	store := newTestNamespacedStore(t, NewInMemoryStore(NoExpiration, time.Minute), "responses", NamespaceOptions{
+		KeyPattern: regexp.MustCompile("^/"),
+	})
+
+	assert.NoError(t, store.Write(ctx, "/repos", 1, NoExpiration))
+	assert.ErrorIs(t, store.Write(ctx, "repositories", 1, NoExpiration), ErrInvalidKey, "keys should match the schema")
+	_, err := store.Read(ctx, "repositories")
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	assert.ErrorIs(t, store.Delete(ctx, ""), ErrInvalidKey, "empty keys should be refused")
+	assert.ErrorIs(t, store.WriteMany(ctx, map[string]any{"/repos": 1, "stats": 1}, NoExpiration), ErrInvalidKey)
+}
+
+func TestNewNamespacedStoreInvalidName(t *testing.T) {
+	inner := NewInMemoryStore(NoExpiration, time.Minute)
+	for _, name := range []string{"", "prod:dataset"} {
+		_, err := NewNamespacedStore(inner, name, NamespaceOptions{})
+		assert.Error(t, err, "namespace %q should be refused", name)
+	}
+}
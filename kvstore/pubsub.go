@@ -0,0 +1,77 @@
+package kvstore
+
+import (
+	"context"
+	"sync"
+)
+
+// PubSub broadcasts messages between the instances sharing a backend.
+type PubSub interface {
+	// Publish sends message to the subscribers of channel
+	Publish(ctx context.Context, channel, message string) error
+
+	// Subscribe calls onMessage with the messages published on channel until ctx is done.
+	// The subscription may be established asynchronously: onResync is called once subscribed and
+	// whenever messages may have been missed (e.g. after a reconnection), so that subscribers can
+	// drop the state derived from the messages.
+	Subscribe(ctx context.Context, channel string, onMessage func(message string), onResync func())
+}
+
+type localSubscriber struct {
+	onMessage func(message string)
+}
+
+type localPubSub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[*localSubscriber]bool
+}
+
+// NewLocalPubSub returns a PubSub delivering messages to the subscribers of the current process.
+// Messages are delivered synchronously by Publish.
+func NewLocalPubSub() *localPubSub {
+	return &localPubSub{
+		subscribers: map[string]map[*localSubscriber]bool{},
+	}
+}
+
+// Publish sends message to the subscribers of channel
+func (lps *localPubSub) Publish(_ context.Context, channel, message string) error {
+	lps.mu.Lock()
+	subscribers := make([]*localSubscriber, 0, len(lps.subscribers[channel]))
+	for subscriber := range lps.subscribers[channel] {
+		subscribers = append(subscribers, subscriber)
+	}
+	lps.mu.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber.onMessage(message)
+	}
+	return nil
+}
+
+// Subscribe calls onMessage with the messages published on channel until ctx is done.
+// The subscription is active when Subscribe returns, onResync is called once before returning.
+func (lps *localPubSub) Subscribe(ctx context.Context, channel string, onMessage func(message string), onResync func()) {
+	subscriber := &localSubscriber{onMessage: onMessage}
+
+	lps.mu.Lock()
+	if lps.subscribers[channel] == nil {
+		lps.subscribers[channel] = map[*localSubscriber]bool{}
+	}
+	lps.subscribers[channel][subscriber] = true
+	lps.mu.Unlock()
+
+	if onResync != nil {
+		onResync()
+	}
+
+	go func() {
+		<-ctx.Done()
+		lps.mu.Lock()
+		defer lps.mu.Unlock()
+		delete(lps.subscribers[channel], subscriber)
+		if len(lps.subscribers[channel]) == 0 {
+			delete(lps.subscribers, channel)
+		}
+	}()
+}
@@ -1,26 +1,628 @@
 package kvstore
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"strings"
 	"time"
 )
 
-//TODO: implement this and move fetcher to its own app
+// RedisOptions holds the settings needed to reach a redis server.
+type RedisOptions struct {
+	Addr         string
+	Password     string
+	DB           int
+	PoolSize     int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
 
-type redisStore struct{}
+	// Codec used to serialize values, defaults to JSONCodec
+	Codec Codec
+}
+
+// redisPipelineSize is the maximum number of commands sent in a single round trip by batch
+// operations, larger batches are split to bound the buffers
+const redisPipelineSize = 1000
+
+// Bounds of the delay between two subscription attempts
+const (
+	redisMinBackoff = 100 * time.Millisecond
+	redisMaxBackoff = 5 * time.Second
+)
 
-func NewRedisStore(_, _ time.Duration) *redisStore {
-	return &redisStore{}
+type redisStore struct {
+	db                int
+	pool              *respPool
+	codec             Codec
+	defaultExpiration time.Duration
 }
 
-// Write an item to the store, overriding the existing one
-func (ims *redisStore) Write(_ context.Context, _ string, _ any, _ time.Duration) error {
-	panic("redisStore.Write: unimplemented")
+// NewRedisStore returns a new key value store backed by a redis server.
+// Connections are established lazily and kept in a pool of at most opts.PoolSize connections.
+// Items written with DefaultExpiration expire after defaultExpiration, or never if it is not positive.
+func NewRedisStore(opts RedisOptions, defaultExpiration time.Duration) *redisStore {
+	dial := func(ctx context.Context) (*respConn, error) {
+		dialer := net.Dialer{Timeout: opts.DialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", opts.Addr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to connect to redis at %s", opts.Addr)
+		}
+		rc := &respConn{
+			conn:         conn,
+			reader:       bufio.NewReader(conn),
+			writer:       bufio.NewWriter(conn),
+			readTimeout:  opts.ReadTimeout,
+			writeTimeout: opts.WriteTimeout,
+		}
+
+		// authenticate and select the database before handing over the connection
+		if opts.Password != "" {
+			_, err = rc.do(ctx, "AUTH", opts.Password)
+			if err != nil {
+				_ = rc.close()
+				return nil, errors.Wrap(err, "Failed to authenticate to redis")
+			}
+		}
+		if opts.DB != 0 {
+			_, err = rc.do(ctx, "SELECT", opts.DB)
+			if err != nil {
+				_ = rc.close()
+				return nil, errors.Wrapf(err, "Failed to select redis database %d", opts.DB)
+			}
+		}
+		return rc, nil
+	}
+
+	codec := opts.Codec
+	if codec == nil {
+		codec = JSONCodec
+	}
+
+	return &redisStore{
+		db:                opts.DB,
+		pool:              newRespPool(opts.PoolSize, dial),
+		codec:             codec,
+		defaultExpiration: defaultExpiration,
+	}
+}
+
+// Write an item to the store, overriding the existing one.
+// The value is serialized using the store's codec.
+func (rs *redisStore) Write(ctx context.Context, key string, value any, expiry time.Duration) error {
+	data, err := rs.codec.Marshal(value)
+	if err != nil {
+		return errors.Wrap(err, "Failed to serialize value")
+	}
+
+	args := []any{"SET", key, data}
+	if expiry = rs.expiration(expiry); expiry != NoExpiration {
+		args = append(args, "PX", toMilliseconds(expiry))
+	}
+	_, err = rs.pool.do(ctx, args...)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write key %q to redis", key)
+	}
 	return nil
 }
 
-// Read an item from the store, returns the item or nil if not found
-func (ims *redisStore) Read(_ context.Context, _ string) any {
-	panic("redisStore. Read: unimplemented")
+// Read an item from the store, returns the item or ErrNotFound if not found.
+// The item is decoded into an untyped value (e.g. map[string]any for structs), use ReadInto to
+// decode typed values.
+func (rs *redisStore) Read(ctx context.Context, key string) (any, error) {
+	var value any
+	err := rs.ReadInto(ctx, key, &value)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// ReadInto decodes the item stored under key into the value pointed to by dst.
+// Returns ErrNotFound if not found and a *DecodeError if the item cannot be decoded.
+func (rs *redisStore) ReadInto(ctx context.Context, key string, dst any) error {
+	reply, err := rs.pool.do(ctx, "GET", key)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read key %q from redis", key)
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return ErrNotFound
+	}
+
+	err = rs.codec.Unmarshal(data, dst)
+	if err != nil {
+		return &DecodeError{Key: key, Err: err}
+	}
+	return nil
+}
+
+// ReadVersion decodes the item stored under key into the value pointed to by dst and returns its
+// version, derived from the serialized item
+func (rs *redisStore) ReadVersion(ctx context.Context, key string, dst any) (uint64, error) {
+	reply, err := rs.pool.do(ctx, "GET", key)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to read key %q from redis", key)
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return 0, ErrNotFound
+	}
+
+	err = rs.codec.Unmarshal(data, dst)
+	if err != nil {
+		return 0, &DecodeError{Key: key, Err: err}
+	}
+	return contentVersion(data), nil
+}
+
+// WriteIfVersion writes an item only if its current version is version, the key is watched
+// during the check so that the write is aborted if the item is modified concurrently
+func (rs *redisStore) WriteIfVersion(ctx context.Context, key string, value any, version uint64, expiry time.Duration) (uint64, error) {
+	data, err := rs.codec.Marshal(value)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to serialize value")
+	}
+	args := []any{"SET", key, data}
+	if expiry = rs.expiration(expiry); expiry != NoExpiration {
+		args = append(args, "PX", toMilliseconds(expiry))
+	}
+
+	conn, err := rs.pool.get(ctx)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to write key %q to redis", key)
+	}
+	defer rs.pool.put(conn)
+
+	committed, err := rs.writeIfVersion(ctx, conn, key, version, args)
+	if err != nil {
+		// the connection may be left in the middle of a transaction
+		conn.broken = true
+		return 0, errors.Wrapf(err, "Failed to write key %q to redis", key)
+	}
+	if !committed {
+		return 0, ErrVersionMismatch
+	}
+	return contentVersion(data), nil
+}
+
+// writeIfVersion runs the optimistic transaction of WriteIfVersion on conn, reports whether the
+// write was committed
+func (rs *redisStore) writeIfVersion(ctx context.Context, conn *respConn, key string, version uint64, args []any) (bool, error) {
+	_, err := conn.do(ctx, "WATCH", key)
+	if err != nil {
+		return false, err
+	}
+	reply, err := conn.do(ctx, "GET", key)
+	if err != nil {
+		return false, err
+	}
+	var current uint64
+	if data, ok := reply.([]byte); ok {
+		current = contentVersion(data)
+	}
+	if current != version {
+		_, err = conn.do(ctx, "UNWATCH")
+		return false, err
+	}
+
+	_, err = conn.do(ctx, "MULTI")
+	if err != nil {
+		return false, err
+	}
+	_, err = conn.do(ctx, args...)
+	if err != nil {
+		return false, err
+	}
+	// EXEC replies a null array when the watched key was modified
+	reply, err = conn.do(ctx, "EXEC")
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// ReadManyInto decodes the items stored under keys into the map pointed to by dst, the items are
+// read with pipelined GET commands
+func (rs *redisStore) ReadManyInto(ctx context.Context, keys []string, dst any) error {
+	items, err := batchDestination(dst)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(keys); start += redisPipelineSize {
+		end := start + redisPipelineSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+		commands := make([][]any, len(batch))
+		for i, key := range batch {
+			commands[i] = []any{"GET", key}
+		}
+		replies, err := rs.pool.pipeline(ctx, commands)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read keys from redis")
+		}
+
+		for i, reply := range replies {
+			key := batch[i]
+			switch r := reply.(type) {
+			case respError:
+				return errors.Wrapf(r, "Failed to read key %q from redis", key)
+			case []byte:
+				err = decodeBatchItem(items, key, func(dst any) error {
+					err := rs.codec.Unmarshal(r, dst)
+					if err != nil {
+						return &DecodeError{Key: key, Err: err}
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// WriteMany sets several items with pipelined SET commands, the writes are not atomic: some items
+// may have been written when an error is returned
+func (rs *redisStore) WriteMany(ctx context.Context, items map[string]any, expiry time.Duration) error {
+	commands := make([][]any, 0, len(items))
+	for key, value := range items {
+		data, err := rs.codec.Marshal(value)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to serialize key %q value", key)
+		}
+		args := []any{"SET", key, data}
+		if expiry := rs.expiration(expiry); expiry != NoExpiration {
+			args = append(args, "PX", toMilliseconds(expiry))
+		}
+		commands = append(commands, args)
+	}
+
+	for start := 0; start < len(commands); start += redisPipelineSize {
+		end := start + redisPipelineSize
+		if end > len(commands) {
+			end = len(commands)
+		}
+		replies, err := rs.pool.pipeline(ctx, commands[start:end])
+		if err != nil {
+			return errors.Wrap(err, "Failed to write keys to redis")
+		}
+		for i, reply := range replies {
+			if rerr, ok := reply.(respError); ok {
+				return errors.Wrapf(rerr, "Failed to write key %q to redis", commands[start+i][1])
+			}
+		}
+	}
+	return nil
+}
+
+// Exists reports whether an item is stored under key
+func (rs *redisStore) Exists(ctx context.Context, key string) (bool, error) {
+	reply, err := rs.pool.do(ctx, "EXISTS", key)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to check key %q existence in redis", key)
+	}
+	return reply == int64(1), nil
+}
+
+// TTL returns the remaining time to live of an item, or NoExpiration if it never expires
+func (rs *redisStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	reply, err := rs.pool.do(ctx, "PTTL", key)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to read key %q TTL from redis", key)
+	}
+	ttl, _ := reply.(int64)
+	switch ttl {
+	case -2:
+		return 0, ErrNotFound
+	case -1:
+		return NoExpiration, nil
+	}
+	return time.Duration(ttl) * time.Millisecond, nil
+}
+
+// Scan returns the keys starting with prefix, iterating over the keyspace with SCAN so that
+// redis is never blocked by a large keyspace
+func (rs *redisStore) Scan(ctx context.Context, prefix string) ([]string, error) {
+	pattern := escapeRedisPattern(prefix) + "*"
+
+	// SCAN may return a key multiple times
+	seen := map[string]bool{}
+	keys := []string{}
+	cursor := []byte("0")
+	for {
+		reply, err := rs.pool.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", 100)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to scan keys with prefix %q in redis", prefix)
+		}
+		page, ok := reply.([]any)
+		if !ok || len(page) != 2 {
+			return nil, errors.Errorf("Unexpected redis SCAN reply %v", reply)
+		}
+		cursor, _ = page[0].([]byte)
+		batch, _ := page[1].([]any)
+		for _, elem := range batch {
+			key, _ := elem.([]byte)
+			if !seen[string(key)] {
+				seen[string(key)] = true
+				keys = append(keys, string(key))
+			}
+		}
+		if string(cursor) == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// Delete removes an item from the store
+func (rs *redisStore) Delete(ctx context.Context, key string) error {
+	_, err := rs.pool.do(ctx, "DEL", key)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to delete key %q from redis", key)
+	}
 	return nil
 }
+
+// Touch resets the expiry of an item
+func (rs *redisStore) Touch(ctx context.Context, key string, expiry time.Duration) error {
+	if expiry = rs.expiration(expiry); expiry != NoExpiration {
+		reply, err := rs.pool.do(ctx, "PEXPIRE", key, toMilliseconds(expiry))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to touch key %q in redis", key)
+		}
+		if reply != int64(1) {
+			return ErrNotFound
+		}
+		return nil
+	}
+
+	reply, err := rs.pool.do(ctx, "PERSIST", key)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to touch key %q in redis", key)
+	}
+	if reply == int64(1) {
+		return nil
+	}
+	// PERSIST also replies 0 for keys without expiry
+	exists, err := rs.Exists(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Publish sends message to the subscribers of channel
+func (rs *redisStore) Publish(ctx context.Context, channel, message string) error {
+	_, err := rs.pool.do(ctx, "PUBLISH", channel, message)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to publish to redis channel %q", channel)
+	}
+	return nil
+}
+
+// Subscribe calls onMessage with the messages published on channel until ctx is done.
+// The subscription runs on a dedicated connection established in background and reconnected on
+// failure, onResync is called every time the subscription is (re)established.
+func (rs *redisStore) Subscribe(ctx context.Context, channel string, onMessage func(message string), onResync func()) {
+	args := []any{"SUBSCRIBE", channel}
+	onPush := func(push []any) {
+		// pushed messages are formatted as ["message", channel, payload]
+		if len(push) == 3 && isRedisBulk(push[0], "message") {
+			message, _ := push[2].([]byte)
+			onMessage(string(message))
+		}
+	}
+	if onResync == nil {
+		onResync = func() {}
+	}
+
+	go func() {
+		conn, err := rs.subscribe(ctx, args...)
+		if err == nil {
+			onResync()
+		}
+		rs.keepSubscribed(ctx, conn, args, onPush, onResync)
+	}()
+}
+
+// Watch returns a channel receiving the changes of the keys starting with prefix.
+// It relies on keyspace notifications, which must be enabled on the server for generic, string
+// and expired events (notify-keyspace-events "K$gx", see EnableKeyspaceNotifications). Writes with
+// an expiry are also notified as touches.
+func (rs *redisStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	channelPrefix := fmt.Sprintf("__keyspace@%d__:", rs.db)
+	args := []any{"PSUBSCRIBE", channelPrefix + escapeRedisPattern(prefix) + "*"}
+	conn, err := rs.subscribe(ctx, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to watch keys with prefix %q in redis", prefix)
+	}
+
+	subscription := newWatchSubscription(prefix)
+	onPush := func(push []any) {
+		// keyspace notifications are formatted as ["pmessage", pattern, channel, event]
+		if len(push) != 4 || !isRedisBulk(push[0], "pmessage") {
+			return
+		}
+		channel, _ := push[2].([]byte)
+		event, _ := push[3].([]byte)
+		eventType, ok := redisKeyspaceEvents[string(event)]
+		if ok {
+			subscription.send(Event{Type: eventType, Key: strings.TrimPrefix(string(channel), channelPrefix)})
+		}
+	}
+	go func() {
+		defer subscription.close()
+		rs.keepSubscribed(ctx, conn, args, onPush, func() {
+			subscription.send(Event{Type: EventResync})
+		})
+	}()
+	return subscription.events, nil
+}
+
+// EnableKeyspaceNotifications configures the server to send the keyspace notifications needed by
+// Watch, keeping the notifications already enabled
+func (rs *redisStore) EnableKeyspaceNotifications(ctx context.Context) error {
+	reply, err := rs.pool.do(ctx, "CONFIG", "GET", "notify-keyspace-events")
+	if err != nil {
+		return errors.Wrap(err, "Failed to read redis keyspace notifications configuration")
+	}
+	var flags string
+	if config, ok := reply.([]any); ok && len(config) == 2 {
+		value, _ := config[1].([]byte)
+		flags = string(value)
+	}
+
+	updated := flags
+	for _, flag := range "K$gx" {
+		// A is an alias for every event class
+		if !strings.ContainsRune(updated, flag) && (flag == 'K' || !strings.ContainsRune(updated, 'A')) {
+			updated += string(flag)
+		}
+	}
+	if updated == flags {
+		return nil
+	}
+	_, err = rs.pool.do(ctx, "CONFIG", "SET", "notify-keyspace-events", updated)
+	if err != nil {
+		return errors.Wrap(err, "Failed to enable redis keyspace notifications")
+	}
+	return nil
+}
+
+// redisKeyspaceEvents maps the keyspace notifications to watch events
+var redisKeyspaceEvents = map[string]EventType{
+	"set":     EventWrite,
+	"del":     EventDelete,
+	"expire":  EventTouch,
+	"persist": EventTouch,
+	"expired": EventExpire,
+	"evicted": EventDelete,
+}
+
+// subscribe runs a (P)SUBSCRIBE command on a dedicated connection and returns the connection
+// once the subscription is confirmed
+func (rs *redisStore) subscribe(ctx context.Context, args ...any) (*respConn, error) {
+	conn, err := rs.pool.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.do(ctx, args...)
+	if err != nil {
+		_ = conn.close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// keepSubscribed receives the messages pushed on a subscribed connection, or nil if the first
+// subscription failed, and subscribes again whenever the connection fails until ctx is done
+func (rs *redisStore) keepSubscribed(ctx context.Context, conn *respConn, args []any, onPush func(push []any), onResync func()) {
+	backoff := redisMinBackoff
+	for {
+		if conn != nil {
+			backoff = redisMinBackoff
+			rs.receive(ctx, conn, onPush)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > redisMaxBackoff {
+			backoff = redisMaxBackoff
+		}
+
+		var err error
+		conn, err = rs.subscribe(ctx, args...)
+		if err == nil {
+			onResync()
+		}
+	}
+}
+
+// receive calls onPush with the messages pushed on a subscribed connection until the connection
+// fails or ctx is done, the connection is closed on return
+func (rs *redisStore) receive(ctx context.Context, conn *respConn, onPush func(push []any)) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// unblock the pending read when ctx is done
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = conn.close()
+	}()
+
+	// messages are pushed whenever published, they must be waited for without timeout
+	_ = conn.conn.SetReadDeadline(time.Time{})
+	for {
+		reply, err := conn.readReply()
+		if err != nil {
+			return
+		}
+		push, _ := reply.([]any)
+		onPush(push)
+	}
+}
+
+// Ping checks that the redis server is reachable
+func (rs *redisStore) Ping(ctx context.Context) error {
+	_, err := rs.pool.do(ctx, "PING")
+	if err != nil {
+		return errors.Wrap(err, "Failed to ping redis")
+	}
+	return nil
+}
+
+// Close releases all the connections held by the store
+func (rs *redisStore) Close() error {
+	return rs.pool.close()
+}
+
+// expiration resolves DefaultExpiration to the store's default and returns NoExpiration
+// for items that should be kept forever
+func (rs *redisStore) expiration(expiry time.Duration) time.Duration {
+	if expiry == DefaultExpiration {
+		expiry = rs.defaultExpiration
+	}
+	if expiry <= 0 {
+		return NoExpiration
+	}
+	return expiry
+}
+
+// isRedisBulk reports whether reply is the given bulk string
+func isRedisBulk(reply any, s string) bool {
+	bulk, ok := reply.([]byte)
+	return ok && string(bulk) == s
+}
+
+// escapeRedisPattern escapes the glob special characters of a SCAN/KEYS pattern
+func escapeRedisPattern(s string) string {
+	var builder strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			builder.WriteRune('\\')
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+// toMilliseconds converts a positive duration to milliseconds, rounding up so that
+// sub-millisecond expirations do not turn into an invalid zero expiry
+func toMilliseconds(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
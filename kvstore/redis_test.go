@@ -0,0 +1,154 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"github.com/MarouaneMan/github-api/internal/testutil/redistest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestRedisStore(t testing.TB, fr *redistest.Server, opts RedisOptions) *redisStore {
+	opts.Addr = fr.Addr()
+	opts.PoolSize = 2
+	opts.DialTimeout = time.Second
+	opts.ReadTimeout = time.Second
+	opts.WriteTimeout = time.Second
+	store := NewRedisStore(opts, 50*time.Millisecond)
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	return store
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(t, newTestRedisStore(t, redistest.New(t, ""), RedisOptions{}))
+}
+
+func TestRedisStoreAuthAndDB(t *testing.T) {
+	ctx := context.Background()
+	fr := redistest.New(t, "secret")
+
+	t.Run("WrongPassword", func(t *testing.T) {
+		store := newTestRedisStore(t, fr, RedisOptions{Password: "wrong"})
+		assert.Error(t, store.Ping(ctx), "should fail to authenticate")
+		assert.Error(t, store.Write(ctx, "key", "value", NoExpiration), "should fail to write")
+	})
+
+	t.Run("DatabasesAreIsolated", func(t *testing.T) {
+		first := newTestRedisStore(t, fr, RedisOptions{Password: "secret", DB: 1})
+		second := newTestRedisStore(t, fr, RedisOptions{Password: "secret", DB: 2})
+		assert.NoError(t, first.Ping(ctx))
+		assert.NoError(t, first.Write(ctx, "key", "value", NoExpiration))
+		value, err := first.Read(ctx, "key")
+		assert.NoError(t, err)
+		assert.Equal(t, "value", value)
+		_, err = second.Read(ctx, "key")
+		assert.ErrorIs(t, err, ErrNotFound, "key should not leak to another database")
+	})
+}
+
+func TestRedisStoreUnreachable(t *testing.T) {
+	ctx := context.Background()
+	fr := redistest.New(t, "")
+	store := newTestRedisStore(t, fr, RedisOptions{})
+	fr.Close()
+
+	assert.Error(t, store.Ping(ctx), "ping should fail when redis is down")
+	assert.Error(t, store.Write(ctx, "key", "value", NoExpiration), "write should fail when redis is down")
+	_, err := store.Read(ctx, "key")
+	assert.Error(t, err, "read should fail when redis is down")
+	assert.NotErrorIs(t, err, ErrNotFound, "an outage should not be reported as a miss")
+	var decodeErr *DecodeError
+	assert.False(t, errors.As(err, &decodeErr), "an outage should not be reported as a decode error")
+}
+
+func TestRedisStoreConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	store := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})
+
+	done := make(chan error)
+	for i := 0; i < 20; i++ {
+		go func() {
+			done <- store.Write(ctx, "key", "value", NoExpiration)
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, <-done)
+	}
+	value, err := store.Read(ctx, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+}
+
+func TestRedisStoreReadInto(t *testing.T) {
+	ctx := context.Background()
+	fr := redistest.New(t, "")
+
+	for _, name := range []string{"json", "gob", "binary"} {
+		t.Run(name, func(t *testing.T) {
+			codec, _ := CodecByName(name)
+			store := newTestRedisStore(t, fr, RedisOptions{Codec: codec})
+			assert.NoError(t, store.Write(ctx, name, newCodecItemMock(), NoExpiration))
+
+			var decoded []*codecItemMock
+			err := ReadInto(ctx, store, name, &decoded)
+			assert.NoError(t, err)
+			assert.Equal(t, newCodecItemMock(), decoded)
+
+			var mismatch int
+			err = ReadInto(ctx, store, name, &mismatch)
+			var decodeErr *DecodeError
+			assert.ErrorAs(t, err, &decodeErr, "should fail to decode into an incompatible type")
+		})
+	}
+}
+
+func TestRedisStoreScanPages(t *testing.T) {
+	ctx := context.Background()
+	store := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})
+
+	expected := make([]string, 0, 250)
+	for i := 0; i < 250; i++ {
+		key := fmt.Sprintf("page:%03d", i)
+		expected = append(expected, key)
+		assert.NoError(t, store.Write(ctx, key, i, NoExpiration))
+	}
+	assert.NoError(t, store.Write(ctx, "other", 0, NoExpiration))
+
+	keys, err := store.Scan(ctx, "page:")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, expected, keys, "scan should walk through every page")
+}
+
+func TestRedisStorePubSub(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fr := redistest.New(t, "")
+	publisher := newTestRedisStore(t, fr, RedisOptions{})
+	subscriber := newTestRedisStore(t, fr, RedisOptions{})
+
+	subscribed := make(chan struct{}, 1)
+	messages := make(chan string, 1)
+	subscriber.Subscribe(ctx, "channel", func(message string) {
+		messages <- message
+	}, func() {
+		subscribed <- struct{}{}
+	})
+
+	select {
+	case <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("subscription should be established")
+	}
+	assert.NoError(t, publisher.Publish(ctx, "other", "ignored"))
+	assert.NoError(t, publisher.Publish(ctx, "channel", "hello"))
+	select {
+	case message := <-messages:
+		assert.Equal(t, "hello", message)
+	case <-time.After(time.Second):
+		t.Fatal("message should be delivered")
+	}
+}
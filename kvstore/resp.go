@@ -0,0 +1,327 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// respError is an error reply sent back by the redis server (e.g. "WRONGTYPE ...").
+// It does not affect the connection, which can be reused for the next command.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// respConn is a single connection to a redis server speaking the RESP protocol.
+type respConn struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	writer       *bufio.Writer
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// broken is set whenever a transport or protocol error occurs, the connection
+	// must not be reused afterward
+	broken bool
+}
+
+// do sends a single command and returns its reply.
+// Replies are decoded as: string (simple string), int64 (integer), []byte (bulk string),
+// []any (array) or nil (null bulk string/array). Error replies are returned as respError.
+func (rc *respConn) do(ctx context.Context, args ...any) (any, error) {
+	err := rc.writeCommand(ctx, args)
+	if err != nil {
+		rc.broken = true
+		return nil, err
+	}
+
+	rc.setDeadline(ctx, rc.readTimeout, rc.conn.SetReadDeadline)
+	reply, err := rc.readReply()
+	if err != nil {
+		if _, ok := err.(respError); !ok {
+			rc.broken = true
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (rc *respConn) close() error {
+	return rc.conn.Close()
+}
+
+// setDeadline applies the earliest deadline between the given timeout and the context's one
+func (rc *respConn) setDeadline(ctx context.Context, timeout time.Duration, set func(time.Time) error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+	_ = set(deadline)
+}
+
+// pipeline sends several commands at once and returns their replies in order. Error replies are
+// returned as respError values so that a failing command does not abort the others.
+func (rc *respConn) pipeline(ctx context.Context, commands [][]any) ([]any, error) {
+	rc.setDeadline(ctx, rc.writeTimeout, rc.conn.SetWriteDeadline)
+	for _, args := range commands {
+		err := rc.bufferCommand(args)
+		if err != nil {
+			rc.broken = true
+			return nil, err
+		}
+	}
+	err := rc.writer.Flush()
+	if err != nil {
+		rc.broken = true
+		return nil, errors.Wrap(err, "Failed to write redis commands")
+	}
+
+	rc.setDeadline(ctx, rc.readTimeout, rc.conn.SetReadDeadline)
+	replies := make([]any, len(commands))
+	for i := range replies {
+		reply, err := rc.readReply()
+		if rerr, ok := err.(respError); ok {
+			replies[i] = rerr
+			continue
+		}
+		if err != nil {
+			rc.broken = true
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+func (rc *respConn) writeCommand(ctx context.Context, args []any) error {
+	rc.setDeadline(ctx, rc.writeTimeout, rc.conn.SetWriteDeadline)
+	err := rc.bufferCommand(args)
+	if err != nil {
+		return err
+	}
+	err = rc.writer.Flush()
+	if err != nil {
+		return errors.Wrap(err, "Failed to write redis command")
+	}
+	return nil
+}
+
+// bufferCommand encodes a command into the write buffer, without flushing it
+func (rc *respConn) bufferCommand(args []any) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		var bulk []byte
+		switch a := arg.(type) {
+		case []byte:
+			bulk = a
+		case string:
+			bulk = []byte(a)
+		case int:
+			bulk = strconv.AppendInt(nil, int64(a), 10)
+		case int64:
+			bulk = strconv.AppendInt(nil, a, 10)
+		default:
+			return errors.Errorf("Unsupported redis argument type %T", arg)
+		}
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(bulk)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, bulk...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	_, err := rc.writer.Write(buf)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write redis command")
+	}
+	return nil
+}
+
+func (rc *respConn) readReply() (any, error) {
+	line, err := rc.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return nil, respError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid redis integer reply")
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid redis bulk string length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		bulk := make([]byte, n+2)
+		_, err = io.ReadFull(rc.reader, bulk)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read redis bulk string")
+		}
+		return bulk[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid redis array length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		array := make([]any, n)
+		for i := range array {
+			elem, err := rc.readReply()
+			if rerr, ok := err.(respError); ok {
+				// error replies nested in arrays do not abort the whole reply
+				array[i] = rerr
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			array[i] = elem
+		}
+		return array, nil
+	}
+	return nil, errors.Errorf("Unexpected redis reply type %q", line[0])
+}
+
+// readLine reads a CRLF terminated line and returns it without the terminator
+func (rc *respConn) readLine() ([]byte, error) {
+	line, err := rc.reader.ReadSlice('\n')
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read redis reply")
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.Errorf("Malformed redis reply %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// respPool is a bounded pool of redis connections.
+type respPool struct {
+	dial func(ctx context.Context) (*respConn, error)
+
+	// idle holds connections ready to be reused
+	idle chan *respConn
+
+	// slots limits the number of live connections, one slot is held per connection
+	slots chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newRespPool(size int, dial func(ctx context.Context) (*respConn, error)) *respPool {
+	if size <= 0 {
+		size = 1
+	}
+	return &respPool{
+		dial:  dial,
+		idle:  make(chan *respConn, size),
+		slots: make(chan struct{}, size),
+	}
+}
+
+// get returns an idle connection, dials a new one if the pool is not full,
+// or waits for a connection to be released otherwise.
+func (p *respPool) get(ctx context.Context) (*respConn, error) {
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return nil, errors.New("Redis connection pool is closed")
+	}
+
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	default:
+	}
+
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	case p.slots <- struct{}{}:
+		conn, err := p.dial(ctx)
+		if err != nil {
+			<-p.slots
+			return nil, err
+		}
+		return conn, nil
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "Failed to acquire a redis connection")
+	}
+}
+
+// put gives the connection back to the pool, broken connections are discarded
+func (p *respPool) put(conn *respConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn.broken || p.closed {
+		_ = conn.close()
+		<-p.slots
+		return
+	}
+	p.idle <- conn
+}
+
+// do runs a single command on a pooled connection
+func (p *respPool) do(ctx context.Context, args ...any) (any, error) {
+	conn, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.put(conn)
+	return conn.do(ctx, args...)
+}
+
+// pipeline runs several commands in a single round trip on a pooled connection
+func (p *respPool) pipeline(ctx context.Context, commands [][]any) ([]any, error) {
+	conn, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.put(conn)
+	return conn.pipeline(ctx, commands)
+}
+
+// close closes idle connections, busy ones are closed as soon as they are released
+func (p *respPool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	for {
+		select {
+		case conn := <-p.idle:
+			_ = conn.close()
+			<-p.slots
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReadBalancing selects the replica serving a read.
+type ReadBalancing string
+
+const (
+	// BalanceRoundRobin spreads reads evenly across replicas.
+	BalanceRoundRobin ReadBalancing = "round_robin"
+
+	// BalanceLeastLatency sends reads to the replica with the lowest average latency.
+	BalanceLeastLatency ReadBalancing = "least_latency"
+)
+
+// leastLatencyExploration is the interval, in reads, at which the least latency balancing falls
+// back to round-robin so that the latency of every replica keeps being measured
+const leastLatencyExploration = 16
+
+// RoutingOptions configures a routing store.
+type RoutingOptions struct {
+	// Balancing defaults to BalanceRoundRobin
+	Balancing ReadBalancing
+
+	// ReadYourWritesWindow routes reads of a key to the primary during this window after it has
+	// been written, so that clients do not read stale data from lagging replicas. 0 disables it.
+	ReadYourWritesWindow time.Duration
+
+	// FailureBackoff is the time during which a failing replica is not read from, defaults to 5s
+	FailureBackoff time.Duration
+}
+
+type routedReplica struct {
+	reader Reader
+
+	// latency is the exponentially weighted moving average of reads latency, in nanoseconds
+	latency atomic.Int64
+
+	// failedUntil is the unix nanoseconds timestamp until which the replica is skipped
+	failedUntil atomic.Int64
+}
+
+func (rr *routedReplica) observe(latency time.Duration, err error, backoff time.Duration) {
+	if err != nil && !isDataError(err) {
+		rr.failedUntil.Store(time.Now().Add(backoff).UnixNano())
+		return
+	}
+	previous := rr.latency.Load()
+	if previous == 0 {
+		rr.latency.Store(int64(latency))
+		return
+	}
+	rr.latency.Store(previous + (int64(latency)-previous)/8)
+}
+
+type routingStore struct {
+	primary  ReadWriter
+	replicas []*routedReplica
+	opts     RoutingOptions
+
+	counter atomic.Uint64
+
+	mu     sync.Mutex
+	writes map[string]time.Time
+}
+
+// NewRoutingStore returns a store sending writes to the primary and balancing reads across
+// replicas. Reads fail over to the primary when a replica is unavailable.
+func NewRoutingStore(primary ReadWriter, replicas []Reader, opts RoutingOptions) (*routingStore, error) {
+	switch opts.Balancing {
+	case "":
+		opts.Balancing = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastLatency:
+	default:
+		return nil, errors.Errorf("Unknown read balancing %q", opts.Balancing)
+	}
+	if opts.FailureBackoff <= 0 {
+		opts.FailureBackoff = 5 * time.Second
+	}
+
+	rs := &routingStore{
+		primary: primary,
+		opts:    opts,
+		writes:  map[string]time.Time{},
+	}
+	for _, replica := range replicas {
+		rs.replicas = append(rs.replicas, &routedReplica{reader: replica})
+	}
+	return rs, nil
+}
+
+// Write an item to the primary
+func (rs *routingStore) Write(ctx context.Context, key string, value any, expiry time.Duration) error {
+	rs.recordWrite(key)
+	return rs.primary.Write(ctx, key, value, expiry)
+}
+
+// Delete removes an item from the primary
+func (rs *routingStore) Delete(ctx context.Context, key string) error {
+	rs.recordWrite(key)
+	return rs.primary.Delete(ctx, key)
+}
+
+// Touch resets the expiry of an item on the primary
+func (rs *routingStore) Touch(ctx context.Context, key string, expiry time.Duration) error {
+	rs.recordWrite(key)
+	return rs.primary.Touch(ctx, key, expiry)
+}
+
+// Read an item from a replica
+func (rs *routingStore) Read(ctx context.Context, key string) (any, error) {
+	var value any
+	err := rs.route(key, func(reader Reader) error {
+		var err error
+		value, err = reader.Read(ctx, key)
+		return err
+	})
+	return value, err
+}
+
+// ReadInto decodes an item read from a replica into the value pointed to by dst
+func (rs *routingStore) ReadInto(ctx context.Context, key string, dst any) error {
+	return rs.route(key, func(reader Reader) error {
+		return ReadInto(ctx, reader, key, dst)
+	})
+}
+
+// Exists reports whether an item is stored under key on a replica
+func (rs *routingStore) Exists(ctx context.Context, key string) (bool, error) {
+	var exists bool
+	err := rs.route(key, func(reader Reader) error {
+		var err error
+		exists, err = reader.Exists(ctx, key)
+		return err
+	})
+	return exists, err
+}
+
+// TTL returns the remaining time to live of an item on a replica
+func (rs *routingStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	var ttl time.Duration
+	err := rs.route(key, func(reader Reader) error {
+		var err error
+		ttl, err = reader.TTL(ctx, key)
+		return err
+	})
+	return ttl, err
+}
+
+// Scan returns the keys starting with prefix on a replica
+func (rs *routingStore) Scan(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := rs.route("", func(reader Reader) error {
+		var err error
+		keys, err = reader.Scan(ctx, prefix)
+		return err
+	})
+	return keys, err
+}
+
+// ReadManyInto decodes items read from a replica into the map pointed to by dst, from the primary
+// if one of the keys has just been written
+func (rs *routingStore) ReadManyInto(ctx context.Context, keys []string, dst any) error {
+	key := ""
+	for _, k := range keys {
+		if rs.recentlyWritten(k) {
+			key = k
+			break
+		}
+	}
+	return rs.route(key, func(reader Reader) error {
+		return ReadManyInto(ctx, reader, keys, dst)
+	})
+}
+
+// WriteMany sets several items on the primary
+func (rs *routingStore) WriteMany(ctx context.Context, items map[string]any, expiry time.Duration) error {
+	for key := range items {
+		rs.recordWrite(key)
+	}
+	return WriteMany(ctx, rs.primary, items, expiry)
+}
+
+// ReadVersion reads an item and its version from the primary, replicas may lag behind
+func (rs *routingStore) ReadVersion(ctx context.Context, key string, dst any) (uint64, error) {
+	return ReadVersion(ctx, rs.primary, key, dst)
+}
+
+// WriteIfVersion writes an item to the primary only if its current version is version
+func (rs *routingStore) WriteIfVersion(ctx context.Context, key string, value any, version uint64, expiry time.Duration) (uint64, error) {
+	version, err := WriteIfVersion(ctx, rs.primary, key, value, version, expiry)
+	if err == nil {
+		rs.recordWrite(key)
+	}
+	return version, err
+}
+
+// Watch returns a channel receiving the changes of the keys starting with prefix on the primary
+func (rs *routingStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return Watch(ctx, rs.primary, prefix)
+}
+
+// route runs read against a replica, or against the primary if the key has just been written,
+// if no replica is available, or if the replica fails
+func (rs *routingStore) route(key string, read func(Reader) error) error {
+	if key != "" && rs.recentlyWritten(key) {
+		return read(rs.primary)
+	}
+	replica := rs.pick()
+	if replica == nil {
+		return read(rs.primary)
+	}
+
+	start := time.Now()
+	err := read(replica.reader)
+	replica.observe(time.Since(start), err, rs.opts.FailureBackoff)
+	if err == nil || isDataError(err) {
+		return err
+	}
+	return read(rs.primary)
+}
+
+// pick returns the replica to read from, or nil if every replica is backing off
+func (rs *routingStore) pick() *routedReplica {
+	now := time.Now().UnixNano()
+	n := rs.counter.Add(1)
+
+	var picked *routedReplica
+	for i := range rs.replicas {
+		replica := rs.replicas[(int(n)+i)%len(rs.replicas)]
+		if replica.failedUntil.Load() > now {
+			continue
+		}
+		if rs.opts.Balancing == BalanceRoundRobin || n%leastLatencyExploration == 0 {
+			return replica
+		}
+		if picked == nil || replica.latency.Load() < picked.latency.Load() {
+			picked = replica
+		}
+	}
+	return picked
+}
+
+func (rs *routingStore) recordWrite(key string) {
+	if rs.opts.ReadYourWritesWindow <= 0 {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	now := time.Now()
+	rs.writes[key] = now.Add(rs.opts.ReadYourWritesWindow)
+
+	// prune elapsed windows once in a while to bound memory
+	if len(rs.writes) > 1024 {
+		for k, until := range rs.writes {
+			if !now.Before(until) {
+				delete(rs.writes, k)
+			}
+		}
+	}
+}
+
+func (rs *routingStore) recentlyWritten(key string) bool {
+	if rs.opts.ReadYourWritesWindow <= 0 {
+		return false
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	until, ok := rs.writes[key]
+	if !ok {
+		return false
+	}
+	if !time.Now().Before(until) {
+		delete(rs.writes, key)
+		return false
+	}
+	return true
+}
+
+// isDataError reports whether err is about the data itself rather than about the backend
+// availability, such errors would be the same on any replica
+func isDataError(err error) bool {
+	var decodeErr *DecodeError
+	return errors.Is(err, ErrNotFound) || errors.As(err, &decodeErr)
+}
@@ -0,0 +1,166 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// unavailableStore fails every operation as an unreachable backend would
+type unavailableStore struct {
+	reads int
+}
+
+var errUnavailable = errors.New("Backend unavailable")
+
+func (us *unavailableStore) Read(context.Context, string) (any, error) {
+	us.reads++
+	return nil, errUnavailable
+}
+
+func (us *unavailableStore) Exists(context.Context, string) (bool, error) {
+	us.reads++
+	return false, errUnavailable
+}
+
+func (us *unavailableStore) TTL(context.Context, string) (time.Duration, error) {
+	us.reads++
+	return 0, errUnavailable
+}
+
+func (us *unavailableStore) Scan(context.Context, string) ([]string, error) {
+	us.reads++
+	return nil, errUnavailable
+}
+
+func (us *unavailableStore) Write(context.Context, string, any, time.Duration) error {
+	return errUnavailable
+}
+
+func (us *unavailableStore) Delete(context.Context, string) error {
+	return errUnavailable
+}
+
+func (us *unavailableStore) Touch(context.Context, string, time.Duration) error {
+	return errUnavailable
+}
+
+func newTestRoutingStore(t *testing.T, primary ReadWriter, replicas []Reader, opts RoutingOptions) *routingStore {
+	store, err := NewRoutingStore(primary, replicas, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestRoutingStore(t *testing.T) {
+	// replicas share the primary data, as with an instantly replicated backend
+	primary := NewInMemoryStore(50*time.Millisecond, time.Minute)
+	testStore(t, newTestRoutingStore(t, primary, []Reader{primary, primary}, RoutingOptions{}))
+}
+
+func TestRoutingStoreRoundRobin(t *testing.T) {
+	ctx := context.Background()
+	primary := NewInMemoryStore(NoExpiration, time.Minute)
+	replicas := []ReadWriter{
+		NewInMemoryStore(NoExpiration, time.Minute),
+		NewInMemoryStore(NoExpiration, time.Minute),
+	}
+	_ = replicas[0].Write(ctx, "key", "replica0", NoExpiration)
+	_ = replicas[1].Write(ctx, "key", "replica1", NoExpiration)
+
+	store := newTestRoutingStore(t, primary, []Reader{replicas[0], replicas[1]}, RoutingOptions{})
+
+	seen := map[any]int{}
+	for i := 0; i < 10; i++ {
+		value, err := store.Read(ctx, "key")
+		assert.NoError(t, err)
+		seen[value]++
+	}
+	assert.Equal(t, map[any]int{"replica0": 5, "replica1": 5}, seen, "reads should be spread evenly across replicas")
+
+	_ = store.Write(ctx, "written", "value", NoExpiration)
+	_, err := primary.Read(ctx, "written")
+	assert.NoError(t, err, "writes should go to the primary")
+	_, err = replicas[0].Read(ctx, "written")
+	assert.ErrorIs(t, err, ErrNotFound, "writes should not go to replicas")
+}
+
+func TestRoutingStoreLeastLatency(t *testing.T) {
+	ctx := context.Background()
+	primary := NewInMemoryStore(NoExpiration, time.Minute)
+	fast := NewInMemoryStore(NoExpiration, time.Minute)
+	slow := NewInMemoryStore(NoExpiration, time.Minute)
+	_ = fast.Write(ctx, "key", "fast", NoExpiration)
+	_ = slow.Write(ctx, "key", "slow", NoExpiration)
+
+	store := newTestRoutingStore(t, primary, []Reader{fast, slow}, RoutingOptions{Balancing: BalanceLeastLatency})
+	store.replicas[0].latency.Store(int64(time.Millisecond))
+	store.replicas[1].latency.Store(int64(time.Second))
+
+	seen := map[any]int{}
+	for i := 0; i < leastLatencyExploration-1; i++ {
+		value, _ := store.Read(ctx, "key")
+		seen[value]++
+	}
+	assert.Equal(t, leastLatencyExploration-1, seen["fast"], "reads should go to the fastest replica")
+}
+
+func TestRoutingStoreFailover(t *testing.T) {
+	ctx := context.Background()
+	primary := NewInMemoryStore(NoExpiration, time.Minute)
+	_ = primary.Write(ctx, "key", "primary", NoExpiration)
+	replica := &unavailableStore{}
+
+	store := newTestRoutingStore(t, primary, []Reader{replica}, RoutingOptions{FailureBackoff: time.Hour})
+
+	value, err := store.Read(ctx, "key")
+	assert.NoError(t, err, "should fall back to the primary when the replica is unavailable")
+	assert.Equal(t, "primary", value)
+
+	_, err = store.Read(ctx, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replica.reads, "failing replica should not be read from during its backoff")
+
+	_, err = store.Read(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRoutingStoreFailoverNotFound(t *testing.T) {
+	ctx := context.Background()
+	primary := NewInMemoryStore(NoExpiration, time.Minute)
+	_ = primary.Write(ctx, "key", "primary", NoExpiration)
+	replica := NewInMemoryStore(NoExpiration, time.Minute)
+
+	store := newTestRoutingStore(t, primary, []Reader{replica}, RoutingOptions{})
+
+	_, err := store.Read(ctx, "key")
+	assert.ErrorIs(t, err, ErrNotFound, "not found items should not be read from the primary")
+}
+
+func TestRoutingStoreReadYourWrites(t *testing.T) {
+	ctx := context.Background()
+	primary := NewInMemoryStore(NoExpiration, time.Minute)
+	replica := NewInMemoryStore(NoExpiration, time.Minute)
+
+	store := newTestRoutingStore(t, primary, []Reader{replica}, RoutingOptions{ReadYourWritesWindow: 50 * time.Millisecond})
+
+	_ = store.Write(ctx, "key", "value", NoExpiration)
+	value, err := store.Read(ctx, "key")
+	assert.NoError(t, err, "recently written keys should be read from the primary")
+	assert.Equal(t, "value", value)
+
+	_, err = store.Read(ctx, "other")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = store.Read(ctx, "key")
+	assert.ErrorIs(t, err, ErrNotFound, "keys should be read from replicas after the window")
+}
+
+func TestRoutingStoreUnknownBalancing(t *testing.T) {
+	_, err := NewRoutingStore(NewInMemoryStore(NoExpiration, time.Minute), nil, RoutingOptions{Balancing: "random"})
+	assert.Error(t, err)
+}
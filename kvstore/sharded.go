@@ -0,0 +1,470 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultVirtualNodes is the default number of points each shard owns on the hash ring.
+const DefaultVirtualNodes = 160
+
+// shardProbeKey is the key checked to probe the shards that cannot be pinged
+const shardProbeKey = "kvstore:health"
+
+// Shard is a named backend of a sharded store. The name determines the keys the shard owns, it
+// must be kept when the shard is moved (e.g. its address changes) to keep its keys.
+type Shard struct {
+	Name  string
+	Store ReadWriter
+}
+
+// ShardedOptions configures a sharded store.
+type ShardedOptions struct {
+	// VirtualNodes is the number of points each shard owns on the hash ring, the more points the
+	// more evenly keys are spread. Defaults to DefaultVirtualNodes
+	VirtualNodes int
+}
+
+// ShardHealth reports the state of a shard, as observed by the operations sent to it and the
+// health checks.
+type ShardHealth struct {
+	Name    string
+	Healthy bool
+
+	// LastError is the error that made the shard unhealthy, nil when healthy
+	LastError error
+
+	// Since is the time the shard became healthy or unhealthy
+	Since time.Time
+
+	Operations uint64
+	Errors     uint64
+}
+
+type shard struct {
+	Shard
+
+	operations atomic.Uint64
+	errors     atomic.Uint64
+
+	mu        sync.Mutex
+	healthy   bool
+	lastError error
+	since     time.Time
+}
+
+// observe records the outcome of an operation, data errors do not make a shard unhealthy
+func (s *shard) observe(err error) {
+	s.operations.Add(1)
+	failed := err != nil && !isDataError(err) && !errors.Is(err, ErrVersionMismatch)
+	if failed {
+		s.errors.Add(1)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if failed {
+		s.lastError = err
+	}
+	if s.healthy == failed {
+		s.healthy = !failed
+		s.since = time.Now()
+	}
+	if s.healthy {
+		s.lastError = nil
+	}
+}
+
+// ring maps hashes to the shards owning them, it is never modified once built
+type ring struct {
+	hashes []uint64
+	shards map[uint64]*shard
+}
+
+func newRing(shards map[string]*shard, virtualNodes int) *ring {
+	r := &ring{shards: map[uint64]*shard{}}
+	for name, s := range shards {
+		for i := 0; i < virtualNodes; i++ {
+			h := hashKey(name + "#" + strconv.Itoa(i))
+			// on the unlikely collision, the point goes to the smallest name to stay deterministic
+			if owner, ok := r.shards[h]; ok && owner.Name < name {
+				continue
+			}
+			if _, ok := r.shards[h]; !ok {
+				r.hashes = append(r.hashes, h)
+			}
+			r.shards[h] = s
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// lookup returns the shard owning key, the first one clockwise on the ring
+func (r *ring) lookup(key string) *shard {
+	h := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.shards[r.hashes[i]]
+}
+
+// hashKey hashes a key with FNV-1a, finalized to spread similar keys across the ring
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+type shardedStore struct {
+	opts ShardedOptions
+
+	mu     sync.RWMutex
+	shards map[string]*shard
+	ring   *ring
+}
+
+// NewShardedStore returns a store distributing keys across shards with consistent hashing, so
+// that adding or removing a shard only moves the keys it owns.
+func NewShardedStore(shards []Shard, opts ShardedOptions) (*shardedStore, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("At least one shard is required")
+	}
+	if opts.VirtualNodes <= 0 {
+		opts.VirtualNodes = DefaultVirtualNodes
+	}
+	ss := &shardedStore{
+		opts:   opts,
+		shards: map[string]*shard{},
+	}
+	for _, s := range shards {
+		err := ss.validate(s)
+		if err != nil {
+			return nil, err
+		}
+		ss.shards[s.Name] = newShard(s)
+	}
+	ss.ring = newRing(ss.shards, opts.VirtualNodes)
+	return ss, nil
+}
+
+func newShard(s Shard) *shard {
+	return &shard{Shard: s, healthy: true, since: time.Now()}
+}
+
+// validate checks a shard can be added, mu must be held when the store is in use
+func (ss *shardedStore) validate(s Shard) error {
+	if s.Name == "" || s.Store == nil {
+		return errors.New("Shards must have a name and a store")
+	}
+	if _, ok := ss.shards[s.Name]; ok {
+		return errors.Errorf("Duplicate shard %q", s.Name)
+	}
+	return nil
+}
+
+// AddShard adds a shard, which takes over the keys it owns on the ring from the other shards.
+// Moved keys are not migrated, they are missing until written again.
+func (ss *shardedStore) AddShard(s Shard) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	err := ss.validate(s)
+	if err != nil {
+		return err
+	}
+	ss.shards[s.Name] = newShard(s)
+	ss.ring = newRing(ss.shards, ss.opts.VirtualNodes)
+	return nil
+}
+
+// RemoveShard removes a shard, its keys are redistributed to the remaining shards without being
+// migrated
+func (ss *shardedStore) RemoveShard(name string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.shards[name]; !ok {
+		return errors.Errorf("Unknown shard %q", name)
+	}
+	if len(ss.shards) == 1 {
+		return errors.New("Cannot remove the last shard")
+	}
+	delete(ss.shards, name)
+	ss.ring = newRing(ss.shards, ss.opts.VirtualNodes)
+	return nil
+}
+
+// ShardFor returns the name of the shard owning key
+func (ss *shardedStore) ShardFor(key string) string {
+	return ss.lookup(key).Name
+}
+
+// Write an item to the shard owning key
+func (ss *shardedStore) Write(ctx context.Context, key string, value any, expiry time.Duration) error {
+	s := ss.lookup(key)
+	err := s.Store.Write(ctx, key, value, expiry)
+	s.observe(err)
+	return err
+}
+
+// Read an item from the shard owning key
+func (ss *shardedStore) Read(ctx context.Context, key string) (any, error) {
+	s := ss.lookup(key)
+	value, err := s.Store.Read(ctx, key)
+	s.observe(err)
+	return value, err
+}
+
+// ReadInto decodes an item read from the shard owning key into the value pointed to by dst
+func (ss *shardedStore) ReadInto(ctx context.Context, key string, dst any) error {
+	s := ss.lookup(key)
+	err := ReadInto(ctx, s.Store, key, dst)
+	s.observe(err)
+	return err
+}
+
+// Exists reports whether an item is stored under key
+func (ss *shardedStore) Exists(ctx context.Context, key string) (bool, error) {
+	s := ss.lookup(key)
+	exists, err := s.Store.Exists(ctx, key)
+	s.observe(err)
+	return exists, err
+}
+
+// TTL returns the remaining time to live of an item
+func (ss *shardedStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	s := ss.lookup(key)
+	ttl, err := s.Store.TTL(ctx, key)
+	s.observe(err)
+	return ttl, err
+}
+
+// Scan returns the keys starting with prefix across every shard, scanned concurrently
+func (ss *shardedStore) Scan(ctx context.Context, prefix string) ([]string, error) {
+	shards := ss.all()
+	results := make([][]string, len(shards))
+	eg, egCtx := errgroup.WithContext(ctx)
+	for i, s := range shards {
+		i, s := i, s
+		eg.Go(func() error {
+			keys, err := s.Store.Scan(egCtx, prefix)
+			s.observe(err)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to scan shard %q", s.Name)
+			}
+			results[i] = keys
+			return nil
+		})
+	}
+	err := eg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, batch := range results {
+		keys = append(keys, batch...)
+	}
+	return keys, nil
+}
+
+// Delete removes an item from the shard owning key
+func (ss *shardedStore) Delete(ctx context.Context, key string) error {
+	s := ss.lookup(key)
+	err := s.Store.Delete(ctx, key)
+	s.observe(err)
+	return err
+}
+
+// Touch resets the expiry of an item
+func (ss *shardedStore) Touch(ctx context.Context, key string, expiry time.Duration) error {
+	s := ss.lookup(key)
+	err := s.Store.Touch(ctx, key, expiry)
+	s.observe(err)
+	return err
+}
+
+// ReadManyInto decodes the items stored under keys into the map pointed to by dst, the shards
+// owning the keys are read concurrently with one batch each
+func (ss *shardedStore) ReadManyInto(ctx context.Context, keys []string, dst any) error {
+	items, err := batchDestination(dst)
+	if err != nil {
+		return err
+	}
+	groups := map[*shard][]string{}
+	for _, key := range keys {
+		s := ss.lookup(key)
+		groups[s] = append(groups[s], key)
+	}
+
+	var mu sync.Mutex
+	eg, egCtx := errgroup.WithContext(ctx)
+	for s, keys := range groups {
+		s, keys := s, keys
+		eg.Go(func() error {
+			fetched := reflect.New(items.Type())
+			err := ReadManyInto(egCtx, s.Store, keys, fetched.Interface())
+			s.observe(err)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			iter := fetched.Elem().MapRange()
+			for iter.Next() {
+				items.SetMapIndex(iter.Key(), iter.Value())
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// WriteMany sets several items, the shards owning the keys are written concurrently with one
+// batch each
+func (ss *shardedStore) WriteMany(ctx context.Context, items map[string]any, expiry time.Duration) error {
+	groups := map[*shard]map[string]any{}
+	for key, value := range items {
+		s := ss.lookup(key)
+		if groups[s] == nil {
+			groups[s] = map[string]any{}
+		}
+		groups[s][key] = value
+	}
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	for s, items := range groups {
+		s, items := s, items
+		eg.Go(func() error {
+			err := WriteMany(egCtx, s.Store, items, expiry)
+			s.observe(err)
+			return err
+		})
+	}
+	return eg.Wait()
+}
+
+// ReadVersion reads an item and its version from the shard owning key
+func (ss *shardedStore) ReadVersion(ctx context.Context, key string, dst any) (uint64, error) {
+	s := ss.lookup(key)
+	version, err := ReadVersion(ctx, s.Store, key, dst)
+	s.observe(err)
+	return version, err
+}
+
+// WriteIfVersion writes an item to the shard owning key only if its current version is version
+func (ss *shardedStore) WriteIfVersion(ctx context.Context, key string, value any, version uint64, expiry time.Duration) (uint64, error) {
+	s := ss.lookup(key)
+	version, err := WriteIfVersion(ctx, s.Store, key, value, version, expiry)
+	s.observe(err)
+	return version, err
+}
+
+// Watch returns a channel merging the changes of the keys starting with prefix on every shard.
+// Shards added afterward are not watched.
+func (ss *shardedStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	var channels []<-chan Event
+	for _, s := range ss.all() {
+		events, err := Watch(ctx, s.Store, prefix)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		channels = append(channels, events)
+	}
+
+	merged := make(chan Event, watchBuffer)
+	var wg sync.WaitGroup
+	for _, events := range channels {
+		wg.Add(1)
+		go func(events <-chan Event) {
+			defer wg.Done()
+			for event := range events {
+				select {
+				case merged <- event:
+				case <-ctx.Done():
+				}
+			}
+		}(events)
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(merged)
+	}()
+	return merged, nil
+}
+
+// Health returns the health of every shard, sorted by name
+func (ss *shardedStore) Health() []ShardHealth {
+	shards := ss.all()
+	health := make([]ShardHealth, 0, len(shards))
+	for _, s := range shards {
+		s.mu.Lock()
+		health = append(health, ShardHealth{
+			Name:       s.Name,
+			Healthy:    s.healthy,
+			LastError:  s.lastError,
+			Since:      s.since,
+			Operations: s.operations.Load(),
+			Errors:     s.errors.Load(),
+		})
+		s.mu.Unlock()
+	}
+	return health
+}
+
+// CheckHealth probes every shard concurrently, pinging the shards that support it, and returns
+// their health
+func (ss *shardedStore) CheckHealth(ctx context.Context) []ShardHealth {
+	var wg sync.WaitGroup
+	for _, s := range ss.all() {
+		wg.Add(1)
+		go func(s *shard) {
+			defer wg.Done()
+			if pinger, ok := s.Store.(interface {
+				Ping(ctx context.Context) error
+			}); ok {
+				s.observe(pinger.Ping(ctx))
+				return
+			}
+			_, err := s.Store.Exists(ctx, shardProbeKey)
+			s.observe(err)
+		}(s)
+	}
+	wg.Wait()
+	return ss.Health()
+}
+
+func (ss *shardedStore) lookup(key string) *shard {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.ring.lookup(key)
+}
+
+// all returns every shard, sorted by name
+func (ss *shardedStore) all() []*shard {
+	ss.mu.RLock()
+	shards := make([]*shard, 0, len(ss.shards))
+	for _, s := range ss.shards {
+		shards = append(shards, s)
+	}
+	ss.mu.RUnlock()
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Name < shards[j].Name })
+	return shards
+}
@@ -0,0 +1,166 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"github.com/MarouaneMan/github-api/internal/testutil/redistest"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestShardedStore(t *testing.T, shards []Shard, opts ShardedOptions) *shardedStore {
+	store, err := NewShardedStore(shards, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func newTestShards(names ...string) []Shard {
+	shards := []Shard{}
+	for _, name := range names {
+		shards = append(shards, Shard{Name: name, Store: NewInMemoryStore(50*time.Millisecond, time.Minute)})
+	}
+	return shards
+}
+
+func TestShardedStore(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testStore(t, newTestShardedStore(t, newTestShards("a", "b", "c"), ShardedOptions{}))
+	})
+	t.Run("redis", func(t *testing.T) {
+		shards := []Shard{}
+		for _, name := range []string{"a", "b", "c"} {
+			shards = append(shards, Shard{Name: name, Store: newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})})
+		}
+		store := newTestShardedStore(t, shards, ShardedOptions{})
+		testStore(t, store)
+		testVersioner(t, store)
+	})
+}
+
+// shardOwners returns the shard owning each of n keys
+func shardOwners(store *shardedStore, n int) map[string]string {
+	owners := map[string]string{}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("repositories:%d", i)
+		owners[key] = store.ShardFor(key)
+	}
+	return owners
+}
+
+func TestShardedStoreDistribution(t *testing.T) {
+	store := newTestShardedStore(t, newTestShards("a", "b", "c"), ShardedOptions{})
+	counts := map[string]int{}
+	for _, shard := range shardOwners(store, 30000) {
+		counts[shard]++
+	}
+	for name, count := range counts {
+		assert.InDelta(t, 10000, count, 2000, "shard %s should own about a third of the keys", name)
+	}
+}
+
+func TestShardedStoreRebalancing(t *testing.T) {
+	ctx := context.Background()
+	shards := newTestShards("a", "b", "c")
+	store := newTestShardedStore(t, shards, ShardedOptions{})
+	before := shardOwners(store, 10000)
+
+	assert.NoError(t, store.AddShard(Shard{Name: "d", Store: NewInMemoryStore(NoExpiration, time.Minute)}))
+	after := shardOwners(store, 10000)
+	moved := 0
+	for key, shard := range after {
+		if shard != before[key] {
+			moved++
+			assert.Equal(t, "d", shard, "keys should only move to the added shard")
+		}
+	}
+	assert.InDelta(t, 2500, moved, 700, "the added shard should take over about a quarter of the keys")
+
+	assert.NoError(t, store.RemoveShard("d"))
+	assert.Equal(t, before, shardOwners(store, 10000), "removing the shard should restore the previous mapping")
+
+	// keys of the remaining shards are still readable
+	_ = store.Write(ctx, "key", "value", NoExpiration)
+	owner := store.ShardFor("key")
+	for _, name := range []string{"a", "b", "c"} {
+		if name != owner {
+			assert.NoError(t, store.RemoveShard(name))
+			break
+		}
+	}
+	value, err := store.Read(ctx, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	assert.Error(t, store.AddShard(Shard{Name: owner, Store: NewInMemoryStore(NoExpiration, time.Minute)}), "should refuse duplicate shards")
+	assert.Error(t, store.RemoveShard("unknown"), "should refuse unknown shards")
+}
+
+func TestShardedStoreScan(t *testing.T) {
+	ctx := context.Background()
+	store := newTestShardedStore(t, newTestShards("a", "b", "c"), ShardedOptions{})
+	expected := []string{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("repositories:%02d", i)
+		expected = append(expected, key)
+		_ = store.Write(ctx, key, i, NoExpiration)
+	}
+	_ = store.Write(ctx, "other", 0, NoExpiration)
+
+	keys, err := store.Scan(ctx, "repositories:")
+	assert.NoError(t, err)
+	sort.Strings(keys)
+	assert.Equal(t, expected, keys, "should scan every shard")
+}
+
+func TestShardedStoreWatch(t *testing.T) {
+	store := newTestShardedStore(t, newTestShards("a", "b", "c"), ShardedOptions{})
+	testWatch(t, store)
+}
+
+func TestShardedStoreHealth(t *testing.T) {
+	ctx := context.Background()
+	fr := redistest.New(t, "")
+	store := newTestShardedStore(t, []Shard{
+		{Name: "down", Store: &unavailableStore{}},
+		{Name: "memory", Store: NewInMemoryStore(NoExpiration, time.Minute)},
+		{Name: "redis", Store: newTestRedisStore(t, fr, RedisOptions{})},
+	}, ShardedOptions{})
+
+	health := store.CheckHealth(ctx)
+	assert.Len(t, health, 3)
+	assert.Equal(t, "down", health[0].Name)
+	assert.False(t, health[0].Healthy)
+	assert.ErrorIs(t, health[0].LastError, errUnavailable)
+	assert.True(t, health[1].Healthy)
+	assert.True(t, health[2].Healthy)
+
+	// not found items do not make a shard unhealthy
+	for i := 0; i < 100; i++ {
+		_, _ = store.Read(ctx, fmt.Sprintf("missing:%d", i))
+	}
+	health = store.Health()
+	assert.True(t, health[1].Healthy)
+	assert.Zero(t, health[1].Errors)
+	assert.Equal(t, uint64(100), health[0].Operations+health[1].Operations+health[2].Operations-3,
+		"every operation should be counted once")
+	assert.Equal(t, health[0].Operations, health[0].Errors)
+
+	fr.Close()
+	fr.DropConnections()
+	health = store.CheckHealth(ctx)
+	assert.False(t, health[2].Healthy, "unreachable shards should be reported unhealthy")
+	assert.Error(t, health[2].LastError)
+}
+
+func TestNewShardedStoreInvalidShards(t *testing.T) {
+	_, err := NewShardedStore(nil, ShardedOptions{})
+	assert.Error(t, err)
+	_, err = NewShardedStore(newTestShards("a", "a"), ShardedOptions{})
+	assert.Error(t, err)
+	_, err = NewShardedStore([]Shard{{Name: "a"}}, ShardedOptions{})
+	assert.Error(t, err)
+}
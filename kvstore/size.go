@@ -0,0 +1,71 @@
+package kvstore
+
+import (
+	"reflect"
+)
+
+// estimateSize approximates the memory retained by value in bytes, following pointers, slices,
+// maps and interfaces. Values shared through pointers are only counted once.
+func estimateSize(value any) int64 {
+	return sizeOf(reflect.ValueOf(value), map[uintptr]bool{})
+}
+
+func sizeOf(v reflect.Value, seen map[uintptr]bool) int64 {
+	if !v.IsValid() {
+		return 0
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		size := int64(v.Type().Size())
+		if v.IsNil() || seen[v.Pointer()] {
+			return size
+		}
+		seen[v.Pointer()] = true
+		return size + sizeOf(v.Elem(), seen)
+	case reflect.Interface:
+		return int64(v.Type().Size()) + sizeOf(v.Elem(), seen)
+	case reflect.String:
+		return int64(v.Type().Size()) + int64(v.Len())
+	case reflect.Slice:
+		size := int64(v.Type().Size())
+		if v.IsNil() {
+			return size
+		}
+		return size + sizeOfElems(v, v.Cap(), seen)
+	case reflect.Array:
+		return sizeOfElems(v, v.Len(), seen)
+	case reflect.Map:
+		size := int64(v.Type().Size())
+		if v.IsNil() {
+			return size
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			size += sizeOf(iter.Key(), seen) + sizeOf(iter.Value(), seen)
+		}
+		return size
+	case reflect.Struct:
+		var size int64
+		for i := 0; i < v.NumField(); i++ {
+			size += sizeOf(v.Field(i), seen)
+		}
+		return size
+	}
+	return int64(v.Type().Size())
+}
+
+// sizeOfElems returns the size of the first n elements of a slice or an array, elements of
+// fixed-size types are not walked through
+func sizeOfElems(v reflect.Value, n int, seen map[uintptr]bool) int64 {
+	elemType := v.Type().Elem()
+	switch elemType.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.String, reflect.Slice, reflect.Array, reflect.Map, reflect.Struct:
+		var size int64
+		for i := 0; i < v.Len(); i++ {
+			size += sizeOf(v.Index(i), seen)
+		}
+		return size + int64(n-v.Len())*int64(elemType.Size())
+	}
+	return int64(n) * int64(elemType.Size())
+}
@@ -0,0 +1,227 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// SnapshotFormat identifies snapshot files
+	SnapshotFormat = "kvstore-snapshot"
+
+	// SnapshotVersion is the version of the snapshot format written by Export
+	SnapshotVersion = 1
+)
+
+// SnapshotHeader is the first record of a snapshot.
+type SnapshotHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Prefixes are the prefixes of the exported keys, empty if every key was exported
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// SnapshotItem is an item of a snapshot, its value is encoded in JSON whatever the codec of the
+// store it was exported from.
+type SnapshotItem struct {
+	Key string `json:"key"`
+
+	// TTL is the time the item had left to live when exported, or NoExpiration
+	TTL   time.Duration   `json:"ttl"`
+	Value json.RawMessage `json:"value"`
+}
+
+// SnapshotOptions configures exports and imports.
+type SnapshotOptions struct {
+	// Prefixes restricts the items to the keys starting with one of the prefixes, every item is
+	// exported or imported if empty
+	Prefixes []string
+
+	// TypeOf returns a pointer to a new value of the type stored under key, or nil if unknown.
+	// Items of a known type are decoded into it, so that they can be exported from stores
+	// unable to decode untyped values (e.g. gob) and are imported with their type into in-memory
+	// stores. Other items are exported and imported as untyped values.
+	TypeOf func(key string) any
+}
+
+// Export writes a snapshot of the items of reader to w, as JSON records separated by newlines,
+// and returns the number of exported items.
+// Items are read one after the other, the snapshot is not atomic: items written during the export
+// may or may not be part of it.
+func Export(ctx context.Context, reader Reader, w io.Writer, opts SnapshotOptions) (int, error) {
+	encoder := json.NewEncoder(w)
+	err := encoder.Encode(SnapshotHeader{
+		Format:    SnapshotFormat,
+		Version:   SnapshotVersion,
+		CreatedAt: time.Now().UTC(),
+		Prefixes:  opts.Prefixes,
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to write snapshot header")
+	}
+
+	keys, err := snapshotKeys(ctx, reader, opts.Prefixes)
+	if err != nil {
+		return 0, err
+	}
+	exported := 0
+	for _, key := range keys {
+		item, err := exportItem(ctx, reader, key, opts)
+		if errors.Is(err, ErrNotFound) {
+			// deleted or expired since the keys were listed
+			continue
+		}
+		if err != nil {
+			return exported, errors.Wrapf(err, "Failed to export key %q", key)
+		}
+		err = encoder.Encode(item)
+		if err != nil {
+			return exported, errors.Wrap(err, "Failed to write snapshot item")
+		}
+		exported++
+	}
+	return exported, nil
+}
+
+// Import writes the items of the snapshot read from r to writer, with the time to live they had
+// left when exported, and returns the number of imported items
+func Import(ctx context.Context, writer Writer, r io.Reader, opts SnapshotOptions) (int, error) {
+	imported := 0
+	_, err := ReadSnapshot(r, func(item SnapshotItem) error {
+		if !hasAnyPrefix(item.Key, opts.Prefixes) {
+			return nil
+		}
+		value, err := decodeSnapshotValue(item, opts.TypeOf)
+		if err != nil {
+			return err
+		}
+		err = writer.Write(ctx, item.Key, value, item.TTL)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to import key %q", item.Key)
+		}
+		imported++
+		return nil
+	})
+	return imported, err
+}
+
+// ReadSnapshot reads the snapshot from r, calling fn for every item, and returns its header.
+// Reading stops at the first error returned by fn.
+func ReadSnapshot(r io.Reader, fn func(item SnapshotItem) error) (SnapshotHeader, error) {
+	decoder := json.NewDecoder(r)
+	var header SnapshotHeader
+	err := decoder.Decode(&header)
+	if err != nil {
+		return header, errors.Wrap(err, "Failed to read snapshot header")
+	}
+	if header.Format != SnapshotFormat {
+		return header, errors.Errorf("Not a snapshot, unknown format %q", header.Format)
+	}
+	if header.Version != SnapshotVersion {
+		return header, errors.Errorf("Unsupported snapshot version %d", header.Version)
+	}
+
+	for {
+		var item SnapshotItem
+		err = decoder.Decode(&item)
+		if err == io.EOF {
+			return header, nil
+		}
+		if err != nil {
+			return header, errors.Wrap(err, "Failed to read snapshot item")
+		}
+		err = fn(item)
+		if err != nil {
+			return header, err
+		}
+	}
+}
+
+// snapshotKeys returns the sorted keys starting with one of the prefixes
+func snapshotKeys(ctx context.Context, reader Reader, prefixes []string) ([]string, error) {
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	unique := map[string]struct{}{}
+	for _, prefix := range prefixes {
+		keys, err := reader.Scan(ctx, prefix)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list keys starting with %q", prefix)
+		}
+		for _, key := range keys {
+			unique[key] = struct{}{}
+		}
+	}
+	keys := make([]string, 0, len(unique))
+	for key := range unique {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// exportItem reads the item stored under key along with its time to live
+func exportItem(ctx context.Context, reader Reader, key string, opts SnapshotOptions) (SnapshotItem, error) {
+	ttl, err := reader.TTL(ctx, key)
+	if err != nil {
+		return SnapshotItem{}, err
+	}
+	if ttl != NoExpiration && ttl <= 0 {
+		return SnapshotItem{}, ErrNotFound
+	}
+
+	var value any
+	if opts.TypeOf != nil {
+		value = opts.TypeOf(key)
+	}
+	if value != nil {
+		err = ReadInto(ctx, reader, key, value)
+	} else {
+		value, err = reader.Read(ctx, key)
+	}
+	if err != nil {
+		return SnapshotItem{}, err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return SnapshotItem{}, errors.Wrap(err, "Failed to encode value in JSON")
+	}
+	return SnapshotItem{Key: key, TTL: ttl, Value: data}, nil
+}
+
+// decodeSnapshotValue decodes the value of an item into its type if known, untyped otherwise
+func decodeSnapshotValue(item SnapshotItem, typeOf func(key string) any) (any, error) {
+	var dst any
+	if typeOf != nil {
+		dst = typeOf(item.Key)
+	}
+	if dst == nil {
+		var value any
+		dst = &value
+	}
+	err := json.Unmarshal(item.Value, dst)
+	if err != nil {
+		return nil, &DecodeError{Key: item.Key, Err: err}
+	}
+	return reflect.ValueOf(dst).Elem().Interface(), nil
+}
+
+func hasAnyPrefix(key string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"github.com/MarouaneMan/github-api/internal/testutil/redistest"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func snapshotTypeMock(key string) any {
+	if strings.HasPrefix(key, "typed:") {
+		return &[]*codecItemMock{}
+	}
+	return nil
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	sources := map[string]ReadWriter{
+		"memory": NewInMemoryStore(NoExpiration, time.Minute),
+		"redis":  newTestRedisStore(t, redistest.New(t, ""), RedisOptions{}),
+		"gob":    newTestRedisStore(t, redistest.New(t, ""), RedisOptions{Codec: GobCodec}),
+	}
+	for name, source := range sources {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, source.Write(ctx, "typed:items", newCodecItemMock(), NoExpiration))
+			assert.NoError(t, source.Write(ctx, "typed:expiring", newCodecItemMock(), time.Hour))
+			assert.NoError(t, source.Write(ctx, "other", "untyped", NoExpiration))
+
+			var snapshot bytes.Buffer
+			opts := SnapshotOptions{Prefixes: []string{"typed:"}, TypeOf: snapshotTypeMock}
+			exported, err := Export(ctx, source, &snapshot, opts)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, exported, "only the keys with the given prefixes should be exported")
+
+			for _, target := range []ReadWriter{
+				NewInMemoryStore(NoExpiration, time.Minute),
+				newTestDiskStore(t, DiskOptions{Path: filepath.Join(t.TempDir(), "store.log")}),
+			} {
+				imported, err := Import(ctx, target, bytes.NewReader(snapshot.Bytes()), opts)
+				assert.NoError(t, err)
+				assert.Equal(t, 2, imported)
+
+				var items []*codecItemMock
+				assert.NoError(t, ReadInto(ctx, target, "typed:items", &items), "items should be imported with their type")
+				assert.Equal(t, newCodecItemMock(), items)
+				ttl, _ := target.TTL(ctx, "typed:items")
+				assert.Equal(t, NoExpiration, ttl)
+				ttl, _ = target.TTL(ctx, "typed:expiring")
+				assert.InDelta(t, time.Hour, ttl, float64(time.Minute), "the time to live should be preserved")
+			}
+		})
+	}
+}
+
+func TestSnapshotUntyped(t *testing.T) {
+	ctx := context.Background()
+	source := NewInMemoryStore(NoExpiration, time.Minute)
+	_ = source.Write(ctx, "a", map[string]any{"name": "a"}, NoExpiration)
+	_ = source.Write(ctx, "b", "b", NoExpiration)
+
+	var snapshot bytes.Buffer
+	exported, err := Export(ctx, source, &snapshot, SnapshotOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, exported, "every key should be exported without prefixes")
+
+	keys := []string{}
+	header, err := ReadSnapshot(bytes.NewReader(snapshot.Bytes()), func(item SnapshotItem) error {
+		keys = append(keys, item.Key)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, SnapshotVersion, header.Version)
+	assert.WithinDuration(t, time.Now(), header.CreatedAt, time.Minute)
+	assert.Equal(t, []string{"a", "b"}, keys, "items should be sorted by key")
+
+	target := NewInMemoryStore(NoExpiration, time.Minute)
+	_, err = Import(ctx, target, &snapshot, SnapshotOptions{Prefixes: []string{"b"}})
+	assert.NoError(t, err)
+	value, _ := target.Read(ctx, "b")
+	assert.Equal(t, "b", value)
+	exists, _ := target.Exists(ctx, "a")
+	assert.False(t, exists, "only the keys with the given prefixes should be imported")
+}
+
+func TestReadSnapshotInvalid(t *testing.T) {
+	for name, snapshot := range map[string]string{
+		"empty":     "",
+		"format":    `{"format":"other","version":1}`,
+		"version":   `{"format":"kvstore-snapshot","version":99}`,
+		"truncated": `{"format":"kvstore-snapshot","version":1}` + "\n" + `{"key":"a","ttl":-1,"val`,
+	} {
+		_, err := ReadSnapshot(strings.NewReader(snapshot), func(SnapshotItem) error { return nil })
+		assert.Error(t, err, "%s snapshot should be refused", name)
+	}
+}
@@ -0,0 +1,380 @@
+package kvstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/Scalingo/go-utils/logger"
+	"github.com/pkg/errors"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TieredMode selects how writes populate the local tier of a tiered store.
+type TieredMode string
+
+const (
+	// WriteThrough writes items to both tiers.
+	WriteThrough TieredMode = "write_through"
+
+	// WriteAround writes items to the shared tier only, the local tier is filled on the next read.
+	WriteAround TieredMode = "write_around"
+)
+
+// DefaultInvalidationChannel is the channel on which tiered stores broadcast invalidations by default.
+const DefaultInvalidationChannel = "kvstore:invalidations"
+
+// TieredOptions configures a tiered store.
+type TieredOptions struct {
+	// L1TTL is the maximum time an item is served from the local tier, defaults to 1 minute
+	L1TTL time.Duration
+
+	// Mode defaults to WriteThrough
+	Mode TieredMode
+
+	// PubSub broadcasts invalidations to the other instances sharing the L2 store, so that they
+	// drop their local copy of the items written by this instance. nil disables it, local copies
+	// are then refreshed after at most L1TTL, as they are when broadcasting fails: the write is
+	// committed to L2 by then, the failure is logged and not returned.
+	PubSub PubSub
+
+	// Channel the invalidations are broadcast on, defaults to DefaultInvalidationChannel
+	Channel string
+
+	// Codec serializes the local copies, which are decoded again on every read so that readers
+	// never share them, defaults to JSONCodec
+	Codec Codec
+}
+
+type tieredStore struct {
+	// l1 holds the local copies encoded with the codec
+	l1   *inMemoryStore
+	l2   ReadWriter
+	opts TieredOptions
+
+	// id identifies this instance in invalidation messages to ignore its own invalidations
+	id string
+
+	// mu serializes L1 fills and invalidations. generation is incremented on every invalidation
+	// so that values read from L2 before an invalidation are not put back into L1.
+	mu         sync.Mutex
+	generation uint64
+
+	cancel context.CancelFunc
+}
+
+// NewTieredStore returns a store serving items from a local in-memory L1 and falling back to the
+// shared l2 store. Call Close to stop listening to invalidations.
+func NewTieredStore(l2 ReadWriter, opts TieredOptions) (*tieredStore, error) {
+	switch opts.Mode {
+	case "":
+		opts.Mode = WriteThrough
+	case WriteThrough, WriteAround:
+	default:
+		return nil, errors.Errorf("Unknown tiered store mode %q", opts.Mode)
+	}
+	if opts.L1TTL <= 0 {
+		opts.L1TTL = time.Minute
+	}
+	if opts.Channel == "" {
+		opts.Channel = DefaultInvalidationChannel
+	}
+	if opts.Codec == nil {
+		opts.Codec = JSONCodec
+	}
+
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate tiered store id")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ts := &tieredStore{
+		l1:     NewInMemoryStore(opts.L1TTL, opts.L1TTL),
+		l2:     l2,
+		opts:   opts,
+		id:     hex.EncodeToString(id),
+		cancel: cancel,
+	}
+	if opts.PubSub != nil {
+		opts.PubSub.Subscribe(ctx, opts.Channel, ts.onInvalidation, ts.flush)
+	}
+	return ts, nil
+}
+
+// Write an item to L2, then to L1 in write-through mode
+func (ts *tieredStore) Write(ctx context.Context, key string, value any, expiry time.Duration) error {
+	err := ts.l2.Write(ctx, key, value, expiry)
+	ts.invalidate(key)
+	if err != nil {
+		return err
+	}
+	ts.written(ctx, key, value, expiry)
+	return nil
+}
+
+// ReadVersion reads an item and its version from L2
+func (ts *tieredStore) ReadVersion(ctx context.Context, key string, dst any) (uint64, error) {
+	return ReadVersion(ctx, ts.l2, key, dst)
+}
+
+// WriteIfVersion writes an item to L2 only if its current version is version, then to L1 in
+// write-through mode
+func (ts *tieredStore) WriteIfVersion(ctx context.Context, key string, value any, version uint64, expiry time.Duration) (uint64, error) {
+	version, err := WriteIfVersion(ctx, ts.l2, key, value, version, expiry)
+	// on a mismatch the local copy is outdated as well
+	ts.invalidate(key)
+	if err != nil {
+		return 0, err
+	}
+	ts.written(ctx, key, value, expiry)
+	return version, nil
+}
+
+// Read an item from L1, or from L2 on a miss
+func (ts *tieredStore) Read(ctx context.Context, key string) (any, error) {
+	var value any
+	err := ts.readL1(ctx, key, &value)
+	if err == nil {
+		return value, nil
+	}
+
+	generation := ts.currentGeneration()
+	value, err = ts.l2.Read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	ts.fill(ctx, key, value, generation)
+	return value, nil
+}
+
+// ReadInto decodes an item read from L1, or from L2 on a miss, into the value pointed to by dst
+func (ts *tieredStore) ReadInto(ctx context.Context, key string, dst any) error {
+	// the local copy may not decode into dst, in which case it is read again from L2
+	err := ts.readL1(ctx, key, dst)
+	if err == nil {
+		return nil
+	}
+
+	generation := ts.currentGeneration()
+	err = ReadInto(ctx, ts.l2, key, dst)
+	if err != nil {
+		return err
+	}
+	ts.fill(ctx, key, reflect.ValueOf(dst).Elem().Interface(), generation)
+	return nil
+}
+
+// ReadManyInto decodes items read from L1, or from L2 on a miss, into the map pointed to by dst.
+// Items read from L2 are not put into L1, as checking their TTL would take another round trip.
+func (ts *tieredStore) ReadManyInto(ctx context.Context, keys []string, dst any) error {
+	items, err := batchDestination(dst)
+	if err != nil {
+		return err
+	}
+	missing := []string{}
+	for _, key := range keys {
+		key := key
+		err = decodeBatchItem(items, key, func(dst any) error {
+			return ts.readL1(ctx, key, dst)
+		})
+		if err != nil {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	fetched := reflect.New(items.Type())
+	err = ReadManyInto(ctx, ts.l2, missing, fetched.Interface())
+	if err != nil {
+		return err
+	}
+	iter := fetched.Elem().MapRange()
+	for iter.Next() {
+		items.SetMapIndex(iter.Key(), iter.Value())
+	}
+	return nil
+}
+
+// WriteMany sets several items in L2, then in L1 in write-through mode. The invalidations are
+// broadcast in a single message.
+func (ts *tieredStore) WriteMany(ctx context.Context, items map[string]any, expiry time.Duration) error {
+	err := WriteMany(ctx, ts.l2, items, expiry)
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		ts.invalidate(key)
+		keys = append(keys, key)
+	}
+	if err != nil {
+		return err
+	}
+	if ts.opts.Mode == WriteThrough {
+		ts.mu.Lock()
+		for key, value := range items {
+			ts.writeL1(ctx, key, value, ts.l1Expiry(expiry))
+		}
+		ts.mu.Unlock()
+	}
+	ts.broadcast(ctx, keys...)
+	return nil
+}
+
+// Exists reports whether an item is stored under key
+func (ts *tieredStore) Exists(ctx context.Context, key string) (bool, error) {
+	exists, _ := ts.l1.Exists(ctx, key)
+	if exists {
+		return true, nil
+	}
+	return ts.l2.Exists(ctx, key)
+}
+
+// TTL returns the remaining time to live of an item in L2
+func (ts *tieredStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return ts.l2.TTL(ctx, key)
+}
+
+// Scan returns the keys starting with prefix in L2
+func (ts *tieredStore) Scan(ctx context.Context, prefix string) ([]string, error) {
+	return ts.l2.Scan(ctx, prefix)
+}
+
+// Delete removes an item from both tiers
+func (ts *tieredStore) Delete(ctx context.Context, key string) error {
+	err := ts.l2.Delete(ctx, key)
+	ts.invalidate(key)
+	if err != nil {
+		return err
+	}
+	ts.broadcast(ctx, key)
+	return nil
+}
+
+// Touch resets the expiry of an item in L2, local copies are dropped so that they do not
+// outlive the item
+func (ts *tieredStore) Touch(ctx context.Context, key string, expiry time.Duration) error {
+	err := ts.l2.Touch(ctx, key, expiry)
+	ts.invalidate(key)
+	if err != nil {
+		return err
+	}
+	ts.broadcast(ctx, key)
+	return nil
+}
+
+// Watch returns a channel receiving the changes of the keys starting with prefix in L2
+func (ts *tieredStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return Watch(ctx, ts.l2, prefix)
+}
+
+// Close stops listening to invalidations
+func (ts *tieredStore) Close() error {
+	ts.cancel()
+	return nil
+}
+
+// written populates L1 in write-through mode and broadcasts the invalidation of an item written to L2
+func (ts *tieredStore) written(ctx context.Context, key string, value any, expiry time.Duration) {
+	if ts.opts.Mode == WriteThrough {
+		ts.mu.Lock()
+		ts.writeL1(ctx, key, value, ts.l1Expiry(expiry))
+		ts.mu.Unlock()
+	}
+	ts.broadcast(ctx, key)
+}
+
+// fill puts a value read from L2 into L1, unless an invalidation occurred since generation.
+// The local copy does not outlive the item in L2.
+func (ts *tieredStore) fill(ctx context.Context, key string, value any, generation uint64) {
+	ttl, err := ts.l2.TTL(ctx, key)
+	if err != nil || (ttl != NoExpiration && ttl <= 0) {
+		return
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.generation != generation {
+		return
+	}
+	ts.writeL1(ctx, key, value, ts.l1Expiry(ttl))
+}
+
+// writeL1 puts the encoded value into L1, it is not cached if it cannot be encoded.
+// The lock must be held.
+func (ts *tieredStore) writeL1(ctx context.Context, key string, value any, expiry time.Duration) {
+	data, err := ts.opts.Codec.Marshal(value)
+	if err != nil {
+		return
+	}
+	_ = ts.l1.Write(ctx, key, data, expiry)
+}
+
+// readL1 decodes the local copy of an item into the value pointed to by dst
+func (ts *tieredStore) readL1(ctx context.Context, key string, dst any) error {
+	var data []byte
+	err := ReadInto(ctx, ts.l1, key, &data)
+	if err != nil {
+		return err
+	}
+	return ts.opts.Codec.Unmarshal(data, dst)
+}
+
+func (ts *tieredStore) currentGeneration() uint64 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.generation
+}
+
+// invalidate drops the local copy of an item
+func (ts *tieredStore) invalidate(key string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.generation++
+	_ = ts.l1.Delete(context.Background(), key)
+}
+
+// flush drops every local copy, called when invalidations may have been missed
+func (ts *tieredStore) flush() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.generation++
+	ts.l1.cache.Flush()
+}
+
+// broadcast asks the other instances to drop their local copy of items. The items are already
+// committed to L2 so a failure is only logged, the other instances serve their local copy for
+// at most L1TTL.
+func (ts *tieredStore) broadcast(ctx context.Context, keys ...string) {
+	if ts.opts.PubSub == nil || len(keys) == 0 {
+		return
+	}
+	err := ts.opts.PubSub.Publish(ctx, ts.opts.Channel, ts.id+" "+strings.Join(keys, "\n"))
+	if err != nil {
+		logger.Get(ctx).WithError(err).WithField("keys", keys).Warn("Failed to broadcast tiered store invalidation")
+	}
+}
+
+// onInvalidation handles the invalidation messages, formatted as "<instance id> <keys>" with keys
+// separated by new lines
+func (ts *tieredStore) onInvalidation(message string) {
+	origin, keys, ok := strings.Cut(message, " ")
+	if !ok || origin == ts.id {
+		return
+	}
+	for _, key := range strings.Split(keys, "\n") {
+		ts.invalidate(key)
+	}
+}
+
+// l1Expiry caps the expiry of an item written to L1 to the L1 TTL, items written with
+// DefaultExpiration expire after at most L1TTL as the L2 default expiration is unknown
+func (ts *tieredStore) l1Expiry(expiry time.Duration) time.Duration {
+	if expiry > 0 && expiry < ts.opts.L1TTL {
+		return expiry
+	}
+	return ts.opts.L1TTL
+}
@@ -0,0 +1,215 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/MarouaneMan/github-api/internal/testutil/redistest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestTieredStore(t *testing.T, l2 ReadWriter, opts TieredOptions) *tieredStore {
+	store, err := NewTieredStore(l2, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	return store
+}
+
+func TestTieredStore(t *testing.T) {
+	// L1 copies must not outlive the 50ms default expiration expected by the suite
+	for _, mode := range []TieredMode{WriteThrough, WriteAround} {
+		t.Run(string(mode), func(t *testing.T) {
+			t.Run("memory", func(t *testing.T) {
+				l2 := NewInMemoryStore(50*time.Millisecond, time.Minute)
+				testStore(t, newTestTieredStore(t, l2, TieredOptions{
+					L1TTL:  50 * time.Millisecond,
+					Mode:   mode,
+					PubSub: NewLocalPubSub(),
+				}))
+			})
+			t.Run("redis", func(t *testing.T) {
+				l2 := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})
+				testStore(t, newTestTieredStore(t, l2, TieredOptions{
+					L1TTL:  50 * time.Millisecond,
+					Mode:   mode,
+					PubSub: l2,
+				}))
+			})
+		})
+	}
+}
+
+func TestTieredStoreL1(t *testing.T) {
+	ctx := context.Background()
+	l2 := NewInMemoryStore(NoExpiration, time.Minute)
+	store := newTestTieredStore(t, l2, TieredOptions{L1TTL: 50 * time.Millisecond})
+
+	_ = store.Write(ctx, "key", "value", NoExpiration)
+	_ = l2.Write(ctx, "key", "updated", NoExpiration) // updated behind the tiered store's back
+
+	value, _ := store.Read(ctx, "key")
+	assert.Equal(t, "value", value, "item should be served from L1")
+
+	time.Sleep(60 * time.Millisecond)
+	value, _ = store.Read(ctx, "key")
+	assert.Equal(t, "updated", value, "item should be read from L2 after the L1 TTL")
+}
+
+func TestTieredStoreWriteAround(t *testing.T) {
+	ctx := context.Background()
+	l2 := NewInMemoryStore(NoExpiration, time.Minute)
+	store := newTestTieredStore(t, l2, TieredOptions{Mode: WriteAround})
+
+	_ = store.Write(ctx, "key", "value", NoExpiration)
+	exists, _ := store.l1.Exists(ctx, "key")
+	assert.False(t, exists, "write-around should not populate L1")
+
+	value, _ := store.Read(ctx, "key")
+	assert.Equal(t, "value", value)
+	exists, _ = store.l1.Exists(ctx, "key")
+	assert.True(t, exists, "reads should populate L1")
+}
+
+func TestTieredStoreReadIntoFillsL1(t *testing.T) {
+	ctx := context.Background()
+	l2 := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})
+	store := newTestTieredStore(t, l2, TieredOptions{Mode: WriteAround})
+
+	_ = store.Write(ctx, "key", newCodecItemMock(), NoExpiration)
+
+	// an untyped read fills L1 with an untyped value, decoded again into the typed destination
+	_, _ = store.Read(ctx, "key")
+	var items []*codecItemMock
+	assert.NoError(t, ReadInto(ctx, store, "key", &items))
+	assert.Equal(t, newCodecItemMock(), items)
+
+	_ = l2.Close() // typed reads are now served from L1
+	items = nil
+	assert.NoError(t, ReadInto(ctx, store, "key", &items))
+	assert.Equal(t, newCodecItemMock(), items)
+}
+
+func TestTieredStoreCallersDoNotShareL1(t *testing.T) {
+	ctx := context.Background()
+	l2 := NewInMemoryStore(NoExpiration, time.Minute)
+	store := newTestTieredStore(t, l2, TieredOptions{})
+
+	// mutate what was written, read from L2, read from L1 and read in batch
+	written := []string{"a", "b"}
+	_ = store.Write(ctx, "written", written, NoExpiration)
+	written[0] = "mutated"
+	_ = l2.Write(ctx, "filled", []string{"a", "b"}, NoExpiration)
+	for _, key := range []string{"written", "filled", "filled"} {
+		var read []string
+		assert.NoError(t, ReadInto(ctx, store, key, &read))
+		assert.Equal(t, []string{"a", "b"}, read, "%s should not be mutated by the caller", key)
+		read[0] = "mutated"
+	}
+	for i := 0; i < 2; i++ {
+		var read map[string][]string
+		assert.NoError(t, store.ReadManyInto(ctx, []string{"written", "filled"}, &read))
+		assert.Equal(t, map[string][]string{"written": {"a", "b"}, "filled": {"a", "b"}}, read)
+		read["written"][0] = "mutated"
+		read["filled"][0] = "mutated"
+	}
+}
+
+func TestTieredStoreInvalidation(t *testing.T) {
+	ctx := context.Background()
+	fr := redistest.New(t, "")
+	newInstance := func() *tieredStore {
+		l2 := newTestRedisStore(t, fr, RedisOptions{})
+		subscribed := make(chan struct{})
+		ts := newTestTieredStore(t, l2, TieredOptions{PubSub: &notifyingPubSub{PubSub: l2, subscribed: subscribed}})
+		select {
+		case <-subscribed:
+		case <-time.After(time.Second):
+			t.Fatal("instance should subscribe to invalidations")
+		}
+		return ts
+	}
+	first, second := newInstance(), newInstance()
+
+	_ = first.Write(ctx, "key", "first", NoExpiration)
+	value, _ := second.Read(ctx, "key")
+	assert.Equal(t, "first", value)
+
+	_ = first.Write(ctx, "key", "second", NoExpiration)
+	assert.Eventually(t, func() bool {
+		value, _ := second.Read(ctx, "key")
+		return value == "second"
+	}, time.Second, 5*time.Millisecond, "write should invalidate the other instances' L1")
+	value, _ = first.Read(ctx, "key")
+	assert.Equal(t, "second", value, "instance should keep its own writes in L1")
+
+	_ = second.Delete(ctx, "key")
+	assert.Eventually(t, func() bool {
+		_, err := first.Read(ctx, "key")
+		return err == ErrNotFound
+	}, time.Second, 5*time.Millisecond, "delete should invalidate the other instances' L1")
+}
+
+func TestTieredStoreResync(t *testing.T) {
+	ctx := context.Background()
+	l2 := NewInMemoryStore(NoExpiration, time.Minute)
+	store := newTestTieredStore(t, l2, TieredOptions{})
+
+	_ = store.Write(ctx, "key", "value", NoExpiration)
+	store.flush()
+	exists, _ := store.l1.Exists(ctx, "key")
+	assert.False(t, exists, "resync should drop every local copy")
+}
+
+func TestTieredStoreBroadcastFailure(t *testing.T) {
+	ctx := context.Background()
+	l2 := NewInMemoryStore(NoExpiration, time.Minute)
+	store := newTestTieredStore(t, l2, TieredOptions{PubSub: &failingPubSub{PubSub: NewLocalPubSub()}})
+
+	assert.NoError(t, store.Write(ctx, "key", "value", NoExpiration), "committed write should not fail")
+	value, _ := l2.Read(ctx, "key")
+	assert.Equal(t, "value", value)
+
+	version, err := store.ReadVersion(ctx, "key", new(string))
+	assert.NoError(t, err)
+	_, err = store.WriteIfVersion(ctx, "key", "updated", version, NoExpiration)
+	assert.NoError(t, err, "committed conditional write should not fail")
+	_, err = store.WriteIfVersion(ctx, "key", "stale", version, NoExpiration)
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+
+	assert.NoError(t, store.WriteMany(ctx, map[string]any{"other": "value"}, NoExpiration))
+	assert.NoError(t, store.Touch(ctx, "key", NoExpiration))
+	assert.NoError(t, store.Delete(ctx, "key"))
+	_, err = l2.Read(ctx, "key")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+// failingPubSub fails to publish any message
+type failingPubSub struct {
+	PubSub
+}
+
+func (fps *failingPubSub) Publish(context.Context, string, string) error {
+	return errors.New("connection refused")
+}
+
+// notifyingPubSub signals the first established subscription
+type notifyingPubSub struct {
+	PubSub
+	subscribed chan struct{}
+}
+
+func (nps *notifyingPubSub) Subscribe(ctx context.Context, channel string, onMessage func(message string), onResync func()) {
+	nps.PubSub.Subscribe(ctx, channel, onMessage, func() {
+		onResync()
+		select {
+		case <-nps.subscribed:
+		default:
+			close(nps.subscribed)
+		}
+	})
+}
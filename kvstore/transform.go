@@ -0,0 +1,147 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// valueTransformer transforms serialized values on their way to and from the inner store
+type valueTransformer interface {
+	encode(key string, data []byte) ([]byte, error)
+	decode(key string, data []byte) ([]byte, error)
+}
+
+// transformingStore serializes values with its codec, transforms them and stores the result as
+// []byte in the inner store. Operations that do not involve values are passed through.
+type transformingStore struct {
+	ReadWriter
+	codec       Codec
+	transformer valueTransformer
+}
+
+func newTransformingStore(inner ReadWriter, codec Codec, transformer valueTransformer) *transformingStore {
+	if codec == nil {
+		codec = JSONCodec
+	}
+	return &transformingStore{
+		ReadWriter:  inner,
+		codec:       codec,
+		transformer: transformer,
+	}
+}
+
+// Write an item to the inner store once serialized and transformed
+func (ts *transformingStore) Write(ctx context.Context, key string, value any, expiry time.Duration) error {
+	data, err := ts.encode(key, value)
+	if err != nil {
+		return err
+	}
+	return ts.ReadWriter.Write(ctx, key, data, expiry)
+}
+
+// Read an item from the store, the item is decoded into an untyped value
+func (ts *transformingStore) Read(ctx context.Context, key string) (any, error) {
+	var value any
+	err := ts.ReadInto(ctx, key, &value)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// ReadInto decodes the item stored under key into the value pointed to by dst.
+// Returns a *DecodeError if the stored item cannot be transformed back or decoded.
+func (ts *transformingStore) ReadInto(ctx context.Context, key string, dst any) error {
+	var data []byte
+	err := ReadInto(ctx, ts.ReadWriter, key, &data)
+	if err != nil {
+		return err
+	}
+	return ts.decode(key, data, dst)
+}
+
+// ReadManyInto decodes the items stored under keys into the map pointed to by dst
+func (ts *transformingStore) ReadManyInto(ctx context.Context, keys []string, dst any) error {
+	items, err := batchDestination(dst)
+	if err != nil {
+		return err
+	}
+	stored := map[string][]byte{}
+	err = ReadManyInto(ctx, ts.ReadWriter, keys, &stored)
+	if err != nil {
+		return err
+	}
+	for key, data := range stored {
+		key, data := key, data
+		err = decodeBatchItem(items, key, func(dst any) error {
+			return ts.decode(key, data, dst)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteMany sets several items in the inner store once serialized and transformed
+func (ts *transformingStore) WriteMany(ctx context.Context, items map[string]any, expiry time.Duration) error {
+	encoded := make(map[string]any, len(items))
+	for key, value := range items {
+		data, err := ts.encode(key, value)
+		if err != nil {
+			return err
+		}
+		encoded[key] = data
+	}
+	return WriteMany(ctx, ts.ReadWriter, encoded, expiry)
+}
+
+// ReadVersion decodes the item stored under key into the value pointed to by dst and returns
+// its version in the inner store
+func (ts *transformingStore) ReadVersion(ctx context.Context, key string, dst any) (uint64, error) {
+	var data []byte
+	version, err := ReadVersion(ctx, ts.ReadWriter, key, &data)
+	if err == nil {
+		err = ts.decode(key, data, dst)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// WriteIfVersion writes an item to the inner store only if its current version is version
+func (ts *transformingStore) WriteIfVersion(ctx context.Context, key string, value any, version uint64, expiry time.Duration) (uint64, error) {
+	data, err := ts.encode(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return WriteIfVersion(ctx, ts.ReadWriter, key, data, version, expiry)
+}
+
+// Watch returns a channel receiving the changes of the keys starting with prefix
+func (ts *transformingStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return Watch(ctx, ts.ReadWriter, prefix)
+}
+
+// encode serializes and transforms a value
+func (ts *transformingStore) encode(key string, value any) ([]byte, error) {
+	data, err := ts.codec.Marshal(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to serialize value")
+	}
+	return ts.transformer.encode(key, data)
+}
+
+// decode transforms back and deserializes an item into the value pointed to by dst
+func (ts *transformingStore) decode(key string, data []byte, dst any) error {
+	data, err := ts.transformer.decode(key, data)
+	if err == nil {
+		err = ts.codec.Unmarshal(data, dst)
+	}
+	if err != nil {
+		return &DecodeError{Key: key, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package kvstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"reflect"
+	"time"
+)
+
+// ErrVersionMismatch is returned by conditional writes when the item was modified since its
+// version was read.
+var ErrVersionMismatch = errors.New("Version mismatch")
+
+// ErrVersioningNotSupported is returned when writing conditionally to a store without versions.
+var ErrVersioningNotSupported = errors.New("Store does not support versioned writes")
+
+// Versioner is implemented by stores able to write items conditionally to their version.
+// Versions are opaque and change whenever the value of the item changes, 0 is the version of
+// missing items.
+//
+// Versions may be derived from the serialized item (e.g. redis) rather than counted: an item
+// written back with a value it held before gets its former version back (ABA). A conditional
+// write then only guarantees that the item holds the value it held when its version was read,
+// not that it was left untouched in between. Callers that must detect every modification store
+// values that never repeat, as locks do with the fencing token of their leases.
+type Versioner interface {
+	// ReadVersion decodes the item stored under key into the value pointed to by dst and returns
+	// its version. Returns ErrNotFound if not found and a *DecodeError if the item cannot be decoded.
+	ReadVersion(ctx context.Context, key string, dst any) (uint64, error)
+
+	// WriteIfVersion writes an item only if its current version is version, 0 meaning that the
+	// item must not exist. Returns the new version, or ErrVersionMismatch if the item was modified.
+	WriteIfVersion(ctx context.Context, key string, value any, version uint64, expiry time.Duration) (uint64, error)
+}
+
+// ReadVersion reads the item stored under key into the value pointed to by dst and returns its
+// version, returns ErrVersioningNotSupported if the store has no versions.
+func ReadVersion(ctx context.Context, reader Reader, key string, dst any) (uint64, error) {
+	versioner, ok := reader.(Versioner)
+	if !ok {
+		return 0, ErrVersioningNotSupported
+	}
+	return versioner.ReadVersion(ctx, key, dst)
+}
+
+// WriteIfVersion writes an item only if its current version is version, returns
+// ErrVersioningNotSupported if the store has no versions.
+func WriteIfVersion(ctx context.Context, writer Writer, key string, value any, version uint64, expiry time.Duration) (uint64, error) {
+	versioner, ok := writer.(Versioner)
+	if !ok {
+		return 0, ErrVersioningNotSupported
+	}
+	return versioner.WriteIfVersion(ctx, key, value, version, expiry)
+}
+
+// CompareAndSwap replaces the item stored under key by value if it is equal to old, a nil old
+// meaning that the item must not exist. Returns ErrVersionMismatch if the item differs from old.
+func CompareAndSwap(ctx context.Context, store ReadWriter, key string, old, value any, expiry time.Duration) error {
+	var version uint64
+	if old != nil {
+		current := reflect.New(reflect.TypeOf(old))
+		var err error
+		version, err = ReadVersion(ctx, store, key, current.Interface())
+		if errors.Is(err, ErrNotFound) {
+			return ErrVersionMismatch
+		}
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(current.Elem().Interface(), old) {
+			return ErrVersionMismatch
+		}
+	}
+	_, err := WriteIfVersion(ctx, store, key, value, version, expiry)
+	return err
+}
+
+// contentVersion returns the version of a serialized item, derived from its content with a
+// cryptographic hash so that distinct values cannot be crafted to share a version
+func contentVersion(data []byte) uint64 {
+	sum := sha256.Sum256(data)
+	if version := binary.BigEndian.Uint64(sum[:8]); version != 0 {
+		return version
+	}
+	// 0 is reserved for missing items
+	return 1
+}
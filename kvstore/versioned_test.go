@@ -0,0 +1,196 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/MarouaneMan/github-api/internal/testutil/redistest"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testVersioner runs the behavioral test suite every versioned store must pass
+func testVersioner(t *testing.T, store interface {
+	ReadWriter
+	Versioner
+}) {
+	ctx := context.Background()
+
+	var value string
+	_, err := store.ReadVersion(ctx, "versioned", &value)
+	assert.ErrorIs(t, err, ErrNotFound, "should return ErrNotFound for missing items")
+
+	v1, err := store.WriteIfVersion(ctx, "versioned", "first", 0, NoExpiration)
+	assert.NoError(t, err, "version 0 should create missing items")
+	assert.NotZero(t, v1)
+	_, err = store.WriteIfVersion(ctx, "versioned", "other", 0, NoExpiration)
+	assert.ErrorIs(t, err, ErrVersionMismatch, "version 0 should not overwrite existing items")
+
+	version, err := store.ReadVersion(ctx, "versioned", &value)
+	assert.NoError(t, err)
+	assert.Equal(t, v1, version)
+	assert.Equal(t, "first", value)
+
+	v2, err := store.WriteIfVersion(ctx, "versioned", "second", v1, NoExpiration)
+	assert.NoError(t, err, "should write items at the expected version")
+	assert.NotEqual(t, v1, v2, "writes should change the version")
+	_, err = store.WriteIfVersion(ctx, "versioned", "stale", v1, NoExpiration)
+	assert.ErrorIs(t, err, ErrVersionMismatch, "should refuse stale writes")
+
+	_ = store.Write(ctx, "versioned", "blind", NoExpiration)
+	_, err = store.WriteIfVersion(ctx, "versioned", "stale", v2, NoExpiration)
+	assert.ErrorIs(t, err, ErrVersionMismatch, "plain writes should change the version")
+
+	_ = store.Delete(ctx, "versioned")
+	_, err = store.WriteIfVersion(ctx, "versioned", "recreated", 0, NoExpiration)
+	assert.NoError(t, err, "deleted items should be missing")
+	_ = store.Delete(ctx, "versioned")
+}
+
+func TestVersionedStores(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testVersioner(t, NewInMemoryStore(NoExpiration, time.Minute))
+	})
+	t.Run("redis", func(t *testing.T) {
+		testVersioner(t, newTestRedisStore(t, redistest.New(t, ""), RedisOptions{}))
+	})
+	t.Run("routing", func(t *testing.T) {
+		primary := NewInMemoryStore(NoExpiration, time.Minute)
+		testVersioner(t, newTestRoutingStore(t, primary, []Reader{NewInMemoryStore(NoExpiration, time.Minute)}, RoutingOptions{}))
+	})
+	t.Run("tiered", func(t *testing.T) {
+		l2 := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})
+		testVersioner(t, newTestTieredStore(t, l2, TieredOptions{PubSub: l2}))
+	})
+	t.Run("instrumented", func(t *testing.T) {
+		testVersioner(t, NewInstrumentedStore(NewInMemoryStore(NoExpiration, time.Minute), newTestMetrics(), InstrumentedOptions{}))
+	})
+	t.Run("encrypted", func(t *testing.T) {
+		inner := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{Codec: RawCodec})
+		testVersioner(t, newTestEncryptedStore(t, inner, testEncryptionKey("a")))
+	})
+}
+
+func TestVersionerABA(t *testing.T) {
+	testCases := map[string]struct {
+		store interface {
+			ReadWriter
+			Versioner
+		}
+		// contentVersions is true for stores deriving versions from the serialized item
+		contentVersions bool
+	}{
+		"memory": {store: NewInMemoryStore(NoExpiration, time.Minute)},
+		"redis":  {store: newTestRedisStore(t, redistest.New(t, ""), RedisOptions{}), contentVersions: true},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := testCase.store
+			v1, err := store.WriteIfVersion(ctx, "key", "a", 0, NoExpiration)
+			assert.NoError(t, err)
+			_ = store.Write(ctx, "key", "b", NoExpiration)
+			_ = store.Write(ctx, "key", "a", NoExpiration)
+
+			var value string
+			current, _ := store.ReadVersion(ctx, "key", &value)
+			assert.Equal(t, testCase.contentVersions, current == v1, "unexpected version of an item written back with a previous value")
+			_, err = store.WriteIfVersion(ctx, "key", "c", v1, NoExpiration)
+			if testCase.contentVersions {
+				assert.NoError(t, err, "item holds the value it held when its version was read")
+			} else {
+				assert.ErrorIs(t, err, ErrVersionMismatch, "counted versions should detect every modification")
+			}
+		})
+	}
+}
+
+func TestInMemoryStoreVersionExpiration(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStore(NoExpiration, 10*time.Millisecond)
+	_, _ = store.WriteIfVersion(ctx, "key", "value", 0, 20*time.Millisecond)
+
+	time.Sleep(30 * time.Millisecond)
+	_, err := store.WriteIfVersion(ctx, "key", "value", 0, NoExpiration)
+	assert.NoError(t, err, "expired items should be missing")
+
+	assert.Eventually(t, func() bool {
+		store.versionsMu.Lock()
+		defer store.versionsMu.Unlock()
+		return len(store.versions) == 1
+	}, time.Second, 10*time.Millisecond, "versions of purged items should be dropped")
+}
+
+func TestRedisStoreWriteIfVersionConcurrentWrite(t *testing.T) {
+	ctx := context.Background()
+	fr := redistest.New(t, "")
+	store := newTestRedisStore(t, fr, RedisOptions{})
+	other := newTestRedisStore(t, fr, RedisOptions{})
+
+	version, _ := store.WriteIfVersion(ctx, "key", "first", 0, NoExpiration)
+	conn, err := store.pool.get(ctx)
+	assert.NoError(t, err)
+	defer store.pool.put(conn)
+
+	// the item is modified between the version check and the write
+	_, err = conn.do(ctx, "WATCH", "key")
+	assert.NoError(t, err)
+	_ = other.Write(ctx, "key", "concurrent", NoExpiration)
+	_, _ = conn.do(ctx, "MULTI")
+	_, _ = conn.do(ctx, "SET", "key", "stale")
+	reply, err := conn.do(ctx, "EXEC")
+	assert.NoError(t, err)
+	assert.Nil(t, reply, "transactions watching a modified key should be aborted")
+
+	var value string
+	current, _ := store.ReadVersion(ctx, "key", &value)
+	assert.Equal(t, "concurrent", value)
+	assert.NotEqual(t, version, current)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	for name, store := range map[string]ReadWriter{
+		"memory": NewInMemoryStore(NoExpiration, time.Minute),
+		"redis":  newTestRedisStore(t, redistest.New(t, ""), RedisOptions{PoolSize: 4}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			assert.NoError(t, CompareAndSwap(ctx, store, "counter", nil, 0, NoExpiration))
+			assert.ErrorIs(t, CompareAndSwap(ctx, store, "counter", nil, 0, NoExpiration), ErrVersionMismatch)
+			assert.ErrorIs(t, CompareAndSwap(ctx, store, "counter", 1, 2, NoExpiration), ErrVersionMismatch)
+			assert.ErrorIs(t, CompareAndSwap(ctx, store, "missing", 1, 2, NoExpiration), ErrVersionMismatch)
+
+			// concurrent increments must not be lost
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						var current int
+						_ = ReadInto(ctx, store, "counter", &current)
+						err := CompareAndSwap(ctx, store, "counter", current, current+1, NoExpiration)
+						if err != ErrVersionMismatch {
+							assert.NoError(t, err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			var counter int
+			_ = ReadInto(ctx, store, "counter", &counter)
+			assert.Equal(t, 10, counter)
+		})
+	}
+}
+
+func TestVersioningNotSupported(t *testing.T) {
+	ctx := context.Background()
+	store := newTestBoundedStore(t, BoundedOptions{})
+	_, err := WriteIfVersion(ctx, store, "key", "value", 0, NoExpiration)
+	assert.ErrorIs(t, err, ErrVersioningNotSupported)
+	var value string
+	_, err = ReadVersion(ctx, store, "key", &value)
+	assert.ErrorIs(t, err, ErrVersioningNotSupported)
+}
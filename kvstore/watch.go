@@ -0,0 +1,149 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+)
+
+// EventType is the kind of change notified to watchers.
+type EventType string
+
+const (
+	// EventWrite is sent when an item is written.
+	EventWrite EventType = "write"
+
+	// EventDelete is sent when an item is deleted.
+	EventDelete EventType = "delete"
+
+	// EventTouch is sent when the expiry of an item is reset.
+	EventTouch EventType = "touch"
+
+	// EventExpire is sent when an expired item is removed.
+	EventExpire EventType = "expire"
+
+	// EventResync is sent, without key, when events may have been missed (e.g. the watcher did
+	// not keep up or the connection to the backend was lost), watchers should reload their state.
+	EventResync EventType = "resync"
+)
+
+// watchBuffer is the number of events buffered per watcher before it is considered as lagging
+const watchBuffer = 64
+
+// ErrWatchNotSupported is returned when watching a store that cannot notify changes.
+var ErrWatchNotSupported = errors.New("Store does not support watching keys")
+
+// Event is a change of the item stored under Key.
+type Event struct {
+	Type EventType
+	Key  string
+}
+
+// Watcher is implemented by stores able to notify changes.
+type Watcher interface {
+	// Watch returns a channel receiving the changes of the keys starting with prefix, an exact key
+	// being watched as a prefix. The channel is closed when ctx is done.
+	Watch(ctx context.Context, prefix string) (<-chan Event, error)
+}
+
+// Watch subscribes to the changes of the keys starting with prefix, returns ErrWatchNotSupported
+// if the store cannot notify changes.
+func Watch(ctx context.Context, reader Reader, prefix string) (<-chan Event, error) {
+	watcher, ok := reader.(Watcher)
+	if !ok {
+		return nil, ErrWatchNotSupported
+	}
+	return watcher.Watch(ctx, prefix)
+}
+
+// watchSubscription delivers events to a single watcher without ever blocking the notifier.
+// When its buffer is full, events are dropped and an EventResync is delivered as soon as possible.
+type watchSubscription struct {
+	prefix string
+	events chan Event
+
+	mu      sync.Mutex
+	lagging bool
+	closed  bool
+}
+
+func newWatchSubscription(prefix string) *watchSubscription {
+	return &watchSubscription{
+		prefix: prefix,
+		events: make(chan Event, watchBuffer),
+	}
+}
+
+func (ws *watchSubscription) send(event Event) {
+	if event.Type != EventResync && !strings.HasPrefix(event.Key, ws.prefix) {
+		return
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closed {
+		return
+	}
+	if ws.lagging {
+		select {
+		case ws.events <- Event{Type: EventResync}:
+			ws.lagging = false
+		default:
+			return
+		}
+		if event.Type == EventResync {
+			return
+		}
+	}
+	select {
+	case ws.events <- event:
+	default:
+		ws.lagging = true
+	}
+}
+
+func (ws *watchSubscription) close() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if !ws.closed {
+		ws.closed = true
+		close(ws.events)
+	}
+}
+
+// watchHub dispatches the events of an in-process store to its watchers, the zero value is ready
+// to use
+type watchHub struct {
+	mu            sync.Mutex
+	subscriptions map[*watchSubscription]bool
+}
+
+// watch registers a watcher until ctx is done
+func (wh *watchHub) watch(ctx context.Context, prefix string) <-chan Event {
+	subscription := newWatchSubscription(prefix)
+
+	wh.mu.Lock()
+	if wh.subscriptions == nil {
+		wh.subscriptions = map[*watchSubscription]bool{}
+	}
+	wh.subscriptions[subscription] = true
+	wh.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		wh.mu.Lock()
+		delete(wh.subscriptions, subscription)
+		wh.mu.Unlock()
+		subscription.close()
+	}()
+	return subscription.events
+}
+
+// notify sends an event to the watchers
+func (wh *watchHub) notify(eventType EventType, key string) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	for subscription := range wh.subscriptions {
+		subscription.send(Event{Type: eventType, Key: key})
+	}
+}
@@ -0,0 +1,167 @@
+package kvstore
+
+import (
+	"context"
+	"github.com/MarouaneMan/github-api/internal/testutil/redistest"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// receiveEvents waits for n events
+func receiveEvents(t *testing.T, events <-chan Event, n int) []Event {
+	t.Helper()
+	received := []Event{}
+	for len(received) < n {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("events channel closed after %v", received)
+			}
+			received = append(received, event)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for events, received %v", received)
+		}
+	}
+	return received
+}
+
+// testWatch runs the behavioral test suite every watchable store must pass
+func testWatch(t *testing.T, store interface {
+	Writer
+	Watcher
+}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := store.Watch(ctx, "watched:")
+	assert.NoError(t, err)
+
+	_ = store.Write(ctx, "other", 1, NoExpiration)
+	_ = store.Write(ctx, "watched:a", 1, NoExpiration)
+	_ = store.Touch(ctx, "watched:a", time.Minute)
+	_ = store.Delete(ctx, "watched:a")
+	assert.Equal(t, []Event{
+		{Type: EventWrite, Key: "watched:a"},
+		{Type: EventTouch, Key: "watched:a"},
+		{Type: EventDelete, Key: "watched:a"},
+	}, receiveEvents(t, events, 3), "only changes of the watched keys should be notified")
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, ok := <-events
+		return !ok
+	}, time.Second, time.Millisecond, "events channel should be closed when the context is done")
+}
+
+func TestInMemoryStoreWatch(t *testing.T) {
+	testWatch(t, NewInMemoryStore(NoExpiration, time.Minute))
+}
+
+func TestInMemoryStoreWatchExpiration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := NewInMemoryStore(NoExpiration, 5*time.Millisecond)
+
+	events, _ := store.Watch(ctx, "")
+	_ = store.Write(ctx, "key", 1, time.Millisecond)
+	assert.Equal(t, []Event{
+		{Type: EventWrite, Key: "key"},
+		{Type: EventExpire, Key: "key"},
+	}, receiveEvents(t, events, 2))
+}
+
+func TestRedisStoreWatch(t *testing.T) {
+	ctx := context.Background()
+	store := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})
+	assert.NoError(t, store.EnableKeyspaceNotifications(ctx))
+	testWatch(t, store)
+}
+
+func TestRedisStoreWatchExpiration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{DB: 3})
+	assert.NoError(t, store.EnableKeyspaceNotifications(ctx))
+
+	events, err := store.Watch(ctx, "")
+	assert.NoError(t, err)
+	_ = store.Write(ctx, "key", 1, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	_, _ = store.Exists(ctx, "key") // the fake server expires keys lazily
+	assert.Equal(t, []Event{
+		{Type: EventWrite, Key: "key"},
+		{Type: EventTouch, Key: "key"},
+		{Type: EventExpire, Key: "key"},
+	}, receiveEvents(t, events, 3))
+}
+
+func TestRedisStoreWatchResync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fr := redistest.New(t, "")
+	store := newTestRedisStore(t, fr, RedisOptions{})
+	assert.NoError(t, store.EnableKeyspaceNotifications(ctx))
+
+	events, err := store.Watch(ctx, "")
+	assert.NoError(t, err)
+	fr.DropConnections()
+	assert.Equal(t, []Event{{Type: EventResync}}, receiveEvents(t, events, 1),
+		"watchers should be told that events may have been missed")
+
+	// pooled connections were dropped as well, the first commands fail
+	assert.Eventually(t, func() bool {
+		return store.Write(ctx, "key", 1, NoExpiration) == nil
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []Event{{Type: EventWrite, Key: "key"}}, receiveEvents(t, events, 1),
+		"watch should resume after reconnecting")
+}
+
+func TestRedisStoreEnableKeyspaceNotifications(t *testing.T) {
+	ctx := context.Background()
+	store := newTestRedisStore(t, redistest.New(t, ""), RedisOptions{})
+
+	_, err := store.pool.do(ctx, "CONFIG", "SET", "notify-keyspace-events", "El")
+	assert.NoError(t, err)
+	assert.NoError(t, store.EnableKeyspaceNotifications(ctx))
+	reply, _ := store.pool.do(ctx, "CONFIG", "GET", "notify-keyspace-events")
+	assert.Equal(t, []any{[]byte("notify-keyspace-events"), []byte("ElK$gx")}, reply,
+		"enabled notifications should be kept")
+}
+
+func TestDiskStoreWatch(t *testing.T) {
+	store := newTestDiskStore(t, DiskOptions{Path: filepath.Join(t.TempDir(), "store.log")})
+	testWatch(t, store)
+}
+
+func TestWatchWrappers(t *testing.T) {
+	primary := NewInMemoryStore(NoExpiration, time.Minute)
+
+	t.Run("Routing", func(t *testing.T) {
+		testWatch(t, newTestRoutingStore(t, primary, []Reader{NewInMemoryStore(NoExpiration, time.Minute)}, RoutingOptions{}))
+	})
+	t.Run("Tiered", func(t *testing.T) {
+		testWatch(t, newTestTieredStore(t, primary, TieredOptions{}))
+	})
+	t.Run("NotSupported", func(t *testing.T) {
+		_, err := Watch(context.Background(), newTestBoundedStore(t, BoundedOptions{}), "")
+		assert.ErrorIs(t, err, ErrWatchNotSupported)
+	})
+}
+
+func TestWatchLaggingWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var hub watchHub
+	events := hub.watch(ctx, "")
+
+	for i := 0; i < watchBuffer+10; i++ {
+		hub.notify(EventWrite, "key")
+	}
+	assert.Len(t, receiveEvents(t, events, watchBuffer), watchBuffer)
+
+	hub.notify(EventDelete, "key")
+	assert.Equal(t, []Event{{Type: EventResync}, {Type: EventDelete, Key: "key"}}, receiveEvents(t, events, 2),
+		"lagging watchers should be told that events were dropped")
+}
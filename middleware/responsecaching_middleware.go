@@ -2,9 +2,11 @@ package middleware
 
 import (
 	"bytes"
+	"context"
 	"github.com/MarouaneMan/github-api/kvstore"
 	"github.com/Scalingo/go-handlers"
 	"github.com/Scalingo/go-utils/logger"
+	"github.com/pkg/errors"
 	"net/http"
 )
 
@@ -13,10 +15,18 @@ type responseCachingMiddleware struct {
 	storeWriter kvstore.Writer
 }
 
-type cachedItem struct {
-	statusCode int
-	body       []byte
-	headers    map[string][]string
+// CachedResponse is a cached response, its fields are exported so that it can be serialized by
+// out-of-process stores and exported in snapshots
+type CachedResponse struct {
+	StatusCode int                 `json:"status_code"`
+	Body       []byte              `json:"body"`
+	Headers    map[string][]string `json:"headers"`
+}
+
+// StoredType returns a pointer to a new value of the type the middleware stores under key, every
+// item of its store being a CachedResponse.
+func StoredType(key string) any {
+	return &CachedResponse{}
 }
 
 // NewResponseCachingMiddleware creates and returns a new response caching middleware.
@@ -28,6 +38,50 @@ func NewResponseCachingMiddleware(storeReader kvstore.Reader, storeWriter kvstor
 	}
 }
 
+// InvalidateCachedResponses drops every cached response from cacheStore whenever an item whose key
+// starts with prefix changes in store, so that responses are never served from an outdated dataset.
+// It returns kvstore.ErrWatchNotSupported if store cannot notify changes.
+func InvalidateCachedResponses(ctx context.Context, store kvstore.Reader, prefix string, cacheStore kvstore.ReadWriter) error {
+	events, err := kvstore.Watch(ctx, store, prefix)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for event := range events {
+			logger.Get(ctx).WithField("key", event.Key).WithField("event", event.Type).Info("Invalidating cached responses")
+			flushCachedResponses(ctx, cacheStore)
+		}
+	}()
+	return nil
+}
+
+// flushCachedResponses deletes the cached responses, stored under their request URL which
+// always starts with a slash. A namespaced cache store is flushed at once.
+func flushCachedResponses(ctx context.Context, cacheStore kvstore.ReadWriter) {
+	log := logger.Get(ctx)
+	if flusher, ok := cacheStore.(interface {
+		Flush(ctx context.Context) (int, error)
+	}); ok {
+		_, err := flusher.Flush(ctx)
+		if err != nil {
+			log.WithError(err).Error("Failed to flush cached responses")
+		}
+		return
+	}
+
+	keys, err := cacheStore.Scan(ctx, "/")
+	if err != nil {
+		log.WithError(err).Error("Failed to list cached responses")
+		return
+	}
+	for _, key := range keys {
+		err = cacheStore.Delete(ctx, key)
+		if err != nil {
+			log.WithError(err).WithField("key", key).Error("Failed to delete cached response")
+		}
+	}
+}
+
 // Apply is the middleware handler that caches responses based on their status code.
 // It serves cached responses if available and caches new responses if the status code is below 300.
 func (rcm *responseCachingMiddleware) Apply(next handlers.HandlerFunc) handlers.HandlerFunc {
@@ -35,17 +89,22 @@ func (rcm *responseCachingMiddleware) Apply(next handlers.HandlerFunc) handlers.
 		log := logger.Get(r.Context())
 
 		// serve cached response if available
-		cachedResponse, ok := rcm.storeReader.Read(r.Context(), r.URL.String()).(*cachedItem)
-		if ok {
+		var cachedResponse CachedResponse
+		err := kvstore.ReadInto(r.Context(), rcm.storeReader, r.URL.String(), &cachedResponse)
+		if err != nil && !errors.Is(err, kvstore.ErrNotFound) {
+			// do not fail the request, the handler can still serve a fresh response
+			log.WithError(err).Error("Failed to read cached response")
+		}
+		if err == nil {
 			log.Debug("Cache hit")
-			for key, values := range cachedResponse.headers {
+			for key, values := range cachedResponse.Headers {
 				for _, value := range values {
 					w.Header().Add(key, value)
 				}
 			}
 			w.Header().Add("X-From-Cache", "True")
-			w.WriteHeader(cachedResponse.statusCode)
-			_, err := w.Write(cachedResponse.body)
+			w.WriteHeader(cachedResponse.StatusCode)
+			_, err = w.Write(cachedResponse.Body)
 			return err
 		}
 
@@ -55,15 +114,15 @@ func (rcm *responseCachingMiddleware) Apply(next handlers.HandlerFunc) handlers.
 		customWriter := customResponseWriter{ResponseWriter: w}
 
 		// process the request
-		err := next(&customWriter, r, vars)
+		err = next(&customWriter, r, vars)
 
 		// cache the response if status code is below 300
 		if err == nil && customWriter.statusCode < 300 {
 			// cache response: statusCode, body and headers
-			cacheErr := rcm.storeWriter.Write(r.Context(), r.URL.String(), &cachedItem{
-				statusCode: customWriter.statusCode,
-				body:       customWriter.body.Bytes(),
-				headers:    customWriter.Header().Clone(),
+			cacheErr := rcm.storeWriter.Write(r.Context(), r.URL.String(), &CachedResponse{
+				StatusCode: customWriter.statusCode,
+				Body:       customWriter.body.Bytes(),
+				Headers:    customWriter.Header().Clone(),
 			}, kvstore.DefaultExpiration)
 			if cacheErr != nil {
 				log.WithError(cacheErr).Error("Failed to cache response")
@@ -2,10 +2,12 @@ package middleware
 
 import (
 	"context"
+	"github.com/MarouaneMan/github-api/internal/testutil/redistest"
 	"github.com/MarouaneMan/github-api/kvstore"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestResponseCachingMiddlewareCacheMiss(t *testing.T) {
@@ -51,7 +53,8 @@ func TestResponseCachingMiddlewareCacheMiss(t *testing.T) {
 			handler.ServeHTTP(rr, req, nil)
 
 			// check cache
-			_, ok := store.Read(context.Background(), tc.path).(*cachedItem)
+			var item CachedResponse
+			ok := kvstore.ReadInto(context.Background(), store, tc.path, &item) == nil
 			if ok != tc.shouldCache {
 				t.Errorf("unexpected caching behavior for %s: got %v want %v", tc.path, ok, tc.shouldCache)
 			}
@@ -60,6 +63,30 @@ func TestResponseCachingMiddlewareCacheMiss(t *testing.T) {
 }
 
 func TestResponseCachingMiddlewareCacheHit(t *testing.T) {
+	testResponseCachingMiddlewareCacheHit(t, func(t *testing.T) kvstore.ReadWriter {
+		return kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+	})
+}
+
+func TestResponseCachingMiddlewareCacheHitRedis(t *testing.T) {
+	for _, codecName := range []string{"json", "gob", "binary"} {
+		t.Run(codecName, func(t *testing.T) {
+			codec, _ := kvstore.CodecByName(codecName)
+			testResponseCachingMiddlewareCacheHit(t, func(t *testing.T) kvstore.ReadWriter {
+				store := kvstore.NewRedisStore(kvstore.RedisOptions{
+					Addr:  redistest.New(t, "").Addr(),
+					Codec: codec,
+				}, kvstore.DefaultExpiration)
+				t.Cleanup(func() {
+					_ = store.Close()
+				})
+				return store
+			})
+		})
+	}
+}
+
+func testResponseCachingMiddlewareCacheHit(t *testing.T, newStore func(t *testing.T) kvstore.ReadWriter) {
 	testCases := []struct {
 		path         string
 		responseCode int
@@ -80,12 +107,13 @@ func TestResponseCachingMiddlewareCacheHit(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run("CacheHit_"+tc.path, func(t *testing.T) {
 
-			store := kvstore.NewInMemoryStore(kvstore.DefaultExpiration, kvstore.DefaultExpiration)
+			store := newStore(t)
 			middleware := NewResponseCachingMiddleware(store, store)
 
 			// make first call to populate cache
 			{
 				populateCacheHandler := func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+					w.Header().Set("Content-Type", "text/plain")
 					w.WriteHeader(tc.responseCode)
 					w.Write([]byte(tc.responseBody))
 					return nil
@@ -113,7 +141,113 @@ func TestResponseCachingMiddlewareCacheHit(t *testing.T) {
 					t.Errorf("expected body %q with status code %v; got body %q with status code %v",
 						tc.responseBody, tc.responseCode, rr.Body.String(), rr.Code)
 				}
+				if rr.Header().Get("Content-Type") != "text/plain" || rr.Header().Get("X-From-Cache") != "True" {
+					t.Errorf("expected cached headers to be restored; got %v", rr.Header())
+				}
 			}
 		})
 	}
 }
+
+func TestResponseCachingMiddlewareStoreUnavailable(t *testing.T) {
+	server := redistest.New(t, "")
+	store := kvstore.NewRedisStore(kvstore.RedisOptions{Addr: server.Addr()}, kvstore.DefaultExpiration)
+	server.Close()
+
+	handlerCalled := false
+	mockHandler := func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		handlerCalled = true
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("fresh bytes"))
+		return nil
+	}
+
+	req, _ := http.NewRequest("GET", "/?foo=bar", nil)
+	rr := httptest.NewRecorder()
+	handler := NewResponseCachingMiddleware(store, store).Apply(mockHandler)
+	err := handler.ServeHTTP(rr, req, nil)
+
+	// the request should be served by the handler even though the cache is down
+	if err != nil || !handlerCalled || rr.Code != http.StatusOK || rr.Body.String() != "fresh bytes" {
+		t.Errorf("expected fresh response; got err %v, handler called %v, status code %v, body %q",
+			err, handlerCalled, rr.Code, rr.Body.String())
+	}
+}
+
+func TestInvalidateCachedResponses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := kvstore.NewInMemoryStore(kvstore.NoExpiration, kvstore.NoExpiration)
+	middleware := NewResponseCachingMiddleware(store, store)
+
+	err := InvalidateCachedResponses(ctx, store, "repositories", store)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	calls := 0
+	handler := middleware.Apply(func(w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		calls++
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	serve := func() {
+		req, _ := http.NewRequest("GET", "/repos", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req, nil)
+	}
+
+	serve()
+	serve()
+	if calls != 1 {
+		t.Fatalf("expected the second response to be served from cache, handler called %d times", calls)
+	}
+
+	_ = store.Write(ctx, "repositories", []string{}, kvstore.NoExpiration)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if exists, _ := store.Exists(ctx, "/repos"); !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cached response should be invalidated when the dataset changes")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if exists, _ := store.Exists(ctx, "repositories"); !exists {
+		t.Error("dataset should not be invalidated")
+	}
+
+	serve()
+	if calls != 2 {
+		t.Errorf("expected a fresh response after invalidation, handler called %d times", calls)
+	}
+}
+
+func TestInvalidateCachedResponsesNamespaced(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := kvstore.NewInMemoryStore(kvstore.NoExpiration, kvstore.NoExpiration)
+	datasetStore, _ := kvstore.NewNamespacedStore(store, "dataset", kvstore.NamespaceOptions{})
+	cacheStore, _ := kvstore.NewNamespacedStore(store, "responses", kvstore.NamespaceOptions{})
+
+	err := InvalidateCachedResponses(ctx, datasetStore, "repositories", cacheStore)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = cacheStore.Write(ctx, "/repos", &CachedResponse{StatusCode: http.StatusOK}, kvstore.NoExpiration)
+	_ = datasetStore.Write(ctx, "repositories", []string{}, kvstore.NoExpiration)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if exists, _ := cacheStore.Exists(ctx, "/repos"); !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("responses namespace should be flushed when the dataset changes")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if exists, _ := datasetStore.Exists(ctx, "repositories"); !exists {
+		t.Error("dataset namespace should not be flushed")
+	}
+}